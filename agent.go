@@ -0,0 +1,515 @@
+package nat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danderson/nat/dtls"
+)
+
+// State is the state of an Agent.
+type State int
+
+// Agent states.
+const (
+	// StateNew is an Agent that has not gathered candidates yet.
+	StateNew State = iota
+	// StateGathering is an Agent gathering its candidates.
+	StateGathering
+	// StateGathered is an Agent ready to connect.
+	StateGathered
+	// StateChecking is an Agent running connectivity checks.
+	StateChecking
+	// StateConnected is an Agent that established its Conns.
+	StateConnected
+	// StateDisconnected is an Agent one of whose Conns lost the
+	// peer's consent.
+	StateDisconnected
+	// StateFailed is an Agent whose negotiation failed.
+	StateFailed
+	// StateClosed is a closed Agent.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateGathering:
+		return "gathering"
+	case StateGathered:
+		return "gathered"
+	case StateChecking:
+		return "checking"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateFailed:
+		return "failed"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// An Agent runs one ICE negotiation step by step, for callers that
+// drive the signaling themselves:
+//
+//	a, _ := NewAgent(cfg)
+//	candidates, _ := a.GatherCandidates()
+//	// Send a.LocalCredentials() and candidates to the peer, and
+//	// pass what it sends to SetRemoteCredentials and
+//	// AddRemoteCandidate.
+//	conns, _ := a.Dial() // or a.Accept() on the peer
+//
+// One peer must Dial and the other Accept. Remote candidates can keep
+// trickling in while the checks run.
+type Agent struct {
+	cfg     *Config
+	session string
+	log     Logger
+	stats   *Stats
+	engines []*attemptEngine
+	local   Credentials
+
+	abort     chan struct{} // closed by Close
+	closeOnce sync.Once     // for closeSockets
+
+	mu            sync.Mutex
+	state         State
+	onStateChange func(State)
+	// snapshot is a copy of stats, taken at the last state change.
+	snapshot    *Stats
+	gathered    []Candidate
+	remote      Credentials
+	remoteCands []Candidate
+	fingerprint string // of the peer's certificate
+	noiseKey    []byte // the peer's static Noise key
+	started     bool   // Dial or Accept was called
+	busy        bool   // gathering or checking
+	conns       []*Conn
+}
+
+// NewAgent opens the sockets of a negotiation with the settings of
+// cfg. The Agent must be closed if it doesn't connect.
+func NewAgent(cfg *Config) (*Agent, error) {
+	n := cfg.components()
+	if n < 1 || n > maxComponents {
+		return nil, fmt.Errorf("invalid number of components %d", n)
+	}
+	if len(cfg.Sockets) != 0 && len(cfg.Sockets) != n {
+		return nil, fmt.Errorf("got %d sockets for %d components", len(cfg.Sockets), n)
+	}
+	local, err := NewCredentials()
+	if err != nil {
+		return nil, err
+	}
+	var tiebreaker uint64
+	if err := binary.Read(rand.Reader, binary.BigEndian, &tiebreaker); err != nil {
+		return nil, err
+	}
+
+	session := newSessionID()
+	a := &Agent{
+		cfg:     cfg,
+		session: session,
+		log:     cfg.logger(session),
+		stats:   newStats(session, false, cfg.clock().Now()),
+		engines: make([]*attemptEngine, n),
+		local:   local,
+		abort:   make(chan struct{}),
+	}
+	a.snapshot = a.stats.clone()
+	for i := range a.engines {
+		var sock net.PacketConn
+		if len(cfg.Sockets) != 0 {
+			sock = cfg.Sockets[i]
+		} else if sock, err = cfg.listen(cfg.BindAddress); err != nil {
+			a.closeSockets()
+			return nil, err
+		}
+		if cfg.TOS > 0 {
+			if err := setTOS(sock, cfg.TOS); err != nil {
+				a.log.Warn("failed to set TOS", "tos", cfg.TOS, "err", err)
+			}
+		}
+		if err := enableECN(sock); err != nil {
+			a.log.Debug("failed to enable ECN reporting", "err", err)
+		}
+		a.engines[i] = &attemptEngine{
+			sock:       sock,
+			cfg:        cfg,
+			component:  i + 1,
+			session:    session,
+			log:        a.log,
+			stats:      a.stats,
+			abort:      a.abort,
+			tiebreaker: tiebreaker,
+		}
+		if cfg.SpraySockets > 0 && !cfg.Lite {
+			if err := a.engines[i].openSpray(cfg.SpraySockets); err != nil {
+				a.closeSockets()
+				return nil, err
+			}
+		}
+	}
+	return a, nil
+}
+
+// closeSockets releases the sockets and port mappings of the engines.
+func (a *Agent) closeSockets() {
+	a.closeOnce.Do(a.doCloseSockets)
+}
+
+func (a *Agent) doCloseSockets() {
+	for _, e := range a.engines {
+		if e == nil {
+			continue
+		}
+		if e.lease != nil {
+			e.lease.Close()
+		}
+		// Pre-bound sockets go back to the caller as we found
+		// them.
+		if len(a.cfg.Sockets) == 0 {
+			e.sock.Close()
+		} else {
+			e.sock.SetDeadline(time.Time{})
+		}
+		e.closeSpray()
+	}
+}
+
+// Session returns the ID of the negotiation, as in logs and events.
+func (a *Agent) Session() string {
+	return a.session
+}
+
+// State returns the current state of a.
+func (a *Agent) State() State {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+// OnStateChange sets f to be called with the new state whenever the
+// state of a changes. f is called synchronously and must not block.
+func (a *Agent) OnStateChange(f func(State)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.onStateChange = f
+}
+
+// setState moves a to state s. It must be called by the goroutine
+// that last updated a.stats.
+func (a *Agent) setState(s State) {
+	a.mu.Lock()
+	if a.state == s || a.state == StateClosed {
+		a.mu.Unlock()
+		return
+	}
+	a.state = s
+	a.snapshot = a.stats.clone()
+	f := a.onStateChange
+	a.mu.Unlock()
+	if f != nil {
+		f(s)
+	}
+}
+
+// setRole makes a the initiator or the controlled peer.
+func (a *Agent) setRole(initiator bool) {
+	setInitiator(a.engines, initiator)
+}
+
+// LocalCredentials returns the credentials to send to the peer.
+func (a *Agent) LocalCredentials() Credentials {
+	return a.local
+}
+
+// GatherCandidates gathers the candidates to send to the peer, for all
+// components. Later calls return the same candidates.
+func (a *Agent) GatherCandidates() ([]Candidate, error) {
+	a.mu.Lock()
+	switch {
+	case a.state == StateClosed:
+		a.mu.Unlock()
+		return nil, ErrAgentClosed
+	case a.gathered != nil:
+		a.mu.Unlock()
+		return a.gathered, nil
+	case a.state != StateNew:
+		a.mu.Unlock()
+		return nil, errors.New("candidates already being gathered")
+	}
+	a.busy = true
+	a.mu.Unlock()
+
+	a.setState(StateGathering)
+	candidates, err := gather(a.engines)
+	if err != nil {
+		a.log.Error("gathering failed", "err", err)
+		return nil, a.fail(err)
+	}
+	if !a.idle() {
+		return nil, ErrAgentClosed
+	}
+	a.mu.Lock()
+	a.gathered = candidates
+	a.mu.Unlock()
+	a.setState(StateGathered)
+	return candidates, nil
+}
+
+// idle marks the end of a gathering or checking phase. If a was
+// closed in the meantime, it releases the sockets and reports false.
+func (a *Agent) idle() bool {
+	a.mu.Lock()
+	a.busy = false
+	closed := a.state == StateClosed
+	a.mu.Unlock()
+	if closed {
+		a.closeSockets()
+	}
+	return !closed
+}
+
+// SetRemoteCredentials sets the credentials the peer sent us.
+func (a *Agent) SetRemoteCredentials(c Credentials) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.started {
+		return errors.New("remote credentials set after the checks started")
+	}
+	a.remote = c
+	return nil
+}
+
+// SetRemoteFingerprint sets the certificate fingerprint the peer sent
+// us, for Conn.Secure.
+func (a *Agent) SetRemoteFingerprint(fp string) error {
+	if _, err := dtls.ParseFingerprint(fp); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.started {
+		return errors.New("remote fingerprint set after the checks started")
+	}
+	a.fingerprint = fp
+	return nil
+}
+
+// SetRemoteNoiseKey sets the static Noise key the peer sent us, for
+// Conn.SecureNoise.
+func (a *Agent) SetRemoteNoiseKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("invalid Noise key of %d bytes", len(key))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.started {
+		return errors.New("remote Noise key set after the checks started")
+	}
+	a.noiseKey = append([]byte(nil), key...)
+	return nil
+}
+
+// AddRemoteCandidate adds a candidate the peer sent us. Candidates
+// added after Dial or Accept join the running checks, until a pair is
+// nominated.
+func (a *Agent) AddRemoteCandidate(c Candidate) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if c.component() > len(a.engines) {
+		return fmt.Errorf("candidate for component %d, have %d", c.component(), len(a.engines))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.started {
+		a.engines[c.component()-1].trickle(c)
+		return nil
+	}
+	a.remoteCands = append(a.remoteCands, c)
+	return nil
+}
+
+// Dial runs the connectivity checks as the controlling peer, and
+// returns a Conn per component once the pairs are nominated.
+func (a *Agent) Dial() ([]*Conn, error) {
+	return a.connect(true)
+}
+
+// Accept runs the connectivity checks as the controlled peer, and
+// returns a Conn per component once the peer nominated the pairs.
+func (a *Agent) Accept() ([]*Conn, error) {
+	return a.connect(false)
+}
+
+func (a *Agent) connect(initiator bool) ([]*Conn, error) {
+	a.mu.Lock()
+	switch {
+	case a.state == StateClosed:
+		a.mu.Unlock()
+		return nil, ErrAgentClosed
+	case a.started:
+		a.mu.Unlock()
+		return nil, errors.New("agent already connecting")
+	case initiator && a.cfg.Lite:
+		a.mu.Unlock()
+		return nil, errors.New("an ICE-lite agent cannot dial")
+	case a.gathered == nil:
+		a.mu.Unlock()
+		return nil, errors.New("candidates not gathered")
+	case a.remote == Credentials{}:
+		a.mu.Unlock()
+		return nil, errors.New("remote credentials not set")
+	}
+	a.started = true
+	a.busy = true
+	remote, candidates := a.remote, a.remoteCands
+	fingerprint, noiseKey := a.fingerprint, a.noiseKey
+	a.mu.Unlock()
+
+	a.stats.SignalTime = a.cfg.clock().Now().Sub(a.stats.Start) - a.stats.GatherTime
+	a.setRole(initiator)
+	// Both sides of an Agent negotiation are recent enough to
+	// answer checks from their Conns, so the controlled peer can
+	// return as soon as a pair is nominated.
+	eager := !initiator || a.cfg.Nomination != NominateRegular
+	for _, e := range a.engines {
+		e.setRemote(a.local, remote, candidates, eager)
+		e.fingerprint, e.noiseKey = fingerprint, noiseKey
+	}
+	return a.check()
+}
+
+// check runs the connectivity checks of all components, and returns
+// their Conns.
+func (a *Agent) check() ([]*Conn, error) {
+	a.setState(StateChecking)
+	errs := make(chan error, len(a.engines))
+	for _, e := range a.engines {
+		go func(e *attemptEngine) {
+			_, err := e.check()
+			errs <- err
+		}(e)
+	}
+	var err error
+	for range a.engines {
+		if err2 := <-errs; err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	a.stats.finish(a.cfg.clock().Now(), a.engines, err)
+	if err != nil {
+		return nil, a.fail(err)
+	}
+	a.cfg.recordNegotiation(a.stats.Start, a.cfg.clock().Now(), a.engines, nil)
+
+	a.mu.Lock()
+	a.busy = false
+	if a.state == StateClosed {
+		a.mu.Unlock()
+		a.closeSockets()
+		return nil, ErrAgentClosed
+	}
+	conns := make([]*Conn, len(a.engines))
+	for i, e := range a.engines {
+		conns[i] = newConn(e.takeSocket(), e)
+		conns[i].onFail = func(error) { a.setState(StateDisconnected) }
+	}
+	a.conns = conns
+	a.mu.Unlock()
+	a.setState(StateConnected)
+	return conns, nil
+}
+
+// fail ends the negotiation with err, and returns the error to give
+// to the caller.
+func (a *Agent) fail(err error) error {
+	a.closeSockets()
+	a.mu.Lock()
+	a.busy = false
+	a.mu.Unlock()
+	a.cfg.emit(Event{Type: EventFailed, Session: a.session, Err: err})
+	a.cfg.recordNegotiation(a.stats.Start, a.cfg.clock().Now(), nil, err)
+	a.stats.Err = err
+	a.setState(StateFailed)
+	return &NegotiationError{Err: err, Stats: a.stats}
+}
+
+// Stats returns the statistics of the negotiation, as of the last
+// state change.
+func (a *Agent) Stats() *Stats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snapshot.clone()
+}
+
+// Close closes a and the Conns it established, or aborts the running
+// gathering or checks.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	if a.state == StateClosed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.state = StateClosed
+	close(a.abort)
+	conns, busy, f := a.conns, a.busy, a.onStateChange
+	a.mu.Unlock()
+	if f != nil {
+		f(StateClosed)
+	}
+
+	switch {
+	case conns != nil:
+		for _, c := range conns {
+			c.Close()
+		}
+	case busy:
+		// Wake up the running phase, which releases the sockets
+		// once it notices.
+		for _, e := range a.engines {
+			e.sock.SetReadDeadline(a.cfg.clock().Now())
+		}
+	default:
+		a.closeSockets()
+	}
+	return nil
+}
+
+// trickle adds a remote candidate to the running checks.
+func (e *attemptEngine) trickle(c Candidate) {
+	e.trickleMu.Lock()
+	defer e.trickleMu.Unlock()
+	e.trickled = append(e.trickled, c)
+}
+
+// addTrickled pairs the candidates added by trickle.
+func (e *attemptEngine) addTrickled() {
+	e.trickleMu.Lock()
+	cands := e.trickled
+	e.trickled = nil
+	e.trickleMu.Unlock()
+	// e.selected points into e.attempts.
+	if e.selected != nil {
+		return
+	}
+	for _, c := range cands {
+		e.log.Debug("added remote candidate", "candidate", c)
+		e.addAttempt(attempt{Candidate: c})
+		e.addSprayAttempts(len(e.attempts) - 1)
+	}
+}
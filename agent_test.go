@@ -0,0 +1,307 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestAgent returns an Agent for cfg, and a channel of its state
+// changes.
+func newTestAgent(t *testing.T, cfg *Config) (*Agent, <-chan State) {
+	a, err := NewAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	states := make(chan State, 10)
+	a.OnStateChange(func(s State) { states <- s })
+	return a, states
+}
+
+// waitState waits for the Agent of states to reach want.
+func waitState(t *testing.T, states <-chan State, want State) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case s := <-states:
+			if s == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("agent never got %v", want)
+		}
+	}
+}
+
+func TestAgent(t *testing.T) {
+	cfgA, cfgB, clock := vnetConfigs(t, nil)
+	a, statesA := newTestAgent(t, cfgA)
+	b, statesB := newTestAgent(t, cfgB)
+	var cands [2][]Candidate
+	for i, ag := range []*Agent{a, b} {
+		var err error
+		if cands[i], err = ag.GatherCandidates(); err != nil {
+			t.Fatal(err)
+		}
+		if len(cands[i]) != 2 || ag.State() != StateGathered {
+			t.Fatalf("gathered %v, in state %v", cands[i], ag.State())
+		}
+	}
+	if err := a.SetRemoteCredentials(b.LocalCredentials()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetRemoteCredentials(a.LocalCredentials()); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		conns []*Conn
+		err   error
+	}
+	ra, rb := make(chan result, 1), make(chan result, 1)
+	go func() { c, err := a.Dial(); ra <- result{c, err} }()
+	go func() { c, err := b.Accept(); rb <- result{c, err} }()
+	// The candidates trickle in once the checks run.
+	waitState(t, statesA, StateChecking)
+	waitState(t, statesB, StateChecking)
+	for _, c := range cands[1] {
+		if err := a.AddRemoteCandidate(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range cands[0] {
+		if err := b.AddRemoteCandidate(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	da, db := <-ra, <-rb
+	if da.err != nil || db.err != nil {
+		t.Fatalf("failed to connect: %v, %v", da.err, db.err)
+	}
+	if len(da.conns) != 1 || len(db.conns) != 1 {
+		t.Fatalf("got %d and %d conns for one component", len(da.conns), len(db.conns))
+	}
+	waitState(t, statesA, StateConnected)
+	waitState(t, statesB, StateConnected)
+	roundTrip(t, da.conns[0], db.conns[0], clock)
+
+	// Closing the Agent closes its Conns.
+	a.Close()
+	if a.State() != StateClosed {
+		t.Fatalf("closed agent in state %v", a.State())
+	}
+	if _, err := da.conns[0].Write([]byte("hello")); err == nil {
+		t.Fatal("write on a closed agent's conn succeeded")
+	}
+	if _, err := a.GatherCandidates(); !errors.Is(err, ErrAgentClosed) {
+		t.Fatalf("GatherCandidates on a closed agent: %v", err)
+	}
+	if _, err := a.Dial(); !errors.Is(err, ErrAgentClosed) {
+		t.Fatalf("Dial on a closed agent: %v", err)
+	}
+}
+
+func TestAgentCloseAccept(t *testing.T) {
+	cfgA, cfgB, _ := vnetConfigs(t, nil)
+	peer, _ := newTestAgent(t, cfgB)
+	a, states := newTestAgent(t, cfgA)
+	if _, err := a.GatherCandidates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetRemoteCredentials(peer.LocalCredentials()); err != nil {
+		t.Fatal(err)
+	}
+	// Accept waits for candidates that never come, until Close.
+	errs := make(chan error, 1)
+	go func() { _, err := a.Accept(); errs <- err }()
+	waitState(t, states, StateChecking)
+	a.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrAgentClosed) {
+			t.Fatalf("Accept ended with %v, want %v", err, ErrAgentClosed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close didn't unblock Accept")
+	}
+	if a.State() != StateClosed {
+		t.Fatalf("closed agent in state %v", a.State())
+	}
+}
+
+func TestAgentStates(t *testing.T) {
+	cfgA, cfgB, _ := vnetConfigs(t, nil)
+	a, err := NewAgent(cfgA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		states []State
+	)
+	a.OnStateChange(func(s State) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, s)
+	})
+	b, _ := newTestAgent(t, cfgB)
+	if a.State() != StateNew {
+		t.Fatalf("new agent in state %v", a.State())
+	}
+	if _, err := a.Dial(); err == nil {
+		t.Fatal("Dial before gathering succeeded")
+	}
+	if err := a.AddRemoteCandidate(Candidate{Type: CandidateHost, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}, Prio: 1, Component: 2}); err == nil {
+		t.Fatal("added a candidate for a missing component")
+	}
+
+	for _, pair := range [][2]*Agent{{a, b}, {b, a}} {
+		cands, err := pair[1].GatherCandidates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cands {
+			if err := pair[0].AddRemoteCandidate(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := pair[0].SetRemoteCredentials(pair[1].LocalCredentials()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Gathering again returns the same candidates.
+	cands, _ := a.GatherCandidates()
+	again, err := a.GatherCandidates()
+	if err != nil || len(again) != len(cands) || &again[0] != &cands[0] {
+		t.Fatalf("second gathering returned %v, %v", again, err)
+	}
+
+	errs := make(chan error, 1)
+	go func() { _, err := b.Accept(); errs <- err }()
+	if _, err := a.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Dial(); err == nil {
+		t.Fatal("second Dial succeeded")
+	}
+	if err := a.SetRemoteCredentials(b.LocalCredentials()); err == nil {
+		t.Fatal("changed the credentials of a connected agent")
+	}
+	stats := a.Stats()
+	if !stats.Initiator || stats.Session != a.Session() || stats.CheckTime == 0 {
+		t.Fatalf("stats of a connected agent: %+v", stats)
+	}
+	a.Close()
+	a.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []State{StateGathering, StateGathered, StateChecking, StateConnected, StateClosed}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("went through %v, want %v", states, want)
+	}
+}
+
+func TestAgentLite(t *testing.T) {
+	cfg, _, _ := vnetConfigs(t, func(cfg *Config) { cfg.Lite = true })
+	a, _ := newTestAgent(t, cfg)
+	if _, err := a.GatherCandidates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetRemoteCredentials(a.LocalCredentials()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Dial(); err == nil {
+		t.Fatal("a lite agent dialed")
+	}
+}
+
+// countingConn counts the datagrams written to a socket.
+type countingConn struct {
+	net.PacketConn
+	writes int64
+}
+
+func (c *countingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestSockets(t *testing.T) {
+	cfgA, cfgB, clock := vnetConfigs(t, nil)
+	// a runs on a socket of its own, b opens its socket through
+	// ListenPacket.
+	sock, err := cfgA.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := &countingConn{PacketConn: sock}
+	cfgA.Sockets = []net.PacketConn{owned}
+	cfgA.ListenPacket = func(network, address string) (net.PacketConn, error) {
+		t.Errorf("opened %s %s despite Sockets", network, address)
+		return nil, errors.New("unexpected listen")
+	}
+	var listened []*countingConn
+	listen := cfgB.ListenPacket
+	cfgB.ListenPacket = func(network, address string) (net.PacketConn, error) {
+		sock, err := listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		c := &countingConn{PacketConn: sock}
+		listened = append(listened, c)
+		return c, nil
+	}
+
+	// Too many sockets for the components.
+	cfg := *cfgA
+	cfg.Sockets = []net.PacketConn{owned, owned}
+	if _, err := NewAgent(&cfg); err == nil {
+		t.Fatal("NewAgent took 2 sockets for 1 component")
+	}
+	// A failed negotiation leaves the socket open.
+	cfg.Sockets = cfgA.Sockets
+	if _, err := ConnectOpt(func([]byte) []byte { return nil }, true, &cfg); err == nil {
+		t.Fatal("negotiation without a peer succeeded")
+	}
+	if _, err := sock.WriteTo([]byte("x"), sock.LocalAddr()); err != nil {
+		t.Fatalf("failed negotiation closed the socket: %v", err)
+	}
+
+	xa, xb := testExchange()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ca, cb := make(chan result, 1), make(chan result, 1)
+	go func() { c, err := ConnectOpt(xa, true, cfgA); ca <- result{c, err} }()
+	go func() { c, err := ConnectOpt(xb, false, cfgB); cb <- result{c, err} }()
+	ra, rb := <-ca, <-cb
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("failed to connect: %v, %v", ra.err, rb.err)
+	}
+	a, b := ra.c.(*Conn), rb.c.(*Conn)
+	defer b.Close()
+	if len(listened) != 1 {
+		t.Fatalf("opened %d sockets for 1 component", len(listened))
+	}
+	before := atomic.LoadInt64(&owned.writes)
+	roundTrip(t, a, b, clock)
+	if atomic.LoadInt64(&owned.writes) <= before || atomic.LoadInt64(&listened[0].writes) == 0 {
+		t.Fatal("the Conns didn't write through the injected sockets")
+	}
+	// The Conn took the socket over.
+	a.Close()
+	if _, err := sock.WriteTo([]byte("x"), sock.LocalAddr()); err == nil {
+		t.Fatal("closing the Conn left its socket open")
+	}
+}
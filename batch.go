@@ -0,0 +1,36 @@
+package nat
+
+import "net"
+
+// readOne and writeEach implement batched I/O one datagram at a
+// time, for platforms and sockets that can't do better.
+
+func readOne(sock net.PacketConn, ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	if u, ok := sock.(*net.UDPConn); ok && ecnOOBSize > 0 {
+		oob := make([]byte, ecnOOBSize)
+		n, oobn, _, from, err := u.ReadMsgUDP(ms[0].Buf, oob)
+		if err != nil {
+			return 0, err
+		}
+		ms[0].N, ms[0].Addr, ms[0].ECN = n, from, parseECN(oob[:oobn])
+		return 1, nil
+	}
+	n, from, err := sock.ReadFrom(ms[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, from
+	return 1, nil
+}
+
+func writeEach(sock net.PacketConn, ms []Message, addr net.Addr) (int, error) {
+	for i := range ms {
+		if _, err := sock.WriteTo(ms[i].Buf, addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
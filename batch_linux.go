@@ -0,0 +1,212 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package nat
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const readBatchSize = 8
+
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// canBatch reports whether readBatch reads several datagrams from
+// sock with a single system call.
+func canBatch(sock net.PacketConn) bool {
+	_, ok := sock.(syscall.Conn)
+	return ok
+}
+
+// readBatch reads up to len(ms) datagrams from sock with a single
+// recvmmsg call.
+func readBatch(sock net.PacketConn, ms []Message) (int, error) {
+	sc, ok := sock.(syscall.Conn)
+	if !ok || len(ms) == 0 {
+		return readOne(sock, ms)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return readOne(sock, ms)
+	}
+
+	hdrs := make([]mmsghdr, len(ms))
+	iovs := make([]syscall.Iovec, len(ms))
+	names := make([]syscall.RawSockaddrAny, len(ms))
+	oob := make([]byte, len(ms)*ecnOOBSize)
+	for i := range ms {
+		if len(ms[i].Buf) == 0 {
+			return 0, errors.New("empty buffer in batch")
+		}
+		iovs[i].Base = &ms[i].Buf[0]
+		iovs[i].SetLen(len(ms[i].Buf))
+		hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		hdrs[i].hdr.Namelen = uint32(unsafe.Sizeof(names[i]))
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.Iovlen = 1
+		hdrs[i].hdr.Control = &oob[i*ecnOOBSize]
+		hdrs[i].hdr.SetControllen(ecnOOBSize)
+	}
+
+	var (
+		n     int
+		operr error
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+		switch e {
+		case 0:
+			n = int(r)
+		case syscall.EAGAIN, syscall.EINTR:
+			return false
+		default:
+			operr = e
+		}
+		return true
+	})
+	if err == nil {
+		err = operr
+	}
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "udp", Source: sock.LocalAddr(), Err: err}
+	}
+	for i := 0; i < n; i++ {
+		ms[i].N = int(hdrs[i].len)
+		ms[i].Addr = sockaddrToUDP(&names[i])
+		ctl := oob[i*ecnOOBSize:]
+		ms[i].ECN = parseECN(ctl[:hdrs[i].hdr.Controllen])
+	}
+	return n, nil
+}
+
+// writeBatch sends the datagrams in ms to addr with sendmmsg.
+func writeBatch(sock net.PacketConn, ms []Message, addr net.Addr) (int, error) {
+	sc, ok := sock.(syscall.Conn)
+	to, ok2 := addr.(*net.UDPAddr)
+	if !ok || !ok2 || len(ms) == 0 {
+		return writeEach(sock, ms, addr)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return writeEach(sock, ms, addr)
+	}
+
+	// The destination must match the family of the socket, which
+	// only the kernel knows for sure.
+	var inet6 bool
+	err = rc.Control(func(fd uintptr) {
+		sa, err := syscall.Getsockname(int(fd))
+		if err == nil {
+			_, inet6 = sa.(*syscall.SockaddrInet6)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	name, namelen, err := udpToSockaddr(to, inet6)
+	if err != nil {
+		return 0, err
+	}
+
+	hdrs := make([]mmsghdr, len(ms))
+	iovs := make([]syscall.Iovec, len(ms))
+	for i := range ms {
+		if len(ms[i].Buf) > 0 {
+			iovs[i].Base = &ms[i].Buf[0]
+			iovs[i].SetLen(len(ms[i].Buf))
+		}
+		hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(name))
+		hdrs[i].hdr.Namelen = namelen
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.Iovlen = 1
+	}
+
+	sent := 0
+	var operr error
+	err = rc.Write(func(fd uintptr) bool {
+		for sent < len(hdrs) {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&hdrs[sent])), uintptr(len(hdrs)-sent), 0, 0, 0)
+			switch e {
+			case 0:
+				sent += int(r)
+			case syscall.EAGAIN:
+				return false
+			case syscall.EINTR:
+			default:
+				operr = e
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = operr
+	}
+	if err != nil {
+		return sent, &net.OpError{Op: "write", Net: "udp", Source: sock.LocalAddr(), Addr: addr, Err: err}
+	}
+	return sent, nil
+}
+
+func sockaddrToUDP(sa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		p := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa4.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+	case syscall.AF_INET6:
+		sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		p := (*[2]byte)(unsafe.Pointer(&sa6.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa6.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+		if sa6.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa6.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+func udpToSockaddr(addr *net.UDPAddr, inet6 bool) (*syscall.RawSockaddrAny, uint32, error) {
+	var sa syscall.RawSockaddrAny
+	if !inet6 {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return nil, 0, &net.AddrError{Err: "non-IPv4 address on an IPv4 socket", Addr: addr.String()}
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&sa))
+		sa4.Family = syscall.AF_INET
+		p := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(sa4.Addr[:], ip)
+		return &sa, syscall.SizeofSockaddrInet4, nil
+	}
+	ip := addr.IP.To16()
+	if ip == nil {
+		return nil, 0, &net.AddrError{Err: "invalid IP address", Addr: addr.String()}
+	}
+	sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&sa))
+	sa6.Family = syscall.AF_INET6
+	p := (*[2]byte)(unsafe.Pointer(&sa6.Port))
+	p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(sa6.Addr[:], ip)
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa6.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return &sa, syscall.SizeofSockaddrInet6, nil
+}
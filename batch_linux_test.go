@@ -0,0 +1,90 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package nat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBatchLoopback(t *testing.T) {
+	listen := func() *net.UDPConn {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sock.Close() })
+		return sock
+	}
+	tx, rx := listen(), listen()
+	if err := setTOS(tx, 0xb8|int(ECNECT0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := enableECN(rx); err != nil {
+		t.Fatal(err)
+	}
+
+	out := []Message{
+		{Buf: []byte("one")},
+		{Buf: make([]byte, 1200)},
+		{Buf: []byte("three")},
+	}
+	if n, err := writeBatch(tx, out, rx.LocalAddr()); n != len(out) || err != nil {
+		t.Fatalf("writeBatch sent %d of %d: %v", n, len(out), err)
+	}
+
+	in := readBuffers(rx, 1500)
+	if len(in) != readBatchSize {
+		t.Fatalf("%d buffers for a UDP socket, want a batch of %d", len(in), readBatchSize)
+	}
+	rx.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []Message
+	for len(got) < len(out) {
+		n, err := readBatch(rx, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range in[:n] {
+			m.Buf = append([]byte(nil), m.Buf[:m.N]...)
+			got = append(got, m)
+		}
+	}
+	for i, m := range got {
+		if string(m.Buf) != string(out[i].Buf) || m.N != len(out[i].Buf) {
+			t.Errorf("message %d: read %d bytes, want %d", i, m.N, len(out[i].Buf))
+		}
+		if m.Addr.String() != tx.LocalAddr().String() {
+			t.Errorf("message %d: from %v, want %v", i, m.Addr, tx.LocalAddr())
+		}
+		if m.ECN != ECNECT0 {
+			t.Errorf("message %d: ECN %v, want %v", i, m.ECN, ECNECT0)
+		}
+	}
+}
+
+func TestReadBuffers(t *testing.T) {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	for _, tc := range []struct {
+		size, n int
+	}{
+		{maxPacketSize, 1},
+		{16384, 4},
+		{1500, readBatchSize},
+	} {
+		ms := readBuffers(sock, tc.size)
+		if len(ms) != tc.n || len(ms[0].Buf) != tc.size {
+			t.Errorf("readBuffers(%d) = %d buffers of %d bytes, want %d", tc.size, len(ms), len(ms[0].Buf), tc.n)
+		}
+	}
+	// Sockets without recvmmsg read one datagram at a time.
+	if ms := readBuffers(struct{ net.PacketConn }{sock}, 1500); len(ms) != 1 {
+		t.Errorf("%d buffers for a socket without recvmmsg", len(ms))
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package nat
+
+import "net"
+
+const readBatchSize = 1
+
+func canBatch(sock net.PacketConn) bool {
+	return false
+}
+
+func readBatch(sock net.PacketConn, ms []Message) (int, error) {
+	return readOne(sock, ms)
+}
+
+func writeBatch(sock net.PacketConn, ms []Message, addr net.Addr) (int, error) {
+	return writeEach(sock, ms, addr)
+}
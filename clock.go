@@ -0,0 +1,38 @@
+package nat
+
+import "time"
+
+// A Clock tells time. Tests can set Config.Clock to run negotiations
+// in virtual time, e.g. on a vnet.VirtualClock. The deadlines of the
+// sockets must follow the same clock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d, unless stop
+	// is called first. stop reports whether it stopped the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+func (c *Config) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
+	}
+	return c.Clock
+}
+
+// newTimer returns a channel that receives the time after d on clock,
+// and a function that stops it.
+func newTimer(clock Clock, d time.Duration) (<-chan time.Time, func() bool) {
+	ch := make(chan time.Time, 1)
+	stop := clock.AfterFunc(d, func() { ch <- clock.Now() })
+	return ch, stop
+}
@@ -0,0 +1,84 @@
+// rendezvous is a signaling server that pairs peers by room name or
+// pairing code, so that two hosts can negotiate a NAT traversal
+// without any other way of talking to each other.
+//
+// rendezvous --http=:8080 --tcp=:8081 --tokens=/etc/rendezvous/tokens
+// nattester --rendezvous=http://example.com:8080
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/danderson/nat/rendezvous"
+)
+
+var (
+	httpAddr   = flag.String("http", ":8080", "Address to serve the HTTP API on, empty to disable")
+	tcpAddr    = flag.String("tcp", ":8081", "Address to serve the TCP protocol on, empty to disable")
+	idle       = flag.Duration("idle_timeout", 10*time.Minute, "How long idle rooms live")
+	tokensFile = flag.String("tokens", "", "File with one accepted client token per line. "+
+		"If not defined, clients need no token")
+	verbose = flag.Bool("verbose", false, "Log room activity")
+)
+
+func readTokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ret []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if t := strings.TrimSpace(scanner.Text()); t != "" && !strings.HasPrefix(t, "#") {
+			ret = append(ret, t)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+func main() {
+	flag.Parse()
+	srv := rendezvous.NewServer()
+	srv.IdleTimeout = *idle
+	srv.Verbose = *verbose
+	if *tokensFile != "" {
+		tokens, err := readTokens(*tokensFile)
+		if err != nil {
+			log.Fatalf("Cannot read tokens: %v", err)
+		}
+		if len(tokens) == 0 {
+			log.Fatalf("No tokens in %s", *tokensFile)
+		}
+		srv.Tokens = tokens
+	}
+	if *httpAddr == "" && *tcpAddr == "" {
+		log.Fatal("Nothing to serve, set --http or --tcp")
+	}
+
+	errs := make(chan error, 2)
+	if *httpAddr != "" {
+		go func() {
+			log.Printf("Serving HTTP on %s", *httpAddr)
+			errs <- http.ListenAndServe(*httpAddr, srv)
+		}()
+	}
+	if *tcpAddr != "" {
+		l, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("Serving TCP on %s", l.Addr())
+			errs <- srv.ServeTCP(l)
+		}()
+	}
+	log.Fatal(<-errs)
+}
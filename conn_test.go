@@ -0,0 +1,219 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/vnet"
+)
+
+// vnetConfigs returns the configs of two peers behind port-restricted
+// NATs of a vnet network run by a virtual clock. edit, if not nil,
+// adjusts both configs.
+func vnetConfigs(t *testing.T, edit func(*Config)) (a, b *Config, clock *vnet.VirtualClock) {
+	clock = vnet.NewVirtualClock(time.Unix(1e9, 0))
+	stop := clock.Run(20 * time.Millisecond)
+	t.Cleanup(stop)
+	n := vnet.New()
+	n.Clock = clock
+	n.SetLink(vnet.LinkConfig{Latency: 20 * time.Millisecond})
+	stunAddr, err := n.AddSTUNServer(net.IPv4(1, 1, 1, 1), 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*Config
+	for _, ip := range []net.IP{net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3)} {
+		g, err := n.AddNAT(ip, *portRestricted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := g.AddHost(net.IPv4(10, 0, 0, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := DefaultConfig()
+		cfg.ListenPacket = h.ListenPacket
+		cfg.InterfaceAddrs = h.InterfaceAddrs
+		cfg.STUNServer = stunAddr.String()
+		cfg.Clock = clock
+		cfg.Nomination = NominateAggressive
+		if edit != nil {
+			edit(cfg)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs[0], cfgs[1], clock
+}
+
+// vnetPair connects two peers configured by vnetConfigs.
+func vnetPair(t *testing.T, edit func(*Config)) (a, b *Conn, clock *vnet.VirtualClock) {
+	cfgA, cfgB, clock := vnetConfigs(t, edit)
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	xa, xb := testExchange()
+	ca, cb := make(chan result, 1), make(chan result, 1)
+	go func() { c, err := ConnectOpt(xa, true, cfgA); ca <- result{c, err} }()
+	go func() { c, err := ConnectOpt(xb, false, cfgB); cb <- result{c, err} }()
+	ra, rb := <-ca, <-cb
+	for _, r := range []result{ra, rb} {
+		if r.c != nil {
+			t.Cleanup(func() { r.c.Close() })
+		}
+	}
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("failed to connect: %v, %v", ra.err, rb.err)
+	}
+	return ra.c.(*Conn), rb.c.(*Conn), clock
+}
+
+// roundTrip checks that a message gets from a to b and back.
+func roundTrip(t *testing.T, a, b *Conn, clock *vnet.VirtualClock) {
+	t.Helper()
+	buf := make([]byte, 100)
+	for _, p := range [][2]*Conn{{a, b}, {b, a}} {
+		from, to := p[0], p[1]
+		if _, err := from.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		to.SetReadDeadline(clock.Now().Add(5 * time.Second))
+		n, err := to.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("read %q, %v", buf[:n], err)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	a, b, clock := vnetPair(t, nil)
+	roundTrip(t, a, b, clock)
+	a.mu.Lock()
+	oldLocal, oldRemote := a.localCreds, a.remoteCreds
+	a.mu.Unlock()
+	oldStats := a.Stats()
+
+	xa, xb := testExchange()
+	errs := make(chan error, 2)
+	go func() { errs <- a.Restart(xa) }()
+	go func() { errs <- b.Restart(xb) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.mu.Lock()
+	local, remote := a.localCreds, a.remoteCreds
+	a.mu.Unlock()
+	b.mu.Lock()
+	peerLocal, peerRemote := b.localCreds, b.remoteCreds
+	b.mu.Unlock()
+	if local == oldLocal || remote == oldRemote {
+		t.Fatal("restart kept the old credentials")
+	}
+	if peerLocal != remote || peerRemote != local {
+		t.Fatalf("peers disagree on the credentials: %+v/%+v and %+v/%+v", local, remote, peerLocal, peerRemote)
+	}
+	if stats := a.Stats(); !stats.Start.After(oldStats.Start) || stats.Session != oldStats.Session {
+		t.Fatalf("stats of the restart: %+v", stats)
+	}
+	roundTrip(t, a, b, clock)
+	// Consent checks use the new credentials, so the connection
+	// outlives the consent timeout.
+	waitClock(clock, 2*DefaultConfig().ConsentTimeout)
+	roundTrip(t, a, b, clock)
+}
+
+// waitClock waits for clock to move d forward, through the timers
+// that expire on the way.
+func waitClock(clock *vnet.VirtualClock, d time.Duration) {
+	done := make(chan struct{})
+	clock.AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+func TestConsentExpiry(t *testing.T) {
+	a, b, clock := vnetPair(t, nil)
+	cfg := DefaultConfig()
+	// Consent answers keep an idle connection up.
+	waitClock(clock, 2*cfg.ConsentTimeout)
+	roundTrip(t, a, b, clock)
+
+	b.Close()
+	start := clock.Now()
+	a.SetReadDeadline(start.Add(10 * cfg.ConsentTimeout))
+	if _, err := a.Read(make([]byte, 100)); err != ErrConsentExpired {
+		t.Fatalf("read after the peer left: %v, want ErrConsentExpired", err)
+	}
+	// The last answer came up to an interval before the peer left,
+	// and checks are randomized around the interval.
+	if d := clock.Now().Sub(start); d < cfg.ConsentTimeout-2*cfg.ConsentInterval || d > cfg.ConsentTimeout+2*cfg.ConsentInterval {
+		t.Fatalf("consent expired after %v", d)
+	}
+	if _, err := a.Write([]byte("hello")); err != ErrConsentExpired {
+		t.Fatalf("write after consent expired: %v", err)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	const components = 3
+	cfgA, cfgB, clock := vnetConfigs(t, func(cfg *Config) { cfg.Components = components })
+	var exchanges int32
+	xa, xb := testExchange()
+	counted := func(m []byte) []byte {
+		atomic.AddInt32(&exchanges, 1)
+		return xa(m)
+	}
+	type result struct {
+		cs  []*Conn
+		err error
+	}
+	ca, cb := make(chan result, 1), make(chan result, 1)
+	go func() { cs, err := ConnectComponents(counted, true, cfgA); ca <- result{cs, err} }()
+	go func() { cs, err := ConnectComponents(xb, false, cfgB); cb <- result{cs, err} }()
+	ra, rb := <-ca, <-cb
+	for _, r := range []result{ra, rb} {
+		for _, c := range r.cs {
+			defer c.Close()
+		}
+	}
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("failed to connect: %v, %v", ra.err, rb.err)
+	}
+	if n := atomic.LoadInt32(&exchanges); n != 1 {
+		t.Fatalf("%d candidate exchanges, want 1", n)
+	}
+	if len(ra.cs) != components || len(rb.cs) != components {
+		t.Fatalf("%d and %d Conns, want %d", len(ra.cs), len(rb.cs), components)
+	}
+	locals := map[string]bool{}
+	for i := 0; i < components; i++ {
+		a, b := ra.cs[i], rb.cs[i]
+		if a.Component() != i+1 || b.Component() != i+1 {
+			t.Fatalf("Conn %d is component %d and %d", i, a.Component(), b.Component())
+		}
+		locals[a.LocalAddr().String()] = true
+	}
+	if len(locals) != components {
+		t.Fatalf("components share sockets: %v", locals)
+	}
+	// Each component carries its own traffic.
+	for i := 0; i < components; i++ {
+		msg := fmt.Sprint("component ", i+1)
+		if _, err := ra.cs[i].Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 100)
+	for i, c := range rb.cs {
+		c.SetReadDeadline(clock.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if want := fmt.Sprint("component ", i+1); err != nil || string(buf[:n]) != want {
+			t.Fatalf("component %d read %q, %v, want %q", i+1, buf[:n], err, want)
+		}
+	}
+}
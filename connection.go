@@ -2,58 +2,271 @@ package nat
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/danderson/nat/portmap"
 )
 
+// Conn is the net.Conn returned by ConnectOpt and friends.
 type Conn struct {
-	conn          *net.UDPConn
-	local, remote net.Addr
+	// lastSend is the UnixNano time of our last transmission to the
+	// peer, used to decide when to send keepalives. It comes first
+	// to be 64-bit aligned for atomic access.
+	lastSend int64
+
+	conn      net.PacketConn
+	cfg       *Config
+	session   string
+	log       Logger
+	initiator bool
+	component int
+	data      *packetQueue
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu                      sync.Mutex
+	local, remote           net.Addr
+	localCreds, remoteCreds Credentials
+	fingerprint             string // of the peer's certificate, for Secure
+	noiseKey                []byte // the peer's static key, for SecureNoise
+	tiebreaker              uint64 // of our checks
+	lease                   *portmap.Lease
+	stats                   *Stats
+	readErr                 error
+	// failErr is set when the connection died, e.g. because the
+	// peer withdrew its consent, and onFail is then called with it.
+	failErr error
+	onFail  func(error)
+	// stun receives the STUN traffic while an ICE restart is
+	// running.
+	stun     *packetQueue
+	handlers [numKinds]func([]byte)
+	// pending holds the transaction IDs of our outstanding consent
+	// checks.
+	pending     map[string]time.Time
+	lastConsent time.Time
+
+	restartMu sync.Mutex
 }
 
-func newConn(sock *net.UDPConn, local, remote net.Addr) *Conn {
+// newConn returns a Conn on sock, using the pair selected by e.
+func newConn(sock net.PacketConn, e *attemptEngine) *Conn {
 	sock.SetDeadline(time.Time{})
-	return &Conn{sock, local, remote}
+	c := &Conn{
+		conn:        sock,
+		cfg:         e.cfg,
+		session:     e.session,
+		log:         e.log,
+		initiator:   e.initiator,
+		component:   e.component,
+		lease:       e.lease,
+		stats:       e.stats,
+		data:        newPacketQueue(256, e.cfg.clock()),
+		done:        make(chan struct{}),
+		lastSend:    e.cfg.clock().Now().UnixNano(),
+		local:       e.localAddr(),
+		remote:      e.selected.Addr,
+		localCreds:  e.local,
+		remoteCreds: e.remote,
+		fingerprint: e.fingerprint,
+		noiseKey:    e.noiseKey,
+		tiebreaker:  e.tiebreaker,
+		pending:     map[string]time.Time{},
+		lastConsent: e.cfg.clock().Now(),
+	}
+	// Data the peer sent as soon as it was done with its checks
+	// reached us while our own checks were running.
+	for _, p := range e.early {
+		if p.from.String() == c.remote.String() {
+			c.data.push(p)
+		}
+	}
+	if src, ok := sock.(packetSource); ok {
+		src.deliverTo(c)
+	} else {
+		go c.readLoop()
+	}
+	go c.consentLoop()
+	return c
 }
 
-func (c *Conn) Read(b []byte) (int, error) {
+// A packetSource is a socket that hands its packets to the demux of
+// its Conn, rather than being read by readLoop.
+type packetSource interface {
+	deliverTo(c *Conn)
+}
+
+// readLoop owns the reads on the socket, and hands the packets to
+// demux.
+func (c *Conn) readLoop() {
+	ms := readBuffers(c.conn, c.cfg.maxDatagramSize())
 	for {
-		n, addr, err := c.conn.ReadFrom(b)
-		// Generic non-address related errors.
-		if addr == nil && err != nil {
-			return n, err
+		n, err := readBatch(c.conn, ms)
+		if err != nil {
+			c.readFailed(err)
+			return
+		}
+		for _, m := range ms[:n] {
+			c.demux(packet{m.Buf[:m.N], m.Addr, m.ECN})
 		}
-		// Filter out anything not related to the address we care
-		// about.
-		if addr.Network() != c.remote.Network() || addr.String() != c.remote.String() {
-			continue
+	}
+}
+
+// readFailed ends the reads of c with err.
+func (c *Conn) readFailed(err error) {
+	c.mu.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+	}
+	c.mu.Unlock()
+	c.data.close()
+}
+
+// readBufferSize is the memory a Conn reads into, shared by the
+// datagrams of a batch.
+const readBufferSize = 65536
+
+// readBuffers returns the messages to read datagrams of up to size
+// bytes from sock into: as many as fit in readBufferSize if sock
+// reads a batch with a single system call, one otherwise.
+func readBuffers(sock net.PacketConn, size int) []Message {
+	n := 1
+	if canBatch(sock) {
+		n = readBufferSize / size
+		if n > readBatchSize {
+			n = readBatchSize
+		}
+		if n < 1 {
+			n = 1
+		}
+	}
+	ms := make([]Message, n)
+	for i := range ms {
+		ms[i].Buf = make([]byte, size)
+	}
+	return ms
+}
+
+// demux sorts a packet between the ICE machinery, packet handlers
+// and Read.
+func (c *Conn) demux(p packet) {
+	b, addr := p.buf, p.from
+	kind := ClassifyPacket(b)
+	c.mu.Lock()
+	remote, restart, handler := c.remote, c.stun, c.handlers[kind]
+	c.mu.Unlock()
+
+	// STUN never reaches the application.
+	if kind == KindSTUN {
+		if !c.handleSTUN(b, addr) && restart != nil {
+			restart.push(p)
 		}
-		return n, err
+		return
+	}
+	// Filter out anything not related to the address we care
+	// about.
+	if addr.Network() != remote.Network() || addr.String() != remote.String() {
+		return
+	}
+	c.countData("rx", 1, len(b))
+	if handler != nil {
+		handler(b)
+		return
+	}
+	c.data.push(p)
+}
+
+// Read reads a single datagram from the peer into b. The part of the
+// datagram that doesn't fit in b is discarded.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, _, err := c.data.read(b)
+	if err != nil {
+		return n, c.readError(err)
 	}
-	panic("unreachable")
+	return n, nil
 }
 
+// readError returns the error to report for a failed read from the
+// data queue.
+func (c *Conn) readError(err error) error {
+	if err != net.ErrClosed {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failErr != nil {
+		return c.failErr
+	}
+	if c.readErr != nil {
+		return c.readErr
+	}
+	return err
+}
+
+// Write sends b to the peer as a single datagram.
 func (c *Conn) Write(b []byte) (int, error) {
-	return c.conn.WriteTo(b, c.remote)
+	c.mu.Lock()
+	remote, err := c.remote, c.failErr
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.conn.WriteTo(b, remote)
+	if err == nil {
+		atomic.StoreInt64(&c.lastSend, c.cfg.clock().Now().UnixNano())
+		c.countData("tx", 1, n)
+	}
+	return n, err
 }
 
 func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.mu.Lock()
+	if c.stun != nil {
+		c.stun.close()
+	}
+	lease := c.lease
+	c.mu.Unlock()
+	c.data.close()
+	if lease != nil {
+		lease.Close()
+	}
 	return c.conn.Close()
 }
 
+// Component returns the ICE component number of c, starting from 1.
+func (c *Conn) Component() int {
+	return c.component
+}
+
+// Session returns the ID of the negotiation that established c, as
+// found in logs and events.
+func (c *Conn) Session() string {
+	return c.session
+}
+
 func (c *Conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.local
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.remote
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.conn.SetDeadline(t)
+	c.data.setDeadline(t)
+	return c.conn.SetWriteDeadline(t)
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+	c.data.setDeadline(t)
+	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
@@ -0,0 +1,209 @@
+package nat
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/danderson/nat/stun"
+)
+
+// ErrConsentExpired is returned by a Conn whose peer stopped
+// answering consent freshness checks for longer than
+// Config.ConsentTimeout.
+var ErrConsentExpired = errors.New("peer consent expired")
+
+// consentInterval is the Config.ConsentInterval of our Conns. Lite
+// peers leave consent checks to the full peer.
+func (c *Config) consentInterval() time.Duration {
+	if c.Lite {
+		return 0
+	}
+	return c.ConsentInterval
+}
+
+// consentLoop periodically checks that the peer still wants our
+// traffic (RFC 7675), and sends keepalives when the connection is
+// idle.
+func (c *Conn) consentLoop() {
+	interval := c.cfg.consentInterval()
+	if interval <= 0 {
+		interval = c.cfg.KeepaliveInterval
+	}
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		// Randomize the interval so that connections don't
+		// synchronize their checks, as RFC 7675 asks.
+		wait := interval
+		if c.cfg.consentInterval() > 0 {
+			wait = time.Duration(float64(interval) * (0.8 + 0.4*rand.Float64()))
+		}
+		timeout, stop := newTimer(c.cfg.clock(), wait)
+		select {
+		case <-c.done:
+			stop()
+			return
+		case <-timeout:
+		}
+
+		if c.cfg.consentInterval() > 0 {
+			if c.consentExpired() {
+				c.log.Warn("peer consent expired, closing", "remote", c.RemoteAddr())
+				c.fail(ErrConsentExpired)
+				return
+			}
+			if err := c.sendConsent(); err != nil {
+				c.log.Debug("failed to send consent check", "err", err)
+			}
+		}
+		if c.cfg.KeepaliveInterval > 0 && c.idleFor() >= c.cfg.KeepaliveInterval {
+			if err := c.sendKeepalive(); err != nil {
+				c.log.Debug("failed to send keepalive", "err", err)
+			}
+		}
+	}
+}
+
+func (c *Conn) consentExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout := c.cfg.ConsentTimeout
+	if timeout <= 0 {
+		return false
+	}
+	now := c.cfg.clock().Now()
+	for tid, sent := range c.pending {
+		if now.Sub(sent) > timeout {
+			delete(c.pending, tid)
+			c.cfg.metrics().Count("nat_stun_timeouts_total", 1, "type", "consent")
+		}
+	}
+	return now.Sub(c.lastConsent) > timeout
+}
+
+func (c *Conn) sendConsent() error {
+	tid, err := stun.RandomTid()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	remote := c.remote
+	ice := stun.ICE{
+		Username:    c.remoteCreds.Ufrag + ":" + c.localCreds.Ufrag,
+		Priority:    checkPriority(c.component),
+		Controlling: c.initiator,
+		Tiebreaker:  c.tiebreaker,
+	}
+	key := []byte(c.remoteCreds.Pwd)
+	c.pending[string(tid)] = c.cfg.clock().Now()
+	c.mu.Unlock()
+
+	req, err := stun.CheckRequest(tid, ice, key)
+	if err != nil {
+		return err
+	}
+	c.cfg.metrics().Count("nat_stun_requests_total", 1, "type", "consent")
+	return c.writeTo(req, remote)
+}
+
+func (c *Conn) sendKeepalive() error {
+	tid, err := stun.RandomTid()
+	if err != nil {
+		return err
+	}
+	ind, err := stun.BindIndication(tid)
+	if err != nil {
+		return err
+	}
+	return c.writeTo(ind, c.RemoteAddr())
+}
+
+func (c *Conn) writeTo(b []byte, addr net.Addr) error {
+	_, err := c.conn.WriteTo(b, addr)
+	if err == nil {
+		atomic.StoreInt64(&c.lastSend, c.cfg.clock().Now().UnixNano())
+	}
+	return err
+}
+
+func (c *Conn) idleFor() time.Duration {
+	return c.cfg.clock().Now().Sub(time.Unix(0, atomic.LoadInt64(&c.lastSend)))
+}
+
+// handleSTUN processes the STUN packets that belong to the
+// established connection: connectivity checks from the peer, answers
+// to our consent checks and keepalives. It reports whether raw was
+// consumed.
+func (c *Conn) handleSTUN(raw []byte, addr net.Addr) bool {
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	class, err := stun.PeekClass(raw)
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	local, remote := c.localCreds, c.remoteCreds
+	remoteAddr := c.remote
+	c.mu.Unlock()
+
+	switch class {
+	case stun.ClassRequest:
+		packet, err := stun.ParsePacket(raw, []byte(local.Pwd))
+		if err != nil || packet.Method != stun.MethodBinding || !strings.HasPrefix(packet.Username, local.Ufrag+":") {
+			return false
+		}
+		// Late checks from a peer still running its engine, or its
+		// consent checks.
+		response, err := stun.BindResponse(packet.Tid[:], from, []byte(local.Pwd), false)
+		if err != nil {
+			return true
+		}
+		c.writeTo(response, from)
+		return true
+
+	case stun.ClassSuccess:
+		if from.String() != remoteAddr.String() {
+			return false
+		}
+		packet, err := stun.ParsePacket(raw, []byte(remote.Pwd))
+		if err != nil || packet.Method != stun.MethodBinding {
+			return false
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.pending[string(packet.Tid[:])]; !ok {
+			// A late answer to the connectivity checks.
+			return true
+		}
+		delete(c.pending, string(packet.Tid[:]))
+		c.lastConsent = c.cfg.clock().Now()
+		return true
+
+	case stun.ClassIndication:
+		return from.String() == remoteAddr.String()
+	}
+	return false
+}
+
+// fail closes c, making future reads and writes return err.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.failErr == nil {
+		c.failErr = err
+	}
+	onFail := c.onFail
+	c.mu.Unlock()
+	c.Close()
+	if onFail != nil {
+		onFail(err)
+	}
+}
@@ -0,0 +1,74 @@
+package nat
+
+import "github.com/danderson/nat/stun"
+
+// A PacketKind is the protocol of a datagram, as told apart by its
+// first byte following RFC 7983.
+type PacketKind int
+
+// Protocols that can share a Conn.
+const (
+	KindUnknown PacketKind = iota
+	KindSTUN
+	KindZRTP
+	KindDTLS
+	KindTURN
+	KindRTP
+	numKinds
+)
+
+func (k PacketKind) String() string {
+	switch k {
+	case KindSTUN:
+		return "STUN"
+	case KindZRTP:
+		return "ZRTP"
+	case KindDTLS:
+		return "DTLS"
+	case KindTURN:
+		return "TURN"
+	case KindRTP:
+		return "RTP"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassifyPacket returns the protocol of b. STUN packets must also
+// carry the magic cookie, so that application data that happens to
+// start with a low byte isn't mistaken for STUN.
+func ClassifyPacket(b []byte) PacketKind {
+	if len(b) == 0 {
+		return KindUnknown
+	}
+	switch c := b[0]; {
+	case c <= 3:
+		if _, err := stun.PeekClass(b); err == nil {
+			return KindSTUN
+		}
+	case c >= 16 && c <= 19:
+		return KindZRTP
+	case c >= 20 && c <= 63:
+		return KindDTLS
+	case c >= 64 && c <= 79:
+		return KindTURN
+	case c >= 128 && c <= 191:
+		return KindRTP
+	}
+	return KindUnknown
+}
+
+// SetHandler makes c deliver the packets of kind k from the peer to
+// h rather than to Read. h runs on the goroutine reading the socket,
+// which on a Listener is shared by all its Conns, so h must not block
+// or retain b. A nil h restores delivery to Read.
+//
+// STUN packets are always consumed by c and cannot be handled.
+func (c *Conn) SetHandler(k PacketKind, h func(b []byte)) {
+	if k == KindSTUN || k < 0 || k >= numKinds {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[k] = h
+}
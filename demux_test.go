@@ -0,0 +1,83 @@
+package nat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/stun"
+)
+
+func TestClassifyPacket(t *testing.T) {
+	tid, err := stun.RandomTid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind, err := stun.BindRequest(tid, nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want PacketKind
+	}{
+		{"empty", nil, KindUnknown},
+		{"stun", bind, KindSTUN},
+		{"low byte without the magic cookie", []byte{1, 1, 0, 0, 1, 2, 3, 4}, KindUnknown},
+		{"zrtp", []byte{16}, KindZRTP},
+		{"dtls low", []byte{20}, KindDTLS},
+		{"dtls high", []byte{63}, KindDTLS},
+		{"turn low", []byte{64}, KindTURN},
+		{"turn high", []byte{79}, KindTURN},
+		{"gap", []byte{100}, KindUnknown},
+		{"rtp low", []byte{128}, KindRTP},
+		{"rtp high", []byte{191}, KindRTP},
+		{"above rtp", []byte{192}, KindUnknown},
+	} {
+		if got := ClassifyPacket(tc.b); got != tc.want {
+			t.Errorf("%s: ClassifyPacket = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDemux(t *testing.T) {
+	a, b, clock := vnetPair(t, nil)
+	turn := make(chan []byte, 1)
+	b.SetHandler(KindTURN, func(p []byte) { turn <- append([]byte(nil), p...) })
+	b.SetHandler(KindSTUN, func([]byte) { t.Error("STUN handler called") })
+
+	// A TURN channel message goes to its handler, and a DTLS record
+	// to Read, neither to the STUN machinery.
+	dtls := []byte{22, 0xfe, 0xfd, 0, 0}
+	channel := []byte{0x40, 0x00, 0, 4, 'd', 'a', 't', 'a'}
+	for _, p := range [][]byte{channel, dtls} {
+		if _, err := a.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.SetReadDeadline(clock.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != string(dtls) {
+		t.Fatalf("read %x, %v, want the DTLS record", buf[:n], err)
+	}
+	select {
+	case p := <-turn:
+		if string(p) != string(channel) {
+			t.Fatalf("TURN handler got %x", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TURN handler not called")
+	}
+
+	// Without a handler, the TURN range goes to Read too.
+	b.SetHandler(KindTURN, nil)
+	if _, err := a.Write(channel); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(clock.Now().Add(5 * time.Second))
+	n, err = b.Read(buf)
+	if err != nil || string(buf[:n]) != string(channel) {
+		t.Fatalf("read %x, %v, want the TURN message", buf[:n], err)
+	}
+}
@@ -0,0 +1,100 @@
+package dtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// GenerateCertificate returns a self-signed certificate with a fresh
+// ECDSA P-256 key, for peers that authenticate each other by
+// fingerprint.
+func GenerateCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "nat"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(30 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+const fingerprintPrefix = "sha-256 "
+
+// Fingerprint returns the SHA-256 fingerprint of the DER certificate
+// der, in the SDP format (RFC 8122), e.g. "sha-256 4A:AD:...".
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	var b strings.Builder
+	b.WriteString(fingerprintPrefix)
+	for i, c := range sum {
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		fmt.Fprintf(&b, "%02X", c)
+	}
+	return b.String()
+}
+
+// ParseFingerprint returns the hash in a fingerprint made by
+// Fingerprint.
+func ParseFingerprint(fp string) ([]byte, error) {
+	if !strings.HasPrefix(strings.ToLower(fp), fingerprintPrefix) {
+		return nil, fmt.Errorf("unsupported fingerprint %q", fp)
+	}
+	hexs := strings.Split(fp[len(fingerprintPrefix):], ":")
+	if len(hexs) != sha256.Size {
+		return nil, fmt.Errorf("malformed fingerprint %q", fp)
+	}
+	ret := make([]byte, len(hexs))
+	for i, h := range hexs {
+		b, err := hex.DecodeString(h)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("malformed fingerprint %q", fp)
+		}
+		ret[i] = b[0]
+	}
+	return ret, nil
+}
+
+// VerifyFingerprint returns a Config.VerifyPeer that accepts only the
+// certificate with fingerprint fp.
+func VerifyFingerprint(fp string) func(der []byte) error {
+	return func(der []byte) error {
+		want, err := ParseFingerprint(fp)
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(der); string(sum[:]) != string(want) {
+			return errors.New("certificate doesn't match the fingerprint")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,430 @@
+// Package dtls implements DTLS 1.2 (RFC 6347) for peers that
+// authenticate each other by certificate fingerprint, as WebRTC does.
+//
+// It only speaks TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 with X25519
+// or P-256 and ECDSA P-256 certificates, always authenticates both
+// peers and requires no certificate authority: each side checks the
+// peer's certificate with Config.VerifyPeer, typically against a
+// fingerprint received over signaling.
+package dtls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config configures a Conn.
+type Config struct {
+	// Certificate is our certificate. Its key must be an ECDSA
+	// P-256 key, see GenerateCertificate.
+	Certificate tls.Certificate
+	// VerifyPeer is called with the DER certificate of the peer, and
+	// fails the handshake if it returns an error. It is required,
+	// see VerifyFingerprint.
+	VerifyPeer func(der []byte) error
+	// HandshakeTimeout bounds the handshake. Zero means 30 seconds.
+	HandshakeTimeout time.Duration
+	// MTU is the largest datagram the handshake sends. Zero means
+	// 1200 bytes.
+	MTU int
+	// Now, if set, replaces time.Now for the retransmission timers,
+	// and must follow the clock of the underlying conn's deadlines.
+	Now func() time.Time
+}
+
+func (c *Config) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) mtu() int {
+	if c.MTU <= 0 {
+		return 1200
+	}
+	return c.MTU
+}
+
+func (c *Config) check() error {
+	if len(c.Certificate.Certificate) == 0 {
+		return errors.New("dtls: no certificate")
+	}
+	key, ok := c.Certificate.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return errors.New("dtls: the certificate key must be ECDSA P-256")
+	}
+	if c.VerifyPeer == nil {
+		return errors.New("dtls: no VerifyPeer")
+	}
+	return nil
+}
+
+// maxPending bounds the application data received but not read yet.
+const maxPending = 64
+
+// Conn is a DTLS connection over a datagram net.Conn, e.g. a *nat.Conn.
+// Each Write sends a datagram, and each Read returns one.
+type Conn struct {
+	conn   net.Conn
+	cfg    *Config
+	client bool
+
+	hsMu   sync.Mutex
+	hsDone bool
+	hsErr  error
+	// hs is kept after the handshake, so that the server can send
+	// its last flight again if the client didn't get it.
+	hs *handshake
+
+	// Read side, owned by the handshake until it's done.
+	rmu        sync.Mutex
+	readCipher *cipherState
+	replay     replayWindow
+	pending    [][]byte
+	buf        []byte
+
+	// Write side.
+	wmu         sync.Mutex
+	writeCipher *cipherState
+	writeSeq    [2]uint64 // per epoch
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	handshaking  bool  // the handshake owns the read deadline
+	readErr      error // the peer closed or failed the connection
+	closed       bool
+	peerCert     *x509.Certificate
+}
+
+// Client returns a Conn that runs the client side of the handshake
+// over conn. The handshake happens on the first Read or Write, or
+// when Handshake is called.
+func Client(conn net.Conn, cfg *Config) *Conn {
+	return newConn(conn, cfg, true)
+}
+
+// Server is like Client, for the server side. Once its handshake is
+// done, the server answers the client's retransmissions from Read, so
+// it must keep reading for the client to finish if the server's last
+// flight gets lost.
+func Server(conn net.Conn, cfg *Config) *Conn {
+	return newConn(conn, cfg, false)
+}
+
+func newConn(conn net.Conn, cfg *Config, client bool) *Conn {
+	return &Conn{
+		conn:   conn,
+		cfg:    cfg,
+		client: client,
+		buf:    make([]byte, 65536),
+	}
+}
+
+// Handshake runs the handshake if it hasn't run yet, and returns its
+// outcome.
+func (c *Conn) Handshake() error {
+	c.hsMu.Lock()
+	defer c.hsMu.Unlock()
+	if c.hsDone {
+		return c.hsErr
+	}
+	c.hsDone = true
+	if c.hsErr = c.cfg.check(); c.hsErr != nil {
+		return c.hsErr
+	}
+	c.mu.Lock()
+	c.handshaking = true
+	c.mu.Unlock()
+	c.hs = newHandshake(c)
+	if c.client {
+		c.hsErr = c.hs.client()
+	} else {
+		c.hsErr = c.hs.server()
+	}
+	c.mu.Lock()
+	c.handshaking = false
+	c.conn.SetReadDeadline(c.readDeadline)
+	c.mu.Unlock()
+	return c.hsErr
+}
+
+// PeerCertificate returns the certificate of the peer, once the
+// handshake succeeded.
+func (c *Conn) PeerCertificate() *x509.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerCert
+}
+
+// Read reads a datagram from the peer into b. A datagram longer than
+// b is truncated.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		c.mu.Lock()
+		err := c.readErr
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.receive(c.buf[:n], nil)
+	}
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+	return copy(b, p), nil
+}
+
+// receive processes a datagram from the peer. Handshake fragments go
+// to h, if not nil.
+func (c *Conn) receive(b []byte, h *handshake) {
+	retransmit := false
+	for _, r := range parseRecords(b) {
+		if c.receiveRecord(r, h) {
+			retransmit = true
+		}
+	}
+	if !retransmit {
+		return
+	}
+	if h == nil {
+		h = c.hs
+	}
+	h.writeFlight()
+}
+
+// receiveRecord processes a record from the peer, and reports whether
+// the peer missed our last flight.
+func (c *Conn) receiveRecord(r record, h *handshake) (retransmit bool) {
+	data := r.data
+	switch r.epoch {
+	case 0:
+		if r.typ == typeApplicationData {
+			return false
+		}
+	case 1:
+		if c.readCipher == nil {
+			// The peer's Finished may arrive along with the
+			// messages we need to compute the keys.
+			if h != nil && len(h.early) < maxPending {
+				r.data = append([]byte(nil), r.data...)
+				h.early = append(h.early, r)
+			}
+			return false
+		}
+		if !c.replay.fresh(r.seq) {
+			return false
+		}
+		var err error
+		if data, err = c.readCipher.open(r); err != nil {
+			return false
+		}
+		c.replay.mark(r.seq)
+	default:
+		return false
+	}
+
+	switch r.typ {
+	case typeHandshake:
+		if h != nil {
+			return h.addFragments(data)
+		}
+		// The client is still sending its last flight, so it missed
+		// ours.
+		return !c.client
+	case typeApplicationData:
+		if len(c.pending) < maxPending {
+			c.pending = append(c.pending, append([]byte(nil), data...))
+		}
+	case typeAlert:
+		// Plaintext alerts only matter before we have keys.
+		if r.epoch == 1 || h != nil {
+			c.handleAlert(data, r.epoch)
+		}
+	}
+	return false
+}
+
+func (c *Conn) handleAlert(data []byte, epoch uint16) {
+	if len(data) != 2 {
+		return
+	}
+	// Unauthenticated warnings could be forged.
+	if epoch == 0 && data[0] != alertLevelFatal {
+		return
+	}
+	var err error
+	switch {
+	case data[1] == alertCloseNotify:
+		err = io.EOF
+	case data[0] == alertLevelFatal:
+		err = alertError(data[1])
+	default:
+		return
+	}
+	c.mu.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+	}
+	c.mu.Unlock()
+}
+
+// Write sends b to the peer in a single record.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if _, err := c.conn.Write(c.record(typeApplicationData, 1, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// record returns the record of payload in epoch.
+func (c *Conn) record(typ uint8, epoch uint16, payload []byte) []byte {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	seq := c.writeSeq[epoch]
+	c.writeSeq[epoch]++
+	if epoch == 0 {
+		b := appendRecordHeader(nil, typ, 0, seq, len(payload))
+		return append(b, payload...)
+	}
+	return c.writeCipher.seal(nil, typ, epoch, seq, payload)
+}
+
+// Close sends a close_notify alert to the peer if the handshake is
+// done, and closes the underlying conn.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.wmu.Lock()
+	secure := c.writeCipher != nil
+	c.wmu.Unlock()
+	if secure {
+		c.sendAlert(alertLevelWarning, alertCloseNotify)
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) sendAlert(level, desc uint8) {
+	c.wmu.Lock()
+	epoch := uint16(0)
+	if c.writeCipher != nil {
+		epoch = 1
+	}
+	c.wmu.Unlock()
+	c.conn.Write(c.record(typeAlert, epoch, []byte{level, desc}))
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of Read, and of the handshake.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	// The handshake sets its own deadlines, and restores this one
+	// when it's done.
+	if c.handshaking {
+		return nil
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// Alert levels and descriptions.
+const (
+	alertLevelWarning = 1
+	alertLevelFatal   = 2
+
+	alertCloseNotify       = 0
+	alertUnexpectedMessage = 10
+	alertHandshakeFailure  = 40
+	alertBadCertificate    = 42
+	alertIllegalParameter  = 47
+	alertDecodeError       = 50
+	alertDecryptError      = 51
+	alertInternalError     = 80
+)
+
+// An alertError is a fatal alert received from the peer.
+type alertError uint8
+
+func (e alertError) Error() string {
+	names := map[alertError]string{
+		alertUnexpectedMessage: "unexpected message",
+		alertHandshakeFailure:  "handshake failure",
+		alertBadCertificate:    "bad certificate",
+		alertIllegalParameter:  "illegal parameter",
+		alertDecodeError:       "decode error",
+		alertDecryptError:      "decrypt error",
+		alertInternalError:     "internal error",
+	}
+	if name, ok := names[e]; ok {
+		return "dtls: peer failed the connection: " + name
+	}
+	return fmt.Sprintf("dtls: peer failed the connection: alert %d", uint8(e))
+}
+
+// signer returns the key of our certificate.
+func (c *Conn) signer() crypto.Signer {
+	return c.cfg.Certificate.PrivateKey.(crypto.Signer)
+}
@@ -0,0 +1,523 @@
+package dtls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A filterConn drops the datagrams that drop returns true for.
+type filterConn struct {
+	net.Conn
+	mu   sync.Mutex
+	drop func(b []byte) bool
+}
+
+func (c *filterConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	drop := c.drop != nil && c.drop(b)
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// lossy returns a drop function that loses a fraction of the
+// datagrams.
+func lossy(seed int64, loss float64) func([]byte) bool {
+	rng := rand.New(rand.NewSource(seed))
+	return func([]byte) bool { return rng.Float64() < loss }
+}
+
+// freePorts returns n UDP addresses on the loopback that nobody
+// listens on.
+func freePorts(t *testing.T, n int) []*net.UDPAddr {
+	var ret []*net.UDPAddr
+	for i := 0; i < n; i++ {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ret = append(ret, c.LocalAddr().(*net.UDPAddr))
+	}
+	return ret
+}
+
+// udpPair returns two UDP conns connected to each other.
+func udpPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	addrs := freePorts(t, 2)
+	a, err := net.DialUDP("udp4", addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.DialUDP("udp4", addrs[1], addrs[0])
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	cert, err := GenerateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func testConfig(cert, peer tls.Certificate) *Config {
+	return &Config{
+		Certificate:      cert,
+		VerifyPeer:       VerifyFingerprint(Fingerprint(peer.Certificate[0])),
+		HandshakeTimeout: 60 * time.Second,
+	}
+}
+
+// runHandshake runs the handshake of client and server, and returns
+// their errors.
+func runHandshake(client, server *Conn) (error, error) {
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	cerr := client.Handshake()
+	return cerr, <-errs
+}
+
+// echo sends msg from a to b, and checks it arrives intact.
+func echo(t *testing.T, a, b *Conn, msg []byte) {
+	t.Helper()
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2000)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("read %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	for _, tc := range []struct {
+		name string
+		mtu  int
+		loss float64
+	}{
+		{"plain", 0, 0},
+		// The Certificate messages don't fit, and go in fragments.
+		{"fragmented", 200, 0},
+		{"lossy", 300, 0.3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ua, ub := udpPair(t)
+			ca, cb := testConfig(ka, kb), testConfig(kb, ka)
+			ca.MTU, cb.MTU = tc.mtu, tc.mtu
+			client := Client(&filterConn{Conn: ua, drop: lossy(1, tc.loss)}, ca)
+			server := Server(&filterConn{Conn: ub, drop: lossy(2, tc.loss)}, cb)
+			defer client.Close()
+			defer server.Close()
+			if cerr, serr := runHandshake(client, server); cerr != nil || serr != nil {
+				t.Fatalf("handshake failed: %v, %v", cerr, serr)
+			}
+			if !bytes.Equal(client.PeerCertificate().Raw, kb.Certificate[0]) || !bytes.Equal(server.PeerCertificate().Raw, ka.Certificate[0]) {
+				t.Fatal("wrong peer certificates")
+			}
+			if tc.loss == 0 {
+				echo(t, client, server, bytes.Repeat([]byte("c"), 1000))
+				echo(t, server, client, []byte("s"))
+			}
+		})
+	}
+}
+
+func TestHandshakeWrongFingerprint(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	ua, ub := udpPair(t)
+	// The client expects its own certificate from the server.
+	client := Client(ua, testConfig(ka, ka))
+	server := Server(ub, testConfig(kb, ka))
+	defer client.Close()
+	defer server.Close()
+	cerr, serr := runHandshake(client, server)
+	if cerr == nil || serr == nil {
+		t.Fatalf("wrong fingerprint accepted: %v, %v", cerr, serr)
+	}
+}
+
+func TestHelloVerifyRequest(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	ua, ub := udpPair(t)
+	defer ua.Close()
+	server := Server(ub, testConfig(kb, ka))
+	defer server.Close()
+	go server.Handshake()
+
+	hello := &clientHello{
+		random:  randomBytes(32),
+		suites:  []uint16{suiteECDHEECDSAAES128GCMSHA256},
+		groups:  []uint16{groupX25519},
+		sigAlgs: []uint16{sigECDSAP256SHA256},
+	}
+	send := func(seq uint16) []byte {
+		body := hello.marshal()
+		frag := appendHandshakeHeader(nil, typeClientHello, len(body), seq, 0, len(body))
+		frag = append(frag, body...)
+		if _, err := ua.Write(append(appendRecordHeader(nil, typeHandshake, 0, uint64(seq), len(frag)), frag...)); err != nil {
+			t.Fatal(err)
+		}
+		ua.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2000)
+		n, err := ua.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs := parseRecords(buf[:n])
+		if len(rs) == 0 || rs[0].typ != typeHandshake || len(rs[0].data) < handshakeHeaderLen {
+			t.Fatalf("server answered %x", buf[:n])
+		}
+		return rs[0].data
+	}
+
+	// The server answers a ClientHello without a cookie with a
+	// HelloVerifyRequest, rather than its certificate.
+	msg := send(0)
+	if msg[0] != typeHelloVerifyRequest {
+		t.Fatalf("server answered with message %d, not HelloVerifyRequest", msg[0])
+	}
+	cookie, ok := parseHelloVerifyRequest(msg[handshakeHeaderLen:])
+	if !ok || len(cookie) == 0 {
+		t.Fatalf("bad HelloVerifyRequest %x", msg)
+	}
+	// It goes again if the ClientHello does.
+	if again := send(0); !bytes.Equal(again, msg) {
+		t.Fatalf("server answered the retransmitted ClientHello with %x", again)
+	}
+	hello.cookie = cookie
+	if msg := send(1); msg[0] != typeServerHello {
+		t.Fatalf("server answered the cookie with message %d, not ServerHello", msg[0])
+	}
+}
+
+func TestHelloVerifyRequestBadCookie(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	ua, ub := udpPair(t)
+	server := Server(ub, testConfig(kb, ka))
+	defer server.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+
+	// A client that makes up a cookie. Its ClientHello has an empty
+	// session ID.
+	client := Client(&filterConn{Conn: ua, drop: func(b []byte) bool {
+		rs := parseRecords(b)
+		if len(rs) > 0 && rs[0].typ == typeHandshake && rs[0].data[0] == typeClientHello {
+			p := parser{b: rs[0].data[handshakeHeaderLen+2+32+1:]}
+			if cookie := p.vec8(); len(cookie) > 0 {
+				cookie[0] ^= 1
+			}
+		}
+		return false
+	}}, testConfig(ka, kb))
+	defer client.Close()
+	go client.Handshake()
+	if err := <-errs; err == nil {
+		t.Fatal("server accepted a bad cookie")
+	}
+}
+
+func TestRetransmitLastFlight(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	ua, ub := udpPair(t)
+	client := Client(ua, testConfig(ka, kb))
+	// The server's last flight starts with its ChangeCipherSpec.
+	// Losing it leaves the client waiting, while the server thinks
+	// it's done.
+	dropped := false
+	server := Server(&filterConn{Conn: ub, drop: func(b []byte) bool {
+		if b[0] == typeChangeCipherSpec && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}}, testConfig(kb, ka))
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		if err := server.Handshake(); err != nil {
+			errs <- err
+			return
+		}
+		// Read answers the retransmissions of the client.
+		server.SetReadDeadline(time.Now().Add(30 * time.Second))
+		buf := make([]byte, 100)
+		n, err := server.Read(buf)
+		if err == nil && string(buf[:n]) != "done" {
+			err = fmt.Errorf("read %q", buf[:n])
+		}
+		errs <- err
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !dropped {
+		t.Fatal("the last flight wasn't lost")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	ua, ub := udpPair(t)
+	var last []byte
+	client := Client(&filterConn{Conn: ua, drop: func(b []byte) bool {
+		last = append(last[:0], b...)
+		return false
+	}}, testConfig(ka, kb))
+	server := Server(ub, testConfig(kb, ka))
+	defer client.Close()
+	defer server.Close()
+	if cerr, serr := runHandshake(client, server); cerr != nil || serr != nil {
+		t.Fatalf("handshake failed: %v, %v", cerr, serr)
+	}
+	echo(t, client, server, []byte("once"))
+	if _, err := ua.Write(last); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := server.Read(make([]byte, 100)); err == nil {
+		t.Fatalf("replayed record read: %d bytes", n)
+	}
+	// The connection is still good.
+	server.SetReadDeadline(time.Time{})
+	echo(t, client, server, []byte("twice"))
+}
+
+func TestRecord(t *testing.T) {
+	key, salt := bytes.Repeat([]byte{1}, 16), []byte{2, 3, 4, 5}
+	s, err := newCipherState(key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := s.seal(nil, typeApplicationData, 1, 42, []byte("hello"))
+	b = s.seal(b, typeAlert, 1, 43, []byte{alertLevelWarning, alertCloseNotify})
+	rs := parseRecords(b)
+	if len(rs) != 2 {
+		t.Fatalf("parsed %d records, want 2", len(rs))
+	}
+	if rs[0].typ != typeApplicationData || rs[0].epoch != 1 || rs[0].seq != 42 {
+		t.Fatalf("bad record header %+v", rs[0])
+	}
+	if got, err := s.open(rs[0]); err != nil || string(got) != "hello" {
+		t.Fatalf("open: %q, %v", got, err)
+	}
+
+	// The header is authenticated.
+	for _, r := range []record{
+		{rs[0].typ, rs[0].epoch, rs[0].seq + 1, rs[0].data},
+		{typeHandshake, rs[0].epoch, rs[0].seq, rs[0].data},
+	} {
+		if _, err := s.open(r); err == nil {
+			t.Errorf("opened a record with a forged header %+v", r)
+		}
+	}
+	data := append([]byte(nil), rs[0].data...)
+	data[len(data)-1] ^= 1
+	if _, err := s.open(record{rs[0].typ, rs[0].epoch, rs[0].seq, data}); err == nil {
+		t.Error("opened a corrupted record")
+	}
+	if _, err := s.open(record{rs[0].typ, rs[0].epoch, rs[0].seq, data[:4]}); err == nil {
+		t.Error("opened a truncated record")
+	}
+
+	// A truncated record ends the datagram.
+	if rs := parseRecords(b[:len(b)-1]); len(rs) != 1 {
+		t.Errorf("parsed %d records of a truncated datagram, want 1", len(rs))
+	}
+	bad := append([]byte(nil), b...)
+	bad[1] = 3
+	if rs := parseRecords(bad); len(rs) != 0 {
+		t.Errorf("parsed %d records with a bad version", len(rs))
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, tc := range []struct {
+		seq   uint64
+		fresh bool
+	}{
+		{10, true},
+		{10, false},
+		{5, true},
+		{11, true},
+		{5, false},
+		{100, true},
+		// Out of the window.
+		{36, false},
+		{37, true},
+		{37, false},
+		{99, true},
+		{100, false},
+		{1000, true},
+		{999, true},
+		{100, false},
+	} {
+		if got := w.fresh(tc.seq); got != tc.fresh {
+			t.Fatalf("fresh(%d) = %v, want %v", tc.seq, got, tc.fresh)
+		}
+		if tc.fresh {
+			w.mark(tc.seq)
+		}
+	}
+}
+
+// writePEM writes the certificate and key of cert in dir, for
+// openssl.
+func writePEM(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// openssl starts openssl with args, and returns its stdin, and its
+// stdout line by line.
+func openssl(t *testing.T, args ...string) (*os.File, <-chan string) {
+	path, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("no openssl")
+	}
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = stdin
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Close()
+	t.Cleanup(func() {
+		w.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("openssl %s:\n%s", strings.Join(args, " "), stderr.String())
+		}
+	})
+	lines := make(chan string, 10)
+	go func() {
+		s := bufio.NewScanner(out)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	return w, lines
+}
+
+// interop exchanges a line each way between c and openssl.
+func interop(t *testing.T, c *Conn, stdin *os.File, stdout <-chan string) {
+	if _, err := c.Write([]byte("from go\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-stdout:
+		if line != "from go" {
+			t.Fatalf("openssl read %q", line)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("openssl read nothing")
+	}
+	if _, err := fmt.Fprintln(stdin, "from openssl"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "from openssl\n" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestOpenSSLServer(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	certFile, keyFile := writePEM(t, t.TempDir(), kb)
+	addrs := freePorts(t, 2)
+	stdin, stdout := openssl(t, "s_server", "-dtls1_2", "-quiet", "-listen",
+		"-accept", addrs[1].String(), "-cert", certFile, "-key", keyFile, "-Verify", "1",
+		"-cipher", "ECDHE-ECDSA-AES128-GCM-SHA256")
+	// Wait for openssl to listen.
+	time.Sleep(500 * time.Millisecond)
+
+	u, err := net.DialUDP("udp4", addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client(u, testConfig(ka, kb))
+	defer c.Close()
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	interop(t, c, stdin, stdout)
+}
+
+func TestOpenSSLClient(t *testing.T) {
+	ka, kb := testCert(t), testCert(t)
+	certFile, keyFile := writePEM(t, t.TempDir(), ka)
+	addrs := freePorts(t, 2)
+	u, err := net.DialUDP("udp4", addrs[1], addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Server(u, testConfig(kb, ka))
+	defer c.Close()
+	// openssl's cookie exchange answers our HelloVerifyRequest.
+	stdin, stdout := openssl(t, "s_client", "-dtls1_2", "-quiet",
+		"-bind", addrs[0].String(), "-connect", addrs[1].String(),
+		"-cert", certFile, "-key", keyFile)
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	interop(t, c, stdin, stdout)
+}
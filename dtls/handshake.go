@@ -0,0 +1,660 @@
+package dtls
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// maxMessageLen bounds the handshake messages we reassemble.
+	maxMessageLen = 1 << 16
+	// maxAhead is how far past the next message we buffer
+	// fragments.
+	maxAhead = 16
+	// Retransmission timer bounds, as in RFC 6347 section 4.2.4.1.
+	initialRetransmit = time.Second
+	maxRetransmit     = 60 * time.Second
+)
+
+var errHandshakeTimeout = errors.New("dtls: handshake timed out")
+
+// A message is a handshake message being reassembled.
+type message struct {
+	typ    uint8
+	body   []byte
+	filled []bool
+	left   int
+}
+
+// An outMessage is a message of our last flight, kept to send it
+// again.
+type outMessage struct {
+	ccs   bool // a ChangeCipherSpec, rather than a handshake message
+	epoch uint16
+	typ   uint8
+	seq   uint16
+	body  []byte
+}
+
+type handshake struct {
+	c *Conn
+
+	// transcript holds the handshake messages so far, each with a
+	// header as if it was sent in a single fragment.
+	transcript []byte
+	sendSeq    uint16
+	recvSeq    uint16
+	msgs       map[uint16]*message
+	early      []record     // epoch 1 records received before the keys
+	next       []outMessage // the flight being built
+	flight     []outMessage // the last flight sent
+
+	deadline     time.Time
+	retransmitAt time.Time
+	timeout      time.Duration
+
+	clientRandom, serverRandom []byte
+	ems                        bool
+	master                     []byte
+	// cookieKey signs the cookies of the server.
+	cookieKey []byte
+}
+
+func newHandshake(c *Conn) *handshake {
+	return &handshake{
+		c:        c,
+		msgs:     map[uint16]*message{},
+		deadline: c.cfg.now().Add(c.cfg.handshakeTimeout()),
+	}
+}
+
+func (h *handshake) client() error {
+	c := h.c
+	h.clientRandom = randomBytes(32)
+	hello := &clientHello{
+		random:  h.clientRandom,
+		suites:  []uint16{suiteECDHEECDSAAES128GCMSHA256},
+		groups:  []uint16{groupX25519, groupP256},
+		sigAlgs: []uint16{sigECDSAP256SHA256},
+		ems:     true,
+	}
+	h.add(0, typeClientHello, hello.marshal())
+	if err := h.flush(); err != nil {
+		return err
+	}
+
+	typ, body, err := h.readMessage()
+	if err != nil {
+		return err
+	}
+	if typ == typeHelloVerifyRequest {
+		cookie, ok := parseHelloVerifyRequest(body)
+		if !ok {
+			return h.fail(alertDecodeError, errors.New("dtls: malformed HelloVerifyRequest"))
+		}
+		// The first ClientHello and the HelloVerifyRequest are not
+		// part of the transcript.
+		h.transcript = nil
+		hello.cookie = cookie
+		h.add(0, typeClientHello, hello.marshal())
+		if err := h.flush(); err != nil {
+			return err
+		}
+		if typ, body, err = h.readMessage(); err != nil {
+			return err
+		}
+	}
+	if typ != typeServerHello {
+		return h.unexpected(typ)
+	}
+	sh, ok := parseServerHello(body)
+	if !ok {
+		return h.fail(alertDecodeError, errors.New("dtls: malformed ServerHello"))
+	}
+	if sh.suite != suiteECDHEECDSAAES128GCMSHA256 {
+		return h.fail(alertIllegalParameter, fmt.Errorf("dtls: server picked unsupported cipher suite %#04x", sh.suite))
+	}
+	h.serverRandom, h.ems = sh.random, sh.ems
+
+	if body, err = h.expect(typeCertificate); err != nil {
+		return err
+	}
+	pub, err := h.verifyPeer(body)
+	if err != nil {
+		return err
+	}
+	if body, err = h.expect(typeServerKeyExchange); err != nil {
+		return err
+	}
+	ske, ok := parseServerKeyExchange(body)
+	if !ok {
+		return h.fail(alertDecodeError, errors.New("dtls: malformed ServerKeyExchange"))
+	}
+	if curve(ske.group) == nil || ske.sigAlg != sigECDSAP256SHA256 {
+		return h.fail(alertIllegalParameter, errors.New("dtls: server picked unsupported key exchange parameters"))
+	}
+	if !verify(pub, concat(h.clientRandom, h.serverRandom, ske.params()), ske.sig) {
+		return h.fail(alertDecryptError, errors.New("dtls: bad ServerKeyExchange signature"))
+	}
+
+	if typ, body, err = h.readMessage(); err != nil {
+		return err
+	}
+	certRequested := typ == typeCertificateRequest
+	if certRequested {
+		sigAlgs, ok := parseCertificateRequest(body)
+		if !ok {
+			return h.fail(alertDecodeError, errors.New("dtls: malformed CertificateRequest"))
+		}
+		if !has(sigAlgs, sigECDSAP256SHA256) {
+			return h.fail(alertHandshakeFailure, errors.New("dtls: server doesn't accept our certificate"))
+		}
+		if typ, body, err = h.readMessage(); err != nil {
+			return err
+		}
+	}
+	if typ != typeServerHelloDone || len(body) != 0 {
+		return h.unexpected(typ)
+	}
+
+	public, pms, err := h.keyExchange(ske.group, ske.public)
+	if err != nil {
+		return err
+	}
+	if certRequested {
+		h.add(0, typeCertificate, marshalCertificate(c.cfg.Certificate.Certificate))
+	}
+	h.add(0, typeClientKeyExchange, marshalClientKeyExchange(public))
+	if err := h.deriveKeys(pms); err != nil {
+		return h.fail(alertInternalError, err)
+	}
+	if certRequested {
+		sig, err := h.sign(h.transcript)
+		if err != nil {
+			return h.fail(alertInternalError, err)
+		}
+		h.add(0, typeCertificateVerify, marshalSignature(sigECDSAP256SHA256, sig))
+	}
+	h.addCCS()
+	h.add(1, typeFinished, h.verifyData("client finished"))
+	if err := h.flush(); err != nil {
+		return err
+	}
+
+	want := h.verifyData("server finished")
+	if body, err = h.expect(typeFinished); err != nil {
+		return err
+	}
+	if !hmac.Equal(body, want) {
+		return h.fail(alertDecryptError, errors.New("dtls: bad server Finished"))
+	}
+	return nil
+}
+
+func (h *handshake) server() error {
+	c := h.c
+	body, err := h.expect(typeClientHello)
+	if err != nil {
+		return err
+	}
+	ch, ok := parseClientHello(body)
+	if !ok {
+		return h.fail(alertDecodeError, errors.New("dtls: malformed ClientHello"))
+	}
+	// The client must echo a cookie before we spend a signature on
+	// it, which proves that it owns its address (RFC 6347 section
+	// 4.2.1).
+	h.cookieKey = randomBytes(32)
+	if cookie := h.cookie(ch); !hmac.Equal(ch.cookie, cookie) {
+		h.add(0, typeHelloVerifyRequest, marshalHelloVerifyRequest(cookie))
+		// The first ClientHello and the HelloVerifyRequest are not
+		// part of the transcript.
+		h.transcript = nil
+		if err := h.flush(); err != nil {
+			return err
+		}
+		// The server stays stateless: the HelloVerifyRequest only
+		// goes again when the ClientHello does.
+		h.retransmitAt = h.deadline
+		if body, err = h.expect(typeClientHello); err != nil {
+			return err
+		}
+		if ch, ok = parseClientHello(body); !ok {
+			return h.fail(alertDecodeError, errors.New("dtls: malformed ClientHello"))
+		}
+		if !hmac.Equal(ch.cookie, h.cookie(ch)) {
+			return h.fail(alertHandshakeFailure, errors.New("dtls: client sent a bad cookie"))
+		}
+	}
+	var group uint16
+	for _, g := range []uint16{groupX25519, groupP256} {
+		if has(ch.groups, g) {
+			group = g
+			break
+		}
+	}
+	if !has(ch.suites, suiteECDHEECDSAAES128GCMSHA256) || group == 0 || !has(ch.sigAlgs, sigECDSAP256SHA256) {
+		return h.fail(alertHandshakeFailure, errors.New("dtls: no algorithms in common with the client"))
+	}
+	h.clientRandom, h.serverRandom, h.ems = ch.random, randomBytes(32), ch.ems
+
+	priv, err := curve(group).GenerateKey(rand.Reader)
+	if err != nil {
+		return h.fail(alertInternalError, err)
+	}
+	ske := &serverKeyExchange{
+		group:  group,
+		public: priv.PublicKey().Bytes(),
+		sigAlg: sigECDSAP256SHA256,
+	}
+	if ske.sig, err = h.sign(concat(h.clientRandom, h.serverRandom, ske.params())); err != nil {
+		return h.fail(alertInternalError, err)
+	}
+	sh := &serverHello{random: h.serverRandom, suite: suiteECDHEECDSAAES128GCMSHA256, ems: h.ems}
+	h.add(0, typeServerHello, sh.marshal())
+	h.add(0, typeCertificate, marshalCertificate(c.cfg.Certificate.Certificate))
+	h.add(0, typeServerKeyExchange, ske.marshal())
+	h.add(0, typeCertificateRequest, marshalCertificateRequest())
+	h.add(0, typeServerHelloDone, nil)
+	if err := h.flush(); err != nil {
+		return err
+	}
+
+	if body, err = h.expect(typeCertificate); err != nil {
+		return err
+	}
+	pub, err := h.verifyPeer(body)
+	if err != nil {
+		return err
+	}
+	if body, err = h.expect(typeClientKeyExchange); err != nil {
+		return err
+	}
+	public, ok := parseClientKeyExchange(body)
+	if !ok {
+		return h.fail(alertDecodeError, errors.New("dtls: malformed ClientKeyExchange"))
+	}
+	peerKey, err := curve(group).NewPublicKey(public)
+	if err != nil {
+		return h.fail(alertIllegalParameter, err)
+	}
+	pms, err := priv.ECDH(peerKey)
+	if err != nil {
+		return h.fail(alertIllegalParameter, err)
+	}
+	if err := h.deriveKeys(pms); err != nil {
+		return h.fail(alertInternalError, err)
+	}
+
+	signed := append([]byte(nil), h.transcript...)
+	if body, err = h.expect(typeCertificateVerify); err != nil {
+		return err
+	}
+	if alg, sig, ok := parseSignature(body); !ok || alg != sigECDSAP256SHA256 || !verify(pub, signed, sig) {
+		return h.fail(alertDecryptError, errors.New("dtls: bad CertificateVerify"))
+	}
+	want := h.verifyData("client finished")
+	if body, err = h.expect(typeFinished); err != nil {
+		return err
+	}
+	if !hmac.Equal(body, want) {
+		return h.fail(alertDecryptError, errors.New("dtls: bad client Finished"))
+	}
+
+	h.addCCS()
+	h.add(1, typeFinished, h.verifyData("server finished"))
+	return h.flush()
+}
+
+// cookie returns the cookie of the client that sent ch.
+func (h *handshake) cookie(ch *clientHello) []byte {
+	mac := hmac.New(sha256.New, h.cookieKey)
+	if addr := h.c.conn.RemoteAddr(); addr != nil {
+		mac.Write([]byte(addr.String()))
+	}
+	mac.Write(ch.random)
+	return mac.Sum(nil)
+}
+
+// keyExchange returns our public key and the premaster secret for the
+// key of the peer in group.
+func (h *handshake) keyExchange(group uint16, peer []byte) (public, pms []byte, err error) {
+	priv, err := curve(group).GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, h.fail(alertInternalError, err)
+	}
+	peerKey, err := curve(group).NewPublicKey(peer)
+	if err != nil {
+		return nil, nil, h.fail(alertIllegalParameter, err)
+	}
+	pms, err = priv.ECDH(peerKey)
+	if err != nil {
+		return nil, nil, h.fail(alertIllegalParameter, err)
+	}
+	return priv.PublicKey().Bytes(), pms, nil
+}
+
+// curve returns the ECDHE curve of group, or nil if we don't speak
+// it. Offering P-256 also tells the peer that we accept its P-256
+// certificate (RFC 8422 section 5.1.1).
+func curve(group uint16) ecdh.Curve {
+	switch group {
+	case groupX25519:
+		return ecdh.X25519()
+	case groupP256:
+		return ecdh.P256()
+	}
+	return nil
+}
+
+// verifyPeer checks the Certificate message of the peer, and returns
+// its key.
+func (h *handshake) verifyPeer(body []byte) (*ecdsa.PublicKey, error) {
+	certs, ok := parseCertificate(body)
+	if !ok {
+		return nil, h.fail(alertDecodeError, errors.New("dtls: malformed Certificate"))
+	}
+	if len(certs) == 0 {
+		return nil, h.fail(alertBadCertificate, errors.New("dtls: peer sent no certificate"))
+	}
+	if err := h.c.cfg.VerifyPeer(certs[0]); err != nil {
+		return nil, h.fail(alertBadCertificate, fmt.Errorf("dtls: bad peer certificate: %v", err))
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, h.fail(alertBadCertificate, fmt.Errorf("dtls: bad peer certificate: %v", err))
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return nil, h.fail(alertBadCertificate, errors.New("dtls: peer certificate key is not ECDSA P-256"))
+	}
+	h.c.mu.Lock()
+	h.c.peerCert = cert
+	h.c.mu.Unlock()
+	return pub, nil
+}
+
+// deriveKeys computes the keys of epoch 1 from the premaster secret.
+// With the extended master secret, the transcript must end with the
+// ClientKeyExchange.
+func (h *handshake) deriveKeys(pms []byte) error {
+	if h.ems {
+		sum := sha256.Sum256(h.transcript)
+		h.master = prf(pms, "extended master secret", sum[:], 48)
+	} else {
+		h.master = prf(pms, "master secret", concat(h.clientRandom, h.serverRandom), 48)
+	}
+	kb := prf(h.master, "key expansion", concat(h.serverRandom, h.clientRandom), 40)
+	client, err := newCipherState(kb[0:16], kb[32:36])
+	if err != nil {
+		return err
+	}
+	server, err := newCipherState(kb[16:32], kb[36:40])
+	if err != nil {
+		return err
+	}
+	read, write := server, client
+	if !h.c.client {
+		read, write = client, server
+	}
+	h.c.readCipher = read
+	h.c.wmu.Lock()
+	h.c.writeCipher = write
+	h.c.wmu.Unlock()
+	for _, r := range h.early {
+		h.c.receiveRecord(r, h)
+	}
+	h.early = nil
+	return nil
+}
+
+func (h *handshake) verifyData(label string) []byte {
+	sum := sha256.Sum256(h.transcript)
+	return prf(h.master, label, sum[:], 12)
+}
+
+func (h *handshake) sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return h.c.signer().Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func verify(pub *ecdsa.PublicKey, data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+	return ecdsa.VerifyASN1(pub, digest[:], sig)
+}
+
+// fail sends a fatal alert to the peer, and returns err.
+func (h *handshake) fail(alert uint8, err error) error {
+	h.c.sendAlert(alertLevelFatal, alert)
+	return err
+}
+
+func (h *handshake) unexpected(typ uint8) error {
+	return h.fail(alertUnexpectedMessage, fmt.Errorf("dtls: unexpected handshake message %d", typ))
+}
+
+// expect reads the next message, which must be of type typ.
+func (h *handshake) expect(typ uint8) ([]byte, error) {
+	got, body, err := h.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if got != typ {
+		return nil, h.unexpected(got)
+	}
+	return body, nil
+}
+
+// add appends a message to the next flight, and to the transcript.
+func (h *handshake) add(epoch uint16, typ uint8, body []byte) {
+	h.next = append(h.next, outMessage{epoch: epoch, typ: typ, seq: h.sendSeq, body: body})
+	h.transcript = appendHandshakeHeader(h.transcript, typ, len(body), h.sendSeq, 0, len(body))
+	h.transcript = append(h.transcript, body...)
+	h.sendSeq++
+}
+
+func (h *handshake) addCCS() {
+	h.next = append(h.next, outMessage{ccs: true})
+}
+
+// flush sends the next flight, and arms the retransmission timer.
+func (h *handshake) flush() error {
+	h.flight, h.next = h.next, nil
+	h.timeout = initialRetransmit
+	h.retransmitAt = h.c.cfg.now().Add(h.timeout)
+	return h.writeFlight()
+}
+
+// writeFlight sends the last flight, packing its records into as few
+// datagrams as the MTU allows. Each transmission uses new record
+// sequence numbers.
+func (h *handshake) writeFlight() error {
+	c := h.c
+	mtu := c.cfg.mtu()
+	maxFragment := mtu - recordHeaderLen - handshakeHeaderLen - explicitNonceLen - 16
+	var dgram []byte
+	flush := func() error {
+		if len(dgram) == 0 {
+			return nil
+		}
+		_, err := c.conn.Write(dgram)
+		dgram = nil
+		return err
+	}
+	for _, m := range h.flight {
+		var records [][]byte
+		if m.ccs {
+			records = append(records, c.record(typeChangeCipherSpec, m.epoch, []byte{1}))
+		} else {
+			for off := 0; ; {
+				n := len(m.body) - off
+				if n > maxFragment {
+					n = maxFragment
+				}
+				frag := appendHandshakeHeader(nil, m.typ, len(m.body), m.seq, off, n)
+				frag = append(frag, m.body[off:off+n]...)
+				records = append(records, c.record(typeHandshake, m.epoch, frag))
+				if off += n; off >= len(m.body) {
+					break
+				}
+			}
+		}
+		for _, r := range records {
+			if len(dgram)+len(r) > mtu {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			dgram = append(dgram, r...)
+		}
+	}
+	return flush()
+}
+
+// readMessage returns the next handshake message of the peer, and
+// adds it to the transcript.
+func (h *handshake) readMessage() (uint8, []byte, error) {
+	for {
+		if m := h.msgs[h.recvSeq]; m != nil && m.left == 0 {
+			delete(h.msgs, h.recvSeq)
+			h.transcript = appendHandshakeHeader(h.transcript, m.typ, len(m.body), h.recvSeq, 0, len(m.body))
+			h.transcript = append(h.transcript, m.body...)
+			h.recvSeq++
+			return m.typ, m.body, nil
+		}
+		if err := h.receive(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// receive waits for a datagram from the peer, sending our last flight
+// again whenever the retransmission timer expires.
+func (h *handshake) receive() error {
+	c := h.c
+	for {
+		c.mu.Lock()
+		userDeadline, err := c.readDeadline, c.readErr
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		now := c.cfg.now()
+		if !now.Before(h.deadline) {
+			return errHandshakeTimeout
+		}
+		if !userDeadline.IsZero() && !now.Before(userDeadline) {
+			return os.ErrDeadlineExceeded
+		}
+		if len(h.flight) > 0 && !now.Before(h.retransmitAt) {
+			if err := h.writeFlight(); err != nil {
+				return err
+			}
+			if h.timeout *= 2; h.timeout > maxRetransmit {
+				h.timeout = maxRetransmit
+			}
+			h.retransmitAt = now.Add(h.timeout)
+		}
+
+		deadline := h.deadline
+		if len(h.flight) > 0 && h.retransmitAt.Before(deadline) {
+			deadline = h.retransmitAt
+		}
+		if !userDeadline.IsZero() && userDeadline.Before(deadline) {
+			deadline = userDeadline
+		}
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return err
+		}
+		c.receive(c.buf[:n], h)
+		return nil
+	}
+}
+
+// addFragments buffers the handshake fragments in b. It reports
+// whether some belong to messages we already had, meaning that the
+// peer is sending its previous flight again because it missed ours.
+func (h *handshake) addFragments(b []byte) (old bool) {
+	for len(b) >= handshakeHeaderLen {
+		typ := b[0]
+		length := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		seq := binary.BigEndian.Uint16(b[4:])
+		off := int(b[6])<<16 | int(b[7])<<8 | int(b[8])
+		n := int(b[9])<<16 | int(b[10])<<8 | int(b[11])
+		if len(b) < handshakeHeaderLen+n || off+n > length || length > maxMessageLen {
+			return old
+		}
+		frag := b[handshakeHeaderLen : handshakeHeaderLen+n]
+		b = b[handshakeHeaderLen+n:]
+		if seq < h.recvSeq {
+			old = true
+			continue
+		}
+		if seq-h.recvSeq > maxAhead {
+			continue
+		}
+		m := h.msgs[seq]
+		if m == nil {
+			m = &message{typ: typ, body: make([]byte, length), filled: make([]bool, length), left: length}
+			h.msgs[seq] = m
+		}
+		if m.typ != typ || len(m.body) != length {
+			continue
+		}
+		for i := range frag {
+			if !m.filled[off+i] {
+				m.filled[off+i] = true
+				m.body[off+i] = frag[i]
+				m.left--
+			}
+		}
+	}
+	return old
+}
+
+// prf is the TLS 1.2 PRF with SHA-256 (RFC 5246 section 5).
+func prf(secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	ret := make([]byte, 0, n+sha256.Size)
+	a := labelSeed
+	for len(ret) < n {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac = hmac.New(sha256.New, secret)
+		mac.Write(a)
+		mac.Write(labelSeed)
+		ret = mac.Sum(ret)
+	}
+	return ret[:n]
+}
+
+func concat(bs ...[]byte) []byte {
+	var ret []byte
+	for _, b := range bs {
+		ret = append(ret, b...)
+	}
+	return ret
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,381 @@
+package dtls
+
+import "encoding/binary"
+
+// Handshake message types.
+const (
+	typeClientHello        = 1
+	typeServerHello        = 2
+	typeHelloVerifyRequest = 3
+	typeCertificate        = 11
+	typeServerKeyExchange  = 12
+	typeCertificateRequest = 13
+	typeServerHelloDone    = 14
+	typeCertificateVerify  = 15
+	typeClientKeyExchange  = 16
+	typeFinished           = 20
+)
+
+// Extensions we know.
+const (
+	extSupportedGroups      = 10
+	extPointFormats         = 11
+	extSignatureAlgorithms  = 13
+	extExtendedMasterSecret = 23
+	extRenegotiationInfo    = 0xff01
+)
+
+// The only algorithms we speak.
+const (
+	suiteECDHEECDSAAES128GCMSHA256 = 0xc02b
+	groupX25519                    = 29
+	groupP256                      = 23
+	sigECDSAP256SHA256             = 0x0403
+	curveTypeNamed                 = 3
+	certTypeECDSASign              = 64
+)
+
+const handshakeHeaderLen = 12
+
+func appendHandshakeHeader(b []byte, typ uint8, length int, seq uint16, off, n int) []byte {
+	var h [handshakeHeaderLen]byte
+	h[0] = typ
+	putUint24(h[1:], length)
+	binary.BigEndian.PutUint16(h[4:], seq)
+	putUint24(h[6:], off)
+	putUint24(h[9:], n)
+	return append(b, h[:]...)
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+// A builder appends the TLS presentation of values to b.
+type builder struct {
+	b []byte
+}
+
+func (b *builder) u8(v uint8)     { b.b = append(b.b, v) }
+func (b *builder) u16(v uint16)   { b.b = append(b.b, byte(v>>8), byte(v)) }
+func (b *builder) u24(v int)      { b.b = append(b.b, byte(v>>16), byte(v>>8), byte(v)) }
+func (b *builder) raw(v []byte)   { b.b = append(b.b, v...) }
+func (b *builder) vec8(v []byte)  { b.u8(uint8(len(v))); b.raw(v) }
+func (b *builder) vec16(v []byte) { b.u16(uint16(len(v))); b.raw(v) }
+func (b *builder) vec24(v []byte) { b.u24(len(v)); b.raw(v) }
+func (b *builder) list16(v []uint16) {
+	b.u16(uint16(2 * len(v)))
+	for _, x := range v {
+		b.u16(x)
+	}
+}
+
+// A parser reads TLS presentation values off b. Reading past the end
+// sets bad and returns zero values.
+type parser struct {
+	b   []byte
+	bad bool
+}
+
+func (p *parser) next(n int) []byte {
+	if p.bad || len(p.b) < n {
+		p.bad = true
+		return nil
+	}
+	ret := p.b[:n]
+	p.b = p.b[n:]
+	return ret
+}
+
+func (p *parser) u8() uint8 {
+	if b := p.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) u16() uint16 {
+	if b := p.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *parser) u24() int {
+	if b := p.next(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
+
+func (p *parser) vec8() []byte  { return p.next(int(p.u8())) }
+func (p *parser) vec16() []byte { return p.next(int(p.u16())) }
+func (p *parser) vec24() []byte { return p.next(p.u24()) }
+
+func (p *parser) list16() []uint16 {
+	raw := p.vec16()
+	if len(raw)%2 != 0 {
+		p.bad = true
+		return nil
+	}
+	ret := make([]uint16, len(raw)/2)
+	for i := range ret {
+		ret[i] = binary.BigEndian.Uint16(raw[2*i:])
+	}
+	return ret
+}
+
+// done reports whether p read all of b without error.
+func (p *parser) done() bool {
+	return !p.bad && len(p.b) == 0
+}
+
+func has(list []uint16, v uint16) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+type clientHello struct {
+	random  []byte
+	cookie  []byte
+	suites  []uint16
+	groups  []uint16
+	sigAlgs []uint16
+	ems     bool // extended master secret, RFC 7627
+}
+
+func (m *clientHello) marshal() []byte {
+	var b builder
+	b.u16(versionDTLS12)
+	b.raw(m.random)
+	b.vec8(nil) // session ID
+	b.vec8(m.cookie)
+	b.list16(m.suites)
+	b.vec8([]byte{0}) // null compression
+
+	var exts builder
+	var v builder
+	v.list16(m.groups)
+	exts.u16(extSupportedGroups)
+	exts.vec16(v.b)
+	exts.u16(extPointFormats)
+	exts.vec16([]byte{1, 0}) // uncompressed
+	v = builder{}
+	v.list16(m.sigAlgs)
+	exts.u16(extSignatureAlgorithms)
+	exts.vec16(v.b)
+	if m.ems {
+		exts.u16(extExtendedMasterSecret)
+		exts.vec16(nil)
+	}
+	exts.u16(extRenegotiationInfo)
+	exts.vec16([]byte{0})
+	b.vec16(exts.b)
+	return b.b
+}
+
+func parseClientHello(body []byte) (*clientHello, bool) {
+	p := parser{b: body}
+	m := &clientHello{}
+	p.u16() // The record layer version is what matters.
+	m.random = p.next(32)
+	p.vec8() // session ID
+	m.cookie = p.vec8()
+	m.suites = p.list16()
+	if comp := p.vec8(); !p.bad && len(comp) == 0 {
+		return nil, false
+	}
+	if len(p.b) > 0 {
+		exts := parser{b: p.vec16()}
+		for !exts.bad && len(exts.b) > 0 {
+			typ := exts.u16()
+			ext := parser{b: exts.vec16()}
+			switch typ {
+			case extSupportedGroups:
+				m.groups = ext.list16()
+			case extSignatureAlgorithms:
+				m.sigAlgs = ext.list16()
+			case extExtendedMasterSecret:
+				m.ems = true
+			}
+			if ext.bad {
+				return nil, false
+			}
+		}
+		if exts.bad {
+			return nil, false
+		}
+	}
+	return m, p.done()
+}
+
+type serverHello struct {
+	random []byte
+	suite  uint16
+	ems    bool
+}
+
+func (m *serverHello) marshal() []byte {
+	var b builder
+	b.u16(versionDTLS12)
+	b.raw(m.random)
+	b.vec8(nil) // session ID, we don't resume
+	b.u16(m.suite)
+	b.u8(0) // null compression
+	var exts builder
+	if m.ems {
+		exts.u16(extExtendedMasterSecret)
+		exts.vec16(nil)
+	}
+	exts.u16(extRenegotiationInfo)
+	exts.vec16([]byte{0})
+	exts.u16(extPointFormats)
+	exts.vec16([]byte{1, 0})
+	b.vec16(exts.b)
+	return b.b
+}
+
+func parseServerHello(body []byte) (*serverHello, bool) {
+	p := parser{b: body}
+	m := &serverHello{}
+	if p.u16() != versionDTLS12 {
+		return nil, false
+	}
+	m.random = p.next(32)
+	p.vec8() // session ID
+	m.suite = p.u16()
+	if p.u8() != 0 {
+		return nil, false
+	}
+	if len(p.b) > 0 {
+		exts := parser{b: p.vec16()}
+		for !exts.bad && len(exts.b) > 0 {
+			typ := exts.u16()
+			exts.vec16()
+			if typ == extExtendedMasterSecret {
+				m.ems = true
+			}
+		}
+		if exts.bad {
+			return nil, false
+		}
+	}
+	return m, p.done()
+}
+
+func marshalHelloVerifyRequest(cookie []byte) []byte {
+	var b builder
+	b.u16(versionDTLS10)
+	b.vec8(cookie)
+	return b.b
+}
+
+func parseHelloVerifyRequest(body []byte) ([]byte, bool) {
+	p := parser{b: body}
+	p.u16()
+	cookie := p.vec8()
+	return cookie, p.done()
+}
+
+func marshalCertificate(certs [][]byte) []byte {
+	var list builder
+	for _, c := range certs {
+		list.vec24(c)
+	}
+	var b builder
+	b.vec24(list.b)
+	return b.b
+}
+
+func parseCertificate(body []byte) ([][]byte, bool) {
+	p := parser{b: body}
+	list := parser{b: p.vec24()}
+	var ret [][]byte
+	for !list.bad && len(list.b) > 0 {
+		ret = append(ret, list.vec24())
+	}
+	return ret, p.done() && !list.bad
+}
+
+// serverKeyExchange is the ECDHE variant of RFC 8422.
+type serverKeyExchange struct {
+	group  uint16
+	public []byte
+	sigAlg uint16
+	sig    []byte
+}
+
+// params returns the part of m that the server signs.
+func (m *serverKeyExchange) params() []byte {
+	var b builder
+	b.u8(curveTypeNamed)
+	b.u16(m.group)
+	b.vec8(m.public)
+	return b.b
+}
+
+func (m *serverKeyExchange) marshal() []byte {
+	b := builder{m.params()}
+	b.u16(m.sigAlg)
+	b.vec16(m.sig)
+	return b.b
+}
+
+func parseServerKeyExchange(body []byte) (*serverKeyExchange, bool) {
+	p := parser{b: body}
+	m := &serverKeyExchange{}
+	if p.u8() != curveTypeNamed {
+		return nil, false
+	}
+	m.group = p.u16()
+	m.public = p.vec8()
+	m.sigAlg = p.u16()
+	m.sig = p.vec16()
+	return m, p.done()
+}
+
+func marshalCertificateRequest() []byte {
+	var b builder
+	b.vec8([]byte{certTypeECDSASign})
+	b.list16([]uint16{sigECDSAP256SHA256})
+	b.vec16(nil) // any authority, we check fingerprints
+	return b.b
+}
+
+func parseCertificateRequest(body []byte) (sigAlgs []uint16, ok bool) {
+	p := parser{b: body}
+	p.vec8()
+	sigAlgs = p.list16()
+	p.vec16()
+	return sigAlgs, p.done()
+}
+
+func marshalClientKeyExchange(public []byte) []byte {
+	var b builder
+	b.vec8(public)
+	return b.b
+}
+
+func parseClientKeyExchange(body []byte) ([]byte, bool) {
+	p := parser{b: body}
+	public := p.vec8()
+	return public, p.done()
+}
+
+func marshalSignature(sigAlg uint16, sig []byte) []byte {
+	var b builder
+	b.u16(sigAlg)
+	b.vec16(sig)
+	return b.b
+}
+
+func parseSignature(body []byte) (sigAlg uint16, sig []byte, ok bool) {
+	p := parser{b: body}
+	sigAlg = p.u16()
+	sig = p.vec16()
+	return sigAlg, sig, p.done()
+}
@@ -0,0 +1,162 @@
+package dtls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+// Record content types.
+const (
+	typeChangeCipherSpec = 20
+	typeAlert            = 21
+	typeHandshake        = 22
+	typeApplicationData  = 23
+)
+
+const (
+	recordHeaderLen = 13
+	versionDTLS10   = 0xfeff
+	versionDTLS12   = 0xfefd
+	// explicitNonceLen is the part of the GCM nonce sent in each
+	// record, which is its epoch and sequence number.
+	explicitNonceLen = 8
+)
+
+var errBadRecord = errors.New("dtls: malformed record")
+
+type record struct {
+	typ   uint8
+	epoch uint16
+	seq   uint64 // 48 bits
+	data  []byte
+}
+
+// parseRecords splits a datagram into its records. It drops what
+// follows a malformed record.
+func parseRecords(b []byte) []record {
+	var ret []record
+	for len(b) >= recordHeaderLen {
+		version := binary.BigEndian.Uint16(b[1:])
+		n := int(binary.BigEndian.Uint16(b[11:]))
+		if (version != versionDTLS12 && version != versionDTLS10) || len(b) < recordHeaderLen+n {
+			break
+		}
+		ret = append(ret, record{
+			typ:   b[0],
+			epoch: binary.BigEndian.Uint16(b[3:]),
+			seq:   uint48(b[5:]),
+			data:  b[recordHeaderLen : recordHeaderLen+n],
+		})
+		b = b[recordHeaderLen+n:]
+	}
+	return ret
+}
+
+func uint48(b []byte) uint64 {
+	return uint64(binary.BigEndian.Uint16(b))<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+}
+
+func putUint48(b []byte, v uint64) {
+	binary.BigEndian.PutUint16(b, uint16(v>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(v))
+}
+
+func appendRecordHeader(b []byte, typ uint8, epoch uint16, seq uint64, n int) []byte {
+	var h [recordHeaderLen]byte
+	h[0] = typ
+	binary.BigEndian.PutUint16(h[1:], versionDTLS12)
+	binary.BigEndian.PutUint16(h[3:], epoch)
+	putUint48(h[5:], seq)
+	binary.BigEndian.PutUint16(h[11:], uint16(n))
+	return append(b, h[:]...)
+}
+
+// A cipherState protects the records of one direction of epoch 1,
+// with AES-GCM as in RFC 5288.
+type cipherState struct {
+	aead cipher.AEAD
+	salt []byte // the implicit part of the nonce
+}
+
+func newCipherState(key, salt []byte) (*cipherState, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead, salt}, nil
+}
+
+// seal appends the record of plaintext to dst.
+func (s *cipherState) seal(dst []byte, typ uint8, epoch uint16, seq uint64, plaintext []byte) []byte {
+	var nonce [12]byte
+	copy(nonce[:4], s.salt)
+	binary.BigEndian.PutUint16(nonce[4:], epoch)
+	putUint48(nonce[6:], seq)
+	n := explicitNonceLen + len(plaintext) + s.aead.Overhead()
+	dst = appendRecordHeader(dst, typ, epoch, seq, n)
+	dst = append(dst, nonce[4:]...)
+	return s.aead.Seal(dst, nonce[:], plaintext, additionalData(typ, epoch, seq, len(plaintext)))
+}
+
+// open returns the plaintext of r.
+func (s *cipherState) open(r record) ([]byte, error) {
+	if len(r.data) < explicitNonceLen+s.aead.Overhead() {
+		return nil, errBadRecord
+	}
+	var nonce [12]byte
+	copy(nonce[:4], s.salt)
+	copy(nonce[4:], r.data[:explicitNonceLen])
+	n := len(r.data) - explicitNonceLen - s.aead.Overhead()
+	return s.aead.Open(nil, nonce[:], r.data[explicitNonceLen:], additionalData(r.typ, r.epoch, r.seq, n))
+}
+
+func additionalData(typ uint8, epoch uint16, seq uint64, n int) []byte {
+	var b [13]byte
+	binary.BigEndian.PutUint16(b[0:], epoch)
+	putUint48(b[2:], seq)
+	b[8] = typ
+	binary.BigEndian.PutUint16(b[9:], versionDTLS12)
+	binary.BigEndian.PutUint16(b[11:], uint16(n))
+	return b[:]
+}
+
+// A replayWindow remembers the last 64 sequence numbers received in
+// an epoch, to drop replayed records (RFC 6347 section 4.1.2.6).
+type replayWindow struct {
+	seen   bool
+	latest uint64
+	mask   uint64 // bit i is latest-i
+}
+
+// fresh reports whether seq wasn't received yet.
+func (w *replayWindow) fresh(seq uint64) bool {
+	if !w.seen || seq > w.latest {
+		return true
+	}
+	d := w.latest - seq
+	return d < 64 && w.mask&(1<<d) == 0
+}
+
+// mark records seq as received. Only authenticated records must be
+// marked.
+func (w *replayWindow) mark(seq uint64) {
+	switch {
+	case !w.seen:
+		w.seen, w.latest, w.mask = true, seq, 1
+	case seq > w.latest:
+		if d := seq - w.latest; d < 64 {
+			w.mask = w.mask<<d | 1
+		} else {
+			w.mask = 1
+		}
+		w.latest = seq
+	default:
+		w.mask |= 1 << (w.latest - seq)
+	}
+}
@@ -0,0 +1,32 @@
+package nat
+
+// ECN is the Explicit Congestion Notification codepoint of a packet
+// (RFC 3168), the low two bits of its traffic class.
+type ECN uint8
+
+// ECN codepoints.
+const (
+	ECNNotECT ECN = 0
+	ECNECT1   ECN = 1
+	ECNECT0   ECN = 2
+	ECNCE     ECN = 3
+)
+
+func (e ECN) String() string {
+	switch e & 3 {
+	case ECNECT1:
+		return "ECT(1)"
+	case ECNECT0:
+		return "ECT(0)"
+	case ECNCE:
+		return "CE"
+	default:
+		return "Not-ECT"
+	}
+}
+
+// SetTOS changes the traffic class (DSCP and ECN bits) of the packets
+// c sends from now on.
+func (c *Conn) SetTOS(tos int) error {
+	return setTOS(c.conn, tos)
+}
@@ -0,0 +1,35 @@
+package nat
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// ecnOOBSize is the room needed for the traffic class control
+// messages of one packet.
+var ecnOOBSize = 2 * syscall.CmsgSpace(4)
+
+// enableECN asks the kernel to report the traffic class of received
+// packets.
+func enableECN(sock net.PacketConn) error {
+	return setsockoptIPBoth(sock, syscall.IP_RECVTOS, syscall.IPV6_RECVTCLASS, 1)
+}
+
+// parseECN returns the ECN codepoint reported in the control
+// messages oob.
+func parseECN(oob []byte) ECN {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return ECNNotECT
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) >= 1:
+			return ECN(m.Data[0] & 3)
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4:
+			return ECN(*(*int32)(unsafe.Pointer(&m.Data[0])) & 3)
+		}
+	}
+	return ECNNotECT
+}
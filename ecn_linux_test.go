@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package nat
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/vnet"
+)
+
+// loopbackPair connects two peers on real UDP sockets over loopback.
+// Host candidates are ignored on loopback, so the peers meet on the
+// reflexive addresses that a STUN server on loopback tells them.
+func loopbackPair(t *testing.T, edit func(cfg *Config, initiator bool)) (a, b *Conn) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go vnet.ServeSTUN(server)
+
+	mk := func(initiator bool) *Config {
+		cfg := DefaultConfig()
+		cfg.BindAddress = &net.UDPAddr{IP: net.IPv4zero}
+		cfg.InterfaceAddrs = func() ([]net.Addr, error) { return nil, nil }
+		cfg.STUNServer = server.LocalAddr().String()
+		cfg.Nomination = NominateAggressive
+		if edit != nil {
+			edit(cfg, initiator)
+		}
+		return cfg
+	}
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	xa, xb := testExchange()
+	ca, cb := make(chan result, 1), make(chan result, 1)
+	go func() { c, err := ConnectOpt(xa, true, mk(true)); ca <- result{c, err} }()
+	go func() { c, err := ConnectOpt(xb, false, mk(false)); cb <- result{c, err} }()
+	ra, rb := <-ca, <-cb
+	for _, r := range []result{ra, rb} {
+		if r.c != nil {
+			t.Cleanup(func() { r.c.Close() })
+		}
+	}
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("failed to connect: %v, %v", ra.err, rb.err)
+	}
+	return ra.c.(*Conn), rb.c.(*Conn)
+}
+
+// readECN writes a datagram from a to b, and returns the ECN
+// codepoint b reads it with.
+func readECN(t *testing.T, a, b *Conn) ECN {
+	t.Helper()
+	if _, err := a.Write([]byte("marked")); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ms := []Message{{Buf: make([]byte, 100)}}
+	if _, err := b.ReadBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+	if string(ms[0].Buf[:ms[0].N]) != "marked" {
+		t.Fatalf("read %q", ms[0].Buf[:ms[0].N])
+	}
+	return ms[0].ECN
+}
+
+func TestConnTOS(t *testing.T) {
+	a, b := loopbackPair(t, func(cfg *Config, initiator bool) {
+		if initiator {
+			cfg.TOS = 0xb8 | int(ECNECT0)
+		}
+	})
+	// Config.TOS marks the packets of the Conn, and the peer reads
+	// the ECN bits back.
+	if got := readECN(t, a, b); got != ECNECT0 {
+		t.Fatalf("read %v, want %v", got, ECNECT0)
+	}
+	if got := readECN(t, b, a); got != ECNNotECT {
+		t.Fatalf("read %v from an unmarked peer", got)
+	}
+	// SetTOS changes the marking of an established Conn.
+	if err := a.SetTOS(int(ECNECT1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readECN(t, a, b); got != ECNECT1 {
+		t.Fatalf("read %v after SetTOS, want %v", got, ECNECT1)
+	}
+}
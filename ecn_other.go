@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package nat
+
+import "net"
+
+// Only Linux reports the traffic class of received packets for now.
+var ecnOOBSize = 0
+
+func enableECN(sock net.PacketConn) error {
+	return nil
+}
+
+func parseECN(oob []byte) ECN {
+	return ECNNotECT
+}
@@ -0,0 +1,251 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/vnet"
+)
+
+// NAT behaviors of the engine tests. A nil *vnet.NATConfig is a host
+// with a public address.
+var (
+	fullCone       = &vnet.NATConfig{Mapping: vnet.EndpointIndependent, Filtering: vnet.EndpointIndependent}
+	restrictedCone = &vnet.NATConfig{Mapping: vnet.EndpointIndependent, Filtering: vnet.AddressDependent}
+	portRestricted = &vnet.NATConfig{Mapping: vnet.EndpointIndependent, Filtering: vnet.AddressPortDependent}
+	symmetric      = &vnet.NATConfig{Mapping: vnet.AddressPortDependent, Filtering: vnet.AddressPortDependent}
+)
+
+var natNames = map[*vnet.NATConfig]string{
+	nil:            "public",
+	fullCone:       "full-cone",
+	restrictedCone: "restricted-cone",
+	portRestricted: "port-restricted",
+	symmetric:      "symmetric",
+}
+
+type engineTest struct {
+	name string
+	a, b *vnet.NATConfig
+	// sameNAT puts b behind the NAT of a. Host candidates are
+	// blacklisted, so that only hairpinning connects them.
+	sameNAT    bool
+	link       vnet.LinkConfig
+	nomination Nomination
+	predict    int
+	spray      int
+	ok         bool
+	// edit, if not nil, adjusts the configs of both peers.
+	edit func(*Config)
+}
+
+// engineTests returns the NAT mapping and filtering matrix, and the
+// special cases.
+func engineTests() []engineTest {
+	var tests []engineTest
+	types := []*vnet.NATConfig{nil, fullCone, restrictedCone, portRestricted, symmetric}
+	for _, a := range types {
+		for _, b := range types {
+			// A symmetric NAT only lets the peer in through a new
+			// mapping, which a filter on the peer's address and
+			// port doesn't know.
+			fail := (a == symmetric && (b == portRestricted || b == symmetric)) ||
+				(b == symmetric && a == portRestricted)
+			tests = append(tests, engineTest{
+				name:       natNames[a] + "/" + natNames[b],
+				a:          a,
+				b:          b,
+				nomination: NominateAggressive,
+				ok:         !fail,
+			})
+		}
+	}
+	sequential := &vnet.NATConfig{Mapping: vnet.AddressPortDependent, Filtering: vnet.AddressPortDependent, PortStride: 1}
+	hairpin := &vnet.NATConfig{Mapping: vnet.EndpointIndependent, Filtering: vnet.AddressPortDependent, Hairpin: true}
+	// A symmetric NAT that maps each destination address to a new
+	// port, in sequence. The STUN server tells nothing about the
+	// port the peer sees, but port prediction does, also for the
+	// spray sockets.
+	sequentialSymmetric := &vnet.NATConfig{Mapping: vnet.AddressDependent, Filtering: vnet.AddressPortDependent, PortStride: 1}
+	return append(tests, []engineTest{
+		{name: "hairpin", a: hairpin, sameNAT: true, nomination: NominateAggressive, ok: true},
+		{name: "no-hairpin", a: portRestricted, sameNAT: true, nomination: NominateAggressive},
+		{name: "regular", a: portRestricted, b: restrictedCone, nomination: NominateRegular, ok: true},
+		{name: "good-enough", a: fullCone, b: portRestricted, nomination: NominateGoodEnough, ok: true},
+		{name: "latency", a: portRestricted, b: portRestricted, link: vnet.LinkConfig{Latency: 150 * time.Millisecond, Jitter: 50 * time.Millisecond}, ok: true},
+		{name: "loss", a: symmetric, b: restrictedCone, link: vnet.LinkConfig{Loss: 0.2}, nomination: NominateAggressive, ok: true},
+		{name: "loss-regular", a: portRestricted, b: fullCone, link: vnet.LinkConfig{Latency: 50 * time.Millisecond, Loss: 0.2}, ok: true},
+		{name: "predicted", a: sequential, b: portRestricted, nomination: NominateAggressive, predict: 8, ok: true},
+		{name: "unpredicted", a: sequentialSymmetric, b: sequentialSymmetric, nomination: NominateAggressive},
+		{name: "predicted-both", a: sequentialSymmetric, b: sequentialSymmetric, nomination: NominateAggressive, predict: 8, ok: true},
+		{name: "sprayed", a: sequentialSymmetric, b: sequentialSymmetric, nomination: NominateAggressive, predict: 8, spray: 4, ok: true},
+	}...)
+}
+
+func TestEngine(t *testing.T) {
+	for _, tc := range engineTests() {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			runEngineTest(t, tc)
+		})
+	}
+}
+
+func runEngineTest(t *testing.T, tc engineTest) {
+	clock := vnet.NewVirtualClock(time.Unix(1e9, 0))
+	stop := clock.Run(20 * time.Millisecond)
+	defer stop()
+	n := vnet.New()
+	n.Clock = clock
+	n.SetLink(tc.link)
+	stunAddr, err := n.AddSTUNServer(net.IPv4(1, 1, 1, 1), 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addHost := func(cfg *vnet.NATConfig, public net.IP) *vnet.Host {
+		var h *vnet.Host
+		if cfg == nil {
+			h, err = n.AddHost(public)
+		} else {
+			var g *vnet.NAT
+			if g, err = n.AddNAT(public, *cfg); err == nil {
+				h, err = g.AddHost(net.IPv4(10, 0, 0, 2))
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	var ha, hb *vnet.Host
+	if tc.sameNAT {
+		g, err := n.AddNAT(net.IPv4(2, 2, 2, 2), *tc.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ha, err = g.AddHost(net.IPv4(10, 0, 0, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if hb, err = g.AddHost(net.IPv4(10, 0, 0, 3)); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		ha = addHost(tc.a, net.IPv4(2, 2, 2, 2))
+		hb = addHost(tc.b, net.IPv4(3, 3, 3, 3))
+	}
+
+	mk := func(h *vnet.Host) *Config {
+		cfg := DefaultConfig()
+		cfg.ListenPacket = h.ListenPacket
+		cfg.InterfaceAddrs = h.InterfaceAddrs
+		cfg.STUNServer = stunAddr.String()
+		cfg.Clock = clock
+		cfg.Nomination = tc.nomination
+		cfg.PredictPorts = tc.predict
+		cfg.SpraySockets = tc.spray
+		if tc.sameNAT {
+			_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+			cfg.BlacklistAddresses = []*net.IPNet{lan}
+		}
+		if tc.edit != nil {
+			tc.edit(cfg)
+		}
+		return cfg
+	}
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	xa, xb := testExchange()
+	ca, cb := make(chan result, 1), make(chan result, 1)
+	go func() { c, err := ConnectOpt(xa, true, mk(ha)); ca <- result{c, err} }()
+	go func() { c, err := ConnectOpt(xb, false, mk(hb)); cb <- result{c, err} }()
+	ra, rb := <-ca, <-cb
+	for _, r := range []result{ra, rb} {
+		if r.c != nil {
+			defer r.c.Close()
+		}
+	}
+	if !tc.ok {
+		if ra.err == nil || rb.err == nil {
+			t.Fatalf("connected, want failure: %v, %v", ra.err, rb.err)
+		}
+		return
+	}
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("failed to connect: %v, %v", ra.err, rb.err)
+	}
+	// Both peers must have picked the same pair for data to go
+	// through, both ways.
+	for i, p := range [][2]net.Conn{{ra.c, rb.c}, {rb.c, ra.c}} {
+		from, to := p[0], p[1]
+		msg := fmt.Sprintf("hello %d", i)
+		buf := make([]byte, 100)
+		// The link can lose packets.
+		for {
+			if _, err := from.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			to.SetReadDeadline(clock.Now().Add(time.Second))
+			n, err := to.Read(buf)
+			if err == nil {
+				if string(buf[:n]) != msg {
+					t.Fatalf("read %q, want %q", buf[:n], msg)
+				}
+				break
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPunchBudget(t *testing.T) {
+	const budget = 5
+	var (
+		mu     sync.Mutex
+		checks = map[string]int{} // by session
+	)
+	cfg := DefaultConfig()
+	// Two symmetric NATs never connect, so the checks go on until
+	// PeerDeadline, over many pairs.
+	runEngineTest(t, engineTest{
+		a:       symmetric,
+		b:       symmetric,
+		predict: 16,
+		spray:   4,
+		edit: func(cfg *Config) {
+			cfg.PunchBudget = budget
+			cfg.OnEvent = func(ev Event) {
+				if ev.Type == EventCheckSent {
+					mu.Lock()
+					checks[ev.Session]++
+					mu.Unlock()
+				}
+			}
+		},
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(checks) != 2 {
+		t.Fatalf("checks from %d peers", len(checks))
+	}
+	rounds := int(cfg.PeerDeadline/cfg.ProbeTimeout) + 1
+	for session, n := range checks {
+		if n == 0 || n > budget*rounds {
+			t.Errorf("%s sent %d checks in %d rounds of %d", session, n, rounds, budget)
+		}
+	}
+}
+
+// testExchange returns the candidate exchange functions of two peers.
+func testExchange() (ExchangeCandidatesFun, ExchangeCandidatesFun) {
+	a, b := make(chan []byte, 1), make(chan []byte, 1)
+	return func(m []byte) []byte { a <- m; return <-b },
+		func(m []byte) []byte { b <- m; return <-a }
+}
@@ -0,0 +1,86 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of negotiation failures. Errors returned by Connect and
+// friends match them with errors.Is.
+var (
+	// ErrGatherFailed is returned when we cannot gather our own
+	// candidates.
+	ErrGatherFailed = errors.New("candidate gathering failed")
+	// ErrSignalingFailed is returned when the exchange with the
+	// peer failed, or the peer sent an invalid signal.
+	ErrSignalingFailed = errors.New("signaling failed")
+	// ErrRoleConflict is returned when both peers want to be the
+	// initiator, or neither does.
+	ErrRoleConflict = errors.New("role conflict")
+	// ErrNoSuccessfulPairs is returned when no connectivity check
+	// got an answer.
+	ErrNoSuccessfulPairs = errors.New("no candidate pair succeeded")
+	// ErrNominationFailed is returned when checks succeeded, but the
+	// peers could not agree on a pair.
+	ErrNominationFailed = errors.New("nomination failed")
+	// ErrTimeout is returned when checks succeeded, but the
+	// initiator did not nominate a pair before PeerDeadline.
+	ErrTimeout = errors.New("negotiation timed out")
+	// ErrAuthentication is returned when no check succeeded and the
+	// peer's checks failed authentication, e.g. because the
+	// credentials were mixed up on the signaling channel.
+	ErrAuthentication = errors.New("authentication failed")
+	// ErrHandshakeFailed is returned by Conn.Secure, Conn.SecureNoise
+	// and the functions built on them when the DTLS or Noise
+	// handshake fails, e.g. because the peer's certificate doesn't
+	// match the fingerprint it signaled.
+	ErrHandshakeFailed = errors.New("secure handshake failed")
+	// ErrAgentClosed is returned by the methods of a closed Agent,
+	// and by the Dial or Accept that Close aborted.
+	ErrAgentClosed = errors.New("agent closed")
+)
+
+// An Error is a failed negotiation. It matches its Kind with
+// errors.Is, and unwraps to its cause.
+type Error struct {
+	// Kind is one of the Err variables above.
+	Kind error
+	// Detail describes the failure, if there is more to say than
+	// the Kind and the cause.
+	Detail string
+	// Err is the cause of the failure, if any.
+	Err error
+}
+
+func newError(kind error, err error, format string, args ...interface{}) *Error {
+	ret := &Error{Kind: kind, Err: err}
+	if format != "" {
+		ret.Detail = fmt.Sprintf(format, args...)
+	}
+	return ret
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Timeout reports whether the negotiation ran out of time, like
+// net.Error.
+func (e *Error) Timeout() bool {
+	return e.Kind == ErrTimeout
+}
@@ -0,0 +1,72 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+)
+
+// EventType says what an Event is about.
+type EventType int
+
+// Event types.
+const (
+	// EventCandidateGathered reports a local candidate, before it is
+	// sent to the peer.
+	EventCandidateGathered EventType = iota + 1
+	// EventCheckSent reports a connectivity check sent to a remote
+	// candidate.
+	EventCheckSent
+	// EventCheckSucceeded reports an answer to one of our checks.
+	EventCheckSucceeded
+	// EventPairNominated reports the pair picked for the connection.
+	EventPairNominated
+	// EventFailed reports a failed negotiation.
+	EventFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCandidateGathered:
+		return "candidate-gathered"
+	case EventCheckSent:
+		return "check-sent"
+	case EventCheckSucceeded:
+		return "check-succeeded"
+	case EventPairNominated:
+		return "pair-nominated"
+	case EventFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// An Event is a milestone of a negotiation, for Config.OnEvent.
+type Event struct {
+	Type EventType
+	// Session identifies the negotiation, as in the logs.
+	Session string
+	// Component is the ICE component, or 0 for events about the
+	// whole negotiation.
+	Component int
+	// Candidate is the gathered candidate, or the remote candidate
+	// of the checked or nominated pair.
+	Candidate Candidate
+	// Local is our reflexive address on the pair, as the peer sees
+	// it, when known.
+	Local net.Addr
+	// Err is why the negotiation failed.
+	Err error
+}
+
+// emit delivers ev to Config.OnEvent, if set.
+func (c *Config) emit(ev Event) {
+	if c.OnEvent != nil {
+		c.OnEvent(ev)
+	}
+}
+
+func (e *attemptEngine) emit(ev Event) {
+	ev.Session = e.session
+	ev.Component = e.component
+	e.cfg.emit(ev)
+}
@@ -14,6 +14,10 @@ import (
 
 const stunTimeout = 5 * time.Second
 
+// stunRTO is the first retransmission timeout of a binding request,
+// doubled after each retransmission.
+const stunRTO = 500 * time.Millisecond
+
 var stunserver = flag.String("stunserver", "stun.l.google.com:19302",
 	"STUN server to query for reflexive address")
 
@@ -24,24 +28,61 @@ var lanNets = []*net.IPNet{
 	{net.ParseIP("fc00"), net.CIDRMask(7, 128)},
 }
 
-type candidate struct {
+// CandidateType describes how a Candidate was obtained.
+type CandidateType string
+
+// Possible candidate types.
+const (
+	// CandidateHost is an address of a local interface.
+	CandidateHost CandidateType = "host"
+	// CandidateServerReflexive is the address of our NAT binding, as
+	// seen by a STUN server.
+	CandidateServerReflexive CandidateType = "srflx"
+	// CandidatePortMapped is a public address that a gateway
+	// forwards to us on request, e.g. with UPnP.
+	CandidatePortMapped CandidateType = "mapped"
+	// CandidatePredicted is a public address that we expect our NAT
+	// to allocate next, see Config.PredictPorts.
+	CandidatePredicted CandidateType = "predicted"
+	// CandidatePeerReflexive is an address the peer sent us checks
+	// from. It is learned during the checks, never signaled.
+	CandidatePeerReflexive CandidateType = "prflx"
+)
+
+// A Candidate is a transport address at which a peer can
+// potentially be reached.
+type Candidate struct {
+	Type CandidateType
 	Addr *net.UDPAddr
 	Prio int64
+	// Component is the ICE component the candidate belongs to,
+	// starting from 1. Zero also means 1.
+	Component int `json:",omitempty"`
+}
+
+func (c Candidate) component() int {
+	if c.Component == 0 {
+		return 1
+	}
+	return c.Component
 }
 
-func (c candidate) String() string {
-	return fmt.Sprintf("%#x %v", c.Prio, c.Addr)
+func (c Candidate) String() string {
+	return fmt.Sprintf("%s %#x %v", c.Type, c.Prio, c.Addr)
 }
 
-func (c candidate) Equal(c2 candidate) bool {
+func (c Candidate) Equal(c2 Candidate) bool {
 	return c.Addr.IP.Equal(c2.Addr.IP) && c.Addr.Port == c2.Addr.Port
 }
 
-func getReflexive(sock *net.UDPConn) (*net.UDPAddr, error) {
-	sock.SetDeadline(time.Now().Add(stunTimeout))
+// getReflexive asks the STUN server of cfg for the reflexive address
+// of sock.
+func getReflexive(sock net.PacketConn, cfg *Config) (*net.UDPAddr, error) {
+	deadline := cfg.clock().Now().Add(stunTimeout)
+	sock.SetDeadline(deadline)
 	defer sock.SetDeadline(time.Time{})
 
-	serverAddr, err := net.ResolveUDPAddr("udp", *stunserver)
+	serverAddr, err := net.ResolveUDPAddr("udp", cfg.stunServer())
 	if err != nil {
 
 		return nil, errors.New("Couldn't resolve STUN server")
@@ -57,34 +98,71 @@ func getReflexive(sock *net.UDPConn) (*net.UDPAddr, error) {
 		return nil, err
 	}
 
-	n, err := sock.WriteTo(request, serverAddr)
-	if err != nil {
-		return nil, err
-	}
-	if n < len(request) {
-		return nil, err
-	}
-
+	// The request or its answer can get lost, so retransmit it
+	// with exponential backoff until stunTimeout (RFC 5389 section
+	// 7.2.1).
 	var buf [1024]byte
-	n, _, err = sock.ReadFromUDP(buf[:])
-	if err != nil {
-		return nil, err
-	}
+	for rto := stunRTO; ; rto *= 2 {
+		n, err := sock.WriteTo(request, serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.metrics().Count("nat_stun_requests_total", 1, "type", "binding")
+		if rto > stunRTO {
+			cfg.metrics().Count("nat_stun_retransmits_total", 1, "type", "binding")
+		}
+		if n < len(request) {
+			return nil, err
+		}
 
-	packet, err := stun.ParsePacket(buf[:n], nil)
-	if err != nil {
-		return nil, err
+		retry := cfg.clock().Now().Add(rto)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		sock.SetReadDeadline(retry)
+		addr, err := readReflexive(sock, serverAddr, tid[:], buf[:])
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() && cfg.clock().Now().Before(deadline) {
+			continue
+		}
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				cfg.metrics().Count("nat_stun_timeouts_total", 1, "type", "binding")
+			}
+			return nil, err
+		}
+		return addr, nil
 	}
+}
 
-	if packet.Class != stun.ClassSuccess || packet.Method != stun.MethodBinding || packet.Addr == nil || !bytes.Equal(tid[:], packet.Tid[:]) {
-		return nil, errors.New("No address provided by STUN server")
-	}
+// readReflexive reads the answer of serverAddr to the binding request
+// tid from sock.
+func readReflexive(sock net.PacketConn, serverAddr *net.UDPAddr, tid, buf []byte) (*net.UDPAddr, error) {
+	// Our peer's checks may be arriving on the same socket, skip
+	// everything that isn't our answer.
+	for {
+		n, from, err := sock.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if from.String() != serverAddr.String() {
+			continue
+		}
 
-	return packet.Addr, nil
+		packet, err := stun.ParsePacket(buf[:n], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if packet.Class != stun.ClassSuccess || packet.Method != stun.MethodBinding || packet.Addr == nil || !bytes.Equal(tid, packet.Tid[:]) {
+			return nil, errors.New("No address provided by STUN server")
+		}
+
+		return packet.Addr, nil
+	}
 }
 
-func pruneDups(cs []candidate) []candidate {
-	ret := make([]candidate, 0, len(cs))
+func pruneDups(cs []Candidate) []Candidate {
+	ret := make([]Candidate, 0, len(cs))
 	for _, c := range cs {
 		unique := true
 		for _, c2 := range ret {
@@ -100,7 +178,7 @@ func pruneDups(cs []candidate) []candidate {
 	return ret
 }
 
-func setPriorities(c []candidate) {
+func setPriorities(c []Candidate) {
 	for i := range c {
 		// Prefer LAN over public net.
 		for _, lan := range lanNets {
@@ -108,14 +186,26 @@ func setPriorities(c []candidate) {
 				c[i].Prio |= 1 << 32
 			}
 		}
+		// A forwarded port on the public net needs no hole
+		// punching.
+		if c[i].Type == CandidatePortMapped {
+			c[i].Prio |= 1 << 31
+		}
 		// Uniquify each priority. Keep the lower bits clear for
 		// computing pair priorities.
 		c[i].Prio += int64(i) << 16
 	}
 }
 
-func pruneCandidates(cands []candidate, blacklist []*net.IPNet) []candidate {
-	ret := []candidate{}
+// checkPriority returns the PRIORITY of our checks on component: that
+// of a peer reflexive candidate, as RFC 8445 computes it. Our own
+// priorities don't fit in its 32 bits.
+func checkPriority(component int) uint32 {
+	return 110<<24 | 65535<<8 | uint32(256-component)
+}
+
+func pruneCandidates(cands []Candidate, blacklist []*net.IPNet) []Candidate {
+	ret := []Candidate{}
 skipCandidate:
 	for _, c := range cands {
 		for _, avoid := range blacklist {
@@ -128,9 +218,18 @@ skipCandidate:
 	return ret
 }
 
-func GatherCandidates(sock *net.UDPConn, ifaces []string, blacklist []*net.IPNet) ([]candidate, error) {
-	laddr := sock.LocalAddr().(*net.UDPAddr)
-	ret := []candidate{}
+func GatherCandidates(sock *net.UDPConn, ifaces []string, blacklist []*net.IPNet) ([]Candidate, error) {
+	return gatherCandidates(sock, &Config{UseInterfaces: ifaces, BlacklistAddresses: blacklist}, nil)
+}
+
+// gatherCandidates finds the candidates of sock, as configured by cfg.
+// mapped, if not nil, is a public address a gateway forwards to sock.
+func gatherCandidates(sock net.PacketConn, cfg *Config, mapped *net.UDPAddr) ([]Candidate, error) {
+	laddr, ok := sock.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("Candidates can only be gathered on UDP sockets")
+	}
+	ret := []Candidate{}
 	switch {
 	case laddr.IP.IsLoopback():
 		return nil, errors.New("Connecting over loopback not supported")
@@ -139,13 +238,19 @@ func GatherCandidates(sock *net.UDPConn, ifaces []string, blacklist []*net.IPNet
 			addrs []net.Addr
 			err   error
 		)
-		if len(ifaces) == 0 {
+		switch {
+		case cfg.InterfaceAddrs != nil:
+			addrs, err = cfg.InterfaceAddrs()
+			if err != nil {
+				return nil, err
+			}
+		case len(cfg.UseInterfaces) == 0:
 			addrs, err = net.InterfaceAddrs()
 			if err != nil {
 				return nil, err
 			}
-		} else {
-			for _, iface := range ifaces {
+		default:
+			for _, iface := range cfg.UseInterfaces {
 				ifi, err := net.InterfaceByName(iface)
 				if err != nil {
 					return nil, err
@@ -161,19 +266,25 @@ func GatherCandidates(sock *net.UDPConn, ifaces []string, blacklist []*net.IPNet
 		for _, addr := range addrs {
 			ip, ok := addr.(*net.IPNet)
 			if ok && ip.IP.IsGlobalUnicast() {
-				ret = append(ret, candidate{&net.UDPAddr{ip.IP, laddr.Port, ""}, 0})
+				ret = append(ret, Candidate{Type: CandidateHost, Addr: &net.UDPAddr{IP: ip.IP, Port: laddr.Port}})
 			}
 		}
 	default:
-		ret = append(ret, candidate{laddr, 0})
+		ret = append(ret, Candidate{Type: CandidateHost, Addr: laddr})
 	}
 
-	// Get the reflexive address
-	reflexive, err := getReflexive(sock)
-	if err == nil {
-		ret = append(ret, candidate{reflexive, 0})
+	// Get the reflexive address. A lite peer's host address is
+	// public.
+	if !cfg.Lite {
+		reflexive, err := getReflexive(sock, cfg)
+		if err == nil {
+			ret = append(ret, Candidate{Type: CandidateServerReflexive, Addr: reflexive})
+		}
+	}
+	if mapped != nil {
+		ret = append(ret, Candidate{Type: CandidatePortMapped, Addr: mapped})
 	}
 
 	setPriorities(ret)
-	return pruneCandidates(ret, blacklist), nil
+	return pruneCandidates(ret, cfg.BlacklistAddresses), nil
 }
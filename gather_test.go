@@ -0,0 +1,125 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/portmap"
+	"github.com/danderson/nat/vnet"
+)
+
+// servePMP answers NAT-PMP requests on sock like a gateway with
+// public address 203.0.113.7, which maps internal port p to external
+// port p+1000. It counts the map requests on maps.
+func servePMP(sock net.PacketConn, maps chan<- uint32) {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := sock.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		switch {
+		case n >= 2 && buf[0] == 0 && buf[1] == 0:
+			sock.WriteTo([]byte{0, 128, 0, 0, 0, 0, 0, 0, 203, 0, 113, 7}, from)
+		case n >= 12 && buf[0] == 0 && buf[1] == 1:
+			resp := make([]byte, 16)
+			resp[1] = 129
+			copy(resp[8:10], buf[4:6])
+			binary.BigEndian.PutUint16(resp[10:], binary.BigEndian.Uint16(buf[4:])+1000)
+			copy(resp[12:16], buf[8:12])
+			maps <- binary.BigEndian.Uint32(buf[8:])
+			sock.WriteTo(resp, from)
+		}
+	}
+}
+
+func TestMappedCandidate(t *testing.T) {
+	listen := func() *net.UDPConn {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sock.Close() })
+		return sock
+	}
+	gw, stunSock := listen(), listen()
+	maps := make(chan uint32, 10)
+	go servePMP(gw, maps)
+	go vnet.ServeSTUN(stunSock)
+
+	cfg := DefaultConfig()
+	cfg.STUNServer = stunSock.LocalAddr().String()
+	cfg.InterfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(192, 168, 1, 2), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.IPv4(198, 51, 100, 2), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+	cfg.PortMapper = &portmap.Client{
+		Gateway:   net.IPv4(127, 0, 0, 1),
+		PMPPort:   gw.LocalAddr().(*net.UDPAddr).Port,
+		Protocols: []portmap.Protocol{portmap.NATPMP},
+		Timeout:   time.Second,
+	}
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	e := &attemptEngine{
+		sock:      sock,
+		cfg:       cfg,
+		component: 1,
+		log:       nopLogger{},
+		stats:     newStats("test", true, time.Now()),
+	}
+	cands, err := gather([]*attemptEngine{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.lease == nil {
+		t.Fatal("no port mapping")
+	}
+
+	prio := map[CandidateType]int64{}
+	var lan, public int64
+	for _, c := range cands {
+		switch {
+		case c.Type == CandidateHost && c.Addr.IP.Equal(net.IPv4(192, 168, 1, 2)):
+			lan = c.Prio
+		case c.Type == CandidateHost:
+			public = c.Prio
+		default:
+			prio[c.Type] = c.Prio
+		}
+		if c.Type == CandidatePortMapped && c.Addr.String() != (&net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: sock.LocalAddr().(*net.UDPAddr).Port + 1000}).String() {
+			t.Errorf("mapped candidate on %v", c.Addr)
+		}
+	}
+	mapped, ok := prio[CandidatePortMapped]
+	if !ok || prio[CandidateServerReflexive] == 0 || lan == 0 || public == 0 {
+		t.Fatalf("missing candidates: %v", cands)
+	}
+	// A forwarded port ranks below the LAN, but above the public
+	// addresses that need hole punching.
+	if mapped&(1<<31) == 0 || mapped >= lan || mapped <= public || mapped <= prio[CandidateServerReflexive] {
+		t.Fatalf("mapped candidate has priority %#x, in %v", mapped, cands)
+	}
+	if e.stats.LocalCandidates[CandidatePortMapped] != 1 {
+		t.Fatalf("stats count %d mapped candidates", e.stats.LocalCandidates[CandidatePortMapped])
+	}
+
+	// Closing the lease deletes the mapping.
+	<-maps
+	e.lease.Close()
+	select {
+	case lifetime := <-maps:
+		if lifetime != 0 {
+			t.Fatalf("closing the lease asked for a lifetime of %ds", lifetime)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease not deleted")
+	}
+}
@@ -0,0 +1,380 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danderson/nat/stun"
+)
+
+const (
+	// maxTids is how many outstanding STUN transactions a Listener
+	// tracks. Once there are that many, it forgets the old ones, at
+	// most once per tidLifetime, or else an arbitrary one.
+	maxTids = 1 << 16
+	// tidLifetime is how long a Listener waits for the answer to a
+	// STUN request.
+	tidLifetime = 30 * time.Second
+)
+
+// A Listener runs the negotiations with many peers over a single UDP
+// socket, so that a server needs one port and one NAT binding however
+// many peers it talks to:
+//
+//	l, _ := nat.Listen(cfg)
+//	// For each peer, with its own signaling:
+//	conn, _ := l.Connect(xchg, false)
+//
+// Checks reach their negotiation by the ufrag in their USERNAME, STUN
+// answers by transaction ID, and the rest by the address of the peer.
+// A negotiation gets the packets of an address once it answered a
+// check from there, i.e. once the check was authenticated.
+type Listener struct {
+	sock net.PacketConn
+	cfg  *Config
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[*muxConn]bool
+	ufrags map[string]*muxConn
+	addrs  map[string]*muxConn
+	tids   map[string]muxTid
+	pruned time.Time // when tids was last pruned
+}
+
+type muxTid struct {
+	c  *muxConn
+	at time.Time
+}
+
+// Listen opens the socket of a Listener on cfg.BindAddress. The
+// negotiations of the Listener use the settings of cfg, except that
+// they have a single component and don't spray, predict ports or map
+// ports.
+func Listen(cfg *Config) (*Listener, error) {
+	if cfg.components() != 1 {
+		return nil, fmt.Errorf("cannot negotiate %d components on a Listener", cfg.Components)
+	}
+	sock, err := cfg.listen(cfg.BindAddress)
+	if err != nil {
+		return nil, err
+	}
+	log := cfg.logger("")
+	if cfg.TOS > 0 {
+		if err := setTOS(sock, cfg.TOS); err != nil {
+			log.Warn("failed to set TOS", "tos", cfg.TOS, "err", err)
+		}
+	}
+	if err := enableECN(sock); err != nil {
+		log.Debug("failed to enable ECN reporting", "err", err)
+	}
+
+	// Sessions get the shared socket through ListenPacket.
+	scfg := *cfg
+	scfg.Components = 1
+	scfg.Sockets = nil
+	scfg.TOS = -1
+	scfg.PortMapper = nil
+	scfg.SpraySockets = 0
+	scfg.PredictPorts = 0
+	l := &Listener{
+		sock:   sock,
+		cfg:    &scfg,
+		conns:  map[*muxConn]bool{},
+		ufrags: map[string]*muxConn{},
+		addrs:  map[string]*muxConn{},
+		tids:   map[string]muxTid{},
+	}
+	scfg.ListenPacket = func(network, address string) (net.PacketConn, error) {
+		return l.newConn()
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// Addr returns the local address of the socket of l.
+func (l *Listener) Addr() net.Addr {
+	return l.sock.LocalAddr()
+}
+
+// NewAgent returns an Agent that negotiates over the socket of l.
+func (l *Listener) NewAgent() (*Agent, error) {
+	a, err := NewAgent(l.cfg)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.bindUfrag(a.engines[0].sock.(*muxConn), a.local.Ufrag)
+	l.mu.Unlock()
+	return a, nil
+}
+
+// Connect is like ConnectOpt, but negotiates over the socket of l.
+func (l *Listener) Connect(xchg ExchangeCandidatesFun, initiator bool) (net.Conn, error) {
+	return l.connect(wrapExchange(xchg), initiator)
+}
+
+// ConnectSignaler is like Connect, but exchanges candidates with the
+// peer over s. s is not closed when ConnectSignaler returns.
+func (l *Listener) ConnectSignaler(s Signaler, initiator bool) (net.Conn, error) {
+	return l.connect(signalerExchange(s), initiator)
+}
+
+func (l *Listener) connect(xchg exchangeFun, initiator bool) (net.Conn, error) {
+	a, err := l.NewAgent()
+	if err != nil {
+		return nil, err
+	}
+	conns, err := a.exchange(xchg, initiator)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
+}
+
+// Close closes the socket of l, and with it the negotiations and
+// Conns that use it.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	conns := l.conns
+	l.conns = nil
+	var owners []*Conn
+	for c := range conns {
+		if c.conn != nil {
+			owners = append(owners, c.conn)
+		}
+	}
+	l.mu.Unlock()
+	for c := range conns {
+		c.q.close()
+	}
+	for _, c := range owners {
+		c.readFailed(net.ErrClosed)
+	}
+	return l.sock.Close()
+}
+
+func (l *Listener) newConn() (*muxConn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	c := &muxConn{
+		l:      l,
+		q:      newPacketQueue(256, l.cfg.clock()),
+		ufrags: map[string]bool{},
+		addrs:  map[string]bool{},
+	}
+	l.conns[c] = true
+	return c, nil
+}
+
+// readLoop reads the socket for all the negotiations and Conns of l.
+func (l *Listener) readLoop() {
+	ms := readBuffers(l.sock, l.cfg.maxDatagramSize())
+	for {
+		n, err := readBatch(l.sock, ms)
+		if err != nil {
+			l.Close()
+			return
+		}
+		for _, m := range ms[:n] {
+			if c := l.route(m.Buf[:m.N], m.Addr); c != nil {
+				c.deliver(packet{m.Buf[:m.N], m.Addr, m.ECN})
+			}
+		}
+	}
+}
+
+// route returns the conn that b, received from addr, belongs to, or
+// nil if none does.
+func (l *Listener) route(b []byte, addr net.Addr) *muxConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if class, err := stun.PeekClass(b); err == nil {
+		switch class {
+		case stun.ClassRequest:
+			// The USERNAME of checks is "ours:theirs".
+			if name, ok := stun.PeekUsername(b); ok {
+				ufrag := name
+				if i := strings.IndexByte(name, ':'); i >= 0 {
+					ufrag = name[:i]
+				}
+				return l.ufrags[ufrag]
+			}
+		case stun.ClassSuccess, stun.ClassError:
+			tid := string(b[8:20])
+			t, ok := l.tids[tid]
+			if !ok {
+				return nil
+			}
+			delete(l.tids, tid)
+			return t.c
+		}
+	}
+	return l.addrs[addr.String()]
+}
+
+// sent records that c sent the STUN packet b to addr, so that the
+// answers come back to c. An answer to a check means c authenticated
+// the peer at addr, which then gets routed to c.
+func (l *Listener) sent(c *muxConn, b []byte, class stun.Class, addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.conns[c] {
+		return
+	}
+	if class == stun.ClassSuccess {
+		l.bindAddr(c, addr.String())
+	}
+	if class != stun.ClassRequest {
+		return
+	}
+	// Our checks carry "theirs:ours", which also catches the new
+	// ufrag of an ICE restart.
+	if name, ok := stun.PeekUsername(b); ok {
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			l.bindUfrag(c, name[i+1:])
+		}
+	}
+	now := l.cfg.clock().Now()
+	if len(l.tids) >= maxTids && now.Sub(l.pruned) > tidLifetime {
+		l.pruned = now
+		for tid, t := range l.tids {
+			if now.Sub(t.at) > tidLifetime || !l.conns[t.c] {
+				delete(l.tids, tid)
+			}
+		}
+	}
+	for tid := range l.tids {
+		if len(l.tids) < maxTids {
+			break
+		}
+		delete(l.tids, tid)
+	}
+	l.tids[string(b[8:20])] = muxTid{c, now}
+}
+
+func (l *Listener) bindUfrag(c *muxConn, ufrag string) {
+	l.ufrags[ufrag] = c
+	c.ufrags[ufrag] = true
+}
+
+func (l *Listener) bindAddr(c *muxConn, addr string) {
+	if l.addrs[addr] == c {
+		return
+	}
+	l.addrs[addr] = c
+	c.addrs[addr] = true
+}
+
+// remove forgets c.
+func (l *Listener) remove(c *muxConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c)
+	for ufrag := range c.ufrags {
+		if l.ufrags[ufrag] == c {
+			delete(l.ufrags, ufrag)
+		}
+	}
+	for addr := range c.addrs {
+		if l.addrs[addr] == c {
+			delete(l.addrs, addr)
+		}
+	}
+}
+
+// A muxConn is the net.PacketConn of one negotiation on a Listener,
+// and then of its Conn.
+type muxConn struct {
+	l *Listener
+	q *packetQueue
+	// The keys of c in the maps of l, guarded by l.mu.
+	ufrags map[string]bool
+	addrs  map[string]bool
+	// conn, once set, takes the packets instead of q. Guarded by
+	// l.mu.
+	conn *Conn
+}
+
+// deliver hands p to the Conn of c, or queues it for the negotiation.
+func (c *muxConn) deliver(p packet) {
+	c.l.mu.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.q.push(p)
+	}
+	c.l.mu.Unlock()
+	if conn != nil {
+		conn.demux(p)
+	}
+}
+
+// deliverTo makes the read loop of the Listener hand the packets of c
+// to conn, so that conn doesn't need a read loop and buffers of its
+// own.
+func (c *muxConn) deliverTo(conn *Conn) {
+	c.l.mu.Lock()
+	c.conn = conn
+	closed := c.l.closed
+	c.l.mu.Unlock()
+	// Packets queued before the handover.
+	for drained := false; !drained; {
+		select {
+		case p := <-c.q.ch:
+			conn.demux(p)
+		default:
+			drained = true
+		}
+	}
+	if closed {
+		conn.readFailed(net.ErrClosed)
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.q.read(b)
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if class, err := stun.PeekClass(b); err == nil {
+		c.l.sent(c, b, class, addr)
+	}
+	return c.l.sock.WriteTo(b, addr)
+}
+
+func (c *muxConn) Close() error {
+	c.q.close()
+	c.l.remove(c)
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.l.sock.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	c.q.setDeadline(t)
+	return nil
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.q.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, the shared socket's write deadline
+// belongs to the Listener.
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/stun"
+	"github.com/danderson/nat/vnet"
+)
+
+func testListener(t *testing.T) *Listener {
+	cfg := DefaultConfig()
+	cfg.BindAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	l, err := Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func newTid(t *testing.T) []byte {
+	tid, err := stun.RandomTid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tid
+}
+
+func TestListenerRouteChecks(t *testing.T) {
+	l := testListener(t)
+	c, err := l.newConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	l.bindUfrag(c, "ours")
+	l.mu.Unlock()
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	data := []byte("data")
+
+	tid := newTid(t)
+	check, err := stun.CheckRequest(tid, stun.ICE{Username: "ours:theirs"}, []byte("whatever password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.route(check, peer) != c {
+		t.Fatal("check not routed by ufrag")
+	}
+	// Anyone can send a check with our ufrag, so the address only
+	// routes to c once c answered.
+	if l.route(data, peer) != nil {
+		t.Fatal("address bound by an unauthenticated check")
+	}
+	resp, err := stun.BindResponse(tid, peer, []byte("password"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.sent(c, resp, stun.ClassSuccess, peer)
+	if l.route(data, peer) != c {
+		t.Fatal("address not bound by an answered check")
+	}
+}
+
+func TestListenerRouteAnswers(t *testing.T) {
+	l := testListener(t)
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	var conns []*muxConn
+	var tids [][]byte
+	for i := 0; i < 2; i++ {
+		c, err := l.newConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tid := newTid(t)
+		req, err := stun.BindRequest(tid, nil, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.sent(c, req, stun.ClassRequest, server)
+		conns, tids = append(conns, c), append(tids, tid)
+	}
+	// The answers go by transaction ID, not to the last conn that
+	// wrote to the server.
+	for i := range conns {
+		resp, err := stun.BindResponse(tids[i], server, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.route(resp, server); got != conns[i] {
+			t.Errorf("answer %d routed to the wrong conn", i)
+		}
+	}
+	resp, err := stun.BindResponse(newTid(t), server, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.route(resp, server) != nil {
+		t.Error("unknown answer routed")
+	}
+	if l.route([]byte("data"), server) != nil {
+		t.Error("data from the STUN server routed")
+	}
+}
+
+func TestListenerMaxTids(t *testing.T) {
+	l := testListener(t)
+	c, err := l.newConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	for i := 0; i < maxTids+100; i++ {
+		req, err := stun.BindRequest(newTid(t), nil, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.sent(c, req, stun.ClassRequest, server)
+	}
+	if len(l.tids) > maxTids {
+		t.Fatalf("%d transactions tracked, want at most %d", len(l.tids), maxTids)
+	}
+}
+
+func TestListener(t *testing.T) {
+	clock := vnet.NewVirtualClock(time.Unix(1e9, 0))
+	stop := clock.Run(20 * time.Millisecond)
+	defer stop()
+	n := vnet.New()
+	n.Clock = clock
+	n.SetLink(vnet.LinkConfig{Latency: 20 * time.Millisecond})
+	stunAddr, err := n.AddSTUNServer(net.IPv4(1, 1, 1, 1), 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := n.AddHost(net.IPv4(5, 5, 5, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := func(h *vnet.Host) *Config {
+		cfg := DefaultConfig()
+		cfg.ListenPacket = h.ListenPacket
+		cfg.InterfaceAddrs = h.InterfaceAddrs
+		cfg.STUNServer = stunAddr.String()
+		cfg.Clock = clock
+		cfg.Nomination = NominateAggressive
+		return cfg
+	}
+	l, err := Listen(mk(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	const peers = 5
+	type result struct {
+		i   int
+		c   net.Conn
+		srv bool
+		err error
+	}
+	ch := make(chan result, 2*peers)
+	for i := 0; i < peers; i++ {
+		g, err := n.AddNAT(net.IPv4(6, 0, 0, byte(i+1)), vnet.NATConfig{Mapping: vnet.AddressPortDependent, Filtering: vnet.AddressPortDependent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := g.AddHost(net.IPv4(10, 0, 0, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := i
+		xa, xb := testExchange()
+		go func() { c, err := ConnectOpt(xa, true, mk(h)); ch <- result{i, c, false, err} }()
+		go func() { c, err := l.Connect(xb, false); ch <- result{i, c, true, err} }()
+	}
+	var cli, srvs [peers]net.Conn
+	for k := 0; k < 2*peers; k++ {
+		r := <-ch
+		if r.err != nil {
+			t.Fatal(r.i, r.err)
+		}
+		defer r.c.Close()
+		if r.srv {
+			srvs[r.i] = r.c
+		} else {
+			cli[r.i] = r.c
+		}
+	}
+	buf := make([]byte, 100)
+	for i := 0; i < peers; i++ {
+		msg := fmt.Sprint("from ", i)
+		if _, err := cli[i].Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		srvs[i].SetReadDeadline(clock.Now().Add(5 * time.Second))
+		n, err := srvs[i].Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("peer %d: read %q, %v", i, buf[:n], err)
+		}
+	}
+}
+
+func TestListenerManyConns(t *testing.T) {
+	l := testListener(t)
+	const peers = 200
+	var socks [peers]net.PacketConn
+	for i := range socks {
+		sock, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sock.Close()
+		socks[i] = sock
+	}
+
+	// Conns on a Listener share its read loop and buffers, so they
+	// cost neither a goroutine nor a datagram-sized buffer each: their
+	// queues are most of what they hold.
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+	var conns [peers]*Conn
+	for i, sock := range socks {
+		mc, err := l.newConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.mu.Lock()
+		l.bindAddr(mc, sock.LocalAddr().String())
+		l.mu.Unlock()
+		e := &attemptEngine{
+			sock:      mc,
+			cfg:       l.cfg,
+			component: 1,
+			log:       nopLogger{},
+			stats:     newStats("test", false, time.Now()),
+			selected:  &attempt{Candidate: Candidate{Type: CandidateHost, Addr: sock.LocalAddr().(*net.UDPAddr)}},
+		}
+		conns[i] = newConn(mc, e)
+		defer conns[i].Close()
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if perConn := (int64(after.HeapAlloc) - int64(before.HeapAlloc)) / peers; perConn >= int64(l.cfg.maxDatagramSize()) {
+		t.Errorf("each Conn holds %d bytes", perConn)
+	}
+	// The consent loop is the only goroutine of a Conn.
+	if n := runtime.NumGoroutine() - goroutines; n > peers+10 {
+		t.Errorf("%d goroutines for %d Conns", n, peers)
+	}
+
+	for i, sock := range socks {
+		if _, err := sock.WriteTo([]byte(fmt.Sprint("from ", i)), l.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 100)
+	for i, c := range conns {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if want := fmt.Sprint("from ", i); err != nil || string(buf[:n]) != want {
+			t.Fatalf("conn %d: read %q, %v, want %q", i, buf[:n], err, want)
+		}
+	}
+
+	// Closing the Listener ends the reads of its Conns.
+	l.Close()
+	conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conns[0].Read(buf); err != net.ErrClosed {
+		t.Fatalf("read after closing the Listener: %v", err)
+	}
+}
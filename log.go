@@ -0,0 +1,82 @@
+package nat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A Logger receives structured logs: a message followed by
+// alternating keys and values. *slog.Logger is a Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// stdLogger prints to the standard logger, for Config.Verbose.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...interface{}) { stdPrint("DEBUG", msg, args) }
+func (stdLogger) Info(msg string, args ...interface{})  { stdPrint("INFO", msg, args) }
+func (stdLogger) Warn(msg string, args ...interface{})  { stdPrint("WARN", msg, args) }
+func (stdLogger) Error(msg string, args ...interface{}) { stdPrint("ERROR", msg, args) }
+
+func stdPrint(level, msg string, args []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	log.Print(b.String())
+}
+
+// sessionLogger tags every log with the session it belongs to.
+type sessionLogger struct {
+	l       Logger
+	session string
+}
+
+func (l sessionLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{"session", l.session}, args...)
+}
+
+func (l sessionLogger) Debug(msg string, args ...interface{}) { l.l.Debug(msg, l.args(args)...) }
+func (l sessionLogger) Info(msg string, args ...interface{})  { l.l.Info(msg, l.args(args)...) }
+func (l sessionLogger) Warn(msg string, args ...interface{})  { l.l.Warn(msg, l.args(args)...) }
+func (l sessionLogger) Error(msg string, args ...interface{}) { l.l.Error(msg, l.args(args)...) }
+
+// logger returns the Logger for session.
+func (c *Config) logger(session string) Logger {
+	switch {
+	case c.Logger != nil:
+		return sessionLogger{c.Logger, session}
+	case c.Verbose:
+		return sessionLogger{stdLogger{}, session}
+	}
+	return nopLogger{}
+}
+
+// newSessionID returns a random ID that correlates the logs and
+// events of a negotiation and of the Conns it yields.
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,83 @@
+package nat
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics receives counters and histograms about negotiations, STUN
+// traffic and Conns, named and labeled in the style of Prometheus.
+// Labels are alternating keys and values. The metrics package
+// implements it with expvar and the Prometheus text format.
+//
+// The metrics are:
+//
+//	nat_negotiations_total{outcome}          negotiations and restarts by outcome
+//	nat_connect_seconds                      time to connect, histogram
+//	nat_selected_pairs_total{local,remote}   candidate types of the nominated pairs
+//	nat_stun_requests_total{type}            STUN requests, of type check, binding or consent
+//	nat_stun_retransmits_total{type}         checks repeated on a pair
+//	nat_stun_timeouts_total{type}            requests that got no answer in time
+//	nat_conn_packets_total{direction}        datagrams over Conns, rx or tx
+//	nat_conn_bytes_total{direction}          bytes over Conns, rx or tx
+//
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Count adds delta to a counter.
+	Count(name string, delta float64, labels ...string)
+	// Observe adds v to a histogram.
+	Observe(name string, v float64, labels ...string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Count(string, float64, ...string)   {}
+func (nopMetrics) Observe(string, float64, ...string) {}
+
+func (c *Config) metrics() Metrics {
+	if c.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Metrics
+}
+
+// outcomes are the labels of nat_negotiations_total for each kind of
+// Error.
+var outcomes = map[error]string{
+	ErrGatherFailed:      "gather_failed",
+	ErrSignalingFailed:   "signaling_failed",
+	ErrRoleConflict:      "role_conflict",
+	ErrNoSuccessfulPairs: "no_successful_pairs",
+	ErrNominationFailed:  "nomination_failed",
+	ErrTimeout:           "timeout",
+	ErrAuthentication:    "authentication_failed",
+}
+
+// recordNegotiation counts a negotiation that ended at now with err,
+// and the pairs engines nominated.
+func (c *Config) recordNegotiation(start, now time.Time, engines []*attemptEngine, err error) {
+	m := c.metrics()
+	if err != nil {
+		outcome := "error"
+		var e *Error
+		if errors.As(err, &e) && outcomes[e.Kind] != "" {
+			outcome = outcomes[e.Kind]
+		}
+		m.Count("nat_negotiations_total", 1, "outcome", outcome)
+		return
+	}
+	m.Count("nat_negotiations_total", 1, "outcome", "success")
+	m.Observe("nat_connect_seconds", now.Sub(start).Seconds())
+	for _, e := range engines {
+		m.Count("nat_selected_pairs_total", 1, "local", string(e.localType()), "remote", string(e.selected.Type))
+	}
+}
+
+// countData counts n bytes of application data going in direction.
+func (c *Conn) countData(direction string, packets, n int) {
+	if c.cfg.Metrics == nil {
+		return
+	}
+	c.cfg.Metrics.Count("nat_conn_packets_total", float64(packets), "direction", direction)
+	c.cfg.Metrics.Count("nat_conn_bytes_total", float64(n), "direction", direction)
+}
@@ -0,0 +1,243 @@
+// Package metrics collects the metrics of nat.Config.Metrics, and
+// exposes them through expvar and in the Prometheus text format:
+//
+//	reg := metrics.NewRegistry()
+//	expvar.Publish("nat", reg)
+//	http.Handle("/metrics", reg)
+//	cfg := nat.DefaultConfig()
+//	cfg.Metrics = reg
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets, suited
+// to durations in seconds.
+var DefaultBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// A series is a metric with a set of label values.
+type series struct {
+	name   string
+	labels string // formatted, without braces
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// A Registry holds counters and histograms. It implements
+// nat.Metrics, expvar.Var and http.Handler. The zero value is an empty
+// Registry.
+type Registry struct {
+	// Buckets are the histogram buckets, in increasing order. Nil
+	// means DefaultBuckets. Set before use.
+	Buckets []float64
+
+	mu       sync.Mutex
+	counters map[series]float64
+	hists    map[series]*histogram
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: map[series]float64{},
+		hists:    map[series]*histogram{},
+	}
+}
+
+func (r *Registry) buckets() []float64 {
+	if r.Buckets == nil {
+		return DefaultBuckets
+	}
+	return r.Buckets
+}
+
+// Count adds delta to the counter name with labels, which are
+// alternating keys and values.
+func (r *Registry) Count(name string, delta float64, labels ...string) {
+	s := series{name, formatLabels(labels)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counters == nil {
+		r.counters = map[series]float64{}
+	}
+	r.counters[s] += delta
+}
+
+// Observe adds v to the histogram name with labels.
+func (r *Registry) Observe(name string, v float64, labels ...string) {
+	s := series{name, formatLabels(labels)}
+	buckets := r.buckets()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hists == nil {
+		r.hists = map[series]*histogram{}
+	}
+	h := r.hists[s]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		r.hists[s] = h
+	}
+	if i := sort.SearchFloat64s(buckets, v); i < len(buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// formatLabels formats labels in the Prometheus syntax. A trailing
+// key without a value is dropped.
+func formatLabels(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (s series) String() string {
+	return s.with("", "")
+}
+
+// with returns s with an extra suffix to its name and an extra
+// label, if label is not empty.
+func (s series) with(suffix, label string) string {
+	labels := s.labels
+	if label != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += label
+	}
+	if labels == "" {
+		return s.name + suffix
+	}
+	return s.name + suffix + "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortSeries(ss []series) {
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].name != ss[j].name {
+			return ss[i].name < ss[j].name
+		}
+		return ss[i].labels < ss[j].labels
+	})
+}
+
+// WriteText writes the metrics of r to w in the Prometheus text
+// exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	buckets := r.buckets()
+
+	r.mu.Lock()
+	var counters, hists []series
+	for s := range r.counters {
+		counters = append(counters, s)
+	}
+	for s := range r.hists {
+		hists = append(hists, s)
+	}
+	sortSeries(counters)
+	sortSeries(hists)
+
+	last := ""
+	for _, s := range counters {
+		if s.name != last {
+			bw.WriteString("# TYPE " + s.name + " counter\n")
+			last = s.name
+		}
+		bw.WriteString(s.String() + " " + formatFloat(r.counters[s]) + "\n")
+	}
+	for _, s := range hists {
+		if s.name != last {
+			bw.WriteString("# TYPE " + s.name + " histogram\n")
+			last = s.name
+		}
+		h := r.hists[s]
+		var cumulative uint64
+		for i, le := range buckets {
+			cumulative += h.counts[i]
+			bw.WriteString(s.with("_bucket", `le="`+formatFloat(le)+`"`) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		bw.WriteString(s.with("_bucket", `le="+Inf"`) + " " + strconv.FormatUint(h.count, 10) + "\n")
+		bw.WriteString(s.with("_sum", "") + " " + formatFloat(h.sum) + "\n")
+		bw.WriteString(s.with("_count", "") + " " + strconv.FormatUint(h.count, 10) + "\n")
+	}
+	r.mu.Unlock()
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition
+// format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+type jsonHistogram struct {
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+// String returns the metrics of r as a JSON object, for expvar.
+// Histogram buckets are cumulative, as in the text format.
+func (r *Registry) String() string {
+	buckets := r.buckets()
+	ret := map[string]interface{}{}
+
+	r.mu.Lock()
+	for s, v := range r.counters {
+		ret[s.String()] = v
+	}
+	for s, h := range r.hists {
+		jh := jsonHistogram{
+			Count:   h.count,
+			Sum:     h.sum,
+			Buckets: map[string]uint64{},
+		}
+		var cumulative uint64
+		for i, le := range buckets {
+			cumulative += h.counts[i]
+			jh.Buckets[formatFloat(le)] = cumulative
+		}
+		jh.Buckets["+Inf"] = h.count
+		ret[s.String()] = jh
+	}
+	r.mu.Unlock()
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fill records a few metrics in r, with sums that floats hold exactly.
+func fill(r *Registry) {
+	r.Count("nat_a_total", 2)
+	// A key without a value is dropped.
+	r.Count("nat_a_total", 1, "dangling")
+	r.Count("nat_b_total", 2, "type", "x")
+	r.Observe("nat_gather_seconds", 2)
+	for _, v := range []float64{0.125, 0.25, 0.5, 4} {
+		r.Observe("nat_latency_seconds", v, "outcome", "ok")
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	// The zero Registry is ready to use.
+	r := &Registry{Buckets: []float64{0.25, 1}}
+	fill(r)
+	r.Count("nat_b_total", 1, "type", "a\"b\\c\nd")
+
+	want := `# TYPE nat_a_total counter
+nat_a_total 3
+# TYPE nat_b_total counter
+nat_b_total{type="a\"b\\c\nd"} 1
+nat_b_total{type="x"} 2
+# TYPE nat_gather_seconds histogram
+nat_gather_seconds_bucket{le="0.25"} 0
+nat_gather_seconds_bucket{le="1"} 0
+nat_gather_seconds_bucket{le="+Inf"} 1
+nat_gather_seconds_sum 2
+nat_gather_seconds_count 1
+# TYPE nat_latency_seconds histogram
+nat_latency_seconds_bucket{outcome="ok",le="0.25"} 2
+nat_latency_seconds_bucket{outcome="ok",le="1"} 3
+nat_latency_seconds_bucket{outcome="ok",le="+Inf"} 4
+nat_latency_seconds_sum{outcome="ok"} 4.875
+nat_latency_seconds_count{outcome="ok"} 4
+`
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != want {
+		t.Fatalf("WriteText wrote:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("served as %q", ct)
+	}
+	if w.Body.String() != want {
+		t.Errorf("served:\n%s", w.Body.String())
+	}
+}
+
+func TestString(t *testing.T) {
+	r := &Registry{Buckets: []float64{0.25, 1}}
+	if got := r.String(); got != "{}" {
+		t.Fatalf("empty registry is %s", got)
+	}
+	fill(r)
+	want := `{"nat_a_total":3,` +
+		`"nat_b_total{type=\"x\"}":2,` +
+		`"nat_gather_seconds":{"count":1,"sum":2,"buckets":{"+Inf":1,"0.25":0,"1":0}},` +
+		`"nat_latency_seconds{outcome=\"ok\"}":{"count":4,"sum":4.875,"buckets":{"+Inf":4,"0.25":2,"1":3}}}`
+	if got := r.String(); got != want {
+		t.Fatalf("String() = %s\nwant %s", got, want)
+	}
+}
+
+func TestDefaultBuckets(t *testing.T) {
+	r := NewRegistry()
+	r.Observe("nat_check_seconds", 0.03)
+	var b strings.Builder
+	r.WriteText(&b)
+	// 0.03s falls in the 0.05 bucket, and all the larger ones.
+	for _, line := range []string{
+		`nat_check_seconds_bucket{le="0.025"} 0`,
+		`nat_check_seconds_bucket{le="0.05"} 1`,
+		`nat_check_seconds_bucket{le="30"} 1`,
+		`nat_check_seconds_bucket{le="+Inf"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, b.String())
+		}
+	}
+}
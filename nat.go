@@ -1,19 +1,44 @@
 package nat
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/danderson/nat/dtls"
+	"github.com/danderson/nat/noise"
+	"github.com/danderson/nat/portmap"
+	"github.com/danderson/nat/stream"
 	"github.com/danderson/nat/stun"
 )
 
 type ExchangeCandidatesFun func([]byte) []byte
 
+// exchangeFun is the internal form of ExchangeCandidatesFun, able to
+// report signaling failures.
+type exchangeFun func([]byte) ([]byte, error)
+
+// Nomination is the strategy the initiator uses to pick the
+// candidate pair for the connection.
+type Nomination int
+
+const (
+	// NominateRegular waits DecisionTime, then picks the working
+	// pair with the highest priority.
+	NominateRegular Nomination = iota
+	// NominateAggressive picks the first pair that works, and
+	// nominates it right away. It connects within two round trips,
+	// at the price of possibly using a lower priority pair.
+	NominateAggressive
+	// NominateGoodEnough picks the first working pair whose
+	// priority is at least NominationThreshold, falling back to
+	// NominateRegular if none shows up before DecisionTime.
+	NominateGoodEnough
+)
+
 type Config struct {
 	// ProbeTimeout is the duration between sending probes.
 	ProbeTimeout time.Duration
@@ -28,17 +53,120 @@ type Config struct {
 	// complete round-trip (stun.ClassSuccess in response to a
 	// stun.ClassRequest) but with UseCandidate set to true.
 	PeerDeadline time.Duration
-	// Prints all the ongoing handshakes.
+	// Verbose prints all the ongoing handshakes to the standard
+	// logger, when Logger is nil.
+	//
+	// Deprecated: set Logger instead.
 	Verbose bool
+	// Logger receives the logs of negotiations and of the Conns they
+	// yield, tagged with a session ID. *slog.Logger fits. Nil logs
+	// nothing, unless Verbose is set.
+	Logger Logger
+	// OnEvent, if set, is called with the milestones of each
+	// negotiation, e.g. for telemetry. It is called synchronously
+	// and must not block.
+	OnEvent func(Event)
 	// Bind locally to a specific address.
 	BindAddress *net.UDPAddr
 	// Which interfaces use for ICE.
 	UseInterfaces []string
 	// Blacklist given addresses for ICE negotiation.
 	BlacklistAddresses []*net.IPNet
-	// TOS, if >0, sets IP_TOS to this value. Note an error is considered
+	// TOS, if >0, sets the traffic class (IP_TOS and IPV6_TCLASS)
+	// of outgoing packets to this value. Note an error is considered
 	// non-fatal, it is just logged.
 	TOS int
+	// MaxDatagramSize is the largest datagram a Conn reads from the
+	// peer, the rest of a longer one is dropped. Zero means 65536.
+	// On Linux, Conns on UDP sockets read as many datagrams as fit
+	// in 64 KiB with each system call, so a size close to the path
+	// MTU saves system calls.
+	MaxDatagramSize int
+	// Nomination is the strategy the initiator uses to pick a
+	// candidate pair. With anything but NominateRegular, both peers
+	// return as soon as a pair is picked instead of waiting for
+	// PeerDeadline. The controlled peer follows the initiator's
+	// strategy and ignores this.
+	Nomination Nomination
+	// NominationThreshold is the lowest priority of the remote
+	// candidate that NominateGoodEnough accepts. Candidates on
+	// private networks have priorities of at least 1<<32.
+	NominationThreshold int64
+	// ConsentInterval is the average time between consent freshness
+	// checks (RFC 7675) on an established connection. Zero disables
+	// consent checks.
+	ConsentInterval time.Duration
+	// ConsentTimeout is how long a connection survives without the
+	// peer answering consent checks. The connection is then closed,
+	// and fails with ErrConsentExpired.
+	ConsentTimeout time.Duration
+	// PortMapper, if set, asks the gateway to forward a public port
+	// to each ICE socket, and offers the forwarded address as a
+	// candidate. Failures are not fatal.
+	PortMapper *portmap.Client
+	// Components is the number of ICE components, e.g. 2 for RTP
+	// and RTCP, that ConnectComponents negotiates. Each component
+	// gets its own socket and Conn. Zero means 1.
+	Components int
+	// KeepaliveInterval is how long a connection can stay silent
+	// before we send a keepalive to hold the NAT bindings open. Zero
+	// disables keepalives.
+	KeepaliveInterval time.Duration
+	// PredictPorts, if >0, watches how our NAT allocates ports and
+	// offers this many predicted public addresses as extra
+	// candidates, for peers behind NATs that map every destination
+	// to a new port.
+	PredictPorts int
+	// SpraySockets, if >0, opens this many extra sockets per
+	// component and sends checks from all of them to the peer's
+	// non-host candidates, so that with enough NAT bindings on both
+	// sides one pair lines up.
+	SpraySockets int
+	// PunchBudget, if >0, caps the checks sent per ProbeTimeout, to
+	// keep prediction and spraying polite.
+	PunchBudget int
+	// ListenPacket, if set, opens the ICE sockets instead of
+	// net.ListenPacket, e.g. on a virtual network or to instrument
+	// them.
+	ListenPacket func(network, address string) (net.PacketConn, error)
+	// Sockets, if set, are bound sockets to run the components on,
+	// one per component in order, instead of opening new ones on
+	// BindAddress. The Conns take them over, but they are left open
+	// if the negotiation fails.
+	Sockets []net.PacketConn
+	// InterfaceAddrs, if set, lists the addresses offered as host
+	// candidates, instead of those of UseInterfaces or of all
+	// interfaces.
+	InterfaceAddrs func() ([]net.Addr, error)
+	// STUNServer is the STUN server that tells us our reflexive
+	// address. Empty means the one given by the -stunserver flag.
+	STUNServer string
+	// Clock, if set, times the negotiation and the Conns instead of
+	// the system clock. The socket deadlines must follow it too.
+	Clock Clock
+	// Metrics, if set, receives counters and histograms about
+	// negotiations, STUN traffic and Conns.
+	Metrics Metrics
+	// Lite runs ICE-lite (RFC 8445), for peers with a public
+	// address: we only offer host candidates, never send checks
+	// and accept the pair the peer nominates. The peer must run
+	// full ICE. A lite peer is always the controlled one, whatever
+	// the initiator argument says, and its Conns don't send consent
+	// checks.
+	Lite bool
+	// Certificate, if set, is announced to the peer by fingerprint
+	// along with our candidates, so that Conn.Secure can run DTLS
+	// with it. It must have an ECDSA P-256 key, see
+	// dtls.GenerateCertificate.
+	Certificate *tls.Certificate
+	// Noise, if set, has its static public key announced to the
+	// peer along with our candidates, so that Conn.SecureNoise can
+	// run a Noise handshake with it. Its PeerKey, if set, pins the
+	// peer's key instead of trusting the one it announces.
+	Noise *noise.Config
+	// Stream configures the stream sessions of Conn.Streams and
+	// ConnectStream. Nil means the defaults of package stream.
+	Stream *stream.Config
 }
 
 func DefaultConfig() *Config {
@@ -48,31 +176,92 @@ func DefaultConfig() *Config {
 		PeerDeadline: 6 * time.Second,
 		BindAddress:  &net.UDPAddr{},
 		TOS:          -1,
+
+		ConsentInterval:   5 * time.Second,
+		ConsentTimeout:    30 * time.Second,
+		KeepaliveInterval: 15 * time.Second,
 	}
 }
 
-func ConnectOpt(xchg ExchangeCandidatesFun, initiator bool, cfg *Config) (net.Conn, error) {
-	sock, err := net.ListenUDP("udp", cfg.BindAddress)
-	if err != nil {
-		return nil, err
+// maxComponents is the largest number of components ICE allows.
+const maxComponents = 256
+
+func (c *Config) components() int {
+	if c.Components == 0 {
+		return 1
 	}
-	if err := setTOS(sock, cfg.TOS); err != nil {
-		log.Printf("Failed to set TOS to %d: %v", cfg.TOS, err)
+	return c.Components
+}
+
+func (c *Config) maxDatagramSize() int {
+	if c.MaxDatagramSize <= 0 {
+		return maxPacketSize
 	}
+	return c.MaxDatagramSize
+}
 
-	engine := &attemptEngine{
-		xchg:      xchg,
-		sock:      sock,
-		initiator: initiator,
-		cfg:       cfg,
+func (c *Config) listen(laddr *net.UDPAddr) (net.PacketConn, error) {
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	}
+	if c.ListenPacket != nil {
+		return c.ListenPacket("udp", laddr.String())
 	}
+	return net.ListenUDP("udp", laddr)
+}
+
+func (c *Config) stunServer() string {
+	if c.STUNServer == "" {
+		return *stunserver
+	}
+	return c.STUNServer
+}
+
+func ConnectOpt(xchg ExchangeCandidatesFun, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectOne(wrapExchange(xchg), initiator, cfg)
+}
 
-	conn, err := engine.run()
+// ConnectComponents is like ConnectOpt, but negotiates cfg.Components
+// paths to the peer with a single exchange of candidates. It returns
+// one Conn per component, in order.
+func ConnectComponents(xchg ExchangeCandidatesFun, initiator bool, cfg *Config) ([]*Conn, error) {
+	return connect(wrapExchange(xchg), initiator, cfg)
+}
+
+func wrapExchange(xchg ExchangeCandidatesFun) exchangeFun {
+	return func(mine []byte) ([]byte, error) {
+		return xchg(mine), nil
+	}
+}
+
+func connectOne(xchg exchangeFun, initiator bool, cfg *Config) (net.Conn, error) {
+	if cfg.components() != 1 {
+		return nil, fmt.Errorf("cannot negotiate %d components on a single Conn, use ConnectComponents", cfg.Components)
+	}
+	conns, err := connect(xchg, initiator, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
+}
+
+func connect(xchg exchangeFun, initiator bool, cfg *Config) ([]*Conn, error) {
+	a, err := NewAgent(cfg)
 	if err != nil {
-		sock.Close()
 		return nil, err
 	}
-	return conn, nil
+	return a.exchange(xchg, initiator)
+}
+
+// exchange runs the whole negotiation of a, exchanging candidates
+// with the peer through xchg.
+func (a *Agent) exchange(xchg exchangeFun, initiator bool) ([]*Conn, error) {
+	a.setRole(initiator)
+	if err := negotiate(xchg, a.engines, a.local); err != nil {
+		a.log.Error("negotiation failed", "err", err)
+		return nil, a.fail(err)
+	}
+	return a.check()
 }
 
 func Connect(xchg ExchangeCandidatesFun, initiator bool) (net.Conn, error) {
@@ -80,251 +269,620 @@ func Connect(xchg ExchangeCandidatesFun, initiator bool) (net.Conn, error) {
 }
 
 type attempt struct {
-	candidate
+	Candidate
 	tid       []byte
 	timeout   time.Time
+	pending   bool // is tid waiting for an answer
 	success   bool // did we get a STUN response from this addr
 	chosen    bool // Has this channel been picked for the connection?
+	nominated bool // did the peer send USE-CANDIDATE on this pair
 	localaddr net.Addr
+	sock      int // index of our socket, see attemptEngine.socket
+	// Counters for Stats.
+	sentAt            time.Time
+	requestsSent      int
+	responsesReceived int
+	requestsReceived  int
+	rtt, totalRTT     time.Duration
 }
 
+// maxEarlyPackets bounds the application data an attemptEngine keeps
+// for the Conn.
+const maxEarlyPackets = 64
+
 type attemptEngine struct {
-	xchg      ExchangeCandidatesFun
-	sock      *net.UDPConn
+	xchg      exchangeFun
+	sock      net.PacketConn
 	initiator bool
 	attempts  []attempt
-	p2pconn   net.Conn
+	selected  *attempt
 	cfg       *Config
+	component int
+	// session identifies the negotiation in logs and events.
+	session string
+	log     Logger
+	// stats is shared by the engines of a negotiation.
+	stats *Stats
+	// lease is our port mapping on the gateway, if any.
+	lease  *portmap.Lease
+	local  Credentials
+	remote Credentials
+	// tiebreaker goes in our checks, with our role.
+	tiebreaker uint64
+	// eager is set when the initiator returns as soon as it has
+	// nominated a pair, rather than sticking around until
+	// PeerDeadline to answer our checks.
+	eager bool
+	// early holds the application data received during the checks,
+	// for the Conn to pick up.
+	early []packet
+	// authErr is the last check that failed authentication.
+	authErr error
+	// gathered holds our candidates.
+	gathered []Candidate
+	// trickled holds the remote candidates added while the checks
+	// run.
+	trickleMu sync.Mutex
+	trickled  []Candidate
+	// abort, when closed, stops the checks.
+	abort <-chan struct{}
+	// spray holds the extra sockets used for birthday punching.
+	spray []net.PacketConn
+	// rx receives the packets read from all our sockets during the
+	// checks.
+	rx     chan rxPacket
+	stop   chan struct{}
+	rxDone sync.WaitGroup
+	// Pacing of checks under Config.PunchBudget.
+	roundEnd time.Time
+	sent     int
+	next     int
+	// byTid and byAddr index e.attempts by the transaction ID of
+	// their last check, and by socket and remote address.
+	byTid   map[string]int
+	byAddr  map[pairKey]int
+	learned int // peer-reflexive attempts
+	// fingerprint and noiseKey are the certificate fingerprint and
+	// Noise static key the peer signaled, if any.
+	fingerprint string
+	noiseKey    []byte
+}
+
+type pairKey struct {
+	sock int
+	addr string
+}
+
+// addAttempt appends a to e.attempts.
+func (e *attemptEngine) addAttempt(a attempt) {
+	if e.byAddr == nil {
+		e.byTid = map[string]int{}
+		e.byAddr = map[pairKey]int{}
+	}
+	k := pairKey{a.sock, a.Addr.String()}
+	if _, ok := e.byAddr[k]; !ok {
+		e.byAddr[k] = len(e.attempts)
+	}
+	e.attempts = append(e.attempts, a)
+}
+
+// find returns the index of the attempt that pairs socket via with
+// addr.
+func (e *attemptEngine) find(addr net.Addr, via int) (int, bool) {
+	i, ok := e.byAddr[pairKey{via, addr.String()}]
+	return i, ok
+}
+
+// localAddr returns our address on the selected pair. A lite peer
+// accepts a nomination without any response telling it that address,
+// in which case the socket's address is the best we have.
+func (e *attemptEngine) localAddr() net.Addr {
+	if e.selected.localaddr != nil {
+		return e.selected.localaddr
+	}
+	return e.socket(e.selected.sock).LocalAddr()
+}
+
+// mapPort asks the gateway to forward a port to our socket.
+func (e *attemptEngine) mapPort() {
+	laddr, ok := e.sock.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	lease, err := e.cfg.PortMapper.Lease(laddr.Port)
+	if err != nil {
+		e.log.Warn("port mapping failed", "err", err)
+		return
+	}
+	e.log.Info("gateway forwards a port", "external", lease.External(), "port", laddr.Port)
+	e.lease = lease
 }
 
 func (e *attemptEngine) init() error {
-	candidates, err := GatherCandidates(e.sock, e.cfg.UseInterfaces, e.cfg.BlacklistAddresses)
+	local, err := NewCredentials()
 	if err != nil {
 		return err
 	}
+	return negotiate(e.xchg, []*attemptEngine{e}, local)
+}
 
-	var peerCandidates []candidate
-	jsonCandidates, err := json.Marshal(candidates)
+// negotiate gathers candidates on the sockets of engines, one per
+// component, exchanges them and our credentials local with the peer
+// in a single signaling round, and sets the engines up to check their
+// component's pairs.
+func negotiate(xchg exchangeFun, engines []*attemptEngine, local Credentials) error {
+	first := engines[0]
+	stats := first.stats
+	fail := func(side Side, err error) error {
+		stats.FailedSide = side
+		return err
+	}
+	candidates, err := gather(engines)
+	if err != nil {
+		return err
+	}
+	lite := first.cfg.Lite
+	if lite {
+		setInitiator(engines, false)
+	}
+	start := first.cfg.clock().Now()
+	mine := &Signal{
+		Version:     SignalVersion,
+		Credentials: local,
+		Role:        roleFor(first.initiator),
+		Candidates:  candidates,
+	}
+	if first.initiator && first.cfg.Nomination != NominateRegular {
+		mine.Capabilities = append(mine.Capabilities, capEagerNomination)
+	}
+	if lite {
+		mine.Capabilities = append(mine.Capabilities, capLite)
+	}
+	if cert := first.cfg.Certificate; cert != nil && len(cert.Certificate) > 0 {
+		mine.Fingerprint = dtls.Fingerprint(cert.Certificate[0])
+	}
+	if n := first.cfg.Noise; n != nil && n.StaticKey != nil {
+		mine.NoiseKey = n.StaticKey.PublicKey().Bytes()
+	}
+	raw, err := mine.Marshal()
 	if err != nil {
-		panic(err)
+		return fail(SideLocal, err)
 	}
-	err = json.Unmarshal(e.xchg(jsonCandidates), &peerCandidates)
+	raw, err = xchg(raw)
 	if err != nil {
-		panic(err)
+		return fail(SideRemote, newError(ErrSignalingFailed, err, ""))
 	}
+	peer, err := ParseSignal(raw)
+	if err != nil {
+		return fail(SideRemote, newError(ErrSignalingFailed, err, ""))
+	}
+	switch {
+	case lite && peer.Has(capLite):
+		return fail(SideRemote, newError(ErrRoleConflict, nil, "both peers are ICE-lite"))
+	case peer.Has(capLite):
+		// The lite peer is always controlled.
+		setInitiator(engines, true)
+	case lite:
+		// The peer takes the controlling role when it sees
+		// capLite, whatever it asked for.
+	case peer.Role == mine.Role:
+		return fail(SideRemote, newError(ErrRoleConflict, nil, "both peers want the %s role", peer.Role))
+	}
+	stats.SignalTime = first.cfg.clock().Now().Sub(start)
 
-	e.attempts = make([]attempt, len(peerCandidates))
-	for i := range peerCandidates {
-		e.attempts[i].candidate = peerCandidates[i]
-		e.attempts[i].timeout = time.Time{}
+	eager := first.cfg.Nomination != NominateRegular
+	if !first.initiator {
+		eager = peer.Has(capEagerNomination)
+	}
+	// A lite peer doesn't check pairs, so there is nothing to wait
+	// for once one is nominated.
+	if lite || peer.Has(capLite) {
+		eager = true
+	}
+	for _, e := range engines {
+		e.setRemote(local, peer.Credentials, peer.Candidates, eager)
+		e.fingerprint, e.noiseKey = peer.Fingerprint, peer.NoiseKey
 	}
+	return nil
+}
 
-	e.sock.SetWriteDeadline(time.Time{})
+// setInitiator makes engines the initiator or the controlled peer.
+func setInitiator(engines []*attemptEngine, initiator bool) {
+	engines[0].stats.Initiator = initiator
+	for _, e := range engines {
+		e.initiator = initiator
+	}
+}
 
-	return nil
+// gather gathers candidates on the sockets of engines.
+func gather(engines []*attemptEngine) ([]Candidate, error) {
+	first := engines[0]
+	stats := first.stats
+	start := first.cfg.clock().Now()
+	var ret []Candidate
+	for _, e := range engines {
+		e.gathered = nil
+		var mapped *net.UDPAddr
+		if e.lease == nil && e.cfg.PortMapper != nil && !e.cfg.Lite {
+			e.mapPort()
+		}
+		if e.lease != nil {
+			mapped = e.lease.External()
+		}
+		candidates, err := gatherCandidates(e.sock, e.cfg, mapped)
+		if err != nil {
+			stats.FailedSide = SideLocal
+			return nil, newError(ErrGatherFailed, err, "")
+		}
+		for _, c := range e.predictCandidates(candidates) {
+			if e.component > 1 {
+				c.Component = e.component
+			}
+			e.log.Info("gathered candidate", "component", e.component, "candidate", c)
+			e.emit(Event{Type: EventCandidateGathered, Candidate: c})
+			ret = append(ret, c)
+			e.gathered = append(e.gathered, c)
+			stats.LocalCandidates[c.Type]++
+		}
+	}
+	stats.GatherTime = first.cfg.clock().Now().Sub(start)
+	return ret, nil
+}
+
+// setRemote sets e up to check its component's pairs with the remote
+// candidates.
+func (e *attemptEngine) setRemote(local, remote Credentials, candidates []Candidate, eager bool) {
+	e.local, e.remote = local, remote
+	e.eager = eager
+	e.attempts, e.byTid, e.byAddr, e.learned = nil, nil, nil, 0
+	for _, c := range candidates {
+		if c.component() == e.component {
+			e.addAttempt(attempt{Candidate: c})
+		}
+	}
+	e.addSprayAttempts(0)
+	e.sock.SetWriteDeadline(time.Time{})
 }
 
 func (e *attemptEngine) xmit() (time.Time, error) {
-	now := time.Now()
+	now := e.cfg.clock().Now()
 	var ret time.Time
-	var err error
+	burst := 0
 
+	// The checks that nominate a pair, or answer the peer's
+	// nomination, go first and don't count against PunchBudget.
 	for i := range e.attempts {
-		if e.attempts[i].timeout.Before(now) {
-			e.attempts[i].timeout = time.Now().Add(e.cfg.ProbeTimeout)
-			e.attempts[i].tid, err = stun.RandomTid()
-			if err != nil {
+		if (e.attempts[i].chosen || e.attempts[i].nominated) && !e.attempts[i].timeout.After(now) {
+			if err := e.sendCheck(i); err != nil {
 				return time.Time{}, err
 			}
-			packet, err := stun.BindRequest(e.attempts[i].tid, nil, false, e.attempts[i].chosen)
-			if err != nil {
-				return time.Time{}, err
+		}
+	}
+
+	// PunchBudget caps the checks sent per round. Start each round
+	// where the last one left off, so that every pair gets its turn.
+	if !now.Before(e.roundEnd) {
+		e.roundEnd = now.Add(e.cfg.ProbeTimeout)
+		e.sent = 0
+	}
+	for k := range e.attempts {
+		i := (e.next + k) % len(e.attempts)
+		if !e.attempts[i].timeout.After(now) {
+			if e.cfg.PunchBudget > 0 && e.sent >= e.cfg.PunchBudget {
+				e.next = i
+				ret = e.roundEnd
+				break
+			}
+			if burst == maxBurst {
+				// Handle the answers before sending more.
+				e.next = i
+				ret = now
+				break
 			}
-			if e.cfg.Verbose {
-				log.Printf("TX probe %v to %v", e.attempts[i].tid, e.attempts[i].Addr)
+			burst++
+			e.sent++
+			if err := e.sendCheck(i); err != nil {
+				return time.Time{}, err
 			}
-			e.sock.WriteToUDP(packet, e.attempts[i].Addr)
 		}
 		if ret.IsZero() || e.attempts[i].timeout.Before(ret) {
 			ret = e.attempts[i].timeout
 		}
 	}
+	// With no pairs yet, wait for the peer's checks or trickled
+	// candidates.
+	if ret.IsZero() {
+		ret = now.Add(e.cfg.ProbeTimeout)
+	}
 	return ret, nil
 }
 
-func (e *attemptEngine) read() error {
-	buf := make([]byte, 512)
-	n, from, err := e.sock.ReadFromUDP(buf)
+// sendCheck sends a connectivity check on attempt i.
+func (e *attemptEngine) sendCheck(i int) error {
+	m := e.cfg.metrics()
+	m.Count("nat_stun_requests_total", 1, "type", "check")
+	if e.attempts[i].requestsSent > 0 {
+		m.Count("nat_stun_retransmits_total", 1, "type", "check")
+	}
+	if e.attempts[i].pending {
+		m.Count("nat_stun_timeouts_total", 1, "type", "check")
+	}
+	e.attempts[i].pending = true
+	e.attempts[i].sentAt = e.cfg.clock().Now()
+	e.attempts[i].timeout = e.attempts[i].sentAt.Add(e.cfg.ProbeTimeout)
+	e.attempts[i].requestsSent++
+	delete(e.byTid, string(e.attempts[i].tid))
+	tid, err := stun.RandomTid()
 	if err != nil {
-		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			return nil
-		}
 		return err
 	}
+	e.attempts[i].tid = tid
+	e.byTid[string(tid)] = i
+	packet, err := stun.CheckRequest(tid, stun.ICE{
+		Username:     e.remote.Ufrag + ":" + e.local.Ufrag,
+		UseCandidate: e.attempts[i].chosen,
+		Priority:     checkPriority(e.component),
+		Controlling:  e.initiator,
+		Tiebreaker:   e.tiebreaker,
+	}, []byte(e.remote.Pwd))
+	if err != nil {
+		return err
+	}
+	e.log.Debug("sent check", "tid", tid, "remote", e.attempts[i].Addr)
+	e.emit(Event{Type: EventCheckSent, Candidate: e.attempts[i].Candidate})
+	e.socket(e.attempts[i].sock).WriteTo(packet, e.attempts[i].Addr)
+	return nil
+}
+
+// handle processes buf, received from addr on socket via. It answers
+// the peer's checks, records the answers to ours, and keeps early
+// application data for the Conn.
+func (e *attemptEngine) handle(buf []byte, addr net.Addr, via int) error {
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	n := len(buf)
 
-	packet, err := stun.ParsePacket(buf[:n], nil)
+	if ClassifyPacket(buf[:n]) != KindSTUN {
+		if via == 0 && len(e.early) < maxEarlyPackets {
+			e.early = append(e.early, packet{buf: buf[:n], from: from})
+		}
+		return nil
+	}
+	// Requests are signed with our password, responses with the
+	// peer's.
+	class, err := stun.PeekClass(buf[:n])
+	if err != nil {
+		e.log.Debug("cannot parse packet", "from", from, "err", err)
+		return nil
+	}
+	key := []byte(e.remote.Pwd)
+	if class == stun.ClassRequest {
+		key = []byte(e.local.Pwd)
+	}
+	packet, err := stun.ParsePacket(buf[:n], key)
 	if err != nil {
-		if e.cfg.Verbose {
-			log.Printf("Cannot parse packet from %v: %v", from, err)
+		e.log.Debug("cannot parse packet", "from", from, "err", err)
+		switch err.(type) {
+		case stun.BadMac, stun.MissingMac, stun.UnverifiableMac:
+			e.authErr = err
 		}
 		return nil
 	}
 
 	if packet.Method != stun.MethodBinding {
-		if e.cfg.Verbose {
-			log.Printf("Packet from %v is not a binding request", from)
-		}
+		e.log.Debug("packet is not a binding request", "from", from)
 		return nil
 	}
 
 	switch packet.Class {
 	case stun.ClassRequest:
-		response, err := stun.BindResponse(packet.Tid[:], from, nil, false)
+		if !strings.HasPrefix(packet.Username, e.local.Ufrag+":") {
+			e.log.Debug("request has wrong username", "from", from, "username", packet.Username)
+			e.authErr = fmt.Errorf("wrong username %q", packet.Username)
+			return nil
+		}
+		response, err := stun.BindResponse(packet.Tid[:], from, []byte(e.local.Pwd), false)
 		if err != nil {
-			if e.cfg.Verbose {
-				log.Printf("Cannot bind response: %v", err)
-			}
+			e.log.Debug("cannot build response", "err", err)
 			return nil
 		}
-		e.sock.WriteToUDP(response, from)
-		if e.cfg.Verbose {
-			log.Printf("RX %v from %v use candidate %v, answering", packet.Tid[:], from, packet.UseCandidate)
+		e.socket(via).WriteTo(response, from)
+		e.learn(from, via)
+		e.log.Debug("answered check", "tid", packet.Tid[:], "from", from, "use_candidate", packet.UseCandidate)
+		i, ok := e.find(from, via)
+		if !ok {
+			return nil
 		}
-		if packet.UseCandidate {
-			for i := range e.attempts {
-				if from.String() != e.attempts[i].Addr.String() {
-					continue
-				}
-				if !e.attempts[i].success {
-					m := fmt.Errorf("bad link: local %v remote %v", e.attempts[i].localaddr, e.attempts[i].Addr)
-					if e.cfg.Verbose {
-						log.Printf("Error: %v", m)
-					}
-					return m
-				}
-				if e.p2pconn == nil {
-					if e.cfg.Verbose {
-						log.Printf("Confirmed local %v remote %v", e.attempts[i].localaddr, e.attempts[i].Addr)
-					}
-					e.p2pconn = newConn(e.sock, e.attempts[i].localaddr, e.attempts[i].Addr)
-				}
-				return nil
+		e.attempts[i].requestsReceived++
+		if packet.UseCandidate && !e.initiator {
+			e.attempts[i].nominated = true
+			if e.attempts[i].success || e.cfg.Lite {
+				// A lite peer doesn't check pairs, the peer's
+				// check is all the validation there is.
+				e.conclude(i)
+			} else {
+				// Check the pair right away, and conclude once
+				// the check succeeds (RFC 8445 §7.3.1.5).
+				e.attempts[i].timeout = time.Time{}
 			}
 		}
 
 	case stun.ClassSuccess:
-		if e.cfg.Verbose {
-			log.Printf("RX %v from %v", packet.Tid[:], from)
+		e.log.Debug("received answer", "tid", packet.Tid[:], "from", from)
+		i, ok := e.byTid[string(packet.Tid[:])]
+		if !ok {
+			return nil
 		}
-	skipAddress:
-		for i := range e.attempts {
-			if !bytes.Equal(packet.Tid[:], e.attempts[i].tid) {
-				continue
-			}
-			if from.String() != e.attempts[i].Addr.String() {
+		if from.String() != e.attempts[i].Addr.String() || e.attempts[i].sock != via {
+			return nil
+		}
+		rtt := e.cfg.clock().Now().Sub(e.attempts[i].sentAt)
+		e.attempts[i].pending = false
+		e.attempts[i].responsesReceived++
+		e.attempts[i].rtt = rtt
+		e.attempts[i].totalRTT += rtt
+		if e.attempts[i].chosen {
+			if e.selected == nil {
+				e.nominate(i)
 				return nil
 			}
-			if e.attempts[i].chosen {
-				if e.p2pconn == nil {
-					if e.cfg.Verbose {
-						log.Printf("Confirmed local %v remote %v", e.attempts[i].localaddr, e.attempts[i].Addr)
-					}
-					e.p2pconn = newConn(e.sock, e.attempts[i].localaddr, e.attempts[i].Addr)
-					return nil
-				}
-			}
-			for _, avoid := range e.cfg.BlacklistAddresses {
-				if avoid.Contains(packet.Addr.IP) {
-					continue skipAddress
-				}
+		}
+		for _, avoid := range e.cfg.BlacklistAddresses {
+			if avoid.Contains(packet.Addr.IP) {
+				return nil
 			}
-			e.attempts[i].success = true
-			e.attempts[i].localaddr = packet.Addr
-			return nil
+		}
+		e.attempts[i].success = true
+		e.attempts[i].localaddr = packet.Addr
+		e.emit(Event{Type: EventCheckSucceeded, Candidate: e.attempts[i].Candidate, Local: packet.Addr})
+		if e.attempts[i].nominated {
+			e.conclude(i)
 		}
 	}
 
 	return nil
 }
 
-func (e *attemptEngine) run() (net.Conn, error) {
-	if err := e.init(); err != nil {
-		return nil, err
-	}
-
-	endTime := time.Now().Add(e.cfg.PeerDeadline)
-	decision := time.Now().Add(e.cfg.DecisionTime)
+// check runs the connectivity checks until a pair is selected.
+func (e *attemptEngine) check() (*attempt, error) {
+	endTime := e.cfg.clock().Now().Add(e.cfg.PeerDeadline)
+	decision := e.cfg.clock().Now().Add(e.cfg.DecisionTime)
+	e.startReaders()
+	defer e.stopReaders()
 
-	for time.Now().Before(endTime) {
-		if e.initiator && !decision.IsZero() && time.Now().After(decision) {
+	for e.cfg.clock().Now().Before(endTime) {
+		if e.selected != nil && e.eager {
+			break
+		}
+		select {
+		case <-e.abort:
+			return nil, ErrAgentClosed
+		default:
+		}
+		e.addTrickled()
+		if e.initiator && !decision.IsZero() && (!e.cfg.clock().Now().Before(decision) || e.goodEnough()) {
 			decision = time.Time{}
 			if err := e.decide(); err != nil {
-				if e.cfg.Verbose {
-					log.Printf("Decision failed: %v", err)
-				}
+				e.log.Error("decision failed", "err", err)
 				return nil, err
 			}
 		}
 
-		timeout, err := e.xmit()
-		if err != nil {
-			if e.cfg.Verbose {
-				log.Printf("TX failed: %v", err)
+		// A lite peer only answers checks.
+		timeout := endTime
+		if !e.cfg.Lite {
+			var err error
+			if timeout, err = e.xmit(); err != nil {
+				e.log.Error("sending checks failed", "err", err)
+				return nil, err
 			}
-			return nil, err
 		}
 
-		e.sock.SetReadDeadline(timeout)
-		if err = e.read(); err != nil {
-			if e.cfg.Verbose {
-				log.Printf("RX failed: %v", err)
-			}
+		if err := e.wait(timeout); err != nil {
+			e.log.Error("receiving checks failed", "err", err)
 			return nil, err
 		}
 
 	}
 
-	if e.p2pconn != nil {
-		if e.cfg.Verbose {
-			log.Print("Success!")
-		}
-		return e.p2pconn, nil
+	if e.selected != nil {
+		e.log.Info("connected", "local", e.selected.localaddr, "remote", e.selected.Addr)
+		return e.selected, nil
 	}
+	var m error
 	for i := range e.attempts {
 		if e.attempts[i].chosen {
-			m := fmt.Errorf("last round with UseCandidate true failed even if a candidate circuit has been established.")
-			if e.cfg.Verbose {
-				log.Printf("Fail: %v", m)
-			}
-			return nil, m
+			m = newError(ErrNominationFailed, nil, "chosen pair stopped answering: local %v remote %v", e.attempts[i].localaddr, e.attempts[i].Addr)
+			break
+		}
+		if e.attempts[i].nominated && !e.attempts[i].success {
+			m = newError(ErrNominationFailed, nil, "peer nominated a pair our checks never validated: remote %v", e.attempts[i].Addr)
+		}
+		if e.attempts[i].success && m == nil {
+			m = newError(ErrTimeout, nil, "no pair nominated after %v", e.cfg.PeerDeadline)
 		}
 	}
-	m := fmt.Errorf("no circuit could be established after %v", e.cfg.PeerDeadline)
-	if e.cfg.Verbose {
-		log.Printf("Fail: %v", m)
+	if m == nil {
+		m = e.failedChecks(fmt.Sprintf("no answer after %v", e.cfg.PeerDeadline))
 	}
+	e.log.Error("negotiation failed", "err", m)
 	return nil, m
 }
 
+// failedChecks returns the error for checks that never got an answer.
+func (e *attemptEngine) failedChecks(detail string) error {
+	if e.authErr != nil {
+		return newError(ErrAuthentication, e.authErr, "%s", detail)
+	}
+	return newError(ErrNoSuccessfulPairs, nil, "%s", detail)
+}
+
+// localType returns the type of our candidate on the selected pair.
+func (e *attemptEngine) localType() CandidateType {
+	local := e.localAddr().String()
+	for _, c := range e.gathered {
+		if c.Addr.String() == local {
+			return c.Type
+		}
+	}
+	return CandidatePeerReflexive
+}
+
+// nominate selects attempt i for the connection.
+func (e *attemptEngine) nominate(i int) {
+	e.log.Info("pair nominated", "local", e.attempts[i].localaddr, "remote", e.attempts[i].Addr)
+	e.emit(Event{Type: EventPairNominated, Candidate: e.attempts[i].Candidate, Local: e.attempts[i].localaddr})
+	e.selected = &e.attempts[i]
+}
+
+// conclude selects attempt i, which the peer nominated and our check
+// validated, unless the selected pair has a higher priority. The
+// controlled peer thus follows the best nomination (RFC 8445 §8.1.1).
+func (e *attemptEngine) conclude(i int) {
+	if e.selected != nil && e.selected.Prio >= e.attempts[i].Prio {
+		return
+	}
+	e.nominate(i)
+}
+
+// goodEnough reports whether NominateAggressive or
+// NominateGoodEnough can pick a pair right away.
+func (e *attemptEngine) goodEnough() bool {
+	for i := range e.attempts {
+		if !e.attempts[i].success {
+			continue
+		}
+		switch e.cfg.Nomination {
+		case NominateAggressive:
+			return true
+		case NominateGoodEnough:
+			if e.attempts[i].Prio >= e.cfg.NominationThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (e *attemptEngine) decide() error {
-	var chosenpos int
-	var chosenprio int64
+	// A public host candidate, such as a lite peer's, can have
+	// priority 0.
+	chosenpos := -1
 	for i := range e.attempts {
-		if e.attempts[i].success && e.attempts[i].Prio > chosenprio {
+		if e.attempts[i].success && (chosenpos < 0 || e.attempts[i].Prio > e.attempts[chosenpos].Prio) {
 			chosenpos = i
-			chosenprio = e.attempts[i].Prio
 		}
 	}
-	if chosenprio == 0 {
-		return errors.New("No feasible connection to peer")
+	if chosenpos < 0 {
+		return e.failedChecks("no feasible connection to peer")
 	}
 
 	// We need one final exchange over the chosen connection, to
 	// indicate to the peer that we've picked this one. That's why we
 	// expire whatever timeout there is here and now.
-	if e.cfg.Verbose {
-		log.Printf("Choosen: local %v remote %v", e.attempts[chosenpos].localaddr, e.attempts[chosenpos].Addr)
-	}
+	e.log.Info("pair chosen", "local", e.attempts[chosenpos].localaddr, "remote", e.attempts[chosenpos].Addr)
 	e.attempts[chosenpos].chosen = true
 	e.attempts[chosenpos].timeout = time.Time{}
 	return nil
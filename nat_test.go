@@ -0,0 +1,305 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/stun"
+	"github.com/danderson/nat/vnet"
+)
+
+// newTestEngine returns a controlled engine with a pair for each of
+// remotes, whose priorities follow their order.
+func newTestEngine(t *testing.T, remotes ...*net.UDPAddr) *attemptEngine {
+	sock, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	e := &attemptEngine{
+		sock:      sock,
+		cfg:       DefaultConfig(),
+		component: 1,
+		log:       nopLogger{},
+	}
+	var cands []Candidate
+	for i, addr := range remotes {
+		cands = append(cands, Candidate{Type: CandidateHost, Addr: addr, Prio: int64(i + 1)})
+	}
+	local := Credentials{Ufrag: "local", Pwd: "local-password-0123456789"}
+	remote := Credentials{Ufrag: "remote", Pwd: "remote-password-0123456789"}
+	e.setRemote(local, remote, cands, true)
+	return e
+}
+
+// peerCheck feeds e a check from the peer on attempt i.
+func peerCheck(t *testing.T, e *attemptEngine, i int, useCandidate bool) {
+	tid, err := stun.RandomTid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := stun.CheckRequest(tid, stun.ICE{
+		Username:     e.local.Ufrag + ":" + e.remote.Ufrag,
+		UseCandidate: useCandidate,
+	}, []byte(e.local.Pwd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.handle(req, e.attempts[i].Addr, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peerAnswer feeds e the peer's answer to its last check on attempt i.
+func peerAnswer(t *testing.T, e *attemptEngine, i int) {
+	resp, err := stun.BindResponse(e.attempts[i].tid, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, []byte(e.remote.Pwd), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.handle(resp, e.attempts[i].Addr, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControlledNomination(t *testing.T) {
+	low := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	high := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10}
+	e := newTestEngine(t, low, high)
+	if _, err := e.xmit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nomination of a pair we haven't validated only triggers a
+	// check.
+	peerCheck(t, e, 0, true)
+	if e.selected != nil {
+		t.Fatal("concluded on an unchecked pair")
+	}
+	if !e.attempts[0].timeout.IsZero() {
+		t.Fatal("nomination of an unchecked pair didn't trigger a check")
+	}
+	if _, err := e.xmit(); err != nil {
+		t.Fatal(err)
+	}
+	peerAnswer(t, e, 0)
+	if e.selected != &e.attempts[0] {
+		t.Fatal("didn't conclude once the nominated pair was validated")
+	}
+
+	// A validated pair isn't selected until it is nominated, and
+	// then wins if its priority is higher.
+	peerAnswer(t, e, 1)
+	if e.selected != &e.attempts[0] {
+		t.Fatal("switched to a pair that wasn't nominated")
+	}
+	peerCheck(t, e, 1, true)
+	if e.selected != &e.attempts[1] {
+		t.Fatal("didn't switch to a higher priority nomination")
+	}
+	peerCheck(t, e, 0, true)
+	if e.selected != &e.attempts[1] {
+		t.Fatal("switched to a lower priority nomination")
+	}
+}
+
+func TestLiteNomination(t *testing.T) {
+	e := newTestEngine(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	e.cfg.Lite = true
+	peerCheck(t, e, 0, false)
+	if e.selected != nil {
+		t.Fatal("concluded without a nomination")
+	}
+	// A lite peer never checks, so it trusts the nomination.
+	peerCheck(t, e, 0, true)
+	if e.selected != &e.attempts[0] {
+		t.Fatal("lite peer didn't accept the nomination")
+	}
+}
+
+func TestSprayWithoutBindAddress(t *testing.T) {
+	e := newTestEngine(t)
+	e.cfg.BindAddress = nil
+	if err := e.openSpray(2); err != nil {
+		t.Fatal(err)
+	}
+	defer e.closeSpray()
+	for _, sock := range e.spray {
+		if ip := sock.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("spray socket on %v, not with the main socket", ip)
+		}
+	}
+}
+
+func TestCheckAttributes(t *testing.T) {
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	e := newTestEngine(t, peer.LocalAddr().(*net.UDPAddr))
+	e.initiator = true
+	e.tiebreaker = 0x0123456789abcdef
+	if _, err := e.xmit(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Full ICE agents drop checks without a FINGERPRINT.
+	if typ := binary.BigEndian.Uint16(buf[n-8:]); typ != 0x8028 {
+		t.Fatalf("check ends with attribute %#x, not FINGERPRINT", typ)
+	}
+	packet, err := stun.ParsePacket(buf[:n], []byte(e.remote.Pwd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Priority != checkPriority(1) || !packet.Controlling || packet.Controlled || packet.Tiebreaker != e.tiebreaker {
+		t.Fatalf("check has priority %#x, controlling %v, controlled %v, tiebreaker %#x", packet.Priority, packet.Controlling, packet.Controlled, packet.Tiebreaker)
+	}
+}
+
+// tapConn records the STUN packets written to and read from a
+// socket.
+type tapConn struct {
+	net.PacketConn
+	mu       sync.Mutex
+	sent     [][]byte
+	received [][]byte
+}
+
+func (c *tapConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && ClassifyPacket(b[:n]) == KindSTUN {
+		c.mu.Lock()
+		c.received = append(c.received, append([]byte(nil), b[:n]...))
+		c.mu.Unlock()
+	}
+	return n, addr, err
+}
+
+func (c *tapConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ClassifyPacket(b) == KindSTUN {
+		c.mu.Lock()
+		c.sent = append(c.sent, append([]byte(nil), b...))
+		c.mu.Unlock()
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestLite(t *testing.T) {
+	clock := vnet.NewVirtualClock(time.Unix(1e9, 0))
+	stop := clock.Run(20 * time.Millisecond)
+	defer stop()
+	n := vnet.New()
+	n.Clock = clock
+	n.SetLink(vnet.LinkConfig{Latency: 20 * time.Millisecond})
+	stunAddr, err := n.AddSTUNServer(net.IPv4(1, 1, 1, 1), 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lite peer has a public address, the full one is behind a
+	// NAT.
+	public, err := n.AddHost(net.IPv4(5, 5, 5, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := n.AddNAT(net.IPv4(2, 2, 2, 2), *portRestricted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := g.AddHost(net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := func(h *vnet.Host) *Config {
+		cfg := DefaultConfig()
+		cfg.ListenPacket = h.ListenPacket
+		cfg.InterfaceAddrs = h.InterfaceAddrs
+		cfg.STUNServer = stunAddr.String()
+		cfg.Clock = clock
+		return cfg
+	}
+	liteCfg := mk(public)
+	liteCfg.Lite = true
+	var tap *tapConn
+	liteCfg.ListenPacket = func(network, address string) (net.PacketConn, error) {
+		sock, err := public.ListenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+		tap = &tapConn{PacketConn: sock}
+		return tap, nil
+	}
+
+	// Both ask to initiate, and the lite peer gives in.
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	xa, xb := testExchange()
+	cl, cf := make(chan result, 1), make(chan result, 1)
+	go func() { c, err := ConnectOpt(xa, true, liteCfg); cl <- result{c, err} }()
+	go func() { c, err := ConnectOpt(xb, true, mk(private)); cf <- result{c, err} }()
+	rl, rf := <-cl, <-cf
+	for _, r := range []result{rl, rf} {
+		if r.c != nil {
+			defer r.c.Close()
+		}
+	}
+	if rl.err != nil || rf.err != nil {
+		t.Fatalf("failed to connect: %v, %v", rl.err, rf.err)
+	}
+	lite, full := rl.c.(*Conn), rf.c.(*Conn)
+	if ls, fs := lite.Stats(), full.Stats(); ls.Initiator || !fs.Initiator {
+		t.Fatalf("lite peer initiator %v, full peer initiator %v", ls.Initiator, fs.Initiator)
+	}
+	if cands := lite.Stats().LocalCandidates; cands[CandidateServerReflexive] != 0 || cands[CandidateHost] != 1 {
+		t.Fatalf("lite peer offered %v", cands)
+	}
+	// The full peer reaches the lite one from its NAT mapping.
+	if ip := lite.RemoteAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(2, 2, 2, 2)) {
+		t.Fatalf("lite peer talks to %v", lite.RemoteAddr())
+	}
+	roundTrip(t, lite, full, clock)
+	// The full peer keeps checking consent, which the lite peer
+	// answers.
+	waitClock(clock, 2*DefaultConfig().ConsentTimeout)
+	roundTrip(t, lite, full, clock)
+
+	lite.mu.Lock()
+	pwd := lite.localCreds.Pwd
+	lite.mu.Unlock()
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	// The checks of the full peer carry its priority and the
+	// controlling role, and it nominates a pair.
+	var checks, nominations int
+	for _, raw := range tap.received {
+		p, err := stun.ParsePacket(raw, []byte(pwd))
+		if err != nil || p.Class != stun.ClassRequest {
+			continue
+		}
+		checks++
+		if p.Priority != checkPriority(1) || !p.Controlling || p.Controlled || p.Tiebreaker == 0 {
+			t.Errorf("check has priority %#x, controlling %v, controlled %v, tiebreaker %#x", p.Priority, p.Controlling, p.Controlled, p.Tiebreaker)
+		}
+		if p.UseCandidate {
+			nominations++
+		}
+	}
+	if checks == 0 || nominations == 0 {
+		t.Fatalf("received %d checks, %d nominations", checks, nominations)
+	}
+	// The lite peer only answers.
+	for _, raw := range tap.sent {
+		if class, _ := stun.PeekClass(raw); class == stun.ClassRequest {
+			t.Fatalf("lite peer sent a STUN request")
+		}
+	}
+}
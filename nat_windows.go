@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 package nat
@@ -9,21 +10,34 @@ import (
 	"syscall"
 )
 
-func setTOS(conn net.Conn, tos int) error {
-	if tos <= 0 {
-		return nil
+// Missing from the syscall package.
+const ipv6TClass = 39
+
+// setTOS sets the traffic class (DSCP and ECN bits) of the packets
+// sent on sock, to both IPv4 and IPv6 destinations. Windows only
+// honors it when the system policy allows.
+func setTOS(sock net.PacketConn, tos int) error {
+	if tos < 0 || tos > 255 {
+		return fmt.Errorf("invalid TOS %d", tos)
 	}
-	ipConn, ok := conn.(*net.IPConn)
+	sc, ok := sock.(syscall.Conn)
 	if !ok {
-		return errors.New("Failed to set TOS, connection is not an IPConn")
+		return errors.New("socket does not support socket options")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
 	}
-	f, err := ipConn.File()
+	var err4, err6 error
+	err = rc.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		err6 = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6TClass, tos)
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to set TOS, connection retrieve the fd: %v", err)
+		return err
 	}
-	defer f.Close()
-	if err := syscall.SetsockoptInt(syscall.Handle(f.Fd()), syscall.SOL_SOCKET, syscall.IP_TOS, tos); err != nil {
-		return fmt.Errorf("Failed to set TOS to %d: %v", tos, err)
+	if err4 != nil && err6 != nil {
+		return err4
 	}
 	return nil
 }
@@ -2,12 +2,20 @@
 //
 // scp nattester do.not.leak.hostnames.google.com:
 // nattester --initiator=hostname.example.com
+//
+// or, without ssh, through a rendezvous server (see cmd/rendezvous):
+//
+// nattester --rendezvous=http://rendezvous.example.com:8080
+// (prints a pairing code, then on the other host)
+// nattester --rendezvous=http://rendezvous.example.com:8080 --room=<code>
 
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"io"
@@ -19,6 +27,11 @@ import (
 	"time"
 
 	"github.com/danderson/nat"
+	"github.com/danderson/nat/dtls"
+	"github.com/danderson/nat/noise"
+	"github.com/danderson/nat/portmap"
+	"github.com/danderson/nat/rendezvous"
+	"github.com/danderson/nat/stream"
 )
 
 var (
@@ -31,7 +44,22 @@ var (
 		"If not defined use all the suitable ones")
 	blacklistAddresses = flag.String("blacklist_addresses", "", "Comma separated list of IP ranges "+
 		"(in CIDR format) to avoid using as possible candidates")
-	cmd *exec.Cmd
+	rendezvousAddr = flag.String("rendezvous", "", "Rendezvous server to signal through instead of ssh, "+
+		"as http://host:port or tcp://host:port")
+	room = flag.String("room", "", "Rendezvous room name or pairing code to join. "+
+		"If not defined, create a room and print its pairing code")
+	token       = flag.String("token", "", "Token for the rendezvous server")
+	controlling = flag.Bool("controlling", false, "Act as the initiator when joining a rendezvous room")
+	portMap     = flag.Bool("portmap", false, "Ask the gateway to forward a port with PCP, NAT-PMP or UPnP")
+	gateway     = flag.String("gateway", "", "Gateway to ask for port mappings, instead of the default gateway")
+	predict     = flag.Int("predict_ports", 0, "Number of NAT port predictions to offer as candidates")
+	spray       = flag.Int("spray_sockets", 0, "Number of extra sockets to send checks from")
+	budget      = flag.Int("punch_budget", 0, "Maximum checks to send per probe timeout, 0 for no limit")
+	lite        = flag.Bool("lite", false, "Run ICE-lite, for a host with a public address")
+	secure      = flag.Bool("secure", false, "Encrypt the connection with DTLS")
+	useNoise    = flag.Bool("noise", false, "Encrypt the connection with Noise IK")
+	useStream   = flag.Bool("stream", false, "Echo over a reliable stream instead of datagrams")
+	cmd         *exec.Cmd
 )
 
 func xchangeCandidates(mine []byte) []byte {
@@ -107,13 +135,92 @@ func main() {
 		}
 		cfg.BlacklistAddresses = addrs
 	}
-	conn, err := nat.ConnectOpt(xchangeCandidates, *initiator != "", cfg)
+	if *portMap {
+		cfg.PortMapper = &portmap.Client{}
+		if *gateway != "" {
+			cfg.PortMapper.Gateway = net.ParseIP(*gateway)
+			if cfg.PortMapper.Gateway == nil {
+				log.Fatalf("Malformed gateway address %q", *gateway)
+			}
+		}
+	}
+	cfg.PredictPorts = *predict
+	cfg.SpraySockets = *spray
+	cfg.PunchBudget = *budget
+	cfg.Lite = *lite
+	if *secure {
+		cert, err := dtls.GenerateCertificate()
+		if err != nil {
+			log.Fatalf("Cannot generate certificate: %v", err)
+		}
+		cfg.Certificate = &cert
+	}
+	if *useNoise {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("Cannot generate Noise key: %v", err)
+		}
+		cfg.Noise = &noise.Config{StaticKey: key}
+	}
+	var (
+		conn      net.Conn
+		err       error
+		initiates = *initiator != ""
+	)
+	if *rendezvousAddr != "" {
+		// The peer creating the room initiates, the one joining it
+		// with the pairing code doesn't unless told otherwise.
+		initiates = *room == "" || *controlling
+		var client rendezvous.Client
+		client, err = rendezvous.Join(*rendezvousAddr, rendezvous.NormalizeRoom(*room), *token)
+		if err != nil {
+			log.Fatalf("Cannot join rendezvous room: %v", err)
+		}
+		defer client.Close()
+		if *room == "" {
+			log.Printf("Pairing code: %s", client.Room())
+		}
+		conn, err = nat.ConnectSignaler(client, initiates, cfg)
+	} else {
+		conn, err = nat.ConnectOpt(xchangeCandidates, initiates, cfg)
+	}
 	if err != nil {
+		if ne, ok := err.(*nat.NegotiationError); ok {
+			log.Printf("Negotiation report:\n%s", ne.Stats)
+		}
 		log.Fatalf("NO CARRIER: %v\n", err)
 	}
+	if *secure {
+		dc, err := conn.(*nat.Conn).Secure()
+		if err != nil {
+			log.Fatalf("NO CARRIER: %v\n", err)
+		}
+		log.Printf("Peer certificate: %s", dtls.Fingerprint(dc.PeerCertificate().Raw))
+		conn = dc
+	} else if *useNoise {
+		nc, err := conn.(*nat.Conn).SecureNoise()
+		if err != nil {
+			log.Fatalf("NO CARRIER: %v\n", err)
+		}
+		log.Printf("Peer Noise key: %x", nc.PeerKey())
+		conn = nc
+	}
+	if *useStream {
+		s := stream.NewSession(conn, initiates, nil)
+		var st *stream.Stream
+		if initiates {
+			st, err = s.Open()
+		} else {
+			st, err = s.Accept()
+		}
+		if err != nil {
+			log.Fatalf("NO CARRIER: %v\n", err)
+		}
+		conn = st
+	}
 	log.Println("CONNECT 9600")
 	conn.SetDeadline(time.Now().Add(10 * time.Second))
-	if *initiator == "" {
+	if !initiates {
 		// Poor man's echo sever
 		io.Copy(conn, conn)
 		return
@@ -125,7 +232,7 @@ func main() {
 			break
 		}
 		recv := make([]byte, len(*testString))
-		if _, err := conn.Read(recv); err != nil {
+		if _, err := io.ReadFull(conn, recv); err != nil {
 			log.Printf("NO CARRIER: %v\n", err)
 			break
 		}
@@ -136,6 +243,8 @@ func main() {
 			break
 		}
 	}
-	cmd.Process.Kill()
+	if cmd != nil {
+		cmd.Process.Kill()
+	}
 	os.Exit(ret)
 }
@@ -0,0 +1,505 @@
+// Package noise secures a datagram connection with the Noise protocol
+// framework (https://noiseprotocol.org), as a lighter alternative to
+// DTLS for small devices.
+//
+// It speaks Noise_IK_25519_AESGCM_SHA256 and
+// Noise_XX_25519_AESGCM_SHA256. Peers are identified by their static
+// X25519 keys, which they exchange or pin out of band. Transport
+// messages carry their nonce, like in WireGuard, so that they survive
+// loss and reordering, and the keys are rotated every 2^20 messages.
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config configures a Conn.
+type Config struct {
+	// Pattern is the handshake pattern. Both peers must use the
+	// same.
+	Pattern Pattern
+	// StaticKey is our static X25519 key. It is required.
+	StaticKey *ecdh.PrivateKey
+	// PeerKey is the static public key of the peer. It is required
+	// by the IK initiator, and when set the handshake fails if the
+	// peer has another key.
+	PeerKey []byte
+	// VerifyPeer, if set, is called with the static key of the
+	// peer, and fails the handshake if it returns an error. Either
+	// PeerKey or VerifyPeer must be set.
+	VerifyPeer func(key []byte) error
+	// Prologue is data both peers must agree on, e.g. the signaling
+	// messages they exchanged. The handshake fails if it differs.
+	Prologue []byte
+	// HandshakeTimeout bounds the handshake. Zero means 30 seconds.
+	HandshakeTimeout time.Duration
+	// Now, if set, replaces time.Now for the retransmission timers,
+	// and must follow the clock of the underlying conn's deadlines.
+	Now func() time.Time
+}
+
+func (c *Config) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) check(initiator bool) error {
+	switch {
+	case c.Pattern != IK && c.Pattern != XX:
+		return errors.New("noise: unknown pattern")
+	case c.StaticKey == nil || c.StaticKey.Curve() != ecdh.X25519():
+		return errors.New("noise: the static key must be an X25519 key")
+	case c.PeerKey != nil && len(c.PeerKey) != keyLen:
+		return errors.New("noise: malformed peer key")
+	case c.PeerKey == nil && c.VerifyPeer == nil:
+		return errors.New("noise: no PeerKey or VerifyPeer")
+	case c.Pattern == IK && initiator && c.PeerKey == nil:
+		return errors.New("noise: the IK initiator needs the PeerKey")
+	}
+	return nil
+}
+
+// Message types, in the first byte of a 4 byte header as in
+// WireGuard. Handshake messages are numbered from 1.
+const (
+	headerLen     = 4
+	typeTransport = 4
+	counterLen    = 8
+	// maxEarly bounds the transport messages kept during the
+	// handshake.
+	maxEarly = 64
+)
+
+const (
+	// rekeyAfter is the number of messages sent under each key.
+	rekeyAfter = 1 << 20
+	// Retransmission timer bounds of the handshake.
+	initialRetransmit = time.Second
+	maxRetransmit     = 60 * time.Second
+)
+
+var errHandshakeTimeout = errors.New("noise: handshake timed out")
+
+// Conn is a Noise session over a datagram net.Conn, e.g. a *nat.Conn.
+// Each Write sends a datagram, and each Read returns one.
+type Conn struct {
+	conn      net.Conn
+	cfg       *Config
+	initiator bool
+
+	hsMu   sync.Mutex
+	hsDone bool
+	hsErr  error
+	// last is our last handshake message, kept to answer the peer
+	// if it didn't get it. lastIdx is its index, and peerIdx the
+	// index of the peer's last message.
+	last    []byte
+	lastIdx int
+	peerIdx int
+
+	// Read side, owned by the handshake until it's done.
+	rmu            sync.Mutex
+	recv, recvPrev *cipherState
+	recvGen        uint64
+	replay         replayWindow
+	buf, plaintext []byte
+	// early holds the transport messages received before the end of
+	// the handshake.
+	early [][]byte
+
+	// Write side.
+	wmu     sync.Mutex
+	send    *cipherState
+	sendCtr uint64
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	handshaking  bool // the handshake owns the read deadline
+	closed       bool
+	peerKey      []byte
+}
+
+// Initiator returns a Conn that runs the initiator side of the
+// handshake over conn. The handshake happens on the first Read or
+// Write, or when Handshake is called.
+func Initiator(conn net.Conn, cfg *Config) *Conn {
+	return newConn(conn, cfg, true)
+}
+
+// Responder is like Initiator, for the responding side. Once its
+// handshake is done, the responder answers the initiator's
+// retransmissions from Read, so it must keep reading for the initiator
+// to finish if the responder's last message gets lost.
+func Responder(conn net.Conn, cfg *Config) *Conn {
+	return newConn(conn, cfg, false)
+}
+
+func newConn(conn net.Conn, cfg *Config, initiator bool) *Conn {
+	return &Conn{
+		conn:      conn,
+		cfg:       cfg,
+		initiator: initiator,
+		buf:       make([]byte, 65536),
+		plaintext: make([]byte, 65536),
+		lastIdx:   -1,
+		peerIdx:   -1,
+	}
+}
+
+// Handshake runs the handshake if it hasn't run yet, and returns its
+// outcome.
+func (c *Conn) Handshake() error {
+	c.hsMu.Lock()
+	defer c.hsMu.Unlock()
+	if c.hsDone {
+		return c.hsErr
+	}
+	c.hsDone = true
+	if c.hsErr = c.cfg.check(c.initiator); c.hsErr != nil {
+		return c.hsErr
+	}
+	c.mu.Lock()
+	c.handshaking = true
+	c.mu.Unlock()
+	c.hsErr = c.handshake()
+	c.mu.Lock()
+	c.handshaking = false
+	c.conn.SetReadDeadline(c.readDeadline)
+	c.mu.Unlock()
+	return c.hsErr
+}
+
+func (c *Conn) handshake() error {
+	var rs []byte
+	if c.cfg.Pattern == IK && c.initiator {
+		// The IK initiator knows the peer's key already.
+		rs = c.cfg.PeerKey
+		if err := c.verify(rs); err != nil {
+			return err
+		}
+	}
+	hs := newHandshakeState(c.cfg.Pattern, c.initiator, c.cfg.StaticKey, rs, c.cfg.Prologue)
+	deadline := c.cfg.now().Add(c.cfg.handshakeTimeout())
+	var retransmitAt time.Time
+	timeout := initialRetransmit
+	for i := range hs.msgs {
+		if (i%2 == 0) == c.initiator {
+			b, err := hs.writeMessage(i, nil)
+			if err != nil {
+				return err
+			}
+			c.last = append([]byte{byte(i + 1), 0, 0, 0}, b...)
+			c.lastIdx = i
+			if _, err := c.conn.Write(c.last); err != nil {
+				return err
+			}
+			timeout = initialRetransmit
+			retransmitAt = c.cfg.now().Add(timeout)
+			continue
+		}
+
+		for {
+			c.mu.Lock()
+			userDeadline := c.readDeadline
+			c.mu.Unlock()
+			now := c.cfg.now()
+			if !now.Before(deadline) {
+				return errHandshakeTimeout
+			}
+			if !userDeadline.IsZero() && !now.Before(userDeadline) {
+				return os.ErrDeadlineExceeded
+			}
+			if c.last != nil && !now.Before(retransmitAt) {
+				if _, err := c.conn.Write(c.last); err != nil {
+					return err
+				}
+				if timeout *= 2; timeout > maxRetransmit {
+					timeout = maxRetransmit
+				}
+				retransmitAt = now.Add(timeout)
+			}
+			d := deadline
+			if c.last != nil && retransmitAt.Before(d) {
+				d = retransmitAt
+			}
+			if !userDeadline.IsZero() && userDeadline.Before(d) {
+				d = userDeadline
+			}
+			c.conn.SetReadDeadline(d)
+			n, err := c.conn.Read(c.buf)
+			if err != nil {
+				if isTimeout(err) {
+					continue
+				}
+				return err
+			}
+			if n > 0 && c.buf[0] == typeTransport && i == len(hs.msgs)-1 && len(c.early) < maxEarly {
+				// The peer is done, and its first messages
+				// overtook its last handshake message.
+				c.early = append(c.early, append([]byte(nil), c.buf[:n]...))
+				continue
+			}
+			idx, ok := c.handshakeIndex(c.buf[:n])
+			if !ok || idx > i {
+				continue
+			}
+			if idx < i {
+				if c.last != nil {
+					// The peer missed our last message.
+					c.conn.Write(c.last)
+				}
+				continue
+			}
+			try := hs
+			// Our handshake messages carry no payload.
+			if payload, err := try.readMessage(i, c.buf[headerLen:n]); err != nil || len(payload) != 0 {
+				// Not from the peer, or corrupted.
+				continue
+			}
+			if try.rs != nil && hs.rs == nil {
+				if err := c.verify(try.rs); err != nil {
+					return err
+				}
+			}
+			hs = try
+			c.peerIdx = i
+			break
+		}
+	}
+
+	c1, c2 := hs.split()
+	if !c.initiator {
+		c1, c2 = c2, c1
+	}
+	c.recv = c2
+	c.wmu.Lock()
+	c.send = c1
+	c.wmu.Unlock()
+	c.mu.Lock()
+	c.peerKey = hs.rs
+	c.mu.Unlock()
+	return nil
+}
+
+// handshakeIndex returns the index of the handshake message in b, if
+// it is one.
+func (c *Conn) handshakeIndex(b []byte) (int, bool) {
+	if len(b) < headerLen || b[0] == 0 || b[0] >= typeTransport || b[1]|b[2]|b[3] != 0 {
+		return 0, false
+	}
+	return int(b[0]) - 1, true
+}
+
+func (c *Conn) verify(key []byte) error {
+	if c.cfg.PeerKey != nil && !bytes.Equal(key, c.cfg.PeerKey) {
+		return errors.New("noise: the peer has the wrong static key")
+	}
+	if c.cfg.VerifyPeer != nil {
+		if err := c.cfg.VerifyPeer(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PeerKey returns the static public key of the peer, once the
+// handshake succeeded.
+func (c *Conn) PeerKey() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerKey
+}
+
+// Read reads a datagram from the peer into b. A datagram longer than
+// b is truncated.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.early) > 0 {
+		msg := c.early[0]
+		c.early = c.early[1:]
+		if p, ok := c.open(msg); ok {
+			return copy(b, p), nil
+		}
+	}
+	for {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if p, ok := c.open(c.buf[:n]); ok {
+			return copy(b, p), nil
+		}
+		if idx, ok := c.handshakeIndex(c.buf[:n]); ok && idx == c.peerIdx && c.lastIdx > idx {
+			// The peer missed our last message.
+			c.conn.Write(c.last)
+		}
+	}
+}
+
+// open returns the plaintext of the transport message b, if it is
+// valid and new.
+func (c *Conn) open(b []byte) ([]byte, bool) {
+	if len(b) < headerLen+counterLen+tagLen || b[0] != typeTransport || b[1]|b[2]|b[3] != 0 {
+		return nil, false
+	}
+	ctr := binary.LittleEndian.Uint64(b[headerLen:])
+	if !c.replay.fresh(ctr) {
+		return nil, false
+	}
+	var cs *cipherState
+	switch gen := ctr / rekeyAfter; {
+	case gen == c.recvGen:
+		cs = c.recv
+	case gen+1 == c.recvGen:
+		cs = c.recvPrev
+	case gen == c.recvGen+1:
+		// The peer moved to its next key. Keys further ahead
+		// would cost us work before authenticating anything.
+		cs = c.recv.rekey()
+	}
+	if cs == nil {
+		return nil, false
+	}
+	p, err := cs.open(c.plaintext[:0], ctr, b[:headerLen+counterLen], b[headerLen+counterLen:])
+	if err != nil {
+		return nil, false
+	}
+	c.replay.mark(ctr)
+	if cs != c.recv && cs != c.recvPrev {
+		c.recvPrev, c.recv = c.recv, cs
+		c.recvGen++
+	}
+	return p, true
+}
+
+// Write sends b to the peer in a single message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	c.wmu.Lock()
+	ctr := c.sendCtr
+	if ctr > 0 && ctr%rekeyAfter == 0 {
+		c.send = c.send.rekey()
+	}
+	c.sendCtr++
+	msg := make([]byte, headerLen+counterLen, headerLen+counterLen+len(b)+tagLen)
+	msg[0] = typeTransport
+	binary.LittleEndian.PutUint64(msg[headerLen:], ctr)
+	msg = c.send.seal(msg, ctr, msg, b)
+	c.wmu.Unlock()
+	if _, err := c.conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying conn.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of Read, and of the handshake.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	// The handshake sets its own deadlines, and restores this one
+	// when it's done.
+	if c.handshaking {
+		return nil
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// A replayWindow remembers the last 64 counters received, to drop
+// replayed messages.
+type replayWindow struct {
+	seen   bool
+	latest uint64
+	mask   uint64 // bit i is latest-i
+}
+
+// fresh reports whether ctr wasn't received yet.
+func (w *replayWindow) fresh(ctr uint64) bool {
+	if !w.seen || ctr > w.latest {
+		return true
+	}
+	d := w.latest - ctr
+	return d < 64 && w.mask&(1<<d) == 0
+}
+
+// mark records ctr as received. Only authenticated messages must be
+// marked.
+func (w *replayWindow) mark(ctr uint64) {
+	switch {
+	case !w.seen:
+		w.seen, w.latest, w.mask = true, ctr, 1
+	case ctr > w.latest:
+		if d := ctr - w.latest; d < 64 {
+			w.mask = w.mask<<d | 1
+		} else {
+			w.mask = 1
+		}
+		w.latest = ctr
+	default:
+		w.mask |= 1 << (w.latest - ctr)
+	}
+}
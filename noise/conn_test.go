@@ -0,0 +1,348 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A filterConn drops the datagrams that drop returns true for.
+type filterConn struct {
+	net.Conn
+	mu   sync.Mutex
+	drop func(b []byte) bool
+}
+
+func (c *filterConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	drop := c.drop != nil && c.drop(b)
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// lossy returns a drop function that loses a fraction of the
+// datagrams.
+func lossy(seed int64, loss float64) func([]byte) bool {
+	rng := mrand.New(mrand.NewSource(seed))
+	return func([]byte) bool { return rng.Float64() < loss }
+}
+
+// udpPair returns two UDP conns connected to each other.
+func udpPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	var addrs []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, c.LocalAddr().(*net.UDPAddr))
+		c.Close()
+	}
+	a, err := net.DialUDP("udp4", addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.DialUDP("udp4", addrs[1], addrs[0])
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func testKey(t *testing.T) *ecdh.PrivateKey {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// testConfigs returns the configs of an initiator with key ki and a
+// responder with key kr, which pin each other's key.
+func testConfigs(p Pattern, ki, kr *ecdh.PrivateKey) (*Config, *Config) {
+	ci := &Config{Pattern: p, StaticKey: ki, PeerKey: kr.PublicKey().Bytes(), Prologue: []byte("signals"), HandshakeTimeout: 60 * time.Second}
+	cr := &Config{Pattern: p, StaticKey: kr, PeerKey: ki.PublicKey().Bytes(), Prologue: []byte("signals"), HandshakeTimeout: 60 * time.Second}
+	return ci, cr
+}
+
+// runHandshake runs the handshake of initiator and responder, and
+// returns their errors.
+func runHandshake(initiator, responder *Conn) (error, error) {
+	errs := make(chan error, 1)
+	go func() { errs <- responder.Handshake() }()
+	ierr := initiator.Handshake()
+	return ierr, <-errs
+}
+
+// echo sends msg from a to b, and checks it arrives intact.
+func echo(t *testing.T, a, b *Conn, msg []byte) {
+	t.Helper()
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2000)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("read %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ki, kr := testKey(t), testKey(t)
+	for _, p := range []Pattern{IK, XX} {
+		for _, loss := range []float64{0, 0.3} {
+			t.Run(fmt.Sprintf("%s/%v", p, loss), func(t *testing.T) {
+				if loss > 0 {
+					t.Parallel()
+				}
+				ua, ub := udpPair(t)
+				cfgi, cfgr := testConfigs(p, ki, kr)
+				if p == XX {
+					// XX learns the key of the initiator.
+					cfgr.PeerKey = nil
+					cfgr.VerifyPeer = func(key []byte) error {
+						if !bytes.Equal(key, ki.PublicKey().Bytes()) {
+							return errors.New("unknown key")
+						}
+						return nil
+					}
+				}
+				ci := Initiator(&filterConn{Conn: ua, drop: lossy(1, loss)}, cfgi)
+				cr := Responder(&filterConn{Conn: ub, drop: lossy(2, loss)}, cfgr)
+				defer ci.Close()
+				defer cr.Close()
+				if loss > 0 {
+					lossyHandshake(t, ci, cr)
+				} else if ierr, rerr := runHandshake(ci, cr); ierr != nil || rerr != nil {
+					t.Fatalf("handshake failed: %v, %v", ierr, rerr)
+				}
+				if !bytes.Equal(ci.PeerKey(), kr.PublicKey().Bytes()) || !bytes.Equal(cr.PeerKey(), ki.PublicKey().Bytes()) {
+					t.Fatal("wrong peer keys")
+				}
+				if loss == 0 {
+					echo(t, ci, cr, bytes.Repeat([]byte("i"), 1000))
+					echo(t, cr, ci, []byte("r"))
+				}
+			})
+		}
+	}
+}
+
+// lossyHandshake runs the handshake of initiator and responder over
+// a lossy link. The peer that is done first reads, to answer the
+// retransmissions of the other, until they exchanged a message each
+// way.
+func lossyHandshake(t *testing.T, initiator, responder *Conn) {
+	errs := make(chan error, 2)
+	for _, c := range []*Conn{initiator, responder} {
+		c := c
+		go func() {
+			if err := c.Handshake(); err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, 100)
+			for {
+				if _, err := c.Write([]byte("ping")); err != nil {
+					errs <- err
+					return
+				}
+				c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				n, err := c.Read(buf)
+				if err == nil && string(buf[:n]) == "ping" {
+					break
+				}
+				if err != nil && !isTimeout(err) {
+					errs <- err
+					return
+				}
+			}
+			// The peer may still need our pings.
+			for i := 0; i < 10; i++ {
+				c.Write([]byte("ping"))
+			}
+			c.SetReadDeadline(time.Time{})
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	ki, kr, other := testKey(t), testKey(t), testKey(t)
+	for _, tc := range []struct {
+		name string
+		edit func(ci, cr *Config)
+	}{
+		{"IK wrong initiator key", func(ci, cr *Config) { cr.PeerKey = other.PublicKey().Bytes() }},
+		{"XX wrong responder key", func(ci, cr *Config) { ci.Pattern, cr.Pattern, ci.PeerKey = XX, XX, other.PublicKey().Bytes() }},
+		{"prologue", func(ci, cr *Config) { ci.Prologue = []byte("other signals") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ua, ub := udpPair(t)
+			cfgi, cfgr := testConfigs(IK, ki, kr)
+			cfgi.HandshakeTimeout, cfgr.HandshakeTimeout = 2*time.Second, 2*time.Second
+			tc.edit(cfgi, cfgr)
+			ci, cr := Initiator(ua, cfgi), Responder(ub, cfgr)
+			defer ci.Close()
+			defer cr.Close()
+			if ierr, rerr := runHandshake(ci, cr); ierr == nil && rerr == nil {
+				t.Fatal("handshake succeeded")
+			}
+		})
+	}
+}
+
+func TestRetransmitLastMessage(t *testing.T) {
+	ki, kr := testKey(t), testKey(t)
+	ua, ub := udpPair(t)
+	cfgi, cfgr := testConfigs(IK, ki, kr)
+	ci := Initiator(ua, cfgi)
+	// The responder is done once it sent its message, which the
+	// initiator never gets the first time.
+	dropped := false
+	cr := Responder(&filterConn{Conn: ub, drop: func(b []byte) bool {
+		if b[0] == 2 && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}}, cfgr)
+	defer ci.Close()
+	defer cr.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		if err := cr.Handshake(); err != nil {
+			errs <- err
+			return
+		}
+		// Read answers the retransmissions of the initiator.
+		cr.SetReadDeadline(time.Now().Add(30 * time.Second))
+		buf := make([]byte, 100)
+		n, err := cr.Read(buf)
+		if err == nil && string(buf[:n]) != "done" {
+			err = fmt.Errorf("read %q", buf[:n])
+		}
+		errs <- err
+	}()
+	if err := ci.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ci.Write([]byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !dropped {
+		t.Fatal("the responder's message wasn't lost")
+	}
+}
+
+// connectedPair returns an initiator and a responder done with their
+// handshake. The initiator's datagrams go through drop.
+func connectedPair(t *testing.T, drop func([]byte) bool) (ci, cr *Conn, ua *net.UDPConn) {
+	ki, kr := testKey(t), testKey(t)
+	ua, ub := udpPair(t)
+	cfgi, cfgr := testConfigs(IK, ki, kr)
+	ci = Initiator(&filterConn{Conn: ua, drop: drop}, cfgi)
+	cr = Responder(ub, cfgr)
+	t.Cleanup(func() {
+		ci.Close()
+		cr.Close()
+	})
+	if ierr, rerr := runHandshake(ci, cr); ierr != nil || rerr != nil {
+		t.Fatalf("handshake failed: %v, %v", ierr, rerr)
+	}
+	return ci, cr, ua
+}
+
+// noRead checks that c has nothing to read.
+func noRead(t *testing.T, c *Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := c.Read(make([]byte, 100)); err == nil {
+		t.Fatalf("read %d bytes", n)
+	}
+	c.SetReadDeadline(time.Time{})
+}
+
+func TestReplay(t *testing.T) {
+	var last []byte
+	ci, cr, ua := connectedPair(t, func(b []byte) bool {
+		last = append(last[:0], b...)
+		return false
+	})
+	echo(t, ci, cr, []byte("once"))
+	if _, err := ua.Write(last); err != nil {
+		t.Fatal(err)
+	}
+	noRead(t, cr)
+	echo(t, ci, cr, []byte("twice"))
+}
+
+func TestRekey(t *testing.T) {
+	var held []byte
+	hold := false
+	ci, cr, ua := connectedPair(t, func(b []byte) bool {
+		if hold {
+			held, hold = append([]byte(nil), b...), false
+			return true
+		}
+		return false
+	})
+	setCtr := func(ctr uint64) {
+		ci.wmu.Lock()
+		ci.sendCtr = ctr
+		ci.wmu.Unlock()
+	}
+
+	// The last message of the first key gets overtaken by the first
+	// of the next key, and still arrives.
+	setCtr(rekeyAfter - 1)
+	hold = true
+	if _, err := ci.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, ci, cr, []byte("next key"))
+	if cr.recvGen != 1 {
+		t.Fatalf("responder at generation %d, want 1", cr.recvGen)
+	}
+	if _, err := ua.Write(held); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	cr.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := cr.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	// Keys more than one generation ahead are not tried.
+	setCtr(3*rekeyAfter + 1)
+	if _, err := ci.Write([]byte("too far")); err != nil {
+		t.Fatal(err)
+	}
+	noRead(t, cr)
+	setCtr(rekeyAfter + 1)
+	echo(t, ci, cr, []byte("back"))
+}
@@ -0,0 +1,312 @@
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Pattern is a Noise handshake pattern.
+type Pattern int
+
+const (
+	// IK completes in a single round trip, but the initiator must
+	// know the responder's static key beforehand.
+	IK Pattern = iota
+	// XX takes a round trip and a half, and both peers learn each
+	// other's static key during the handshake.
+	XX
+)
+
+func (p Pattern) String() string {
+	switch p {
+	case IK:
+		return "IK"
+	case XX:
+		return "XX"
+	}
+	return "unknown"
+}
+
+// Tokens of the handshake patterns.
+const (
+	tokE = iota
+	tokS
+	tokEE
+	tokES
+	tokSE
+	tokSS
+)
+
+// messages returns the tokens of each message of p, and whether the
+// responder's static key is known beforehand.
+func (p Pattern) messages() (msgs [][]int, preResponder bool) {
+	switch p {
+	case IK:
+		return [][]int{{tokE, tokES, tokS, tokSS}, {tokE, tokEE, tokSE}}, true
+	case XX:
+		return [][]int{{tokE}, {tokE, tokEE, tokS, tokES}, {tokS, tokSE}}, false
+	}
+	return nil, false
+}
+
+const (
+	keyLen = 32
+	tagLen = 16
+)
+
+var errDecrypt = errors.New("noise: message authentication failed")
+
+// A cipherState encrypts with AES-256-GCM under one key, with an
+// explicit nonce.
+type cipherState struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newCipherState(key []byte) *cipherState {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // key is always keyLen bytes
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &cipherState{key: key, aead: aead}
+}
+
+func nonce(n uint64) []byte {
+	var ret [12]byte
+	binary.BigEndian.PutUint64(ret[4:], n)
+	return ret[:]
+}
+
+func (c *cipherState) seal(dst []byte, n uint64, ad, plaintext []byte) []byte {
+	return c.aead.Seal(dst, nonce(n), plaintext, ad)
+}
+
+func (c *cipherState) open(dst []byte, n uint64, ad, ciphertext []byte) ([]byte, error) {
+	ret, err := c.aead.Open(dst, nonce(n), ciphertext, ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return ret, nil
+}
+
+// rekey returns the cipherState of the next key, as defined by the
+// Noise specification.
+func (c *cipherState) rekey() *cipherState {
+	var zeros [keyLen]byte
+	return newCipherState(c.seal(nil, math.MaxUint64, nil, zeros[:])[:keyLen])
+}
+
+// hkdf is the HKDF of the Noise specification, returning two keys.
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+// handshakeState runs a Noise handshake. It is a value, so that a
+// message that fails to decrypt can be tried on a copy and
+// discarded.
+type handshakeState struct {
+	initiator bool
+	msgs      [][]int
+
+	// The symmetric state.
+	ck, h []byte
+	k     *cipherState
+	n     uint64
+
+	s      *ecdh.PrivateKey
+	e      *ecdh.PrivateKey
+	rs, re []byte
+}
+
+func newHandshakeState(p Pattern, initiator bool, s *ecdh.PrivateKey, rs, prologue []byte) handshakeState {
+	msgs, preResponder := p.messages()
+	name := []byte("Noise_" + p.String() + "_25519_AESGCM_SHA256")
+	var h []byte
+	if len(name) <= sha256.Size {
+		h = make([]byte, sha256.Size)
+		copy(h, name)
+	} else {
+		sum := sha256.Sum256(name)
+		h = sum[:]
+	}
+	hs := handshakeState{
+		initiator: initiator,
+		msgs:      msgs,
+		ck:        h,
+		h:         h,
+		s:         s,
+		rs:        rs,
+	}
+	hs.mixHash(prologue)
+	if preResponder {
+		if initiator {
+			hs.mixHash(rs)
+		} else {
+			hs.mixHash(s.PublicKey().Bytes())
+		}
+	}
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(hs.h)
+	sum.Write(data)
+	hs.h = sum.Sum(nil)
+}
+
+func (hs *handshakeState) mixKey(ikm []byte) {
+	var k []byte
+	hs.ck, k = hkdf(hs.ck, ikm)
+	hs.k, hs.n = newCipherState(k), 0
+}
+
+func (hs *handshakeState) encryptAndHash(dst, plaintext []byte) []byte {
+	start := len(dst)
+	if hs.k == nil {
+		dst = append(dst, plaintext...)
+	} else {
+		dst = hs.k.seal(dst, hs.n, hs.h, plaintext)
+		hs.n++
+	}
+	hs.mixHash(dst[start:])
+	return dst
+}
+
+func (hs *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if hs.k != nil {
+		var err error
+		if plaintext, err = hs.k.open(nil, hs.n, hs.h, ciphertext); err != nil {
+			return nil, err
+		}
+		hs.n++
+	}
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// dh mixes the Diffie-Hellman of the keys named by tok.
+func (hs *handshakeState) dh(tok int) error {
+	var local *ecdh.PrivateKey
+	var remote []byte
+	// es is the initiator's e with the responder's s, and so on.
+	first, second := tok == tokEE || tok == tokES, tok == tokEE || tok == tokSE
+	if hs.initiator {
+		local, remote = hs.pick(first, second)
+	} else {
+		local, remote = hs.pick(second, first)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return err
+	}
+	secret, err := local.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	hs.mixKey(secret)
+	return nil
+}
+
+// pick returns our ephemeral or static key, and the peer's.
+func (hs *handshakeState) pick(localEphemeral, remoteEphemeral bool) (*ecdh.PrivateKey, []byte) {
+	local, remote := hs.s, hs.rs
+	if localEphemeral {
+		local = hs.e
+	}
+	if remoteEphemeral {
+		remote = hs.re
+	}
+	return local, remote
+}
+
+// writeMessage returns message i of the handshake, carrying payload.
+// Our ephemeral key is generated unless hs.e is already set.
+func (hs *handshakeState) writeMessage(i int, payload []byte) ([]byte, error) {
+	var b []byte
+	for _, tok := range hs.msgs[i] {
+		switch tok {
+		case tokE:
+			if hs.e == nil {
+				e, err := ecdh.X25519().GenerateKey(rand.Reader)
+				if err != nil {
+					return nil, err
+				}
+				hs.e = e
+			}
+			e := hs.e
+			b = append(b, e.PublicKey().Bytes()...)
+			hs.mixHash(e.PublicKey().Bytes())
+		case tokS:
+			b = hs.encryptAndHash(b, hs.s.PublicKey().Bytes())
+		default:
+			if err := hs.dh(tok); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hs.encryptAndHash(b, payload), nil
+}
+
+// readMessage processes message i of the handshake, and returns its
+// payload. It leaves hs in an unspecified state if b is not valid.
+func (hs *handshakeState) readMessage(i int, b []byte) ([]byte, error) {
+	for _, tok := range hs.msgs[i] {
+		switch tok {
+		case tokE:
+			if len(b) < keyLen {
+				return nil, errDecrypt
+			}
+			hs.re = append([]byte(nil), b[:keyLen]...)
+			b = b[keyLen:]
+			hs.mixHash(hs.re)
+		case tokS:
+			n := keyLen
+			if hs.k != nil {
+				n += tagLen
+			}
+			if len(b) < n {
+				return nil, errDecrypt
+			}
+			rs, err := hs.decryptAndHash(b[:n])
+			if err != nil {
+				return nil, err
+			}
+			hs.rs = rs
+			b = b[n:]
+		default:
+			if err := hs.dh(tok); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hs.decryptAndHash(b)
+}
+
+// split returns the cipherStates of the initiator to responder and
+// responder to initiator directions.
+func (hs *handshakeState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(hs.ck, nil)
+	return newCipherState(k1), newCipherState(k2)
+}
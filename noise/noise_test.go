@@ -0,0 +1,177 @@
+package noise
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A vector is a test vector in the format of the cacophony and
+// flynn/noise vectors.
+type vector struct {
+	pattern  Pattern
+	initS    *ecdh.PrivateKey
+	respS    *ecdh.PrivateKey
+	initE    *ecdh.PrivateKey
+	respE    *ecdh.PrivateKey
+	prologue []byte
+	payloads [][]byte
+	msgs     [][]byte
+}
+
+func readVectors(t *testing.T) []vector {
+	f, err := os.Open("testdata/vectors.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ret []vector
+	var v *vector
+	key := func(s string) *ecdh.PrivateKey {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, val, ok := strings.Cut(line, "=")
+		if !ok {
+			t.Fatalf("bad vector line %q", line)
+		}
+		switch {
+		case k == "handshake":
+			ret = append(ret, vector{})
+			v = &ret[len(ret)-1]
+			switch val {
+			case "Noise_IK_25519_AESGCM_SHA256":
+				v.pattern = IK
+			case "Noise_XX_25519_AESGCM_SHA256":
+				v.pattern = XX
+			default:
+				t.Fatalf("unsupported handshake %s", val)
+			}
+		case k == "init_static":
+			v.initS = key(val)
+		case k == "resp_static":
+			v.respS = key(val)
+		case k == "gen_init_ephemeral":
+			v.initE = key(val)
+		case k == "gen_resp_ephemeral":
+			v.respE = key(val)
+		case k == "prologue" || strings.HasSuffix(k, "_payload") || strings.HasSuffix(k, "_ciphertext"):
+			b, err := hex.DecodeString(val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case k == "prologue":
+				v.prologue = b
+			case strings.HasSuffix(k, "_payload"):
+				v.payloads = append(v.payloads, b)
+			default:
+				v.msgs = append(v.msgs, b)
+			}
+		default:
+			t.Fatalf("unknown vector key %q", k)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestVectors(t *testing.T) {
+	vectors := readVectors(t)
+	if len(vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+	for n, v := range vectors {
+		var rs []byte
+		if v.pattern == IK {
+			rs = v.respS.PublicKey().Bytes()
+		}
+		init := newHandshakeState(v.pattern, true, v.initS, rs, v.prologue)
+		resp := newHandshakeState(v.pattern, false, v.respS, nil, v.prologue)
+		init.e, resp.e = v.initE, v.respE
+		// The handshake messages alternate between the peers, and so
+		// do the transport messages, starting with the initiator.
+		var c1, c2 *cipherState
+		var n1, n2 uint64
+		for i := range v.msgs {
+			var got []byte
+			var err error
+			send, recv := &init, &resp
+			if i%2 == 1 {
+				send, recv = recv, send
+			}
+			if i < len(init.msgs) {
+				if got, err = send.writeMessage(i, v.payloads[i]); err != nil {
+					t.Fatal(n, i, err)
+				}
+				payload, err := recv.readMessage(i, got)
+				if err != nil || !bytes.Equal(payload, v.payloads[i]) {
+					t.Fatalf("vector %d: message %d: read %x, %v", n, i, payload, err)
+				}
+				if i == len(init.msgs)-1 {
+					c1, c2 = init.split()
+				}
+			} else {
+				cs, ctr := c1, &n1
+				if (i-len(init.msgs))%2 == 1 {
+					cs, ctr = c2, &n2
+				}
+				got = cs.seal(nil, *ctr, nil, v.payloads[i])
+				*ctr++
+			}
+			if !bytes.Equal(got, v.msgs[i]) {
+				t.Fatalf("vector %d: message %d is %x, want %x", n, i, got, v.msgs[i])
+			}
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, tc := range []struct {
+		ctr   uint64
+		fresh bool
+	}{
+		{0, true},
+		{0, false},
+		{3, true},
+		{1, true},
+		{3, false},
+		{200, true},
+		// Out of the window.
+		{136, false},
+		{137, true},
+		{137, false},
+		{199, true},
+		{200, false},
+		{1 << 40, true},
+		{1<<40 - 1, true},
+		{1<<40 - 1, false},
+	} {
+		if got := w.fresh(tc.ctr); got != tc.fresh {
+			t.Fatalf("fresh(%d) = %v, want %v", tc.ctr, got, tc.fresh)
+		}
+		if tc.fresh {
+			w.mark(tc.ctr)
+		}
+	}
+}
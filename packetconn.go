@@ -0,0 +1,89 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// A Message is a single datagram in a batch for ReadBatch and
+// WriteBatch.
+type Message struct {
+	// Buf holds the datagram. ReadBatch reads into Buf, and drops
+	// the part of the datagram that doesn't fit.
+	Buf []byte
+	// N is the number of bytes read into Buf.
+	N int
+	// Addr is the address the datagram came from. It is ignored by
+	// WriteBatch, which always sends to the peer.
+	Addr net.Addr
+	// ECN is the ECN codepoint the datagram arrived with, on
+	// platforms that report it.
+	ECN ECN
+}
+
+// ReadBatch reads datagrams from the peer into ms, blocking until at
+// least one is available, and returns the number of messages filled.
+func (c *Conn) ReadBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	if err := c.data.readMsg(&ms[0]); err != nil {
+		return 0, c.readError(err)
+	}
+	i := 1
+	for i < len(ms) && c.data.tryRead(&ms[i]) {
+		i++
+	}
+	return i, nil
+}
+
+// WriteBatch sends the datagrams in ms to the peer, and returns how
+// many were sent. On Linux, it uses a single sendmmsg system call
+// when possible.
+func (c *Conn) WriteBatch(ms []Message) (int, error) {
+	c.mu.Lock()
+	remote, err := c.remote, c.failErr
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n, err := writeBatch(c.conn, ms, remote)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastSend, c.cfg.clock().Now().UnixNano())
+		size := 0
+		for _, m := range ms[:n] {
+			size += len(m.Buf)
+		}
+		c.countData("tx", n, size)
+	}
+	return n, err
+}
+
+// A PacketConn is a net.PacketConn view of a Conn, for protocols
+// that want one. It only talks to the peer: ReadFrom returns the
+// peer's datagrams, and WriteTo refuses any other destination.
+type PacketConn struct {
+	*Conn
+}
+
+// PacketConn returns a net.PacketConn view of c. Closing either
+// closes both.
+func (c *Conn) PacketConn() *PacketConn {
+	return &PacketConn{c}
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.data.read(b)
+	if err != nil {
+		return 0, nil, c.readError(err)
+	}
+	return n, from, nil
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if remote := c.RemoteAddr(); addr == nil || addr.Network() != remote.Network() || addr.String() != remote.String() {
+		return 0, fmt.Errorf("cannot write to %v, only to the peer at %v", addr, remote)
+	}
+	return c.Write(b)
+}
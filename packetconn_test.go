@@ -0,0 +1,57 @@
+package nat
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketConn(t *testing.T) {
+	a, b, clock := vnetPair(t, nil)
+	pa, pb := a.PacketConn(), b.PacketConn()
+	if _, err := pa.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3478}); err == nil {
+		t.Fatal("wrote to a stranger")
+	}
+	if _, err := pa.WriteTo([]byte("hello"), pa.RemoteAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	pb.SetReadDeadline(clock.Now().Add(5 * time.Second))
+	n, from, err := pb.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" || from.String() != pb.RemoteAddr().String() {
+		t.Fatalf("read %q from %v, %v", buf[:n], from, err)
+	}
+
+	// The virtual network may reorder the batch.
+	out := []Message{{Buf: []byte("one")}, {Buf: []byte("two")}, {Buf: []byte("three")}}
+	if n, err := b.WriteBatch(out); n != len(out) || err != nil {
+		t.Fatalf("WriteBatch sent %d of %d: %v", n, len(out), err)
+	}
+	in := make([]Message, 5)
+	for i := range in {
+		in[i].Buf = make([]byte, 100)
+	}
+	var got []string
+	a.SetReadDeadline(clock.Now().Add(5 * time.Second))
+	for len(got) < len(out) {
+		n, err := a.ReadBatch(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range in[:n] {
+			got = append(got, string(m.Buf[:m.N]))
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "one,three,two" {
+		t.Fatalf("read %q", got)
+	}
+
+	// Closing the view closes the Conn.
+	pa.Close()
+	if _, err := a.Write([]byte("x")); err == nil {
+		t.Fatal("write after closing the PacketConn succeeded")
+	}
+}
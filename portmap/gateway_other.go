@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package portmap
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultGateway returns the IPv4 default gateway of the host. It is
+// only implemented on Linux, elsewhere set Client.Gateway.
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("cannot find the default gateway on this platform, set Client.Gateway")
+}
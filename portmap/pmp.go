@@ -0,0 +1,207 @@
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	pmpOpExternal = 0
+	pmpOpMapUDP   = 1
+	pcpVersion    = 2
+	pcpOpMap      = 1
+	protoUDP      = 17
+	pcpLen        = 60
+)
+
+var pmpResults = []string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+var pcpResults = []string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external address",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+func resultError(results []string, code int) error {
+	if code == 1 {
+		return errUnsupported
+	}
+	if code < len(results) && results[code] != "" {
+		return fmt.Errorf("gateway error: %s", results[code])
+	}
+	return fmt.Errorf("gateway error %d", code)
+}
+
+// pmpMap creates, refreshes or, with a zero lifetime, deletes a
+// NAT-PMP mapping.
+func (c *Client) pmpMap(m *Mapping, lifetime time.Duration) error {
+	suggested := m.InternalPort
+	if m.External != nil {
+		suggested = m.External.Port
+	}
+	if lifetime == 0 {
+		suggested = 0
+	}
+	req := make([]byte, 12)
+	req[1] = pmpOpMapUDP
+	binary.BigEndian.PutUint16(req[4:], uint16(m.InternalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(suggested))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp, err := c.roundTrip(m.gateway, req, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == 0 && b[1] == 128+pmpOpMapUDP && int(binary.BigEndian.Uint16(b[8:])) == m.InternalPort
+	})
+	if err != nil {
+		return err
+	}
+	if code := int(binary.BigEndian.Uint16(resp[2:])); code != 0 {
+		return resultError(pmpResults, code)
+	}
+	if lifetime == 0 {
+		return nil
+	}
+
+	ip, err := c.pmpExternalIP(m.gateway)
+	if err != nil {
+		return err
+	}
+	m.External = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(resp[10:]))}
+	m.Lifetime = time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return nil
+}
+
+func (c *Client) pmpExternalIP(gw net.IP) (net.IP, error) {
+	resp, err := c.roundTrip(gw, []byte{0, pmpOpExternal}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == 0 && b[1] == 128+pmpOpExternal
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := int(binary.BigEndian.Uint16(resp[2:])); code != 0 {
+		return nil, resultError(pmpResults, code)
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// pcpMap creates, refreshes or, with a zero lifetime, deletes a PCP
+// mapping.
+func (c *Client) pcpMap(m *Mapping, lifetime time.Duration) error {
+	if m.nonce == [12]byte{} {
+		if _, err := rand.Read(m.nonce[:]); err != nil {
+			return err
+		}
+	}
+	req := make([]byte, pcpLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], m.local.To16())
+	copy(req[24:36], m.nonce[:])
+	req[36] = protoUDP
+	binary.BigEndian.PutUint16(req[40:], uint16(m.InternalPort))
+	// Suggest the mapping we already have, or any address of the
+	// gateway's family.
+	suggestIP := net.IPv4zero
+	if m.local.To4() == nil {
+		suggestIP = net.IPv6zero
+	}
+	if m.External != nil {
+		binary.BigEndian.PutUint16(req[42:], uint16(m.External.Port))
+		suggestIP = m.External.IP
+	} else {
+		binary.BigEndian.PutUint16(req[42:], uint16(m.InternalPort))
+	}
+	copy(req[44:60], suggestIP.To16())
+
+	resp, err := c.roundTrip(m.gateway, req, func(b []byte) bool {
+		// A NAT-PMP only gateway answers with its own version.
+		if len(b) >= 4 && b[0] == 0 {
+			return true
+		}
+		return len(b) >= pcpLen && b[0] == pcpVersion && b[1] == 0x80|pcpOpMap && bytes.Equal(b[24:36], m.nonce[:])
+	})
+	if err != nil {
+		return err
+	}
+	if resp[0] != pcpVersion {
+		return errUnsupported
+	}
+	if code := int(resp[3]); code != 0 {
+		return resultError(pcpResults, code)
+	}
+	if lifetime == 0 {
+		return nil
+	}
+	if resp[36] != protoUDP || int(binary.BigEndian.Uint16(resp[40:])) != m.InternalPort {
+		return errors.New("gateway mapped the wrong port")
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, resp[44:60])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	m.External = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(resp[42:]))}
+	m.Lifetime = time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second
+	return nil
+}
+
+// roundTrip sends req to the PCP/NAT-PMP port of gw and returns the
+// first response that accept likes. Requests are retransmitted with
+// exponential backoff from 250ms, as RFC 6886 asks, until the
+// client's timeout.
+func (c *Client) roundTrip(gw net.IP, req []byte, accept func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gw, Port: c.pmpPort()})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout())
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 1100)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		next := time.Now().Add(wait)
+		if next.After(deadline) {
+			next = deadline
+		}
+		wait *= 2
+		conn.SetReadDeadline(next)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if accept(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+	return nil, errors.New("no answer from gateway")
+}
@@ -0,0 +1,295 @@
+// Package portmap asks home routers to forward a UDP port to us,
+// using PCP (RFC 6887), NAT-PMP (RFC 6886) or UPnP IGD.
+//
+// A mapped port is reachable from the internet without any hole
+// punching, which makes it a very good ICE candidate.
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol is a port mapping protocol.
+type Protocol string
+
+// Supported protocols.
+const (
+	PCP    Protocol = "PCP"
+	NATPMP Protocol = "NAT-PMP"
+	UPnP   Protocol = "UPnP"
+)
+
+// DefaultProtocols is the order in which a Client tries protocols by
+// default. PCP supersedes NAT-PMP, and routers speaking it answer
+// faster than UPnP ones.
+var DefaultProtocols = []Protocol{PCP, NATPMP, UPnP}
+
+const (
+	defaultPMPPort  = 5351
+	defaultTimeout  = 2 * time.Second
+	defaultLifetime = 2 * time.Hour
+)
+
+var defaultSSDPAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// A Client requests port mappings from a gateway. The zero value
+// talks to the host's default gateway with default settings.
+type Client struct {
+	// Gateway is the router to ask. If nil, the default gateway of
+	// the host is used.
+	Gateway net.IP
+	// PMPPort is the port PCP and NAT-PMP servers listen on. Zero
+	// means the standard 5351.
+	PMPPort int
+	// SSDPAddr is where UPnP discovery requests are sent. Nil means
+	// the standard multicast group.
+	SSDPAddr *net.UDPAddr
+	// Protocols lists the protocols to try, in order. Nil means
+	// DefaultProtocols.
+	Protocols []Protocol
+	// Timeout bounds each protocol's attempt at a request. Zero
+	// means 2 seconds.
+	Timeout time.Duration
+	// Lifetime is the lifetime to request for mappings. Zero means
+	// 2 hours.
+	Lifetime time.Duration
+	// Description labels the UPnP mappings in the router's UI.
+	Description string
+
+	mu  sync.Mutex
+	igd *igd // cached UPnP gateway
+}
+
+// A Mapping is a port forwarded to us by a gateway.
+type Mapping struct {
+	// Protocol is the protocol that obtained the mapping.
+	Protocol Protocol
+	// InternalPort is our local port.
+	InternalPort int
+	// External is the public address that forwards to InternalPort.
+	External *net.UDPAddr
+	// Lifetime is how long the gateway keeps the mapping without a
+	// refresh.
+	Lifetime time.Duration
+
+	gateway net.IP
+	local   net.IP
+	nonce   [12]byte // PCP
+	igd     *igd     // UPnP
+}
+
+func (m *Mapping) String() string {
+	return fmt.Sprintf("%s %d -> %v for %v", m.Protocol, m.InternalPort, m.External, m.Lifetime)
+}
+
+var errUnsupported = errors.New("protocol not supported by the gateway")
+
+// Map asks the gateway to forward a public UDP port to the local
+// port, trying each protocol in turn.
+func (c *Client) Map(port int) (*Mapping, error) {
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	gw, err := c.gateway()
+	if err != nil {
+		return nil, err
+	}
+	local, err := localIPFor(gw)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, proto := range c.protocols() {
+		m := &Mapping{
+			Protocol:     proto,
+			InternalPort: port,
+			gateway:      gw,
+			local:        local,
+		}
+		if err := c.request(m, c.lifetime()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", proto, err))
+			continue
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("no port mapping protocol worked (%s)", strings.Join(errs, "; "))
+}
+
+// Refresh renews m before it expires. The external address may
+// change, e.g. after a gateway reboot.
+func (c *Client) Refresh(m *Mapping) error {
+	return c.request(m, c.lifetime())
+}
+
+// Delete asks the gateway to remove m.
+func (c *Client) Delete(m *Mapping) error {
+	switch m.Protocol {
+	case PCP:
+		return c.pcpMap(m, 0)
+	case NATPMP:
+		return c.pmpMap(m, 0)
+	case UPnP:
+		return c.upnpDelete(m)
+	}
+	return fmt.Errorf("unknown protocol %q", m.Protocol)
+}
+
+func (c *Client) request(m *Mapping, lifetime time.Duration) error {
+	switch m.Protocol {
+	case PCP:
+		return c.pcpMap(m, lifetime)
+	case NATPMP:
+		return c.pmpMap(m, lifetime)
+	case UPnP:
+		return c.upnpMap(m, lifetime)
+	}
+	return fmt.Errorf("unknown protocol %q", m.Protocol)
+}
+
+func (c *Client) gateway() (net.IP, error) {
+	if c.Gateway != nil {
+		return c.Gateway, nil
+	}
+	return DefaultGateway()
+}
+
+func (c *Client) protocols() []Protocol {
+	if c.Protocols == nil {
+		return DefaultProtocols
+	}
+	return c.Protocols
+}
+
+func (c *Client) pmpPort() int {
+	if c.PMPPort == 0 {
+		return defaultPMPPort
+	}
+	return c.PMPPort
+}
+
+func (c *Client) ssdpAddr() *net.UDPAddr {
+	if c.SSDPAddr == nil {
+		return defaultSSDPAddr
+	}
+	return c.SSDPAddr
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Client) lifetime() time.Duration {
+	if c.Lifetime == 0 {
+		return defaultLifetime
+	}
+	return c.Lifetime
+}
+
+// localIPFor returns the local address we use to reach gw.
+func localIPFor(gw net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gw, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// A Lease keeps a Mapping alive by refreshing it in the background,
+// until closed.
+type Lease struct {
+	c         *Client
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	mu sync.Mutex
+	m  *Mapping
+}
+
+// Lease maps port like Map, and keeps the mapping alive until the
+// returned Lease is closed.
+func (c *Client) Lease(port int) (*Lease, error) {
+	m, err := c.Map(port)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lease{
+		c:    c,
+		done: make(chan struct{}),
+		m:    m,
+	}
+	l.wg.Add(1)
+	go l.refreshLoop()
+	return l, nil
+}
+
+// Mapping returns a copy of the current mapping.
+func (l *Lease) Mapping() Mapping {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return *l.m
+}
+
+// External returns the current public address of the lease.
+func (l *Lease) External() *net.UDPAddr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.m.External
+}
+
+// Close stops refreshing the mapping and deletes it from the
+// gateway.
+func (l *Lease) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		err = l.c.Delete(l.m)
+	})
+	return err
+}
+
+func (l *Lease) refreshLoop() {
+	defer l.wg.Done()
+	l.mu.Lock()
+	wait := l.m.Lifetime / 2
+	l.mu.Unlock()
+	for {
+		if wait <= 0 {
+			wait = time.Minute
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-l.done:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		l.mu.Lock()
+		m := *l.m
+		l.mu.Unlock()
+		if err := l.c.Refresh(&m); err != nil {
+			// Try again soon, the mapping may still have some
+			// life left.
+			wait = m.Lifetime / 8
+			continue
+		}
+		l.mu.Lock()
+		l.m = &m
+		l.mu.Unlock()
+		wait = m.Lifetime / 2
+	}
+}
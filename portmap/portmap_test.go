@@ -0,0 +1,425 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 7)
+
+// fakePMP is a PCP and NAT-PMP gateway on loopback. It maps internal
+// port p to external port p+1000.
+type fakePMP struct {
+	sock *net.UDPConn
+	// noPCP makes it a NAT-PMP only gateway, and result is the
+	// result code of its map answers.
+	noPCP  bool
+	result int
+
+	mu       sync.Mutex
+	mappings map[int]time.Duration // by internal port
+	requests int
+	nonces   map[string]bool
+}
+
+func newFakePMP(t *testing.T, noPCP bool, result int) *fakePMP {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	g := &fakePMP{sock: sock, noPCP: noPCP, result: result, mappings: map[int]time.Duration{}, nonces: map[string]bool{}}
+	go g.serve()
+	return g
+}
+
+// client returns a Client of g that only speaks proto.
+func (g *fakePMP) client(proto Protocol) *Client {
+	return &Client{
+		Gateway:   net.IPv4(127, 0, 0, 1),
+		PMPPort:   g.sock.LocalAddr().(*net.UDPAddr).Port,
+		Protocols: []Protocol{proto},
+		Timeout:   time.Second,
+	}
+}
+
+func (g *fakePMP) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := g.sock.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := g.answer(buf[:n]); resp != nil {
+			g.sock.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (g *fakePMP) answer(req []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case len(req) >= 2 && req[0] == 0 && req[1] == pmpOpExternal:
+		resp := make([]byte, 12)
+		resp[1] = 128 + pmpOpExternal
+		copy(resp[8:], externalIP.To4())
+		return resp
+	case len(req) >= 12 && req[0] == 0 && req[1] == pmpOpMapUDP:
+		g.requests++
+		internal := int(binary.BigEndian.Uint16(req[4:]))
+		lifetime := time.Duration(binary.BigEndian.Uint32(req[8:])) * time.Second
+		resp := make([]byte, 16)
+		resp[1] = 128 + pmpOpMapUDP
+		binary.BigEndian.PutUint16(resp[2:], uint16(g.result))
+		copy(resp[8:10], req[4:6])
+		if g.result == 0 {
+			g.update(internal, lifetime)
+			binary.BigEndian.PutUint16(resp[10:], uint16(internal+1000))
+			binary.BigEndian.PutUint32(resp[12:], uint32(lifetime/time.Second))
+		}
+		return resp
+	case len(req) >= pcpLen && req[0] == pcpVersion && req[1] == pcpOpMap:
+		if g.noPCP {
+			// NAT-PMP gateways answer other versions with their own.
+			return []byte{0, 128 + pcpOpMap, 0, 1}
+		}
+		g.requests++
+		g.nonces[string(req[24:36])] = true
+		internal := int(binary.BigEndian.Uint16(req[40:]))
+		lifetime := time.Duration(binary.BigEndian.Uint32(req[4:])) * time.Second
+		resp := make([]byte, pcpLen)
+		resp[0] = pcpVersion
+		resp[1] = 0x80 | pcpOpMap
+		resp[3] = byte(g.result)
+		copy(resp[24:], req[24:44])
+		if g.result == 0 {
+			g.update(internal, lifetime)
+			binary.BigEndian.PutUint32(resp[4:], uint32(lifetime/time.Second))
+			binary.BigEndian.PutUint16(resp[42:], uint16(internal+1000))
+			copy(resp[44:60], externalIP.To16())
+		}
+		return resp
+	}
+	return nil
+}
+
+// update creates, refreshes or deletes the mapping of internal.
+// Called with g.mu held.
+func (g *fakePMP) update(internal int, lifetime time.Duration) {
+	if lifetime == 0 {
+		delete(g.mappings, internal)
+		return
+	}
+	g.mappings[internal] = lifetime
+}
+
+func (g *fakePMP) mapped(internal int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.mappings[internal]
+	return ok
+}
+
+func TestPMP(t *testing.T) {
+	for _, proto := range []Protocol{PCP, NATPMP} {
+		t.Run(string(proto), func(t *testing.T) {
+			g := newFakePMP(t, false, 0)
+			c := g.client(proto)
+			c.Lifetime = time.Hour
+			m, err := c.Map(4000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Protocol != proto || m.External.String() != "203.0.113.7:5000" || m.Lifetime != time.Hour {
+				t.Fatalf("got mapping %v", m)
+			}
+			if !g.mapped(4000) {
+				t.Fatal("gateway has no mapping")
+			}
+			if err := c.Refresh(m); err != nil {
+				t.Fatal(err)
+			}
+			if m.External.String() != "203.0.113.7:5000" {
+				t.Fatalf("refreshed mapping %v", m)
+			}
+			g.mu.Lock()
+			nonces := len(g.nonces)
+			g.mu.Unlock()
+			if proto == PCP && nonces != 1 {
+				t.Fatalf("refresh used a new nonce, %d nonces", nonces)
+			}
+			if err := c.Delete(m); err != nil {
+				t.Fatal(err)
+			}
+			if g.mapped(4000) {
+				t.Fatal("mapping not deleted")
+			}
+		})
+	}
+}
+
+func TestPCPFallback(t *testing.T) {
+	g := newFakePMP(t, true, 0)
+	c := g.client(PCP)
+	c.Protocols = []Protocol{PCP, NATPMP}
+	m, err := c.Map(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != NATPMP {
+		t.Fatalf("mapped with %s, want NAT-PMP", m.Protocol)
+	}
+}
+
+func TestResultErrors(t *testing.T) {
+	for _, tc := range []struct {
+		results []string
+		code    int
+		want    string
+	}{
+		{pmpResults, 1, errUnsupported.Error()},
+		{pmpResults, 2, "gateway error: not authorized"},
+		{pcpResults, 8, "gateway error: no resources"},
+		{pcpResults, 13, "gateway error: excessive remote peers"},
+		{pcpResults, 14, "gateway error 14"},
+		{pmpResults, 99, "gateway error 99"},
+	} {
+		if got := resultError(tc.results, tc.code).Error(); got != tc.want {
+			t.Errorf("resultError(%d) = %q, want %q", tc.code, got, tc.want)
+		}
+	}
+
+	// Gateways answer with result codes, which end the attempt.
+	for _, proto := range []Protocol{PCP, NATPMP} {
+		g := newFakePMP(t, false, 2)
+		start := time.Now()
+		_, err := g.client(proto).Map(4000)
+		if err == nil || !strings.Contains(err.Error(), "not authorized") {
+			t.Errorf("%s: Map with a refusing gateway: %v", proto, err)
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("%s: a refusal took %v, as if it were retried", proto, time.Since(start))
+		}
+	}
+	g := newFakePMP(t, false, 1)
+	m := &Mapping{Protocol: NATPMP, InternalPort: 4000, gateway: net.IPv4(127, 0, 0, 1)}
+	if err := g.client(NATPMP).request(m, time.Hour); err != errUnsupported {
+		t.Errorf("NAT-PMP unsupported version: %v", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	g := newFakePMP(t, false, 0)
+	c := g.client(NATPMP)
+	// Leases refresh at half their lifetime.
+	c.Lifetime = 2 * time.Second
+	l, err := c.Lease(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.External().String() != "203.0.113.7:5000" {
+		t.Fatalf("lease on %v", l.External())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.Lock()
+		n := g.requests
+		g.mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lease not refreshed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if g.mapped(4000) {
+		t.Fatal("closed lease still mapped")
+	}
+}
+
+// fakeIGD is a UPnP gateway: an SSDP responder on loopback, and its
+// description and control URL on an HTTP server.
+type fakeIGD struct {
+	ssdp *net.UDPConn
+	http *httptest.Server
+	// taken is an external port that AddPortMapping refuses as a
+	// conflict, and onlyPermanent makes it refuse lease durations.
+	taken         int
+	onlyPermanent bool
+
+	mu       sync.Mutex
+	mappings map[string]string // lease duration by external port
+}
+
+func newFakeIGD(t *testing.T, taken int, onlyPermanent bool) *fakeIGD {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	d := &fakeIGD{ssdp: sock, taken: taken, onlyPermanent: onlyPermanent, mappings: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		// The WAN service hides in nested devices.
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+    <deviceList><device>
+      <serviceList><service>
+        <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+        <controlURL>/ctl</controlURL>
+      </service></serviceList>
+    </device></deviceList>
+  </device></deviceList>
+</device>
+</root>`)
+	})
+	mux.HandleFunc("/ctl", d.control)
+	d.http = httptest.NewServer(mux)
+	t.Cleanup(d.http.Close)
+	go d.serveSSDP()
+	return d
+}
+
+func (d *fakeIGD) client() *Client {
+	return &Client{
+		Gateway:   net.IPv4(127, 0, 0, 1),
+		SSDPAddr:  d.ssdp.LocalAddr().(*net.UDPAddr),
+		Protocols: []Protocol{UPnP},
+		Timeout:   time.Second,
+	}
+}
+
+func (d *fakeIGD) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := d.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") || !strings.Contains(string(buf[:n]), igdSearchTarget) {
+			continue
+		}
+		resp := "HTTP/1.1 200 OK\r\nST: " + igdSearchTarget + "\r\nLocation: " + d.http.URL + "/desc.xml\r\n\r\n"
+		d.ssdp.WriteToUDP([]byte(resp), from)
+	}
+}
+
+func (d *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	args, err := xmlLeaves(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fail := func(code int, desc string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, desc)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch action := r.Header.Get("SOAPAction"); {
+	case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>%s</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, externalIP)
+	case strings.HasSuffix(action, `#AddPortMapping"`):
+		port := args["NewExternalPort"]
+		switch {
+		case port == fmt.Sprint(d.taken):
+			fail(upnpConflict, "ConflictInMappingEntry")
+		case d.onlyPermanent && args["NewLeaseDuration"] != "0":
+			fail(upnpOnlyPermanent, "OnlyPermanentLeasesSupported")
+		default:
+			d.mappings[port] = args["NewLeaseDuration"]
+		}
+	case strings.HasSuffix(action, `#DeletePortMapping"`):
+		if _, ok := d.mappings[args["NewExternalPort"]]; !ok {
+			fail(714, "NoSuchEntryInArray")
+			return
+		}
+		delete(d.mappings, args["NewExternalPort"])
+	default:
+		fail(401, "Invalid Action")
+	}
+}
+
+// lease returns the lease duration of the mapping of port, if any.
+func (d *fakeIGD) lease(port int) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lease, ok := d.mappings[fmt.Sprint(port)]
+	return lease, ok
+}
+
+func TestUPnP(t *testing.T) {
+	d := newFakeIGD(t, 0, false)
+	c := d.client()
+	c.Lifetime = time.Hour
+	m, err := c.Map(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != UPnP || m.External.String() != "203.0.113.7:4000" || m.Lifetime != time.Hour {
+		t.Fatalf("got mapping %v", m)
+	}
+	if got, _ := d.lease(4000); got != "3600" {
+		t.Fatalf("requested a lease of %q seconds", got)
+	}
+	if err := c.Refresh(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.lease(4000); ok {
+		t.Fatal("mapping not deleted")
+	}
+	// The mapping is gone, the gateway says so.
+	var uerr *upnpError
+	if err := c.Delete(m); !errors.As(err, &uerr) || uerr.code != 714 {
+		t.Fatalf("deleting twice: %v", err)
+	}
+}
+
+func TestUPnPConflict(t *testing.T) {
+	d := newFakeIGD(t, 4000, false)
+	m, err := d.client().Map(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.External.Port == 4000 {
+		t.Fatal("mapped a taken port")
+	}
+	if _, ok := d.lease(m.External.Port); !ok {
+		t.Fatalf("gateway has no mapping for %v", m.External)
+	}
+}
+
+func TestUPnPOnlyPermanent(t *testing.T) {
+	d := newFakeIGD(t, 0, true)
+	c := d.client()
+	c.Lifetime = time.Hour
+	m, err := c.Map(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Permanent mappings are still refreshed, in case the gateway
+	// reboots.
+	if lease, _ := d.lease(4000); lease != "0" || m.Lifetime != time.Hour {
+		t.Fatalf("mapping %v, lease %q", m, lease)
+	}
+}
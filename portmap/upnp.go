@@ -0,0 +1,329 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const igdSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+// Services offering AddPortMapping, in order of preference.
+var igdServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP errors we handle.
+const (
+	upnpConflict      = 718
+	upnpOnlyPermanent = 725
+)
+
+// igd is the control endpoint of a UPnP Internet Gateway Device.
+type igd struct {
+	controlURL string
+	service    string
+}
+
+func (c *Client) upnpMap(m *Mapping, lifetime time.Duration) error {
+	d := m.igd
+	if d == nil {
+		var err error
+		if d, err = c.discoverIGD(m.gateway); err != nil {
+			return err
+		}
+	}
+	ip, err := c.soap(d, "GetExternalIPAddress", nil)
+	if err != nil {
+		return err
+	}
+	extIP := net.ParseIP(ip["NewExternalIPAddress"])
+	if extIP == nil {
+		return fmt.Errorf("gateway returned invalid external IP %q", ip["NewExternalIPAddress"])
+	}
+
+	port := m.InternalPort
+	if m.External != nil {
+		port = m.External.Port
+	}
+	desc := c.Description
+	if desc == "" {
+		desc = "nat"
+	}
+	// Pick a random port when the one we want is taken, a few times.
+	for try := 0; ; try++ {
+		_, err = c.soap(d, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(port)},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+			{"NewInternalClient", m.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", desc},
+			{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+		})
+		var uerr *upnpError
+		if errors.As(err, &uerr) && uerr.code == upnpOnlyPermanent && lifetime != 0 {
+			lifetime = 0
+			continue
+		}
+		if errors.As(err, &uerr) && uerr.code == upnpConflict && try < 3 {
+			port = 1024 + rand.Intn(65535-1024)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return err
+	}
+
+	m.igd = d
+	m.External = &net.UDPAddr{IP: extIP, Port: port}
+	m.Lifetime = lifetime
+	if lifetime == 0 {
+		// Permanent, but refresh anyway in case the gateway
+		// reboots.
+		m.Lifetime = c.lifetime()
+	}
+	return nil
+}
+
+func (c *Client) upnpDelete(m *Mapping) error {
+	if m.igd == nil || m.External == nil {
+		return errors.New("mapping was never created")
+	}
+	_, err := c.soap(m.igd, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(m.External.Port)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+// discoverIGD finds the IGD of gw with SSDP and fetches its
+// description.
+func (c *Client) discoverIGD(gw net.IP) (*igd, error) {
+	c.mu.Lock()
+	d := c.igd
+	c.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	location, err := c.ssdpSearch(gw)
+	if err != nil {
+		return nil, err
+	}
+	d, err = c.fetchDescription(location)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.igd = d
+	c.mu.Unlock()
+	return d, nil
+}
+
+func (c *Client) ssdpSearch(gw net.IP) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	dst := c.ssdpAddr()
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + dst.String() + "\r\n" +
+		"ST: " + igdSearchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	deadline := time.Now().Add(c.timeout())
+	buf := make([]byte, 2048)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+			return "", err
+		}
+		next := time.Now().Add(time.Second)
+		if next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					break
+				}
+				return "", err
+			}
+			// Other devices on the LAN answer too.
+			if !from.IP.Equal(gw) {
+				continue
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				continue
+			}
+			if loc := resp.Header.Get("Location"); loc != "" {
+				return loc, nil
+			}
+		}
+	}
+	return "", errors.New("no UPnP gateway found")
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+func (d *upnpDevice) find(service string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == service {
+			return s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].find(service); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+func (c *Client) fetchDescription(location string) (*igd, error) {
+	hc := &http.Client{Timeout: c.timeout()}
+	resp, err := hc.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching gateway description: %s", resp.Status)
+	}
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("parsing gateway description: %v", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	for _, service := range igdServices {
+		control := root.Device.find(service)
+		if control == "" {
+			continue
+		}
+		u, err := base.Parse(control)
+		if err != nil {
+			return nil, err
+		}
+		return &igd{controlURL: u.String(), service: service}, nil
+	}
+	return nil, errors.New("gateway has no WAN connection service")
+}
+
+type upnpError struct {
+	code int
+	desc string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.code, e.desc)
+}
+
+// soap calls action on d, and returns the leaf elements of the
+// response by name.
+func (c *Client) soap(d *igd, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + d.service + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", d.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+d.service+"#"+action+`"`)
+	hc := &http.Client{Timeout: c.timeout()}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	fields, err := xmlLeaves(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s response: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if code, err := strconv.Atoi(fields["errorCode"]); err == nil {
+			return nil, &upnpError{code, fields["errorDescription"]}
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+	return fields, nil
+}
+
+// xmlLeaves returns the text of the leaf elements of an XML
+// document, by local name.
+func xmlLeaves(r io.Reader) (map[string]string, error) {
+	ret := map[string]string{}
+	dec := xml.NewDecoder(r)
+	var (
+		name string
+		text strings.Builder
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				ret[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
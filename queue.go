@@ -0,0 +1,177 @@
+package nat
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type packet struct {
+	buf  []byte
+	from net.Addr
+	ecn  ECN
+}
+
+// A packetQueue hands datagrams read by one goroutine to readers
+// with net.Conn-style deadlines. When the queue is full, new packets
+// are dropped, as the network would.
+type packetQueue struct {
+	ch     chan packet
+	closed chan struct{}
+	once   sync.Once
+	clock  Clock
+
+	mu       sync.Mutex
+	deadline time.Time
+	// kick is closed and replaced when the deadline changes, to
+	// wake up blocked readers.
+	kick chan struct{}
+}
+
+func newPacketQueue(size int, clock Clock) *packetQueue {
+	return &packetQueue{
+		ch:     make(chan packet, size),
+		closed: make(chan struct{}),
+		clock:  clock,
+		kick:   make(chan struct{}),
+	}
+}
+
+// push queues p with a copy of its buffer, and reports whether it
+// fit.
+func (q *packetQueue) push(p packet) bool {
+	select {
+	case <-q.closed:
+		return false
+	default:
+	}
+	select {
+	case q.ch <- packet{append([]byte(nil), p.buf...), p.from, p.ecn}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *packetQueue) read(b []byte) (int, net.Addr, error) {
+	m := Message{Buf: b}
+	err := q.readMsg(&m)
+	return m.N, m.Addr, err
+}
+
+// readMsg is like read, but also returns the packet's metadata in m.
+func (q *packetQueue) readMsg(m *Message) error {
+	for {
+		q.mu.Lock()
+		deadline, kick := q.deadline, q.kick
+		q.mu.Unlock()
+
+		// Drain queued packets before reporting closure or
+		// timeouts.
+		if q.tryRead(m) {
+			return nil
+		}
+		select {
+		case <-q.closed:
+			return net.ErrClosed
+		default:
+		}
+
+		var (
+			timeout <-chan time.Time
+			stop    = func() bool { return false }
+		)
+		if !deadline.IsZero() {
+			d := deadline.Sub(q.clock.Now())
+			if d <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timeout, stop = newTimer(q.clock, d)
+		}
+		select {
+		case p := <-q.ch:
+			stop()
+			p.fill(m)
+			return nil
+		case <-q.closed:
+			stop()
+			return net.ErrClosed
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-kick:
+			stop()
+		}
+	}
+}
+
+// tryRead is like readMsg, but returns false rather than waiting
+// when the queue is empty.
+func (q *packetQueue) tryRead(m *Message) bool {
+	select {
+	case p := <-q.ch:
+		p.fill(m)
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *packet) fill(m *Message) {
+	m.N = copy(m.Buf, p.buf)
+	m.Addr = p.from
+	m.ECN = p.ecn
+}
+
+func (q *packetQueue) setDeadline(t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deadline = t
+	close(q.kick)
+	q.kick = make(chan struct{})
+}
+
+func (q *packetQueue) close() {
+	q.once.Do(func() { close(q.closed) })
+}
+
+// A queueConn is a net.PacketConn that reads from a packetQueue and
+// writes to an underlying socket. It lets the ICE machinery run on a
+// socket whose reads are owned by a Conn.
+type queueConn struct {
+	q    *packetQueue
+	sock net.PacketConn
+}
+
+func (c *queueConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.q.read(b)
+}
+
+func (c *queueConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.sock.WriteTo(b, addr)
+}
+
+func (c *queueConn) Close() error {
+	c.q.close()
+	return nil
+}
+
+func (c *queueConn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+func (c *queueConn) SetDeadline(t time.Time) error {
+	c.q.setDeadline(t)
+	return nil
+}
+
+func (c *queueConn) SetReadDeadline(t time.Time) error {
+	c.q.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, the underlying socket's write deadline
+// belongs to its owner.
+func (c *queueConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
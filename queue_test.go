@@ -0,0 +1,120 @@
+package nat
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPacketQueue(t *testing.T) {
+	q := newPacketQueue(2, systemClock{})
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	buf := []byte("one")
+	if !q.push(packet{buf, from, ECNECT0}) || !q.push(packet{[]byte("two"), from, ECNNotECT}) {
+		t.Fatal("push into a queue with room failed")
+	}
+	// A full queue drops the packet, and push copies the buffer.
+	if q.push(packet{[]byte("three"), from, ECNNotECT}) {
+		t.Fatal("push into a full queue succeeded")
+	}
+	copy(buf, "xxx")
+
+	m := Message{Buf: make([]byte, 2)}
+	if err := q.readMsg(&m); err != nil {
+		t.Fatal(err)
+	}
+	// The part that doesn't fit is dropped.
+	if string(m.Buf[:m.N]) != "on" || m.Addr != from || m.ECN != ECNECT0 {
+		t.Fatalf("read %q from %v with %v", m.Buf[:m.N], m.Addr, m.ECN)
+	}
+
+	// A deadline in the past fails reads on an empty queue, but not
+	// on queued packets.
+	q.setDeadline(time.Now().Add(-time.Second))
+	b := make([]byte, 10)
+	if n, _, err := q.read(b); err != nil || string(b[:n]) != "two" {
+		t.Fatalf("read %q, %v", b[:n], err)
+	}
+	if _, _, err := q.read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+	if q.tryRead(&m) {
+		t.Fatal("tryRead on an empty queue succeeded")
+	}
+
+	// Moving the deadline wakes up a blocked reader.
+	q.setDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() { _, _, err := q.read(b); errs <- err }()
+	time.Sleep(10 * time.Millisecond)
+	q.setDeadline(time.Now().Add(10 * time.Millisecond))
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader missed the new deadline")
+	}
+
+	// Close wakes up a blocked reader, after the queue drains.
+	q.setDeadline(time.Time{})
+	q.push(packet{[]byte("last"), from, ECNNotECT})
+	q.close()
+	q.close()
+	if n, _, err := q.read(b); err != nil || string(b[:n]) != "last" {
+		t.Fatalf("read %q, %v from a closed queue", b[:n], err)
+	}
+	if _, _, err := q.read(b); err != net.ErrClosed {
+		t.Fatalf("read from a closed queue: %v", err)
+	}
+	if q.push(packet{[]byte("late"), from, ECNNotECT}) {
+		t.Fatal("push into a closed queue succeeded")
+	}
+}
+
+func TestQueueConn(t *testing.T) {
+	listen := func() *net.UDPConn {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sock.Close() })
+		return sock
+	}
+	sock, peer := listen(), listen()
+	c := &queueConn{q: newPacketQueue(1, systemClock{}), sock: sock}
+	if c.LocalAddr() != sock.LocalAddr() {
+		t.Fatalf("local address %v, want %v", c.LocalAddr(), sock.LocalAddr())
+	}
+
+	// Writes go out on the socket, reads come from the queue.
+	if _, err := c.WriteTo([]byte("out"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 10)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, from, err := peer.ReadFrom(b); err != nil || string(b[:n]) != "out" || from.String() != sock.LocalAddr().String() {
+		t.Fatalf("peer read %q from %v, %v", b[:n], from, err)
+	}
+	c.q.push(packet{buf: []byte("in"), from: peer.LocalAddr()})
+	if n, from, err := c.ReadFrom(b); err != nil || string(b[:n]) != "in" || from != peer.LocalAddr() {
+		t.Fatalf("read %q from %v, %v", b[:n], from, err)
+	}
+	c.SetDeadline(time.Now().Add(-time.Second))
+	if _, _, err := c.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+
+	// The write deadline and the socket belong to the owner.
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	c.Close()
+	if _, _, err := c.ReadFrom(b); err != net.ErrClosed {
+		t.Fatalf("read from a closed queueConn: %v", err)
+	}
+	if _, err := sock.WriteTo([]byte("still open"), peer.LocalAddr()); err != nil {
+		t.Fatalf("closing the queueConn broke the socket: %v", err)
+	}
+}
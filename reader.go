@@ -0,0 +1,105 @@
+package nat
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// maxPacketSize is the largest datagram the engine reads, so that
+	// STUN messages with large attributes are never truncated.
+	maxPacketSize = 65536
+	// rxQueueSize is how many received packets wait for the engine
+	// before the readers stop reading.
+	rxQueueSize = 1024
+	// maxBurst is how many checks xmit sends before the engine
+	// handles the packets received meanwhile.
+	maxBurst = 64
+)
+
+type rxPacket struct {
+	via  int
+	buf  []byte
+	from net.Addr
+}
+
+// startReaders reads each of our sockets in its own goroutine, and
+// feeds the packets to e.rx.
+func (e *attemptEngine) startReaders() {
+	e.rx = make(chan rxPacket, rxQueueSize)
+	e.stop = make(chan struct{})
+	for i := 0; i <= len(e.spray); i++ {
+		sock := e.socket(i)
+		sock.SetReadDeadline(time.Time{})
+		e.rxDone.Add(1)
+		go e.reader(i, sock)
+	}
+}
+
+func (e *attemptEngine) reader(via int, sock net.PacketConn) {
+	defer e.rxDone.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := sock.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-e.stop:
+				return
+			default:
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				continue
+			}
+			return
+		}
+		p := rxPacket{via, append([]byte(nil), buf[:n]...), from}
+		select {
+		case e.rx <- p:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *attemptEngine) stopReaders() {
+	close(e.stop)
+	for i := 0; i <= len(e.spray); i++ {
+		e.socket(i).SetReadDeadline(e.cfg.clock().Now())
+	}
+	e.rxDone.Wait()
+	e.rx = nil
+	for i := 0; i <= len(e.spray); i++ {
+		e.socket(i).SetReadDeadline(time.Time{})
+	}
+}
+
+// wait handles the packets received until deadline. It returns early
+// once it handled a packet and the queue is empty, so that the checks
+// go on without waiting. Past the deadline, it only handles the
+// packets already queued.
+func (e *attemptEngine) wait(deadline time.Time) error {
+	if d := deadline.Sub(e.cfg.clock().Now()); d > 0 {
+		timeout, stop := newTimer(e.cfg.clock(), d)
+		defer stop()
+		select {
+		case p := <-e.rx:
+			if err := e.handle(p.buf, p.from, p.via); err != nil {
+				return err
+			}
+		case <-timeout:
+			return nil
+		case <-e.abort:
+			return ErrAgentClosed
+		}
+	}
+	for {
+		select {
+		case p := <-e.rx:
+			if err := e.handle(p.buf, p.from, p.via); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package rendezvous
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var errClientClosed = errors.New("signaler closed")
+
+// HTTPClient is a nat.Signaler talking to a Server's HTTP API.
+type HTTPClient struct {
+	// Client is the HTTP client used for requests.
+	Client *http.Client
+
+	room  string
+	token string
+	base  string // URL of the peer's mailbox
+
+	// ctx is canceled by Close, to end a pending long-poll.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// JoinHTTP joins room on the server at baseURL (e.g.
+// "http://example.com:8080") over HTTP. If room is empty, the server
+// creates a room with a pairing code, which Room returns. token may
+// be empty if the server doesn't require one.
+func JoinHTTP(baseURL, room, token string) (*HTTPClient, error) {
+	roomsURL := strings.TrimRight(baseURL, "/") + "/rooms"
+	joinURL := roomsURL
+	if room != "" {
+		joinURL += "/" + url.PathEscape(room)
+	}
+	c := &HTTPClient{
+		Client: http.DefaultClient,
+		token:  token,
+	}
+	resp, err := c.do(context.Background(), "POST", joinURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(resp)
+	}
+	var joined struct{ Room, Peer string }
+	if err := json.NewDecoder(resp.Body).Decode(&joined); err != nil {
+		return nil, err
+	}
+	if joined.Room == "" || joined.Peer == "" {
+		return nil, errors.New("rendezvous server returned no room or peer ID")
+	}
+	c.room = joined.Room
+	c.base = roomsURL + "/" + url.PathEscape(joined.Room) + "/" + url.PathEscape(joined.Peer)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c, nil
+}
+
+// Room returns the name or pairing code of the room c joined.
+func (c *HTTPClient) Room() string {
+	return c.room
+}
+
+func (c *HTTPClient) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.Client.Do(req)
+}
+
+func (c *HTTPClient) Send(msg []byte) error {
+	resp, err := c.do(c.ctx, "POST", c.base, msg)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return errClientClosed
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return httpStatusError(resp)
+	}
+	return nil
+}
+
+// Recv long-polls the server until a message arrives. It returns
+// io.EOF once the other peer has left the room.
+func (c *HTTPClient) Recv() ([]byte, error) {
+	for {
+		resp, err := c.do(c.ctx, "GET", c.base, nil)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return nil, errClientClosed
+			}
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			msg, err := io.ReadAll(io.LimitReader(resp.Body, MaxMessageLen+1))
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			if len(msg) > MaxMessageLen {
+				return nil, fmt.Errorf("rendezvous server: message larger than %d bytes", MaxMessageLen)
+			}
+			return msg, nil
+		case http.StatusNoContent:
+			resp.Body.Close()
+		default:
+			err := httpStatusError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+}
+
+// Close leaves the room, and ends a pending Recv.
+func (c *HTTPClient) Close() error {
+	c.cancel()
+	resp, err := c.do(context.Background(), "DELETE", c.base, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func httpStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(body))
+	if msg == errPeerGone.Error() {
+		return io.EOF
+	}
+	return fmt.Errorf("rendezvous server: %s: %s", resp.Status, msg)
+}
+
+// TCPClient is a nat.Signaler talking to a Server over TCP.
+type TCPClient struct {
+	room string
+	conn net.Conn
+	dec  *json.Decoder
+	wmu  sync.Mutex
+	enc  *json.Encoder
+}
+
+// JoinTCP joins room on the server listening at addr over TCP. If
+// room is empty, the server creates a room with a pairing code,
+// which Room returns. token may be empty if the server doesn't
+// require one.
+func JoinTCP(addr, room, token string) (*TCPClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &TCPClient{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+	if err := c.enc.Encode(tcpHello{Room: room, Token: token}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var hello tcpHello
+	if err := c.dec.Decode(&hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if hello.Error != "" {
+		conn.Close()
+		return nil, fmt.Errorf("rendezvous server: %s", hello.Error)
+	}
+	c.room = hello.Room
+	return c, nil
+}
+
+// Room returns the name or pairing code of the room c joined.
+func (c *TCPClient) Room() string {
+	return c.room
+}
+
+func (c *TCPClient) Send(msg []byte) error {
+	if len(msg) > MaxMessageLen {
+		return errors.New("message too large")
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.enc.Encode(tcpFrame{Data: msg})
+}
+
+// Recv waits for the next message. It returns io.EOF once the other
+// peer has left the room.
+func (c *TCPClient) Recv() ([]byte, error) {
+	var f tcpFrame
+	if err := c.dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Error == errPeerGone.Error() {
+		return nil, io.EOF
+	}
+	if f.Error != "" {
+		return nil, fmt.Errorf("rendezvous server: %s", f.Error)
+	}
+	return f.Data, nil
+}
+
+// Close leaves the room.
+func (c *TCPClient) Close() error {
+	return c.conn.Close()
+}
+
+// A Client is a peer's connection to a rendezvous server. It
+// implements nat.Signaler.
+type Client interface {
+	Send(msg []byte) error
+	Recv() ([]byte, error)
+	Close() error
+	// Room returns the name or pairing code of the joined room.
+	Room() string
+}
+
+// Join joins room on the server at addr, picking the transport from
+// the scheme of addr: "http://" and "https://" use the HTTP API,
+// "tcp://" the TCP protocol.
+func Join(addr, room, token string) (Client, error) {
+	switch {
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		c, err := JoinHTTP(addr, room, token)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		c, err := JoinTCP(strings.TrimPrefix(addr, "tcp://"), room, token)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported rendezvous address %q", addr)
+}
@@ -0,0 +1,285 @@
+package rendezvous
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat"
+)
+
+var (
+	_ nat.Signaler = (*HTTPClient)(nil)
+	_ nat.Signaler = (*TCPClient)(nil)
+)
+
+// serve runs s over HTTP and TCP on loopback, and returns the
+// addresses to Join.
+func serve(t *testing.T, s *Server) (httpAddr, tcpAddr string) {
+	hs := httptest.NewServer(s)
+	t.Cleanup(hs.Close)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.ServeTCP(l)
+	return hs.URL, "tcp://" + l.Addr().String()
+}
+
+// relaySignal sends a Signal from a to b, and checks that b gets it.
+func relaySignal(t *testing.T, a, b Client, role nat.Role) {
+	t.Helper()
+	creds, err := nat.NewCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &nat.Signal{
+		Version:     nat.SignalVersion,
+		Credentials: creds,
+		Role:        role,
+		Candidates: []nat.Candidate{
+			{Type: nat.CandidateHost, Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}},
+		},
+	}
+	raw, err := sig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send(raw); err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := nat.ParseSignal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Credentials != creds || parsed.Role != role || len(parsed.Candidates) != 1 || parsed.Candidates[0].Addr.String() != "192.0.2.1:4000" {
+		t.Fatalf("relayed signal %+v, want %+v", parsed, sig)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s := NewServer()
+	s.PollTimeout = 200 * time.Millisecond
+	httpAddr, tcpAddr := serve(t, s)
+	for _, tc := range []struct {
+		name   string
+		a, b   string
+		byName bool
+	}{
+		{"http", httpAddr, httpAddr, false},
+		{"tcp", tcpAddr, tcpAddr, false},
+		{"http to tcp", httpAddr, tcpAddr, false},
+		{"tcp to http by name", tcpAddr, httpAddr, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			room := ""
+			if tc.byName {
+				room = "relay " + tc.name
+			}
+			a, err := Join(tc.a, room, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if !tc.byName && !isCode(a.Room()) {
+				t.Fatalf("created room %q is not a pairing code", a.Room())
+			}
+			b, err := Join(tc.b, a.Room(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			// Both ways, with a long poll timing out in between.
+			relaySignal(t, a, b, nat.RoleControlling)
+			time.Sleep(300 * time.Millisecond)
+			relaySignal(t, b, a, nat.RoleControlled)
+
+			a.Close()
+			if _, err := b.Recv(); err != io.EOF {
+				t.Fatalf("Recv after the peer left: %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestInboxLimit(t *testing.T) {
+	httpAddr, tcpAddr := serve(t, NewServer())
+	// b never reads what a sends.
+	pair := func(addr string) (a, b Client) {
+		a, err := Join(addr, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { a.Close() })
+		b, err = JoinHTTP(httpAddr, a.Room(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		return a, b
+	}
+
+	t.Run("http messages", func(t *testing.T) {
+		a, _ := pair(httpAddr)
+		for i := 0; i < maxInboxMessages; i++ {
+			if err := a.Send([]byte("hi")); err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+		}
+		if err := a.Send([]byte("hi")); err == nil || !strings.Contains(err.Error(), errInboxFull.Error()) {
+			t.Fatalf("Send to a full inbox: %v", err)
+		}
+	})
+	t.Run("http bytes", func(t *testing.T) {
+		a, b := pair(httpAddr)
+		msg := make([]byte, MaxMessageLen)
+		for i := 0; i < maxInboxBytes/MaxMessageLen; i++ {
+			if err := a.Send(msg); err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+		}
+		if err := a.Send([]byte("hi")); err == nil || !strings.Contains(err.Error(), errInboxFull.Error()) {
+			t.Fatalf("Send to a full inbox: %v", err)
+		}
+		// Reading makes room again.
+		if _, err := b.Recv(); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Send([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("tcp", func(t *testing.T) {
+		a, _ := pair(tcpAddr)
+		for i := 0; i <= maxInboxMessages; i++ {
+			if err := a.Send([]byte("hi")); err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+		}
+		if _, err := a.Recv(); err == nil || !strings.Contains(err.Error(), errInboxFull.Error()) {
+			t.Fatalf("Recv after filling the inbox: %v", err)
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	s := NewServer()
+	s.PollTimeout = 100 * time.Millisecond
+	s.IdleTimeout = 500 * time.Millisecond
+	httpAddr, tcpAddr := serve(t, s)
+	for _, addr := range []string{httpAddr, tcpAddr} {
+		a, err := Join(addr, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		b, err := Join(addr, a.Room(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		relaySignal(t, a, b, nat.RoleControlling)
+		// Polling doesn't keep a room alive, only messages do.
+		start := time.Now()
+		_, err = a.Recv()
+		if err == nil || !strings.Contains(err.Error(), errRoomExpired.Error()) {
+			t.Fatalf("Recv in an idle room: %v", err)
+		}
+		if d := time.Since(start); d < 400*time.Millisecond {
+			t.Fatalf("room expired after %v", d)
+		}
+		if _, err := Join(addr, a.Room(), ""); err == nil {
+			t.Fatal("joined an expired room")
+		}
+	}
+}
+
+func TestOversized(t *testing.T) {
+	httpAddr, tcpAddr := serve(t, NewServer())
+	big := make([]byte, MaxMessageLen+1)
+	for _, addr := range []string{httpAddr, tcpAddr} {
+		a, err := Join(addr, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		if err := a.Send(big); err == nil {
+			t.Fatalf("%s: sent an oversized message", addr)
+		}
+	}
+
+	// A frame too large for the server ends the connection.
+	a, err := JoinTCP(strings.TrimPrefix(tcpAddr, "tcp://"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := JoinHTTP(httpAddr, a.Room(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := a.enc.Encode(tcpFrame{Data: big}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Recv(); err == nil {
+		t.Fatal("server took an oversized frame")
+	}
+	if _, err := b.Recv(); err != io.EOF {
+		t.Fatalf("Recv after the peer was dropped: %v, want io.EOF", err)
+	}
+}
+
+func TestHTTPRecvOversized(t *testing.T) {
+	// A server sending more than MaxMessageLen is an error, not a
+	// truncated message.
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.Write([]byte(`{"Room": "room", "Peer": "peer"}`))
+			return
+		}
+		w.Write(make([]byte, MaxMessageLen+1))
+	}))
+	defer hs.Close()
+	c, err := JoinHTTP(hs.URL, "room", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := c.Recv(); err == nil {
+		t.Fatalf("Recv returned %d bytes", len(msg))
+	}
+}
+
+func TestHTTPCloseUnblocksRecv(t *testing.T) {
+	s := NewServer()
+	s.PollTimeout = time.Minute
+	httpAddr, _ := serve(t, s)
+	a, err := JoinHTTP(httpAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Recv()
+		errs <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	a.Close()
+	select {
+	case err := <-errs:
+		if err != errClientClosed {
+			t.Fatalf("Recv on a closed client: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't end the long-poll")
+	}
+}
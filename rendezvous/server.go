@@ -0,0 +1,690 @@
+// Package rendezvous implements a signaling server that pairs two
+// peers and relays their signaling messages, along with matching
+// clients implementing nat.Signaler.
+//
+// Peers meet in a room. A room admits exactly two peers, and every
+// message one of them sends is delivered to the other. Rooms are
+// either named by the peers, or created by the server under a short
+// pairing code that the first peer hands to the second out of band.
+// Peers can talk to the server with HTTP long-polling or with the
+// JSON signaling protocol over TCP, and the two can be mixed in a
+// room.
+package rendezvous
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxMessageLen bounds the size of a single relayed message.
+const MaxMessageLen = 64 * 1024
+
+var (
+	errRoomFull     = errors.New("room is full")
+	errUnknownPeer  = errors.New("unknown peer")
+	errUnknownCode  = errors.New("unknown pairing code")
+	errPeerGone     = errors.New("peer left the room")
+	errRoomExpired  = errors.New("room expired")
+	errUnauthorized = errors.New("invalid token")
+	errTooManyJoins = errors.New("too many failed joins, try again later")
+	errTooManyRooms = errors.New("too many rooms created, try again later")
+	errInboxFull    = errors.New("peer's inbox is full")
+)
+
+const (
+	// A client that fails maxFailedJoins joins within
+	// failedJoinWindow is turned away until the window ends, so that
+	// pairing codes can't be guessed.
+	maxFailedJoins   = 10
+	failedJoinWindow = time.Minute
+	// A client creates at most maxCreates rooms within createWindow,
+	// so that it can't fill the room table.
+	maxCreates   = 20
+	createWindow = time.Minute
+	// A peer holds at most maxInboxMessages messages, of at most
+	// maxInboxBytes in all, that the other peer hasn't read yet.
+	maxInboxMessages = 64
+	maxInboxBytes    = 1 << 20
+)
+
+// A Server pairs peers and relays their messages. The zero value is
+// a valid Server, whose rooms never expire.
+type Server struct {
+	// PollTimeout is how long an HTTP long-poll waits for a message
+	// before returning empty-handed. Zero means 30 seconds.
+	PollTimeout time.Duration
+	// IdleTimeout is how long a room lives without any peer joining
+	// or sending a message. Zero means forever.
+	IdleTimeout time.Duration
+	// Tokens, if not empty, lists the tokens clients must present to
+	// use the server.
+	Tokens []string
+	// Verbose logs room activity.
+	Verbose bool
+
+	mu       sync.Mutex
+	rooms    map[string]*room
+	failures map[string]*clientEvents // failed joins, by client IP
+	creates  map[string]*clientEvents // created rooms, by client IP
+}
+
+// clientEvents counts the events of a client since a time.
+type clientEvents struct {
+	n     int
+	since time.Time
+}
+
+// limited reports whether client had max events within window.
+func limited(m map[string]*clientEvents, client string, max int, window time.Duration) bool {
+	f := m[client]
+	return f != nil && f.n >= max && time.Since(f.since) < window
+}
+
+// countEvent counts an event of client in *m, which starts a new
+// window if the last one ended.
+func countEvent(m *map[string]*clientEvents, client string, window time.Duration) {
+	if client == "" {
+		return
+	}
+	if *m == nil {
+		*m = map[string]*clientEvents{}
+	}
+	now := time.Now()
+	f := (*m)[client]
+	if f == nil || now.Sub(f.since) >= window {
+		// Forget the clients whose window ended, now and then.
+		if len(*m) >= 1024 {
+			for c, f := range *m {
+				if now.Sub(f.since) >= window {
+					delete(*m, c)
+				}
+			}
+		}
+		f = &clientEvents{since: now}
+		(*m)[client] = f
+	}
+	f.n++
+}
+
+// NewServer returns a Server with default settings.
+func NewServer() *Server {
+	return &Server{
+		PollTimeout: 30 * time.Second,
+		IdleTimeout: 10 * time.Minute,
+	}
+}
+
+func (s *Server) pollTimeout() time.Duration {
+	if s.PollTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return s.PollTimeout
+}
+
+// addRoomLocked adds r to the rooms. Must be called with s.mu held.
+func (s *Server) addRoomLocked(r *room) {
+	if s.rooms == nil {
+		s.rooms = map[string]*room{}
+	}
+	s.rooms[r.name] = r
+}
+
+type room struct {
+	name   string
+	peers  [2]*peer
+	active time.Time
+	// joins counts the peers that ever joined. Rooms are single
+	// use, so a peer that leaves cannot be replaced.
+	joins int
+	// An expired room lingers for another IdleTimeout, so that its
+	// peers learn why it is gone.
+	expired bool
+}
+
+type peer struct {
+	id         string // empty until a peer takes the seat
+	inbox      [][]byte
+	inboxBytes int
+	gone       bool // the other peer left
+	left       bool
+	wake       chan struct{}
+}
+
+func (p *peer) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) authorized(token string) bool {
+	if len(s.Tokens) == 0 {
+		return true
+	}
+	for _, t := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func newRoom(name string) *room {
+	r := &room{name: name, active: time.Now()}
+	for i := range r.peers {
+		r.peers[i] = &peer{wake: make(chan struct{}, 1)}
+	}
+	return r
+}
+
+// create makes a room under a fresh pairing code and joins it on
+// behalf of client, the IP address of the peer.
+func (s *Server) create(client string) (code string, p *peer, err error) {
+	s.mu.Lock()
+	if limited(s.creates, client, maxCreates, createWindow) {
+		s.mu.Unlock()
+		return "", nil, errTooManyRooms
+	}
+	countEvent(&s.creates, client, createWindow)
+	s.mu.Unlock()
+	for {
+		code, err = randomCode()
+		if err != nil {
+			return "", nil, err
+		}
+		s.mu.Lock()
+		_, taken := s.rooms[code]
+		if !taken {
+			s.addRoomLocked(newRoom(code))
+		}
+		s.mu.Unlock()
+		if !taken {
+			break
+		}
+	}
+	p, err = s.join(code, "")
+	return code, p, err
+}
+
+// join joins the room name on behalf of client, the IP address of the
+// peer.
+func (s *Server) join(name, client string) (*peer, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limited(s.failures, client, maxFailedJoins, failedJoinWindow) {
+		return nil, errTooManyJoins
+	}
+	p, err := s.joinLocked(name, id)
+	if err == errUnknownCode || err == errRoomFull {
+		countEvent(&s.failures, client, failedJoinWindow)
+	}
+	return p, err
+}
+
+func (s *Server) joinLocked(name, id string) (*peer, error) {
+	s.expireLocked()
+	r := s.rooms[name]
+	if r == nil || r.expired {
+		// Pairing codes are only handed out by the server, so a
+		// missing one is a typo or an expired room, not a request
+		// for a new room.
+		if isCode(name) {
+			return nil, errUnknownCode
+		}
+		r = newRoom(name)
+		s.addRoomLocked(r)
+	}
+	if r.joins == len(r.peers) {
+		return nil, errRoomFull
+	}
+	// The seat may already hold messages sent before we joined.
+	p := r.peers[r.joins]
+	p.id = id
+	r.joins++
+	r.active = time.Now()
+	if s.Verbose {
+		log.Printf("Peer %s joined room %q", id, name)
+	}
+	return p, nil
+}
+
+// expireLocked closes the rooms that have been idle for too long. Must
+// be called with s.mu held.
+func (s *Server) expireLocked() {
+	if s.IdleTimeout <= 0 {
+		return
+	}
+	for name, r := range s.rooms {
+		idle := time.Since(r.active)
+		switch {
+		case idle >= 2*s.IdleTimeout:
+			delete(s.rooms, name)
+		case idle >= s.IdleTimeout && !r.expired:
+			r.expired = true
+			for _, p := range r.peers {
+				p.notify()
+			}
+			if s.Verbose {
+				log.Printf("Room %q expired", name)
+			}
+		}
+	}
+}
+
+// lookup returns the room name, the peer with the given id in it and
+// the other seat of the room. Must be called with s.mu held.
+func (s *Server) lookup(name, id string) (r *room, me, other *peer, err error) {
+	s.expireLocked()
+	r = s.rooms[name]
+	if r == nil {
+		return nil, nil, nil, errUnknownPeer
+	}
+	for i, p := range r.peers {
+		if id != "" && p.id == id && !p.left {
+			if r.expired {
+				return nil, nil, nil, errRoomExpired
+			}
+			return r, p, r.peers[1-i], nil
+		}
+	}
+	return nil, nil, nil, errUnknownPeer
+}
+
+func (s *Server) send(name, id string, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, me, other, err := s.lookup(name, id)
+	if err != nil {
+		return err
+	}
+	if me.gone {
+		return errPeerGone
+	}
+	if len(other.inbox) >= maxInboxMessages || other.inboxBytes+len(msg) > maxInboxBytes {
+		return errInboxFull
+	}
+	r.active = time.Now()
+	other.inbox = append(other.inbox, append([]byte{}, msg...))
+	other.inboxBytes += len(msg)
+	other.notify()
+	return nil
+}
+
+// recv waits up to timeout for a message for peer id. It returns nil
+// and no error on timeout.
+func (s *Server) recv(name, id string, timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		_, me, _, err := s.lookup(name, id)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if len(me.inbox) > 0 {
+			msg := me.inbox[0]
+			me.inbox = me.inbox[1:]
+			me.inboxBytes -= len(msg)
+			s.mu.Unlock()
+			return msg, nil
+		}
+		if me.gone {
+			s.mu.Unlock()
+			return nil, errPeerGone
+		}
+		wake := me.wake
+		s.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-deadline.C:
+			return nil, nil
+		case <-cancel:
+			return nil, nil
+		}
+	}
+}
+
+func (s *Server) leave(name, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, me, other, err := s.lookup(name, id)
+	if err != nil {
+		return
+	}
+	me.left = true
+	me.notify()
+	if other.id != "" && !other.left {
+		other.gone = true
+		other.notify()
+	} else {
+		delete(s.rooms, r.name)
+	}
+	if s.Verbose {
+		log.Printf("Peer %s left room %q", id, name)
+	}
+}
+
+func randomID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// codeChars avoids characters that are easily confused when read
+// aloud or typed (0/O, 1/I/L).
+const codeChars = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// randomCode returns a pairing code of the form "XXXX-XXXX", about 40
+// bits of entropy.
+func randomCode() (string, error) {
+	code := make([]byte, 0, 9)
+	var b [16]byte
+	for len(code) < 9 {
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			// Drop the bytes past the last multiple of
+			// len(codeChars), so that all characters are equally
+			// likely.
+			if int(c) >= 256/len(codeChars)*len(codeChars) {
+				continue
+			}
+			if len(code) == 4 {
+				code = append(code, '-')
+			}
+			code = append(code, codeChars[int(c)%len(codeChars)])
+			if len(code) == 9 {
+				break
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// clientIP returns the IP address of a client, to count its failed
+// joins.
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func isCode(name string) bool {
+	if len(name) != 9 || name[4] != '-' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if i != 4 && strings.IndexByte(codeChars, name[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeRoom canonicalizes a room name typed by a human. Pairing
+// codes are case insensitive, room names are not.
+func NormalizeRoom(name string) string {
+	name = strings.TrimSpace(name)
+	if code := strings.ToUpper(name); isCode(code) {
+		return code
+	}
+	return name
+}
+
+// ServeHTTP implements the long-polling HTTP API:
+//
+//	POST   /rooms                create a room with a pairing code and join
+//	                             it, returns {"Room": <code>, "Peer": <id>}
+//	POST   /rooms/<room>         join, returns {"Room": <room>, "Peer": <id>}
+//	POST   /rooms/<room>/<id>    send the request body to the other peer
+//	GET    /rooms/<room>/<id>    wait for a message, 204 if none came
+//	DELETE /rooms/<room>/<id>    leave the room
+//
+// If the server requires tokens, clients present them in an
+// "Authorization: Bearer <token>" header.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		httpError(w, errUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "rooms" || len(parts) > 3 || (len(parts) > 1 && parts[1] == "") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) <= 2 {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var (
+			name string
+			p    *peer
+			err  error
+		)
+		if len(parts) == 1 {
+			name, p, err = s.create(clientIP(r.RemoteAddr))
+		} else {
+			name = parts[1]
+			p, err = s.join(name, clientIP(r.RemoteAddr))
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Room, Peer string }{name, p.id})
+		return
+	}
+
+	name, id := parts[1], parts[2]
+	switch r.Method {
+	case "POST":
+		msg, err := io.ReadAll(io.LimitReader(r.Body, MaxMessageLen+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(msg) > MaxMessageLen {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := s.send(name, id, msg); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		msg, err := s.recv(name, id, s.pollTimeout(), r.Context().Done())
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if msg == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(msg)
+	case "DELETE":
+		s.leave(name, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case errRoomFull:
+		code = http.StatusConflict
+	case errUnknownPeer, errUnknownCode:
+		code = http.StatusNotFound
+	case errPeerGone, errRoomExpired:
+		code = http.StatusGone
+	case errUnauthorized:
+		code = http.StatusUnauthorized
+	case errTooManyJoins, errTooManyRooms, errInboxFull:
+		code = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// A tcpHello is the first object a TCP client sends, and the server's
+// answer to it. A client that sends no Room asks for a new room with
+// a pairing code.
+type tcpHello struct {
+	Room  string `json:",omitempty"`
+	Token string `json:",omitempty"`
+	Peer  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// A tcpFrame carries one message, or an error that terminates the
+// stream. It is the frame of nat.NewJSONSignaler.
+type tcpFrame struct {
+	Data  []byte `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// ServeTCP accepts connections on l and serves the JSON signaling
+// protocol on them, until l fails.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(c)
+	}
+}
+
+// maxFrameLen bounds the JSON encoding of a tcpFrame: the base64 of
+// its message, and some room for the rest.
+const maxFrameLen = MaxMessageLen/3*4 + 1024
+
+// frameLimiter fails the reads of a connection once n bytes have been
+// read, so that a client can't have the decoder buffer an endless
+// frame. It is reset before each frame.
+type frameLimiter struct {
+	r io.Reader
+	n int
+}
+
+func (l *frameLimiter) Read(b []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errors.New("frame too large")
+	}
+	if len(b) > l.n {
+		b = b[:l.n]
+	}
+	n, err := l.r.Read(b)
+	l.n -= n
+	return n, err
+}
+
+func (s *Server) serveTCPConn(c net.Conn) {
+	defer c.Close()
+	// The decoder reads ahead, so a frame may be charged for the
+	// start of the next one, which then gets a fresh allowance: at
+	// most two frames are ever buffered.
+	limit := &frameLimiter{r: c, n: maxFrameLen}
+	dec := json.NewDecoder(limit)
+	enc := json.NewEncoder(c)
+
+	var hello tcpHello
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := dec.Decode(&hello); err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	if !s.authorized(hello.Token) {
+		enc.Encode(tcpHello{Error: errUnauthorized.Error()})
+		return
+	}
+	var (
+		p   *peer
+		err error
+	)
+	if hello.Room == "" {
+		hello.Room, p, err = s.create(clientIP(c.RemoteAddr().String()))
+	} else {
+		p, err = s.join(hello.Room, clientIP(c.RemoteAddr().String()))
+	}
+	if err != nil {
+		enc.Encode(tcpHello{Error: err.Error()})
+		return
+	}
+	defer s.leave(hello.Room, p.id)
+	if err := enc.Encode(tcpHello{Room: hello.Room, Peer: p.id}); err != nil {
+		return
+	}
+
+	// The frames carry no answers, so a message the server refuses
+	// ends the stream with the error.
+	done := make(chan struct{})
+	var sendErr error
+	go func() {
+		defer close(done)
+		for {
+			var f tcpFrame
+			limit.n = maxFrameLen
+			if err := dec.Decode(&f); err != nil {
+				return
+			}
+			if len(f.Data) > MaxMessageLen {
+				return
+			}
+			if err := s.send(hello.Room, p.id, f.Data); err != nil {
+				sendErr = err
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := s.recv(hello.Room, p.id, s.pollTimeout(), done)
+		if err != nil {
+			enc.Encode(tcpFrame{Error: err.Error()})
+			return
+		}
+		select {
+		case <-done:
+			if sendErr != nil {
+				enc.Encode(tcpFrame{Error: sendErr.Error()})
+			}
+			return
+		default:
+		}
+		if msg == nil {
+			continue
+		}
+		if err := enc.Encode(tcpFrame{Data: msg}); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package rendezvous
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRandomCode(t *testing.T) {
+	counts := map[byte]int{}
+	for i := 0; i < 2000; i++ {
+		code, err := randomCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isCode(code) {
+			t.Fatalf("randomCode returned %q, which isCode rejects", code)
+		}
+		if NormalizeRoom(" "+strings.ToLower(code)+" ") != code {
+			t.Fatalf("NormalizeRoom doesn't recover %q", code)
+		}
+		for j := 0; j < len(code); j++ {
+			if code[j] != '-' {
+				counts[code[j]]++
+			}
+		}
+	}
+	// 16000 characters over 31: about 516 each. A modulo bias would
+	// favor the first 8 characters by 9 to 8.
+	for _, c := range []byte(codeChars) {
+		if n := counts[c]; n < 400 || n > 640 {
+			t.Errorf("character %q drawn %d times", c, n)
+		}
+	}
+}
+
+func TestIsCode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"ABCD-2345", true},
+		{"ABC-234", false},
+		{"ABCD2345", false},
+		{"ABCD-2340", false}, // 0 is not a code character
+		{"abcd-2345", false},
+		{"my room", false},
+	} {
+		if got := isCode(tc.name); got != tc.want {
+			t.Errorf("isCode(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestZeroServer(t *testing.T) {
+	var s Server
+	code, p, err := s.create("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := s.join(code, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.send(code, p.id, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.recv(code, q.id, s.pollTimeout(), nil)
+	if err != nil || string(msg) != "hi" {
+		t.Fatalf("recv = %q, %v", msg, err)
+	}
+}
+
+func TestFailedJoinLimit(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < maxFailedJoins; i++ {
+		if _, err := s.join("ABCD-2345", "192.0.2.1"); err != errUnknownCode {
+			t.Fatalf("join %d: %v, want %v", i, err, errUnknownCode)
+		}
+	}
+	code, _, err := s.create("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even a good code is refused now, so that guessing gets nowhere.
+	if _, err := s.join(code, "192.0.2.1"); err != errTooManyJoins {
+		t.Fatalf("join after failures: %v, want %v", err, errTooManyJoins)
+	}
+	if _, err := s.join(code, "192.0.2.2"); err != nil {
+		t.Fatalf("join from another client: %v", err)
+	}
+}
+
+func TestCreateLimit(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < maxCreates; i++ {
+		if _, _, err := s.create("192.0.2.1"); err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+	}
+	if _, _, err := s.create("192.0.2.1"); err != errTooManyRooms {
+		t.Fatalf("create over the limit: %v, want %v", err, errTooManyRooms)
+	}
+	if _, _, err := s.create("192.0.2.2"); err != nil {
+		t.Fatalf("create from another client: %v", err)
+	}
+}
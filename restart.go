@@ -0,0 +1,86 @@
+package nat
+
+import "time"
+
+// Restart performs an ICE restart on c: it gathers candidates again,
+// exchanges them and fresh credentials with the peer through xchg,
+// and runs connectivity checks while the current path keeps carrying
+// traffic. Once a new candidate pair is nominated, c atomically
+// switches over to it.
+//
+// Both peers must call Restart, typically after agreeing to over
+// their signaling channel, and they keep their original roles. If
+// the restart fails, c keeps using the current path.
+//
+// Only the component of c is restarted, and the peer must restart
+// the same component.
+func (c *Conn) Restart(xchg ExchangeCandidatesFun) error {
+	return c.restart(func(mine []byte) ([]byte, error) {
+		return xchg(mine), nil
+	})
+}
+
+// RestartSignaler is like Restart, but exchanges candidates with the
+// peer over s.
+func (c *Conn) RestartSignaler(s Signaler) error {
+	return c.restart(signalerExchange(s))
+}
+
+func (c *Conn) restart(xchg exchangeFun) error {
+	c.restartMu.Lock()
+	defer c.restartMu.Unlock()
+
+	q := newPacketQueue(256, c.cfg.clock())
+	c.mu.Lock()
+	c.stun = q
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.stun = nil
+		c.mu.Unlock()
+		q.close()
+	}()
+
+	c.mu.Lock()
+	lease := c.lease
+	c.mu.Unlock()
+	engine := &attemptEngine{
+		xchg:      xchg,
+		sock:      &queueConn{q, c.conn},
+		initiator: c.initiator,
+		cfg:       c.cfg,
+		component: c.component,
+		session:   c.session,
+		log:       c.log,
+		stats:     newStats(c.session, c.initiator, c.cfg.clock().Now()),
+		lease:     lease,
+		// The peer knows our tiebreaker, keep it.
+		tiebreaker: c.tiebreaker,
+	}
+	var sel *attempt
+	err := engine.init()
+	if err == nil {
+		sel, err = engine.check()
+		engine.stats.finish(c.cfg.clock().Now(), []*attemptEngine{engine}, err)
+	}
+	c.cfg.recordNegotiation(engine.stats.Start, c.cfg.clock().Now(), []*attemptEngine{engine}, err)
+	if err != nil {
+		engine.stats.Err = err
+		engine.emit(Event{Type: EventFailed, Err: err})
+		// Drop the mapping made by this restart, if any.
+		if engine.lease != lease {
+			engine.lease.Close()
+		}
+		return &NegotiationError{Err: err, Stats: engine.stats}
+	}
+
+	c.mu.Lock()
+	c.lease = engine.lease
+	c.local, c.remote = engine.localAddr(), sel.Addr
+	c.localCreds, c.remoteCreds = engine.local, engine.remote
+	c.pending = map[string]time.Time{}
+	c.lastConsent = c.cfg.clock().Now()
+	c.stats = engine.stats
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,143 @@
+package nat
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+
+	"github.com/danderson/nat/dtls"
+	"github.com/danderson/nat/noise"
+)
+
+// Secure runs a DTLS handshake over c, authenticated by the
+// certificates whose fingerprints the peers signaled (see
+// Config.Certificate), and returns the encrypted connection. The
+// initiator is the DTLS client. c belongs to the returned Conn, and is
+// closed if the handshake fails.
+func (c *Conn) Secure() (*dtls.Conn, error) {
+	c.mu.Lock()
+	fp := c.fingerprint
+	c.mu.Unlock()
+	switch {
+	case c.cfg.Certificate == nil:
+		return nil, newError(ErrHandshakeFailed, nil, "no local certificate")
+	case fp == "":
+		return nil, newError(ErrHandshakeFailed, nil, "the peer signaled no certificate fingerprint")
+	}
+	cfg := &dtls.Config{
+		Certificate: *c.cfg.Certificate,
+		VerifyPeer:  dtls.VerifyFingerprint(fp),
+		Now:         c.cfg.clock().Now,
+	}
+	var conn *dtls.Conn
+	if c.initiator {
+		conn = dtls.Client(c, cfg)
+	} else {
+		conn = dtls.Server(c, cfg)
+	}
+	if err := conn.Handshake(); err != nil {
+		c.log.Error("DTLS handshake failed", "err", err)
+		c.Close()
+		return nil, newError(ErrHandshakeFailed, err, "")
+	}
+	c.log.Info("DTLS handshake done")
+	return conn, nil
+}
+
+// ConnectSecure is like ConnectOpt, but returns a connection
+// encrypted and authenticated with DTLS, see Conn.Secure. If
+// cfg.Certificate is nil, it uses a fresh certificate.
+func ConnectSecure(xchg ExchangeCandidatesFun, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectSecure(wrapExchange(xchg), initiator, cfg)
+}
+
+// ConnectSignalerSecure is like ConnectSecure, but exchanges
+// candidates with the peer over s.
+func ConnectSignalerSecure(s Signaler, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectSecure(signalerExchange(s), initiator, cfg)
+}
+
+func connectSecure(xchg exchangeFun, initiator bool, cfg *Config) (net.Conn, error) {
+	if cfg.Certificate == nil {
+		cert, err := dtls.GenerateCertificate()
+		if err != nil {
+			return nil, err
+		}
+		cfg2 := *cfg
+		cfg2.Certificate = &cert
+		cfg = &cfg2
+	}
+	conn, err := connectOne(xchg, initiator, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*Conn).Secure()
+}
+
+// SecureNoise is like Secure, but runs the Noise handshake of
+// Config.Noise. The initiator is the Noise initiator. The peer's
+// static key is the one pinned in Config.Noise.PeerKey, or else the
+// one it signaled.
+func (c *Conn) SecureNoise() (*noise.Conn, error) {
+	c.mu.Lock()
+	peerKey := c.noiseKey
+	c.mu.Unlock()
+	if c.cfg.Noise == nil {
+		return nil, newError(ErrHandshakeFailed, nil, "no Noise configuration")
+	}
+	cfg := *c.cfg.Noise
+	if cfg.PeerKey == nil {
+		cfg.PeerKey = peerKey
+	}
+	if cfg.Now == nil {
+		cfg.Now = c.cfg.clock().Now
+	}
+	var conn *noise.Conn
+	if c.initiator {
+		conn = noise.Initiator(c, &cfg)
+	} else {
+		conn = noise.Responder(c, &cfg)
+	}
+	if err := conn.Handshake(); err != nil {
+		c.log.Error("Noise handshake failed", "err", err)
+		c.Close()
+		return nil, newError(ErrHandshakeFailed, err, "")
+	}
+	c.log.Info("Noise handshake done", "pattern", cfg.Pattern)
+	return conn, nil
+}
+
+// ConnectNoise is like ConnectOpt, but returns a connection encrypted
+// and authenticated with Noise, see Conn.SecureNoise. If cfg.Noise is
+// nil, it runs IK with a fresh static key.
+func ConnectNoise(xchg ExchangeCandidatesFun, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectNoise(wrapExchange(xchg), initiator, cfg)
+}
+
+// ConnectSignalerNoise is like ConnectNoise, but exchanges candidates
+// with the peer over s.
+func ConnectSignalerNoise(s Signaler, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectNoise(signalerExchange(s), initiator, cfg)
+}
+
+func connectNoise(xchg exchangeFun, initiator bool, cfg *Config) (net.Conn, error) {
+	if cfg.Noise == nil || cfg.Noise.StaticKey == nil {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		n := &noise.Config{}
+		if cfg.Noise != nil {
+			*n = *cfg.Noise
+		}
+		n.StaticKey = key
+		cfg2 := *cfg
+		cfg2.Noise = n
+		cfg = &cfg2
+	}
+	conn, err := connectOne(xchg, initiator, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*Conn).SecureNoise()
+}
@@ -0,0 +1,233 @@
+package nat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/danderson/nat/dtls"
+)
+
+// SignalVersion is the version of the signaling message format
+// spoken by this package. Peers refuse messages of any other
+// version. Version 2 added port-mapped candidates, and ignores the
+// fields and candidate types it doesn't know, so that new optional
+// fields and types don't need a new version.
+const SignalVersion = 2
+
+// Capabilities a peer can advertise in a Signal.
+const (
+	// capEagerNomination is advertised by an initiator that doesn't
+	// wait for PeerDeadline once it has nominated a pair, so the
+	// controlled peer must accept nominations right away.
+	capEagerNomination = "eager-nomination"
+	// capLite is advertised by an ICE-lite peer, see Config.Lite.
+	capLite = "ice-lite"
+)
+
+// Role is the ICE role of a peer in a negotiation. The controlling
+// peer (the initiator) decides which candidate pair gets used.
+type Role string
+
+// Possible roles.
+const (
+	RoleControlling Role = "controlling"
+	RoleControlled  Role = "controlled"
+)
+
+func roleFor(initiator bool) Role {
+	if initiator {
+		return RoleControlling
+	}
+	return RoleControlled
+}
+
+// Credentials are the ICE username fragment and password of a peer,
+// used to authenticate connectivity checks.
+type Credentials struct {
+	Ufrag string
+	Pwd   string
+}
+
+const iceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+
+// NewCredentials returns a fresh set of random credentials.
+func NewCredentials() (Credentials, error) {
+	ufrag, err := randomICEString(8)
+	if err != nil {
+		return Credentials{}, err
+	}
+	pwd, err := randomICEString(24)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{ufrag, pwd}, nil
+}
+
+func randomICEString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i := range buf {
+		buf[i] = iceChars[int(buf[i])%len(iceChars)]
+	}
+	return string(buf), nil
+}
+
+// Validate checks that the credentials conform to RFC 5245.
+func (c Credentials) Validate() error {
+	if len(c.Ufrag) < 4 || len(c.Ufrag) > 256 || !isICEString(c.Ufrag) {
+		return fmt.Errorf("invalid ufrag %q", c.Ufrag)
+	}
+	if len(c.Pwd) < 22 || len(c.Pwd) > 256 || !isICEString(c.Pwd) {
+		return errors.New("invalid password")
+	}
+	return nil
+}
+
+func isICEString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if bytes.IndexByte([]byte(iceChars), s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A Signal is the message a peer sends to the other over the
+// signaling channel to start a negotiation.
+type Signal struct {
+	Version     int
+	Credentials Credentials
+	Role        Role
+	// Capabilities lists the optional features the sender
+	// supports. Unknown capabilities are ignored.
+	Capabilities []string
+	Candidates   []Candidate
+	// Fingerprint is the fingerprint of the sender's DTLS
+	// certificate, see Config.Certificate.
+	Fingerprint string `json:",omitempty"`
+	// NoiseKey is the sender's static Noise key, see Config.Noise.
+	NoiseKey []byte `json:",omitempty"`
+}
+
+// Has reports whether the sender of s advertised capability c.
+func (s *Signal) Has(c string) bool {
+	for _, c2 := range s.Capabilities {
+		if c == c2 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that s is well formed and was produced by a
+// compatible version of this package.
+func (s *Signal) Validate() error {
+	if s.Version != SignalVersion {
+		return fmt.Errorf("unsupported signaling version %d, want %d", s.Version, SignalVersion)
+	}
+	if err := s.Credentials.Validate(); err != nil {
+		return err
+	}
+	if s.Role != RoleControlling && s.Role != RoleControlled {
+		return fmt.Errorf("unknown role %q", s.Role)
+	}
+	if s.Fingerprint != "" {
+		if _, err := dtls.ParseFingerprint(s.Fingerprint); err != nil {
+			return err
+		}
+	}
+	if s.NoiseKey != nil && len(s.NoiseKey) != 32 {
+		return fmt.Errorf("invalid Noise key of %d bytes", len(s.NoiseKey))
+	}
+	for _, c := range s.Candidates {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signaled reports whether candidates of type t can be sent to the
+// peer.
+func (t CandidateType) signaled() bool {
+	switch t {
+	case CandidateHost, CandidateServerReflexive, CandidatePortMapped, CandidatePredicted:
+		return true
+	}
+	return false
+}
+
+func (c Candidate) validate() error {
+	if !c.Type.signaled() {
+		return fmt.Errorf("unknown candidate type %q", c.Type)
+	}
+	if c.Addr == nil {
+		return errors.New("candidate without address")
+	}
+	if len(c.Addr.IP) != net.IPv4len && len(c.Addr.IP) != net.IPv6len {
+		return fmt.Errorf("invalid candidate IP %v", c.Addr.IP)
+	}
+	if c.Addr.Port <= 0 || c.Addr.Port > 65535 {
+		return fmt.Errorf("invalid candidate port %d", c.Addr.Port)
+	}
+	if c.Prio < 0 {
+		return fmt.Errorf("invalid candidate priority %d", c.Prio)
+	}
+	if c.Component < 0 || c.Component > maxComponents {
+		return fmt.Errorf("invalid candidate component %d", c.Component)
+	}
+	return nil
+}
+
+// Marshal validates s and returns its wire encoding.
+func (s *Signal) Marshal() ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+// ParseSignal decodes and validates a signaling message received
+// from a peer.
+func ParseSignal(raw []byte) (*Signal, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("empty signaling message")
+	}
+	// Check the version first, so that a peer running a different
+	// version gets a clear error rather than a decoding failure.
+	var v struct{ Version int }
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("malformed signaling message: %v", err)
+	}
+	if v.Version != SignalVersion {
+		return nil, fmt.Errorf("unsupported signaling version %d, want %d", v.Version, SignalVersion)
+	}
+
+	// Fields added after us are optional, and the peer's business.
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	var s Signal
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("malformed signaling message: %v", err)
+	}
+	if dec.More() {
+		return nil, errors.New("malformed signaling message: trailing data")
+	}
+	// Candidates of types added after us are the peer's business.
+	known := s.Candidates[:0]
+	for _, c := range s.Candidates {
+		if c.Type.signaled() {
+			known = append(known, c)
+		}
+	}
+	s.Candidates = known
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid signaling message: %v", err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,145 @@
+package nat
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testSignal(t *testing.T) *Signal {
+	creds, err := NewCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Signal{
+		Version:     SignalVersion,
+		Credentials: creds,
+		Role:        RoleControlling,
+		Candidates: []Candidate{
+			{Type: CandidateHost, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 1000}, Prio: 1 << 32},
+			{Type: CandidatePortMapped, Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 2000}, Prio: 100},
+			{Type: CandidatePredicted, Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 2002}, Prio: 1},
+		},
+	}
+}
+
+// editSignal marshals s and passes its JSON form through edit.
+func editSignal(t *testing.T, s *Signal, edit func(m map[string]interface{})) []byte {
+	raw, err := s.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		t.Fatal(err)
+	}
+	edit(m)
+	raw, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestSignalRoundTrip(t *testing.T) {
+	s := testSignal(t)
+	raw, err := s.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseSignal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Candidates) != 3 || got.Candidates[1].Type != CandidatePortMapped || got.Candidates[2].Type != CandidatePredicted {
+		t.Fatalf("candidates = %v", got.Candidates)
+	}
+}
+
+func TestSignalVersion(t *testing.T) {
+	raw := editSignal(t, testSignal(t), func(m map[string]interface{}) {
+		m["Version"] = SignalVersion - 1
+	})
+	if _, err := ParseSignal(raw); err == nil || !strings.Contains(err.Error(), "unsupported signaling version") {
+		t.Fatalf("ParseSignal of an old version: %v", err)
+	}
+}
+
+func TestSignalUnknownCandidateType(t *testing.T) {
+	raw := editSignal(t, testSignal(t), func(m map[string]interface{}) {
+		cands := m["Candidates"].([]interface{})
+		relay := map[string]interface{}{}
+		for k, v := range cands[0].(map[string]interface{}) {
+			relay[k] = v
+		}
+		relay["Type"] = "relay"
+		m["Candidates"] = append(cands, relay)
+	})
+	s, err := ParseSignal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Candidates) != 3 {
+		t.Fatalf("unknown candidate type not skipped: %v", s.Candidates)
+	}
+}
+
+func TestSignalUnknownField(t *testing.T) {
+	raw := editSignal(t, testSignal(t), func(m map[string]interface{}) {
+		m["Future"] = map[string]interface{}{"Field": 1}
+	})
+	if _, err := ParseSignal(raw); err != nil {
+		t.Fatalf("unknown field not ignored: %v", err)
+	}
+}
+
+func TestSignalNoiseKey(t *testing.T) {
+	// Peers that don't know NoiseKey ignore it, and peers that know
+	// it don't need it.
+	s := testSignal(t)
+	s.NoiseKey = make([]byte, 32)
+	s.NoiseKey[0] = 1
+	raw, err := s.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseSignal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.NoiseKey) != 32 || got.NoiseKey[0] != 1 {
+		t.Fatalf("NoiseKey = %x", got.NoiseKey)
+	}
+	raw = editSignal(t, s, func(m map[string]interface{}) { delete(m, "NoiseKey") })
+	if got, err = ParseSignal(raw); err != nil || got.NoiseKey != nil {
+		t.Fatalf("signal without NoiseKey: %v, %x", err, got.NoiseKey)
+	}
+	raw = editSignal(t, s, func(m map[string]interface{}) { m["NoiseKey"] = "AAAA" })
+	if _, err := ParseSignal(raw); err == nil {
+		t.Fatal("short NoiseKey accepted")
+	}
+}
+
+func TestSignalInvalid(t *testing.T) {
+	good, err := testSignal(t).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"role", editSignal(t, testSignal(t), func(m map[string]interface{}) { m["Role"] = "boss" })},
+		{"port", editSignal(t, testSignal(t), func(m map[string]interface{}) {
+			c := m["Candidates"].([]interface{})[0].(map[string]interface{})
+			c["Addr"].(map[string]interface{})["Port"] = 0
+		})},
+		{"trailing", append(append([]byte(nil), good...), good...)},
+	} {
+		if _, err := ParseSignal(tc.raw); err == nil {
+			t.Errorf("%s: invalid signal accepted", tc.name)
+		}
+	}
+}
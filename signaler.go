@@ -0,0 +1,157 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// A Signaler carries signaling messages between two peers, so that
+// they can exchange candidates before attempting to connect.
+//
+// The rendezvous package provides Signalers that talk to a
+// rendezvous server over HTTP or TCP.
+type Signaler interface {
+	// Send delivers one message to the peer.
+	Send(msg []byte) error
+	// Recv blocks until the next message from the peer arrives.
+	Recv() ([]byte, error)
+	Close() error
+}
+
+// ConnectSignaler is like ConnectOpt, but exchanges candidates with
+// the peer over s. s is not closed when ConnectSignaler returns.
+func ConnectSignaler(s Signaler, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectOne(signalerExchange(s), initiator, cfg)
+}
+
+// ConnectSignalerComponents is like ConnectComponents, but exchanges
+// candidates with the peer over s.
+func ConnectSignalerComponents(s Signaler, initiator bool, cfg *Config) ([]*Conn, error) {
+	return connect(signalerExchange(s), initiator, cfg)
+}
+
+func signalerExchange(s Signaler) exchangeFun {
+	return func(mine []byte) ([]byte, error) {
+		// Send and receive concurrently, so that unbuffered
+		// transports don't deadlock with both peers sending.
+		sent := make(chan error, 1)
+		go func() { sent <- s.Send(mine) }()
+		theirs, err := s.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if err := <-sent; err != nil {
+			return nil, err
+		}
+		return theirs, nil
+	}
+}
+
+// maxSignalLen bounds the size of a single signaling message.
+const maxSignalLen = 64 * 1024
+
+type streamSignaler struct {
+	r   *bufio.Scanner
+	w   io.Writer
+	c   []io.Closer
+	wmu sync.Mutex
+}
+
+// NewStreamSignaler returns a Signaler that writes newline-terminated
+// messages to w and reads them from r, e.g. the stdin and stdout of
+// an ssh session. Close closes r and w if they are io.Closers.
+func NewStreamSignaler(r io.Reader, w io.Writer) Signaler {
+	s := &streamSignaler{r: bufio.NewScanner(r), w: w}
+	s.r.Buffer(make([]byte, 4096), maxSignalLen+1)
+	for _, x := range []interface{}{r, w} {
+		if c, ok := x.(io.Closer); ok {
+			s.c = append(s.c, c)
+		}
+	}
+	return s
+}
+
+func (s *streamSignaler) Send(msg []byte) error {
+	if bytes.IndexByte(msg, '\n') >= 0 {
+		return errors.New("signaling message contains a newline")
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.w.Write(append(msg[:len(msg):len(msg)], '\n'))
+	return err
+}
+
+func (s *streamSignaler) Recv() ([]byte, error) {
+	if !s.r.Scan() {
+		if err := s.r.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return append([]byte(nil), s.r.Bytes()...), nil
+}
+
+func (s *streamSignaler) Close() error {
+	var ret error
+	for _, c := range s.c {
+		if err := c.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// The JSON signaling protocol is a stream of JSON objects, one per
+// message. A frame with an Error terminates the stream.
+type jsonFrame struct {
+	Data  []byte `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+type jsonSignaler struct {
+	conn io.ReadWriteCloser
+	dec  *json.Decoder
+	wmu  sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONSignaler returns a Signaler that speaks the JSON signaling
+// protocol over conn, typically a TCP connection to the peer. To go
+// through a rendezvous server, which expects a hello first, use
+// rendezvous.JoinTCP instead.
+func NewJSONSignaler(conn io.ReadWriteCloser) Signaler {
+	return &jsonSignaler{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+}
+
+func (s *jsonSignaler) Send(msg []byte) error {
+	if len(msg) > maxSignalLen {
+		return errors.New("signaling message too large")
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.enc.Encode(jsonFrame{Data: msg})
+}
+
+func (s *jsonSignaler) Recv() ([]byte, error) {
+	var f jsonFrame
+	if err := s.dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Error != "" {
+		return nil, errors.New(f.Error)
+	}
+	return f.Data, nil
+}
+
+func (s *jsonSignaler) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,225 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Side says which peer a failed negotiation is blamed on.
+type Side int
+
+// Sides.
+const (
+	// SideNone is for negotiations that succeeded.
+	SideNone Side = iota
+	// SideLocal is us: we could not gather candidates, or the
+	// peer's checks reached us but ours never got an answer.
+	SideLocal
+	// SideRemote is the peer, or the signaling channel to it: it
+	// sent no valid signal, or none of its checks reached us.
+	SideRemote
+)
+
+func (s Side) String() string {
+	switch s {
+	case SideNone:
+		return "none"
+	case SideLocal:
+		return "local"
+	case SideRemote:
+		return "remote"
+	}
+	return fmt.Sprintf("Side(%d)", int(s))
+}
+
+// Stats describes a negotiation, after the ICE entries of WebRTC's
+// getStats: the candidates of both sides, the checks run on each
+// candidate pair, and the time spent in each phase.
+type Stats struct {
+	// Session identifies the negotiation, as in logs and events.
+	Session   string
+	Initiator bool
+	// LocalCandidates counts our candidates by type, and
+	// RemoteCandidates the peer's, including those we learned from
+	// its checks.
+	LocalCandidates  map[CandidateType]int
+	RemoteCandidates map[CandidateType]int
+	// Pairs lists the candidate pairs we checked.
+	Pairs []PairStats
+	// Start is when the negotiation began. GatherTime, SignalTime
+	// and CheckTime are how long its phases took.
+	Start      time.Time
+	GatherTime time.Duration
+	SignalTime time.Duration
+	CheckTime  time.Duration
+	// Err is the error that ended the negotiation, nil on success,
+	// and FailedSide who it is blamed on.
+	Err        error
+	FailedSide Side
+}
+
+// PairStats describes the checks run on a candidate pair.
+type PairStats struct {
+	Component int
+	// Local is the address of our socket, and Reflexive our address
+	// as the peer sees it, once a check succeeded.
+	Local     net.Addr
+	Reflexive net.Addr
+	Remote    Candidate
+	Succeeded bool
+	Nominated bool
+	// Checks counters, as in WebRTC's RTCIceCandidatePairStats.
+	RequestsSent      int
+	ResponsesReceived int
+	RequestsReceived  int
+	ResponsesSent     int
+	// CurrentRoundTripTime is the RTT of the last answered check,
+	// TotalRoundTripTime the sum over all answered checks.
+	CurrentRoundTripTime time.Duration
+	TotalRoundTripTime   time.Duration
+}
+
+func newStats(session string, initiator bool, start time.Time) *Stats {
+	return &Stats{
+		Session:          session,
+		Initiator:        initiator,
+		LocalCandidates:  map[CandidateType]int{},
+		RemoteCandidates: map[CandidateType]int{},
+		Start:            start,
+	}
+}
+
+// clone returns a deep copy of s.
+func (s *Stats) clone() *Stats {
+	ret := *s
+	ret.LocalCandidates = map[CandidateType]int{}
+	for k, v := range s.LocalCandidates {
+		ret.LocalCandidates[k] = v
+	}
+	ret.RemoteCandidates = map[CandidateType]int{}
+	for k, v := range s.RemoteCandidates {
+		ret.RemoteCandidates[k] = v
+	}
+	ret.Pairs = append([]PairStats(nil), s.Pairs...)
+	return &ret
+}
+
+// finish completes s once the connectivity checks of engines are
+// over, at now, with err.
+func (s *Stats) finish(now time.Time, engines []*attemptEngine, err error) {
+	s.CheckTime = now.Sub(s.Start) - s.GatherTime - s.SignalTime
+	for _, e := range engines {
+		s.addPairs(e)
+	}
+	s.Err = err
+	if err != nil {
+		s.blameChecks()
+	}
+}
+
+// addPairs records the pairs checked by e.
+func (s *Stats) addPairs(e *attemptEngine) {
+	for i := range e.attempts {
+		a := &e.attempts[i]
+		if a.sock == 0 {
+			s.RemoteCandidates[a.Type]++
+		}
+		if a.requestsSent == 0 && a.requestsReceived == 0 {
+			continue
+		}
+		s.Pairs = append(s.Pairs, PairStats{
+			Component:            e.component,
+			Local:                e.socket(a.sock).LocalAddr(),
+			Reflexive:            a.localaddr,
+			Remote:               a.Candidate,
+			Succeeded:            a.success,
+			Nominated:            a == e.selected,
+			RequestsSent:         a.requestsSent,
+			ResponsesReceived:    a.responsesReceived,
+			RequestsReceived:     a.requestsReceived,
+			ResponsesSent:        a.requestsReceived,
+			CurrentRoundTripTime: a.rtt,
+			TotalRoundTripTime:   a.totalRTT,
+		})
+	}
+}
+
+// blameChecks sets FailedSide for connectivity checks that failed.
+func (s *Stats) blameChecks() {
+	for _, p := range s.Pairs {
+		if p.RequestsReceived > 0 {
+			s.FailedSide = SideLocal
+			return
+		}
+	}
+	s.FailedSide = SideRemote
+}
+
+// String returns a human readable report of s.
+func (s *Stats) String() string {
+	var b strings.Builder
+	role := "controlled"
+	if s.Initiator {
+		role = "controlling"
+	}
+	fmt.Fprintf(&b, "session %s (%s): gather %v, signal %v, checks %v\n", s.Session, role, s.GatherTime, s.SignalTime, s.CheckTime)
+	if s.Err != nil {
+		fmt.Fprintf(&b, "failed on the %s side: %v\n", s.FailedSide, s.Err)
+	}
+	fmt.Fprintf(&b, "local candidates: %s\n", countTypes(s.LocalCandidates))
+	fmt.Fprintf(&b, "remote candidates: %s\n", countTypes(s.RemoteCandidates))
+	for _, p := range s.Pairs {
+		state := "failed"
+		switch {
+		case p.Nominated:
+			state = "nominated"
+		case p.Succeeded:
+			state = "succeeded"
+		}
+		rtt := "-"
+		if p.ResponsesReceived > 0 {
+			rtt = p.CurrentRoundTripTime.String()
+		}
+		fmt.Fprintf(&b, "  [%d] %v -> %v: %s, sent %d, answered %d, received %d, rtt %s\n",
+			p.Component, p.Local, p.Remote, state, p.RequestsSent, p.ResponsesReceived, p.RequestsReceived, rtt)
+	}
+	return b.String()
+}
+
+func countTypes(m map[CandidateType]int) string {
+	if len(m) == 0 {
+		return "none"
+	}
+	var ret []string
+	for t, n := range m {
+		ret = append(ret, fmt.Sprintf("%d %s", n, t))
+	}
+	sort.Strings(ret)
+	return strings.Join(ret, ", ")
+}
+
+// A NegotiationError is a failed negotiation, with the Stats that
+// help understand why.
+type NegotiationError struct {
+	Err   error
+	Stats *Stats
+}
+
+func (e *NegotiationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NegotiationError) Unwrap() error {
+	return e.Err
+}
+
+// Stats returns the statistics of the negotiation that established
+// c, or of its last successful ICE restart.
+func (c *Conn) Stats() *Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats.clone()
+}
@@ -0,0 +1,113 @@
+package nat
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	a, b, _ := vnetPair(t, nil)
+	s := a.Stats()
+	if s.Session != a.Session() || !s.Initiator || s.Err != nil || s.FailedSide != SideNone {
+		t.Fatalf("stats of a connected initiator: %+v", s)
+	}
+	if s.LocalCandidates[CandidateHost] != 1 || s.LocalCandidates[CandidateServerReflexive] != 1 {
+		t.Errorf("local candidates %v", s.LocalCandidates)
+	}
+	if s.RemoteCandidates[CandidateHost] != 1 || s.RemoteCandidates[CandidateServerReflexive] != 1 {
+		t.Errorf("remote candidates %v", s.RemoteCandidates)
+	}
+	// The STUN server and the peer are a round trip of 40ms away.
+	if s.GatherTime < 40*time.Millisecond || s.CheckTime < 40*time.Millisecond {
+		t.Errorf("gathered in %v, checked in %v", s.GatherTime, s.CheckTime)
+	}
+	var nominated []PairStats
+	for _, p := range s.Pairs {
+		if p.Nominated {
+			nominated = append(nominated, p)
+		}
+	}
+	if len(nominated) != 1 {
+		t.Fatalf("%d nominated pairs in %+v", len(nominated), s.Pairs)
+	}
+	p := nominated[0]
+	if !p.Succeeded || p.RequestsSent == 0 || p.ResponsesReceived == 0 || p.Remote.Addr.String() != b.LocalAddr().String() {
+		t.Errorf("nominated pair %+v, peer on %v", p, b.LocalAddr())
+	}
+	if p.CurrentRoundTripTime < 40*time.Millisecond || p.TotalRoundTripTime < p.CurrentRoundTripTime {
+		t.Errorf("round trip times %v, total %v", p.CurrentRoundTripTime, p.TotalRoundTripTime)
+	}
+	if !strings.Contains(s.String(), "nominated") {
+		t.Errorf("report doesn't show the nominated pair:\n%s", s)
+	}
+	// Stats returns a copy.
+	s.LocalCandidates[CandidateHost] = 10
+	if a.Stats().LocalCandidates[CandidateHost] != 1 {
+		t.Error("Stats shares its maps with the Conn")
+	}
+}
+
+// deafConn drops the packets that don't come from allow.
+type deafConn struct {
+	net.PacketConn
+	allow string
+}
+
+func (c *deafConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || addr.String() == c.allow {
+			return n, addr, err
+		}
+	}
+}
+
+func TestStatsFailedSide(t *testing.T) {
+	// a hears nothing but the STUN server: its checks reach b, but
+	// neither b's answers nor b's checks come back.
+	cfgA, cfgB, _ := vnetConfigs(t, nil)
+	listen := cfgA.ListenPacket
+	cfgA.ListenPacket = func(network, address string) (net.PacketConn, error) {
+		sock, err := listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &deafConn{sock, cfgA.STUNServer}, nil
+	}
+	xa, xb := testExchange()
+	errs := make(chan error, 2)
+	go func() { _, err := ConnectOpt(xa, true, cfgA); errs <- err }()
+	go func() { _, err := ConnectOpt(xb, false, cfgB); errs <- err }()
+	sides := map[bool]Side{}
+	for i := 0; i < 2; i++ {
+		var nerr *NegotiationError
+		if err := <-errs; !errors.As(err, &nerr) {
+			t.Fatalf("negotiation ended with %v, want a NegotiationError", err)
+		}
+		s := nerr.Stats
+		if s.Err == nil || len(s.Pairs) == 0 {
+			t.Fatalf("stats of a failed negotiation: %+v", s)
+		}
+		sides[s.Initiator] = s.FailedSide
+	}
+	// a got no check from b, and blames it. b got a's checks, but
+	// none of its own were answered.
+	if sides[true] != SideRemote || sides[false] != SideLocal {
+		t.Fatalf("blamed %v on the deaf side, %v on its peer", sides[true], sides[false])
+	}
+}
+
+func TestStatsSignalingFailed(t *testing.T) {
+	cfg, _, _ := vnetConfigs(t, nil)
+	_, err := ConnectOpt(func([]byte) []byte { return []byte("not a signal") }, true, cfg)
+	var nerr *NegotiationError
+	if !errors.As(err, &nerr) || !errors.Is(err, ErrSignalingFailed) {
+		t.Fatalf("negotiation with a bad signal ended with %v", err)
+	}
+	if nerr.Stats.FailedSide != SideRemote || nerr.Stats.LocalCandidates[CandidateHost] != 1 {
+		t.Fatalf("stats %+v", nerr.Stats)
+	}
+}
@@ -0,0 +1,194 @@
+package stream
+
+import "encoding/binary"
+
+// A packet is a marker byte, a 64-bit packet number, and frames. The
+// marker is outside of the ranges of RFC 7983, so that the packets
+// share a nat.Conn with STUN and media.
+const (
+	packetMarker    = 0xd0
+	packetHeaderLen = 9
+)
+
+// Frame types.
+const (
+	frameStream  = 1 // stream data, and its end
+	frameAck     = 2 // packet numbers received
+	frameMaxData = 3 // flow control credit of a stream
+	framePing    = 4 // elicits an ack
+	frameClose   = 5 // the session is over
+)
+
+const (
+	streamHeaderLen  = 16 // type, flags, ID, offset, length
+	ackRangeLen      = 16
+	maxAckRanges     = 32
+	maxDataFrameLen  = 13
+	flagFin          = 1
+	maxReceivedRange = 64 // packet number ranges we remember
+)
+
+// A span is the range [lo, hi).
+type span struct {
+	lo, hi uint64
+}
+
+type frame struct {
+	typ    uint8
+	id     uint32
+	off    uint64 // frameStream
+	fin    bool   // frameStream
+	data   []byte // frameStream
+	max    uint64 // frameMaxData
+	ranges []span // frameAck, in decreasing order
+}
+
+// parsePacket returns the packet number and frames of b.
+func parsePacket(b []byte) (uint64, []frame, bool) {
+	if len(b) < packetHeaderLen || b[0] != packetMarker {
+		return 0, nil, false
+	}
+	pn := binary.BigEndian.Uint64(b[1:])
+	b = b[packetHeaderLen:]
+	var frames []frame
+	for len(b) > 0 {
+		f := frame{typ: b[0]}
+		switch f.typ {
+		case frameStream:
+			if len(b) < streamHeaderLen {
+				return 0, nil, false
+			}
+			f.fin = b[1]&flagFin != 0
+			f.id = binary.BigEndian.Uint32(b[2:])
+			f.off = binary.BigEndian.Uint64(b[6:])
+			n := int(binary.BigEndian.Uint16(b[14:]))
+			if len(b) < streamHeaderLen+n || f.off+uint64(n) < f.off {
+				return 0, nil, false
+			}
+			f.data = b[streamHeaderLen : streamHeaderLen+n]
+			b = b[streamHeaderLen+n:]
+		case frameAck:
+			if len(b) < 2 {
+				return 0, nil, false
+			}
+			n := int(b[1])
+			if n == 0 || len(b) < 2+n*ackRangeLen {
+				return 0, nil, false
+			}
+			for i := 0; i < n; i++ {
+				r := b[2+i*ackRangeLen:]
+				lo, hi := binary.BigEndian.Uint64(r), binary.BigEndian.Uint64(r[8:])
+				if lo >= hi {
+					return 0, nil, false
+				}
+				f.ranges = append(f.ranges, span{lo, hi})
+			}
+			b = b[2+n*ackRangeLen:]
+		case frameMaxData:
+			if len(b) < maxDataFrameLen {
+				return 0, nil, false
+			}
+			f.id = binary.BigEndian.Uint32(b[1:])
+			f.max = binary.BigEndian.Uint64(b[5:])
+			b = b[maxDataFrameLen:]
+		case framePing, frameClose:
+			b = b[1:]
+		default:
+			return 0, nil, false
+		}
+		frames = append(frames, f)
+	}
+	return pn, frames, true
+}
+
+func appendStreamFrame(b []byte, id uint32, off uint64, fin bool, data []byte) []byte {
+	var h [streamHeaderLen]byte
+	h[0] = frameStream
+	if fin {
+		h[1] = flagFin
+	}
+	binary.BigEndian.PutUint32(h[2:], id)
+	binary.BigEndian.PutUint64(h[6:], off)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(data)))
+	return append(append(b, h[:]...), data...)
+}
+
+// appendAckFrame appends an ack of the highest ranges of r that fit
+// in room bytes.
+func appendAckFrame(b []byte, r rangeSet, room int) []byte {
+	n := len(r)
+	if n > maxAckRanges {
+		n = maxAckRanges
+	}
+	if fit := (room - 2) / ackRangeLen; n > fit {
+		n = fit
+	}
+	if n <= 0 {
+		return b
+	}
+	b = append(b, frameAck, byte(n))
+	for i := 0; i < n; i++ {
+		s := r[len(r)-1-i]
+		b = binary.BigEndian.AppendUint64(b, s.lo)
+		b = binary.BigEndian.AppendUint64(b, s.hi)
+	}
+	return b
+}
+
+func appendMaxDataFrame(b []byte, id uint32, max uint64) []byte {
+	b = append(b, frameMaxData)
+	b = binary.BigEndian.AppendUint32(b, id)
+	return binary.BigEndian.AppendUint64(b, max)
+}
+
+// A rangeSet is a set of integers, as increasing disjoint spans.
+type rangeSet []span
+
+// add adds [lo, hi) to r.
+func (r *rangeSet) add(lo, hi uint64) {
+	if lo >= hi {
+		return
+	}
+	s := *r
+	// Find the first span that ends at or after lo.
+	i := 0
+	for i < len(s) && s[i].hi < lo {
+		i++
+	}
+	j := i
+	for j < len(s) && s[j].lo <= hi {
+		if s[j].lo < lo {
+			lo = s[j].lo
+		}
+		if s[j].hi > hi {
+			hi = s[j].hi
+		}
+		j++
+	}
+	if i == j {
+		s = append(s, span{})
+		copy(s[i+1:], s[i:])
+		s[i] = span{lo, hi}
+	} else {
+		s[i] = span{lo, hi}
+		s = append(s[:i+1], s[j:]...)
+	}
+	*r = s
+}
+
+// contains reports whether r holds all of [lo, hi).
+func (r rangeSet) contains(lo, hi uint64) bool {
+	for _, s := range r {
+		if s.lo <= lo && hi <= s.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// trim drops the lowest spans, to keep at most n.
+func (r *rangeSet) trim(n int) {
+	if len(*r) > n {
+		*r = append(rangeSet(nil), (*r)[len(*r)-n:]...)
+	}
+}
@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestRangeSet(t *testing.T) {
+	var r rangeSet
+	r.add(10, 20)
+	r.add(30, 40)
+	r.add(0, 5)
+	r.add(7, 7) // empty
+	if want := (rangeSet{{0, 5}, {10, 20}, {30, 40}}); !equalRanges(r, want) {
+		t.Fatalf("ranges %v, want %v", r, want)
+	}
+	// Adjacent and overlapping spans merge.
+	r.add(20, 30)
+	r.add(4, 10)
+	if want := (rangeSet{{0, 40}}); !equalRanges(r, want) {
+		t.Fatalf("ranges %v, want %v", r, want)
+	}
+	r.add(50, 60)
+	r.add(45, 55)
+	r.add(100, 101)
+	r.add(70, 80)
+	if want := (rangeSet{{0, 40}, {45, 60}, {70, 80}, {100, 101}}); !equalRanges(r, want) {
+		t.Fatalf("ranges %v, want %v", r, want)
+	}
+	// A span covering several merges them all.
+	r.add(42, 90)
+	if want := (rangeSet{{0, 40}, {42, 90}, {100, 101}}); !equalRanges(r, want) {
+		t.Fatalf("ranges %v, want %v", r, want)
+	}
+
+	for _, tc := range []struct {
+		lo, hi uint64
+		want   bool
+	}{
+		{0, 40, true},
+		{43, 89, true},
+		{39, 43, false},
+		{100, 101, true},
+		{100, 102, false},
+	} {
+		if got := r.contains(tc.lo, tc.hi); got != tc.want {
+			t.Errorf("contains(%d, %d) = %v, want %v", tc.lo, tc.hi, got, tc.want)
+		}
+	}
+
+	// trim keeps the highest spans, in a copy.
+	old := r
+	r.trim(2)
+	if want := (rangeSet{{42, 90}, {100, 101}}); !equalRanges(r, want) {
+		t.Fatalf("trimmed to %v, want %v", r, want)
+	}
+	r.add(95, 96)
+	if old[1] != (span{42, 90}) || old[2] != (span{100, 101}) {
+		t.Fatalf("trim shares its spans: %v", old)
+	}
+	r.trim(5)
+	if len(r) != 3 {
+		t.Fatalf("trim to more spans than there are: %v", r)
+	}
+}
+
+func equalRanges(a, b rangeSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParsePacket(t *testing.T) {
+	var acks rangeSet
+	acks.add(1, 3)
+	acks.add(5, 9)
+	b := []byte{packetMarker, 0, 0, 0, 0, 0, 0, 0, 42}
+	b = appendStreamFrame(b, 3, 1000, true, []byte("data"))
+	b = appendAckFrame(b, acks, 100)
+	b = appendMaxDataFrame(b, 4, 1<<20)
+	b = append(b, framePing, frameClose)
+
+	pn, frames, ok := parsePacket(b)
+	if !ok || pn != 42 || len(frames) != 5 {
+		t.Fatalf("parsePacket = %d, %v, %v", pn, frames, ok)
+	}
+	if f := frames[0]; f.typ != frameStream || f.id != 3 || f.off != 1000 || !f.fin || !bytes.Equal(f.data, []byte("data")) {
+		t.Errorf("stream frame %+v", f)
+	}
+	// Acks list the ranges in decreasing order.
+	if f := frames[1]; f.typ != frameAck || len(f.ranges) != 2 || f.ranges[0] != (span{5, 9}) || f.ranges[1] != (span{1, 3}) {
+		t.Errorf("ack frame %+v", f)
+	}
+	if f := frames[2]; f.typ != frameMaxData || f.id != 4 || f.max != 1<<20 {
+		t.Errorf("max data frame %+v", f)
+	}
+	if frames[3].typ != framePing || frames[4].typ != frameClose {
+		t.Errorf("frames %+v", frames[3:])
+	}
+
+	// An ack only takes the highest ranges that fit.
+	if ack := appendAckFrame(nil, acks, 2+ackRangeLen); len(ack) != 2+ackRangeLen || binary.BigEndian.Uint64(ack[2:]) != 5 {
+		t.Errorf("ack of one range: %x", ack)
+	}
+	if ack := appendAckFrame(nil, acks, ackRangeLen); len(ack) != 0 {
+		t.Errorf("ack in no room: %x", ack)
+	}
+}
+
+func TestParsePacketMalformed(t *testing.T) {
+	header := []byte{packetMarker, 0, 0, 0, 0, 0, 0, 0, 1}
+	packet := func(frames ...[]byte) []byte {
+		b := append([]byte(nil), header...)
+		for _, f := range frames {
+			b = append(b, f...)
+		}
+		return b
+	}
+	stream := appendStreamFrame(nil, 1, 0, false, []byte("data"))
+	overflow := appendStreamFrame(nil, 1, ^uint64(0)-1, false, []byte("data"))
+	var acks rangeSet
+	acks.add(1, 3)
+	ack := appendAckFrame(nil, acks, 100)
+	backwards := append([]byte(nil), ack...)
+	binary.BigEndian.PutUint64(backwards[2:], 3)
+	binary.BigEndian.PutUint64(backwards[10:], 1)
+	noRanges := append([]byte(nil), ack[:2]...)
+	noRanges[1] = 0
+
+	for _, tc := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"short header", header[:5]},
+		{"marker", append([]byte{0x17}, header[1:]...)},
+		{"stream header", packet(stream[:streamHeaderLen-1])},
+		{"stream data", packet(stream[:len(stream)-1])},
+		{"stream offset overflow", packet(overflow)},
+		{"ack header", packet(ack[:1])},
+		{"ack ranges", packet(ack[:len(ack)-1])},
+		{"ack no ranges", packet(noRanges)},
+		{"ack backwards range", packet(backwards)},
+		{"max data", packet(appendMaxDataFrame(nil, 1, 1)[:maxDataFrameLen-1])},
+		{"unknown frame", packet([]byte{0x7f})},
+		{"trailing garbage", packet(stream, []byte{0})},
+	} {
+		if _, _, ok := parsePacket(tc.b); ok {
+			t.Errorf("%s: malformed packet parsed", tc.name)
+		}
+	}
+}
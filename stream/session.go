@@ -0,0 +1,930 @@
+// Package stream runs reliable, ordered byte streams over a datagram
+// connection, such as a nat.Conn, so that TCP-shaped protocols can
+// cross the NAT path.
+//
+// A Session multiplexes any number of Streams over one connection.
+// Its packets are numbered and acknowledged with ranges, like in
+// QUIC, and lost stream data is sent again. A NewReno congestion
+// controller paces the session, each stream has its own flow control
+// window, and keepalives keep the path, and the NAT bindings on it,
+// alive while the streams are idle.
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config configures a Session. The zero value is valid.
+type Config struct {
+	// MTU is the size of the largest packet sent. Zero means 1200
+	// bytes, which crosses nearly every path even inside DTLS or
+	// Noise.
+	MTU int
+	// StreamWindow is how many bytes each stream buffers in each
+	// direction, which bounds its throughput to StreamWindow per
+	// round trip. Zero means 256KiB, and it is at least 64KiB.
+	StreamWindow int
+	// MaxStreams is the number of streams the peer may have open at
+	// once. Zero means 256. The packets opening more streams are
+	// dropped, until some close.
+	MaxStreams int
+	// KeepaliveInterval is how long the session may stay silent
+	// before it sends a keepalive. Zero means 15 seconds.
+	KeepaliveInterval time.Duration
+	// IdleTimeout is how long the session survives without hearing
+	// from the peer. Zero means 60 seconds.
+	IdleTimeout time.Duration
+}
+
+func (c *Config) mtu() int {
+	if c.MTU <= 0 {
+		return 1200
+	}
+	if c.MTU < packetHeaderLen+streamHeaderLen+ackRangeLen+2 {
+		return packetHeaderLen + streamHeaderLen + ackRangeLen + 2
+	}
+	return c.MTU
+}
+
+func (c *Config) streamWindow() int {
+	switch {
+	case c.StreamWindow <= 0:
+		return 256 << 10
+	case c.StreamWindow < initialWindow:
+		return initialWindow
+	}
+	return c.StreamWindow
+}
+
+func (c *Config) maxStreams() int {
+	if c.MaxStreams <= 0 {
+		return 256
+	}
+	return c.MaxStreams
+}
+
+func (c *Config) keepaliveInterval() time.Duration {
+	if c.KeepaliveInterval <= 0 {
+		return 15 * time.Second
+	}
+	return c.KeepaliveInterval
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return 60 * time.Second
+	}
+	return c.IdleTimeout
+}
+
+var (
+	errPeerClosed  = errors.New("stream: session closed by the peer")
+	errIdleTimeout = errors.New("stream: the peer stopped responding")
+)
+
+const (
+	// ackDelay is how long we may sit on an ack, hoping to send it
+	// along with data, and maxAckDelay what the peer assumes.
+	ackDelay    = 10 * time.Millisecond
+	maxAckDelay = 25 * time.Millisecond
+	// initialRTT is the RTT assumed before the first sample.
+	initialRTT = 333 * time.Millisecond
+	maxPTO     = 60 * time.Second
+	// A packet is deemed lost once reorderPackets later packets, or
+	// reorderDelay eighths of the RTT, are acked. Both grow, up to
+	// the max, each time a packet deemed lost turns out to be late.
+	reorderPackets    = 3
+	maxReorderPackets = 64
+	reorderDelay      = 9
+	maxReorderDelay   = 16
+	maxLostHistory    = 64
+	// maxBurst is how many packets are sent before looking at acks
+	// again.
+	maxBurst = 16
+	// closeLinger bounds how long Close waits for the data in flight
+	// to be acked.
+	closeLinger = 5 * time.Second
+)
+
+// A Session multiplexes reliable streams over a datagram connection.
+type Session struct {
+	conn      net.Conn
+	cfg       Config
+	initiator bool
+	mtu       int
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	peerID   uint32 // the highest stream ID the peer opened
+	accepted []*Stream
+	err      error // why the session ended
+
+	// Acks of the packets we receive.
+	received     rangeSet
+	largestRecv  uint64
+	ackPending   bool
+	ackAt        time.Time
+	unackedCount int // ack-eliciting packets received since our last ack
+
+	// Loss recovery and congestion control, as in RFC 9002.
+	nextPN        uint64
+	inflight      []*sentPacket // ack-eliciting, by packet number
+	largestAcked  uint64
+	hasAcked      bool
+	srtt, rttvar  time.Duration
+	latestRTT     time.Duration
+	hasRTT        bool
+	lossTime      time.Time
+	ptoCount      uint
+	probes        int
+	lastEliciting time.Time
+	bytesInFlight int
+	cwnd          int
+	ssthresh      int
+	recoveryStart time.Time
+	reorder       uint64        // in packets
+	reorderDelay  time.Duration // in eighths of the RTT
+	lost          []uint64      // packets deemed lost lately
+	priorCwnd     int           // before the last loss, to undo it
+	priorSsthresh int
+	retransmit    []sentFrame // lost stream data to send again
+	pingPending   bool
+	lastSend      time.Time
+	lastRecv      time.Time
+
+	kick     chan struct{} // wakes sendLoop
+	acked    chan struct{} // wakes Close
+	acceptCh chan struct{}
+	done     chan struct{}
+}
+
+// A sentPacket is an ack-eliciting packet in flight.
+type sentPacket struct {
+	pn     uint64
+	sentAt time.Time
+	// size counts against the congestion window. It is zero for the
+	// packets opening a stream, which the peer refuses beyond its
+	// stream limit, and which would otherwise fill the window.
+	size   int
+	frames []sentFrame
+}
+
+// A sentFrame is what a sent packet carried, to act upon its ack or
+// loss.
+type sentFrame struct {
+	typ uint8
+	id  uint32
+	off uint64
+	n   int
+	fin bool
+}
+
+// NewSession returns a Session over conn. One of the peers must be
+// the initiator, and the other not. The Session owns conn, and
+// closes it when it ends.
+func NewSession(conn net.Conn, initiator bool, cfg *Config) *Session {
+	s := &Session{
+		conn:      conn,
+		initiator: initiator,
+		streams:   map[uint32]*Stream{},
+		kick:      make(chan struct{}, 1),
+		acked:     make(chan struct{}, 1),
+		acceptCh:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	s.mtu = s.cfg.mtu()
+	s.cwnd = 10 * s.mtu
+	s.ssthresh = int(^uint(0) >> 1)
+	s.reorder, s.reorderDelay = reorderPackets, reorderDelay
+	// The initiator opens the odd streams, the other peer the even
+	// ones.
+	s.nextID = 2
+	if initiator {
+		s.nextID = 1
+	}
+	now := time.Now()
+	s.lastSend, s.lastRecv = now, now
+	go s.readLoop()
+	go s.sendLoop()
+	return s
+}
+
+// Open opens a new stream. The peer learns of it right away, and
+// gets it from Accept.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.nextID > ^uint32(0)-2 {
+		return nil, errors.New("stream: out of stream IDs")
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.signal(s.kick)
+	return st, nil
+}
+
+// Accept waits for the next stream the peer opens.
+func (s *Session) Accept() (*Stream, error) {
+	for {
+		s.mu.Lock()
+		if len(s.accepted) > 0 {
+			st := s.accepted[0]
+			s.accepted = s.accepted[1:]
+			s.mu.Unlock()
+			return st, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-s.acceptCh:
+		case <-s.done:
+		}
+	}
+}
+
+// Close closes all the streams, waits a little for the data in
+// flight to reach the peer, then ends the session and closes the
+// underlying connection.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	for _, st := range s.streams {
+		st.closeLocked()
+	}
+	s.mu.Unlock()
+	s.signal(s.kick)
+
+	linger := time.NewTimer(closeLinger)
+	defer linger.Stop()
+	for {
+		s.mu.Lock()
+		drained := s.drainedLocked()
+		s.mu.Unlock()
+		if drained {
+			break
+		}
+		select {
+		case <-s.acked:
+			continue
+		case <-linger.C:
+		case <-s.done:
+		}
+		break
+	}
+
+	s.mu.Lock()
+	var pkt []byte
+	if s.err == nil {
+		pkt = make([]byte, packetHeaderLen+1)
+		s.putHeader(pkt)
+		pkt[packetHeaderLen] = frameClose
+	}
+	s.mu.Unlock()
+	// There is no ack of the close, so say it a few times.
+	for i := 0; pkt != nil && i < 3; i++ {
+		s.conn.Write(pkt)
+	}
+	s.shutdown(net.ErrClosed)
+	return nil
+}
+
+// drainedLocked reports whether the peer acked everything we wrote.
+func (s *Session) drainedLocked() bool {
+	if s.err != nil {
+		return true
+	}
+	for _, st := range s.streams {
+		if !st.sendDoneLocked() {
+			return false
+		}
+	}
+	return true
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Done returns a channel that is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, or nil if it is still running.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// shutdown ends the session with err.
+func (s *Session) shutdown(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failLocked(err)
+}
+
+// failLocked ends the session with err, unless it already ended.
+func (s *Session) failLocked(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	go s.conn.Close()
+}
+
+// signal wakes up whoever waits on ch.
+func (s *Session) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// putHeader writes the header of a new packet at the start of b.
+func (s *Session) putHeader(b []byte) {
+	b[0] = packetMarker
+	binary.BigEndian.PutUint64(b[1:], s.nextPN)
+	s.nextPN++
+}
+
+func (s *Session) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			// A deadline left over from before the session.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.conn.SetReadDeadline(time.Time{})
+				continue
+			}
+			s.shutdown(err)
+			return
+		}
+		s.receive(buf[:n])
+	}
+}
+
+// receive processes a packet from the peer.
+func (s *Session) receive(b []byte) {
+	pn, frames, ok := parsePacket(b)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.lastRecv = now
+
+	eliciting := false
+	for _, f := range frames {
+		if f.typ != frameAck {
+			eliciting = true
+		}
+	}
+	dup := s.received.contains(pn, pn+1)
+	for i := range frames {
+		if !dup && frames[i].typ == frameStream && s.refuses(&frames[i]) {
+			// The acks still count, or a peer opening too many
+			// streams would stall the others.
+			for _, f := range frames {
+				if f.typ == frameAck {
+					s.onAck(f.ranges, now)
+				}
+			}
+			return
+		}
+	}
+	if eliciting {
+		s.unackedCount++
+		// Ack at once what looks like loss or reordering, so that
+		// the peer recovers quickly, and every other packet.
+		ackAt := now.Add(ackDelay)
+		if dup || pn != s.largestRecv+1 || s.unackedCount >= 2 {
+			ackAt = now
+		}
+		if !s.ackPending || ackAt.Before(s.ackAt) {
+			s.ackAt = ackAt
+		}
+		s.ackPending = true
+		s.signal(s.kick)
+	}
+	if dup {
+		return
+	}
+	s.received.add(pn, pn+1)
+	s.received.trim(maxReceivedRange)
+	if pn > s.largestRecv {
+		s.largestRecv = pn
+	}
+
+	for _, f := range frames {
+		switch f.typ {
+		case frameAck:
+			s.onAck(f.ranges, now)
+		case frameStream:
+			s.onStreamFrame(&f)
+		case frameMaxData:
+			if st := s.streams[f.id]; st != nil && f.max > st.peerMax {
+				st.peerMax = f.max
+				s.signal(s.kick)
+			}
+		case frameClose:
+			s.failLocked(errPeerClosed)
+			return
+		}
+	}
+}
+
+// peerParity returns the parity of the stream IDs of the peer.
+func (s *Session) peerParity() uint32 {
+	if s.initiator {
+		return 0
+	}
+	return 1
+}
+
+// peerOpens returns how many new streams a frame of stream id opens.
+// Streams are opened in order, so the ones of the peer before id are
+// open too, even if their frames are late.
+func (s *Session) peerOpens(id uint32) int {
+	if s.streams[id] != nil || id%2 != s.peerParity() || id <= s.peerID {
+		return 0
+	}
+	first := s.peerID + 2
+	if s.peerID == 0 {
+		first = 2 - s.peerParity()
+	}
+	return int((id-first)/2) + 1
+}
+
+// refuses reports whether f exceeds the flow control window of its
+// stream, or the number of streams the peer may open. The packet is
+// then dropped without an ack, for the peer to send it again later.
+func (s *Session) refuses(f *frame) bool {
+	end := f.off + uint64(len(f.data))
+	if st := s.streams[f.id]; st != nil {
+		return end > st.recvMax
+	}
+	n := s.peerOpens(f.id)
+	if n == 0 {
+		return false
+	}
+	for _, st := range s.streams {
+		if st.id%2 == s.peerParity() {
+			n++
+		}
+	}
+	return n > s.cfg.maxStreams() || end > uint64(s.cfg.streamWindow())
+}
+
+// onStreamFrame delivers stream data, opening the streams it implies.
+func (s *Session) onStreamFrame(f *frame) {
+	if n := s.peerOpens(f.id); n > 0 {
+		for id := f.id - uint32(2*(n-1)); id <= f.id; id += 2 {
+			st := newStream(s, id)
+			st.announced, st.peerKnows = true, true
+			s.streams[id] = st
+			s.accepted = append(s.accepted, st)
+		}
+		s.peerID = f.id
+		s.signal(s.acceptCh)
+	}
+	// Frames of closed streams are dropped.
+	if st := s.streams[f.id]; st != nil {
+		st.onData(f.off, f.data, f.fin)
+	}
+}
+
+// onAck processes an ack of ranges, in decreasing order.
+func (s *Session) onAck(ranges []span, now time.Time) {
+	largest := ranges[0].hi - 1
+	s.detectSpurious(ranges)
+	var newlyAcked []*sentPacket
+	kept := s.inflight[:0]
+	for _, p := range s.inflight {
+		if inRanges(ranges, p.pn) {
+			newlyAcked = append(newlyAcked, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	s.inflight = kept
+	if !s.hasAcked || largest > s.largestAcked {
+		s.largestAcked, s.hasAcked = largest, true
+	}
+	if len(newlyAcked) == 0 {
+		return
+	}
+	if last := newlyAcked[len(newlyAcked)-1]; last.pn == largest {
+		s.updateRTT(now.Sub(last.sentAt))
+	}
+	s.ptoCount = 0
+	for _, p := range newlyAcked {
+		s.bytesInFlight -= p.size
+		for _, f := range p.frames {
+			if f.typ != frameStream {
+				continue
+			}
+			if st := s.streams[f.id]; st != nil {
+				st.onAcked(f.off, f.n, f.fin)
+			}
+		}
+		// No growth for what was sent before the last loss.
+		if !p.sentAt.After(s.recoveryStart) {
+			continue
+		}
+		if s.cwnd < s.ssthresh {
+			s.cwnd += p.size
+		} else {
+			s.cwnd += s.mtu * p.size / s.cwnd
+		}
+	}
+	s.detectLost(now)
+	s.signal(s.acked)
+	s.signal(s.kick)
+}
+
+func inRanges(ranges []span, pn uint64) bool {
+	for _, r := range ranges {
+		if r.lo <= pn && pn < r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// detectSpurious looks for acks of packets deemed lost. The path
+// reorders more than we thought, so we wait longer before deeming
+// packets lost, and restore the congestion window.
+func (s *Session) detectSpurious(ranges []span) {
+	spurious := false
+	kept := s.lost[:0]
+	for _, pn := range s.lost {
+		if inRanges(ranges, pn) {
+			spurious = true
+		} else {
+			kept = append(kept, pn)
+		}
+	}
+	s.lost = kept
+	if !spurious {
+		return
+	}
+	if s.reorder < maxReorderPackets {
+		s.reorder *= 2
+	}
+	if s.reorderDelay < maxReorderDelay {
+		s.reorderDelay++
+	}
+	if s.cwnd < s.priorCwnd {
+		s.cwnd, s.ssthresh = s.priorCwnd, s.priorSsthresh
+	}
+}
+
+func (s *Session) updateRTT(sample time.Duration) {
+	s.latestRTT = sample
+	if !s.hasRTT {
+		s.srtt, s.rttvar, s.hasRTT = sample, sample/2, true
+		return
+	}
+	d := s.srtt - sample
+	if d < 0 {
+		d = -d
+	}
+	s.rttvar = (3*s.rttvar + d) / 4
+	s.srtt = (7*s.srtt + sample) / 8
+}
+
+// detectLost declares lost the packets that were overtaken by acked
+// ones, by too many packets or for too long.
+func (s *Session) detectLost(now time.Time) {
+	s.lossTime = time.Time{}
+	if !s.hasAcked {
+		return
+	}
+	delay := s.srtt
+	if s.latestRTT > delay {
+		delay = s.latestRTT
+	}
+	delay = delay * s.reorderDelay / 8
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	kept := s.inflight[:0]
+	for _, p := range s.inflight {
+		switch {
+		case p.pn > s.largestAcked:
+			kept = append(kept, p)
+		case s.largestAcked-p.pn >= s.reorder || !now.Before(p.sentAt.Add(delay)):
+			s.onLost(p, now)
+		default:
+			if t := p.sentAt.Add(delay); s.lossTime.IsZero() || t.Before(s.lossTime) {
+				s.lossTime = t
+			}
+			kept = append(kept, p)
+		}
+	}
+	s.inflight = kept
+}
+
+// onLost queues the data of p to be sent again, and shrinks the
+// congestion window, once per round trip.
+func (s *Session) onLost(p *sentPacket, now time.Time) {
+	s.bytesInFlight -= p.size
+	s.requeue(p)
+	if len(s.lost) == maxLostHistory {
+		s.lost = s.lost[1:]
+	}
+	s.lost = append(s.lost, p.pn)
+	// A refused stream says nothing of congestion.
+	if p.size > 0 && p.sentAt.After(s.recoveryStart) {
+		s.recoveryStart = now
+		s.priorCwnd, s.priorSsthresh = s.cwnd, s.ssthresh
+		s.cwnd /= 2
+		if s.cwnd < 2*s.mtu {
+			s.cwnd = 2 * s.mtu
+		}
+		s.ssthresh = s.cwnd
+	}
+}
+
+// requeue queues the stream data and flow control updates of p to be
+// sent again.
+func (s *Session) requeue(p *sentPacket) {
+	for _, f := range p.frames {
+		st := s.streams[f.id]
+		if st == nil {
+			continue
+		}
+		switch f.typ {
+		case frameStream:
+			s.retransmit = append(s.retransmit, f)
+		case frameMaxData:
+			st.maxDataPending = true
+		}
+	}
+}
+
+// ptoDeadline returns when to probe the peer for acks, if anything is
+// in flight.
+func (s *Session) ptoDeadline() time.Time {
+	if len(s.inflight) == 0 {
+		return time.Time{}
+	}
+	srtt, rttvar := s.srtt, s.rttvar
+	if !s.hasRTT {
+		srtt, rttvar = initialRTT, initialRTT/2
+	}
+	if rttvar < time.Millisecond/4 {
+		rttvar = time.Millisecond / 4
+	}
+	pto := srtt + 4*rttvar + maxAckDelay
+	for i := uint(0); i < s.ptoCount && pto < maxPTO; i++ {
+		pto *= 2
+	}
+	if pto > maxPTO {
+		pto = maxPTO
+	}
+	return s.lastEliciting.Add(pto)
+}
+
+// timers runs the timers that are due.
+func (s *Session) timers(now time.Time) {
+	if now.Sub(s.lastRecv) >= s.cfg.idleTimeout() {
+		s.failLocked(errIdleTimeout)
+		return
+	}
+	if !s.lossTime.IsZero() && !now.Before(s.lossTime) {
+		s.detectLost(now)
+	} else if pto := s.ptoDeadline(); !pto.IsZero() && !now.Before(pto) {
+		// Nothing was acked for a while: send the oldest data again,
+		// regardless of the congestion window, to get an ack.
+		s.ptoCount++
+		s.probes = 2
+		s.pingPending = true
+		s.requeue(s.inflight[0])
+		// The peer may refuse the oldest for opening too many
+		// streams, and take a lower one.
+		for _, p := range s.inflight[1:] {
+			if p.size == 0 {
+				s.requeue(p)
+			}
+		}
+		s.lastEliciting = now
+	}
+	if now.Sub(s.lastSend) >= s.cfg.keepaliveInterval() {
+		s.pingPending = true
+	}
+}
+
+// nextTimer returns when to run the timers next.
+func (s *Session) nextTimer() time.Time {
+	next := s.lastRecv.Add(s.cfg.idleTimeout())
+	earliest := func(t time.Time) {
+		if !t.IsZero() && t.Before(next) {
+			next = t
+		}
+	}
+	earliest(s.lastSend.Add(s.cfg.keepaliveInterval()))
+	if s.ackPending {
+		earliest(s.ackAt)
+	}
+	if !s.lossTime.IsZero() {
+		earliest(s.lossTime)
+	} else {
+		earliest(s.ptoDeadline())
+	}
+	return next
+}
+
+func (s *Session) sendLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		if s.err == nil {
+			s.timers(now)
+		}
+		if s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		var pkts [][]byte
+		for len(pkts) < maxBurst {
+			p := s.packet(now)
+			if p == nil {
+				break
+			}
+			pkts = append(pkts, p)
+		}
+		if len(pkts) == maxBurst {
+			s.signal(s.kick)
+		}
+		next := s.nextTimer()
+		s.mu.Unlock()
+
+		for _, p := range pkts {
+			if _, err := s.conn.Write(p); err != nil {
+				s.shutdown(err)
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+		select {
+		case <-s.kick:
+		case <-timer.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// packet returns the next packet to send, or nil if there is nothing
+// to send.
+func (s *Session) packet(now time.Time) []byte {
+	b := make([]byte, packetHeaderLen, s.mtu)
+	var frames []sentFrame
+
+	if s.ackPending && !now.Before(s.ackAt) {
+		b = appendAckFrame(b, s.received, s.mtu-len(b))
+		s.ackPending, s.unackedCount = false, 0
+	}
+
+	// The frames of a stream the peer doesn't know of yet go alone,
+	// since the peer drops the packets of streams beyond its limit.
+	hasStream, alone := false, false
+	if s.probes > 0 || s.bytesInFlight+s.mtu <= s.cwnd {
+		for _, st := range s.streams {
+			// A stream of ours takes credit only once the peer knows
+			// of it.
+			if st.maxDataPending && st.peerKnows && s.mtu-len(b) >= maxDataFrameLen {
+				b = appendMaxDataFrame(b, st.id, st.recvMax)
+				st.maxDataPending = false
+				frames = append(frames, sentFrame{typ: frameMaxData, id: st.id})
+			}
+		}
+		for len(s.retransmit) > 0 && s.mtu-len(b) > streamHeaderLen && !alone {
+			f := &s.retransmit[0]
+			st := s.streams[f.id]
+			if st == nil || st.ackedLocked(f.off, f.n, f.fin) {
+				s.retransmit = s.retransmit[1:]
+				continue
+			}
+			if !st.peerKnows {
+				if hasStream {
+					break
+				}
+				alone = true
+			}
+			hasStream = true
+			if f.off < st.sendBase {
+				// The start was acked since.
+				skip := int(st.sendBase - f.off)
+				if skip > f.n {
+					skip = f.n
+				}
+				f.off += uint64(skip)
+				f.n -= skip
+			}
+			n := f.n
+			if room := s.mtu - len(b) - streamHeaderLen; n > room {
+				n = room
+			}
+			start := int(f.off - st.sendBase)
+			fin := f.fin && n == f.n
+			b = appendStreamFrame(b, f.id, f.off, fin, st.sendBuf[start:start+n])
+			frames = append(frames, sentFrame{typ: frameStream, id: f.id, off: f.off, n: n, fin: fin})
+			if n == f.n {
+				s.retransmit = s.retransmit[1:]
+			} else {
+				f.off += uint64(n)
+				f.n -= n
+			}
+		}
+		for _, st := range s.streams {
+			room := s.mtu - len(b) - streamHeaderLen
+			if room <= 0 || alone {
+				break
+			}
+			if !st.peerKnows && hasStream {
+				continue
+			}
+			off, n, fin, ok := st.nextFrameLocked(room)
+			if !ok {
+				continue
+			}
+			alone, hasStream = !st.peerKnows, true
+			start := int(off - st.sendBase)
+			b = appendStreamFrame(b, st.id, off, fin, st.sendBuf[start:start+n])
+			frames = append(frames, sentFrame{typ: frameStream, id: st.id, off: off, n: n, fin: fin})
+		}
+		if s.pingPending && len(frames) == 0 && s.mtu-len(b) >= 1 {
+			b = append(b, framePing)
+			frames = append(frames, sentFrame{typ: framePing})
+		}
+		if len(frames) > 0 {
+			s.pingPending = false
+		}
+	}
+
+	if len(b) == packetHeaderLen {
+		return nil
+	}
+	s.putHeader(b)
+	s.lastSend = now
+	if len(frames) > 0 {
+		size := len(b)
+		if alone {
+			size = 0
+		}
+		s.inflight = append(s.inflight, &sentPacket{
+			pn:     s.nextPN - 1,
+			sentAt: now,
+			size:   size,
+			frames: frames,
+		})
+		s.bytesInFlight += size
+		s.lastEliciting = now
+		if s.probes > 0 {
+			s.probes--
+		}
+	}
+	return b
+}
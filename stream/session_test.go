@@ -0,0 +1,357 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danderson/nat/vnet"
+)
+
+func TestPeerOpens(t *testing.T) {
+	// The peer of the initiator opens the even streams.
+	s := &Session{initiator: true, streams: map[uint32]*Stream{}}
+	for _, tc := range []struct {
+		id   uint32
+		want int
+	}{
+		{2, 1},
+		{6, 3},
+		{3, 0}, // ours
+	} {
+		if got := s.peerOpens(tc.id); got != tc.want {
+			t.Errorf("peerOpens(%d) = %d, want %d", tc.id, got, tc.want)
+		}
+	}
+	s.peerID = 6
+	s.streams[6] = newStream(s, 6)
+	for _, tc := range []struct {
+		id   uint32
+		want int
+	}{
+		{4, 0}, // implied by 6
+		{6, 0}, // already open
+		{8, 1},
+		{12, 3},
+	} {
+		if got := s.peerOpens(tc.id); got != tc.want {
+			t.Errorf("after 6: peerOpens(%d) = %d, want %d", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestRefuses(t *testing.T) {
+	s := &Session{initiator: true, cfg: Config{MaxStreams: 3}, streams: map[uint32]*Stream{}}
+	window := uint64(s.cfg.streamWindow())
+	data := []byte("data")
+	for _, tc := range []struct {
+		name string
+		f    frame
+		want bool
+	}{
+		{"opens max streams", frame{id: 6, data: data}, false},
+		{"opens too many streams", frame{id: 8}, true},
+		{"fills the window", frame{id: 2, off: window - 4, data: data}, false},
+		{"overflows the window", frame{id: 2, off: window - 3, data: data}, true},
+		{"our stream", frame{id: 101, off: 1 << 40, data: data}, false},
+	} {
+		if got := s.refuses(&tc.f); got != tc.want {
+			t.Errorf("%s: refuses = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Open streams count, ours don't.
+	s.streams[2] = newStream(s, 2)
+	s.streams[1] = newStream(s, 1)
+	s.peerID = 2
+	if !s.refuses(&frame{id: 8}) {
+		t.Error("accepted a fourth stream")
+	}
+	if s.refuses(&frame{id: 6}) {
+		t.Error("refused a third stream")
+	}
+	// Open streams have their own window.
+	st := s.streams[2]
+	if s.refuses(&frame{id: 2, off: st.recvMax - 4, data: data}) || !s.refuses(&frame{id: 2, off: st.recvMax - 3, data: data}) {
+		t.Errorf("stream window of %d not enforced", st.recvMax)
+	}
+}
+
+// A vnetConn is a net.Conn to raddr over a vnet socket. Once cut is
+// set, it drops what it sends and receives.
+type vnetConn struct {
+	net.PacketConn
+	raddr net.Addr
+	cut   *atomic.Bool
+}
+
+func (c *vnetConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if addr.String() == c.raddr.String() && !c.cut.Load() {
+			return n, nil
+		}
+	}
+}
+
+func (c *vnetConn) Write(b []byte) (int, error) {
+	if c.cut.Load() {
+		return len(b), nil
+	}
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *vnetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// vnetSessions returns an initiator and a responder session over a
+// vnet link, and the switch that cuts the link.
+func vnetSessions(t *testing.T, link vnet.LinkConfig, cfg *Config) (*Session, *Session, *atomic.Bool) {
+	n := vnet.New()
+	n.SetLink(link)
+	var conns []net.PacketConn
+	for _, ip := range []net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)} {
+		h, err := n.AddHost(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := h.ListenPacket("udp4", ":4000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	cut := new(atomic.Bool)
+	a := &vnetConn{conns[0], &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 4000}, cut}
+	b := &vnetConn{conns[1], &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 4000}, cut}
+	sa, sb := NewSession(a, true, cfg), NewSession(b, false, cfg)
+	t.Cleanup(func() {
+		// Don't linger on a cut link.
+		cut.Store(true)
+		sa.shutdown(net.ErrClosed)
+		sb.shutdown(net.ErrClosed)
+	})
+	return sa, sb, cut
+}
+
+// A lossy link that reorders packets with its jitter.
+var lossyLink = vnet.LinkConfig{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.1}
+
+// openPair opens a stream on a and accepts it on b.
+func openPair(t *testing.T, a, b *Session) (*Stream, *Stream) {
+	sa, err := a.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The peer learns of the stream with its first frame.
+	if _, err := sa.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return sa, sb
+}
+
+// transfer writes size random bytes on w and closes it, and checks
+// that r reads them, then io.EOF.
+func transfer(t *testing.T, w, r *Stream, size int) error {
+	data := make([]byte, size)
+	rand.Read(data)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.CloseWrite()
+		}
+		errs <- err
+	}()
+	r.SetReadDeadline(time.Now().Add(60 * time.Second))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("stream data corrupted")
+	}
+	return nil
+}
+
+func TestTransferLossy(t *testing.T) {
+	sa, sb, _ := vnetSessions(t, lossyLink, nil)
+	a, b := openPair(t, sa, sb)
+	errs := make(chan error, 2)
+	go func() { errs <- transfer(t, a, b, 1<<20) }()
+	go func() { errs <- transfer(t, b, a, 256<<10) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Once both directions are done, the streams are forgotten.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sa.mu.Lock()
+		n := len(sa.streams)
+		sa.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManyStreamsLossy(t *testing.T) {
+	sa, sb, _ := vnetSessions(t, lossyLink, &Config{MaxStreams: 4})
+	// Echo what the initiator's streams send.
+	go func() {
+		for {
+			st, err := sb.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+	var wg sync.WaitGroup
+	// More streams than the responder takes at once.
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := sa.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data := bytes.Repeat([]byte{byte(i)}, 20000+i)
+			if _, err := st.Write(data); err != nil {
+				t.Error(err)
+				return
+			}
+			st.CloseWrite()
+			st.SetReadDeadline(time.Now().Add(60 * time.Second))
+			got, err := io.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stream %d: echoed %d bytes, %v", st.ID(), len(got), err)
+			}
+			st.Close()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCloseLinger(t *testing.T) {
+	sa, sb, _ := vnetSessions(t, lossyLink, nil)
+	a, b := openPair(t, sa, sb)
+	data := make([]byte, 50000)
+	rand.Read(data)
+	if _, err := a.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for the data in flight to get through.
+	closed := make(chan struct{})
+	go func() {
+		sa.Close()
+		close(closed)
+	}()
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	<-closed
+	select {
+	case <-sb.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer session still up")
+	}
+	if err := sb.Err(); err != errPeerClosed {
+		t.Fatalf("peer session ended with %v", err)
+	}
+	if _, err := sa.Open(); err == nil {
+		t.Fatal("opened a stream on a closed session")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cfg := &Config{KeepaliveInterval: 100 * time.Millisecond, IdleTimeout: 500 * time.Millisecond}
+	sa, sb, cut := vnetSessions(t, lossyLink, cfg)
+	a, b := openPair(t, sa, sb)
+	// Keepalives keep an idle session up.
+	time.Sleep(1500 * time.Millisecond)
+	if sa.Err() != nil || sb.Err() != nil {
+		t.Fatalf("idle session ended: %v, %v", sa.Err(), sb.Err())
+	}
+	cut.Store(true)
+	if _, err := b.Read(make([]byte, 1)); err != errIdleTimeout {
+		t.Fatalf("read on a dead link: %v", err)
+	}
+	select {
+	case <-sa.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still up on a dead link")
+	}
+	if _, err := a.Write([]byte("x")); err != errIdleTimeout {
+		t.Fatalf("write on a dead link: %v", err)
+	}
+}
+
+func TestFlowControlStall(t *testing.T) {
+	sa, sb, _ := vnetSessions(t, lossyLink, &Config{StreamWindow: 64 << 10})
+	a, b := openPair(t, sa, sb)
+	// With nobody reading, the writer stalls once the peer's window
+	// and its own buffer are full.
+	a.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	n, err := a.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write didn't stall: %d bytes, %v", n, err)
+	}
+	if n < 64<<10 || n > 2*64<<10 {
+		t.Fatalf("wrote %d bytes before stalling", n)
+	}
+	// Reading opens the window again.
+	a.SetWriteDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Write(data[n:])
+		if err == nil {
+			err = a.CloseWrite()
+		}
+		errs <- err
+	}()
+	b.SetReadDeadline(time.Now().Add(60 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,361 @@
+package stream
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// initialWindow is the flow control window of a new stream, before
+// its receiver grants more.
+const initialWindow = 64 << 10
+
+// A Stream is a reliable, ordered byte stream of a Session. It
+// implements net.Conn.
+type Stream struct {
+	s       *Session
+	id      uint32
+	readCh  chan struct{}
+	writeCh chan struct{}
+
+	// The fields below are guarded by s.mu.
+
+	// sendBuf holds the data written and not acked yet, from offset
+	// sendBase. sendNext is the offset of the first byte never sent.
+	sendBuf       []byte
+	sendBase      uint64
+	sendNext      uint64
+	sendAcked     rangeSet
+	peerMax       uint64 // the flow control limit of the peer
+	finWritten    bool
+	finSent       bool
+	finAcked      bool
+	announced     bool // sent at least one frame
+	peerKnows     bool // the peer acked a frame of ours
+	writeDeadline time.Time
+
+	// recvBuf holds the data received and not read yet, from offset
+	// readOffset. recvGot has the ranges received.
+	recvBuf        []byte
+	readOffset     uint64
+	recvGot        rangeSet
+	recvMax        uint64 // the flow control limit we gave the peer
+	maxDataPending bool
+	hasFin         bool
+	finOffset      uint64
+	closed         bool // no more reads, and data is discarded
+	readDeadline   time.Time
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		s:       s,
+		id:      id,
+		readCh:  make(chan struct{}, 1),
+		writeCh: make(chan struct{}, 1),
+		peerMax: initialWindow,
+		recvMax: initialWindow,
+	}
+	if w := uint64(s.cfg.streamWindow()); w > st.recvMax {
+		st.recvMax, st.maxDataPending = w, true
+	}
+	return st
+}
+
+// ID returns the ID of st, which is odd for the streams of the
+// session initiator and even for the others.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads the next bytes of the stream. It returns io.EOF once
+// the peer closed the stream and all its data was read.
+func (st *Stream) Read(b []byte) (int, error) {
+	s := st.s
+	for {
+		s.mu.Lock()
+		deadline := st.readDeadline
+		if st.closed {
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if n := st.readableLocked(); n > 0 {
+			n = copy(b, st.recvBuf[:n])
+			st.consumeLocked(n)
+			s.mu.Unlock()
+			return n, nil
+		}
+		if st.hasFin && st.readOffset == st.finOffset {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := st.wait(st.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes b to the stream. It returns once b is buffered, which
+// blocks while the peer doesn't keep up.
+func (st *Stream) Write(b []byte) (int, error) {
+	s := st.s
+	total := 0
+	for len(b) > 0 {
+		s.mu.Lock()
+		deadline := st.writeDeadline
+		if st.finWritten {
+			s.mu.Unlock()
+			return total, net.ErrClosed
+		}
+		if err := s.err; err != nil {
+			s.mu.Unlock()
+			return total, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			s.mu.Unlock()
+			return total, os.ErrDeadlineExceeded
+		}
+		if room := s.cfg.streamWindow() - len(st.sendBuf); room > 0 {
+			if room > len(b) {
+				room = len(b)
+			}
+			st.sendBuf = append(st.sendBuf, b[:room]...)
+			b = b[room:]
+			total += room
+			s.mu.Unlock()
+			s.signal(s.kick)
+			continue
+		}
+		s.mu.Unlock()
+		if err := st.wait(st.writeCh, deadline); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// wait waits for a signal on ch, the end of the session or deadline.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+		case <-st.s.done:
+		}
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+	case <-st.s.done:
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// CloseWrite closes the writing side of the stream. The peer reads
+// io.EOF once it got all the data written before.
+func (st *Stream) CloseWrite() error {
+	st.s.mu.Lock()
+	if st.finWritten {
+		st.s.mu.Unlock()
+		return nil
+	}
+	st.finWritten = true
+	st.s.mu.Unlock()
+	st.s.signal(st.writeCh)
+	st.s.signal(st.s.kick)
+	return nil
+}
+
+// Close closes the writing side of the stream like CloseWrite, and
+// discards what the peer sends from now on. The data written before
+// is still delivered.
+func (st *Stream) Close() error {
+	st.s.mu.Lock()
+	if st.closed {
+		st.s.mu.Unlock()
+		return net.ErrClosed
+	}
+	st.closeLocked()
+	st.s.mu.Unlock()
+	st.s.signal(st.s.kick)
+	return nil
+}
+
+func (st *Stream) closeLocked() {
+	st.finWritten, st.closed = true, true
+	st.recvBuf = nil
+	st.consumeLocked(st.readableLocked())
+	st.s.signal(st.readCh)
+	st.s.signal(st.writeCh)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.s.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.s.mu.Lock()
+	st.readDeadline = t
+	st.s.mu.Unlock()
+	st.s.signal(st.readCh)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.s.mu.Lock()
+	st.writeDeadline = t
+	st.s.mu.Unlock()
+	st.s.signal(st.writeCh)
+	return nil
+}
+
+// readableLocked returns how many bytes are ready to be read.
+func (st *Stream) readableLocked() int {
+	if len(st.recvGot) == 0 || st.recvGot[0].lo > st.readOffset {
+		return 0
+	}
+	return int(st.recvGot[0].hi - st.readOffset)
+}
+
+// consumeLocked drops n bytes that were read, and grants the peer
+// more credit when half of the window was used.
+func (st *Stream) consumeLocked(n int) {
+	st.readOffset += uint64(n)
+	if len(st.recvBuf) > n {
+		st.recvBuf = st.recvBuf[n:]
+	} else {
+		st.recvBuf = nil
+	}
+	w := uint64(st.s.cfg.streamWindow())
+	if st.readOffset+w-st.recvMax >= w/2 {
+		st.recvMax = st.readOffset + w
+		st.maxDataPending = true
+		st.s.signal(st.s.kick)
+	}
+	st.maybeRemoveLocked()
+}
+
+// onData stores data received at offset off.
+func (st *Stream) onData(off uint64, data []byte, fin bool) {
+	end := off + uint64(len(data))
+	if fin && !st.hasFin {
+		st.hasFin, st.finOffset = true, end
+	}
+	st.recvGot.add(off, end)
+	if st.closed {
+		st.consumeLocked(st.readableLocked())
+		return
+	}
+	if end > st.readOffset {
+		if off < st.readOffset {
+			data = data[st.readOffset-off:]
+			off = st.readOffset
+		}
+		if need := int(end - st.readOffset); len(st.recvBuf) < need {
+			st.recvBuf = append(st.recvBuf, make([]byte, need-len(st.recvBuf))...)
+		}
+		copy(st.recvBuf[off-st.readOffset:], data)
+	}
+	st.s.signal(st.readCh)
+	st.maybeRemoveLocked()
+}
+
+// nextFrameLocked picks the data of the next new frame of st, at most
+// room bytes, and marks it sent.
+func (st *Stream) nextFrameLocked(room int) (off uint64, n int, fin bool, ok bool) {
+	// Until the peer acks the first frame, it may be refusing the
+	// stream, so the rest waits.
+	if st.announced && !st.peerKnows {
+		return 0, 0, false, false
+	}
+	end := st.sendBase + uint64(len(st.sendBuf))
+	limit := end
+	if st.peerMax < limit {
+		limit = st.peerMax
+	}
+	if st.sendNext < limit {
+		n = int(limit - st.sendNext)
+		if n > room {
+			n = room
+		}
+	}
+	fin = st.finWritten && !st.finSent && st.sendNext+uint64(n) == end
+	if n == 0 && !fin && st.announced {
+		return 0, 0, false, false
+	}
+	off = st.sendNext
+	st.sendNext += uint64(n)
+	st.announced = true
+	if fin {
+		st.finSent = true
+	}
+	return off, n, fin, true
+}
+
+// onAcked processes the ack of a frame of st.
+func (st *Stream) onAcked(off uint64, n int, fin bool) {
+	st.peerKnows = true
+	if fin {
+		st.finAcked = true
+	}
+	st.sendAcked.add(off, off+uint64(n))
+	if len(st.sendAcked) > 0 {
+		if r := st.sendAcked[0]; r.lo <= st.sendBase && r.hi > st.sendBase {
+			k := int(r.hi - st.sendBase)
+			if k < len(st.sendBuf) {
+				st.sendBuf = st.sendBuf[k:]
+			} else {
+				st.sendBuf = nil
+			}
+			st.sendBase = r.hi
+			st.s.signal(st.writeCh)
+		}
+	}
+	st.maybeRemoveLocked()
+}
+
+// ackedLocked reports whether the peer acked the frame at off.
+func (st *Stream) ackedLocked(off uint64, n int, fin bool) bool {
+	switch {
+	case fin && !st.finAcked:
+		return false
+	case n == 0:
+		return fin || st.peerKnows
+	}
+	return off+uint64(n) <= st.sendBase || st.sendAcked.contains(off, off+uint64(n))
+}
+
+// sendDoneLocked reports whether the peer acked all we wrote, and the
+// end of the stream.
+func (st *Stream) sendDoneLocked() bool {
+	return st.finAcked && len(st.sendBuf) == 0
+}
+
+// maybeRemoveLocked forgets st once both directions are done.
+func (st *Stream) maybeRemoveLocked() {
+	if st.sendDoneLocked() && st.hasFin && st.readOffset == st.finOffset {
+		delete(st.s.streams, st.id)
+	}
+}
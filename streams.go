@@ -0,0 +1,60 @@
+package nat
+
+import (
+	"net"
+
+	"github.com/danderson/nat/stream"
+)
+
+// Streams returns a session of reliable streams over c, configured by
+// Config.Stream. The initiator of c is the session initiator. c
+// belongs to the session. To run the streams over DTLS or Noise, pass
+// the secured connection to stream.NewSession instead.
+func (c *Conn) Streams() *stream.Session {
+	return stream.NewSession(c, c.initiator, c.cfg.Stream)
+}
+
+// ConnectStream is like ConnectOpt, but returns a reliable, ordered
+// byte stream, see Conn.Streams. The initiator opens the stream, and
+// closing it ends the session.
+func ConnectStream(xchg ExchangeCandidatesFun, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectStream(wrapExchange(xchg), initiator, cfg)
+}
+
+// ConnectSignalerStream is like ConnectStream, but exchanges
+// candidates with the peer over s.
+func ConnectSignalerStream(s Signaler, initiator bool, cfg *Config) (net.Conn, error) {
+	return connectStream(signalerExchange(s), initiator, cfg)
+}
+
+func connectStream(xchg exchangeFun, initiator bool, cfg *Config) (net.Conn, error) {
+	conn, err := connectOne(xchg, initiator, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := conn.(*Conn)
+	s := c.Streams()
+	var st *stream.Stream
+	if c.initiator {
+		st, err = s.Open()
+	} else {
+		st, err = s.Accept()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &sessionStream{st, s}, nil
+}
+
+// sessionStream is the only stream of a session, which it ends when
+// closed.
+type sessionStream struct {
+	*stream.Stream
+	session *stream.Session
+}
+
+func (s *sessionStream) Close() error {
+	s.Stream.Close()
+	return s.session.Close()
+}
@@ -36,7 +36,14 @@ type Packet struct {
 	Addr         *net.UDPAddr
 	HasMac       bool
 	Software     string
+	Username     string
 	UseCandidate bool
+	// Priority, Controlling, Controlled and Tiebreaker are the ICE
+	// attributes of a check.
+	Priority    uint32
+	Controlling bool
+	Controlled  bool
+	Tiebreaker  uint64
 
 	Error     *PacketError
 	Alternate *net.UDPAddr
@@ -74,6 +81,71 @@ func BindRequest(tid []byte, macKey []byte, compat bool, useCandidate bool) ([]b
 	return buildPacket(hdr, buf.Bytes(), macKey, compat)
 }
 
+// BindIndication constructs and returns a Binding Indication STUN
+// packet, which needs no answer and is used as a keepalive.
+//
+// tid must be 12 bytes long.
+func BindIndication(tid []byte) ([]byte, error) {
+	if len(tid) != 12 {
+		panic("Wrong length for tid")
+	}
+	var hdr header
+	hdr.TypeCode = typeCode(ClassIndication, MethodBinding)
+	hdr.Magic = magic
+	copy(hdr.Tid[:], tid)
+	return buildPacket(hdr, nil, nil, false)
+}
+
+// ICE holds the ICE attributes (RFC 5245) carried by a connectivity
+// check.
+type ICE struct {
+	// Username is "<receiver ufrag>:<sender ufrag>".
+	Username     string
+	UseCandidate bool
+	// Priority is the priority of the peer reflexive candidate that
+	// the check would reveal.
+	Priority uint32
+	// Controlling is the role of the sender, Tiebreaker settles a
+	// conflict if both peers think they have it.
+	Controlling bool
+	Tiebreaker  uint64
+}
+
+// CheckRequest constructs and returns a Binding Request STUN packet
+// for an ICE connectivity check.
+//
+// tid must be 12 bytes long. The packet is signed with macKey, which
+// should be the password of the receiving agent.
+func CheckRequest(tid []byte, ice ICE, macKey []byte) ([]byte, error) {
+	if len(tid) != 12 {
+		panic("Wrong length for tid")
+	}
+	var hdr header
+	hdr.TypeCode = typeCode(ClassRequest, MethodBinding)
+	hdr.Magic = magic
+	copy(hdr.Tid[:], tid)
+
+	var buf bytes.Buffer
+	if ice.Username != "" {
+		writeAttr(&buf, attrUsername, []byte(ice.Username))
+	}
+	var prio [4]byte
+	binary.BigEndian.PutUint32(prio[:], ice.Priority)
+	writeAttr(&buf, attrPriority, prio[:])
+	if ice.UseCandidate {
+		writeAttr(&buf, attrUseCandidate, nil)
+	}
+	var tb [8]byte
+	binary.BigEndian.PutUint64(tb[:], ice.Tiebreaker)
+	if ice.Controlling {
+		writeAttr(&buf, attrControlling, tb[:])
+	} else {
+		writeAttr(&buf, attrControlled, tb[:])
+	}
+
+	return buildPacket(hdr, buf.Bytes(), macKey, false)
+}
+
 // BindResponse constructs and returns a Binding Success STUN packet.
 //
 // tid must be 12 bytes long. If a macKey is provided, the returned
@@ -112,12 +184,56 @@ func BindResponse(tid []byte, addr *net.UDPAddr, macKey []byte, compat bool) ([]
 	return buildPacket(hdr, attrs, macKey, compat)
 }
 
+// PeekClass returns the class of the STUN packet in raw without
+// parsing or verifying it, so that callers can pick the key to
+// verify the packet with.
+func PeekClass(raw []byte) (Class, error) {
+	if len(raw) < headerLen {
+		return 0, MalformedPacket{}
+	}
+	typeCode := binary.BigEndian.Uint16(raw)
+	if typeCode&0xC000 != 0 || binary.BigEndian.Uint32(raw[4:]) != magic {
+		return 0, MalformedPacket{}
+	}
+	return typeCodeClass(typeCode), nil
+}
+
+// PeekUsername returns the USERNAME attribute of the STUN packet in
+// raw without verifying the packet, so that callers sharing a socket
+// can route it to the session it names.
+func PeekUsername(raw []byte) (string, bool) {
+	if _, err := PeekClass(raw); err != nil {
+		return "", false
+	}
+	attrs := raw[headerLen:]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		n := int(binary.BigEndian.Uint16(attrs[2:]))
+		attrs = attrs[4:]
+		if n > len(attrs) {
+			return "", false
+		}
+		if typ == attrUsername {
+			return string(attrs[:n]), true
+		}
+		n = (n + 3) &^ 3
+		if n > len(attrs) {
+			return "", false
+		}
+		attrs = attrs[n:]
+	}
+	return "", false
+}
+
 // ParsePacket parses a byte slice as a STUN packet.
 //
 // If a macKey is provided, only packets correctly signed with that
 // key will be accepted. If no macKey is provided, only unsigned
 // packets will be accepted.
 func ParsePacket(raw []byte, macKey []byte) (*Packet, error) {
+	if len(raw) < headerLen {
+		return nil, MalformedPacket{}
+	}
 	var hdr header
 	if err := binary.Read(bytes.NewBuffer(raw[:headerLen]), binary.BigEndian, &hdr); err != nil {
 		return nil, err
@@ -184,6 +300,18 @@ func ParsePacket(raw []byte, macKey []byte) (*Packet, error) {
 			haveXor = true
 		case attrUseCandidate:
 			pkt.UseCandidate = true
+		case attrPriority:
+			if len(value) != 4 {
+				return nil, MalformedPacket{}
+			}
+			pkt.Priority = binary.BigEndian.Uint32(value)
+		case attrControlling, attrControlled:
+			if len(value) != 8 {
+				return nil, MalformedPacket{}
+			}
+			pkt.Controlling = ahdr.Type == attrControlling
+			pkt.Controlled = ahdr.Type == attrControlled
+			pkt.Tiebreaker = binary.BigEndian.Uint64(value)
 
 		case attrFingerprint:
 			return nil, MalformedPacket{}
@@ -191,7 +319,9 @@ func ParsePacket(raw []byte, macKey []byte) (*Packet, error) {
 			if len(macKey) == 0 {
 				return nil, UnverifiableMac{}
 			}
-			tocheck := raw[:len(raw)-attrReader.Len()-macLen]
+			// Copy the signed prefix, its length gets rewritten
+			// and raw belongs to the caller.
+			tocheck := append([]byte(nil), raw[:len(raw)-attrReader.Len()-macLen]...)
 			binary.BigEndian.PutUint16(tocheck[2:4], uint16(len(tocheck)+macLen-headerLen))
 			macer := hmac.New(sha1.New, macKey)
 			if _, err := macer.Write(tocheck); err != nil {
@@ -221,6 +351,7 @@ func ParsePacket(raw []byte, macKey []byte) (*Packet, error) {
 			pkt.Alternate = &net.UDPAddr{ip, port, ""}
 
 		case attrUsername:
+			pkt.Username = string(value)
 		case attrRealm:
 		case attrNonce:
 			return nil, errors.New("Unsupported STUN attribute")
@@ -340,6 +471,14 @@ func buildPacket(hdr header, attributes, macKey []byte, compat bool) ([]byte, er
 	return buf.Bytes(), nil
 }
 
+func writeAttr(buf *bytes.Buffer, typ uint16, value []byte) {
+	binary.Write(buf, binary.BigEndian, attrHeader{typ, uint16(len(value))})
+	buf.Write(value)
+	if pad := len(value) % 4; pad != 0 {
+		buf.Write(make([]byte, 4-pad))
+	}
+}
+
 func parseAddress(raw []byte) (net.IP, int, error) {
 	if len(raw) != 8 && len(raw) != 20 {
 		return nil, 0, MalformedPacket{}
@@ -428,12 +567,15 @@ const (
 	attrRealm        = 0x14 //
 	attrNonce        = 0x15 //
 	attrXorAddress   = 0x20 //
+	attrPriority     = 0x24 //
 	attrUseCandidate = 0x25 //
 
 	// Comprehension optional
 	attrSoftware    = 0x8022 //
 	attrAlternate   = 0x8023 //
 	attrFingerprint = 0x8028 //
+	attrControlled  = 0x8029 //
+	attrControlling = 0x802A //
 )
 
 const (
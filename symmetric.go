@@ -0,0 +1,188 @@
+package nat
+
+import (
+	"math/rand"
+	"net"
+)
+
+// Symmetric NATs pick a new public port for every destination, so
+// the srflx candidate a peer learns from the STUN server is useless
+// to it. We fight back in two ways: we predict the ports our NAT will
+// pick next and advertise them, and we send checks from many sockets
+// at once, so that with enough mappings on both sides a pair of them
+// lines up (birthday punching).
+
+const (
+	// predictionProbes is how many fresh mappings we watch the NAT
+	// allocate to guess its next ports.
+	predictionProbes = 3
+	// maxPredictedPorts bounds Config.PredictPorts, so that the
+	// candidates fit in a signaling message.
+	maxPredictedPorts = 256
+	// maxLearned bounds the peer-reflexive candidates we learn.
+	maxLearned = 64
+)
+
+// predictPorts guesses the public addresses our NAT will allocate for
+// the next n mappings it creates, from the reflexive address srflx of
+// our socket. If the NAT allocates ports sequentially, they follow
+// the observed stride, otherwise they are random guesses.
+func (e *attemptEngine) predictPorts(srflx *net.UDPAddr, n int) []Candidate {
+	cfg := e.cfg
+	if n > maxPredictedPorts {
+		n = maxPredictedPorts
+	}
+	var ports []int
+	for i := 0; i < predictionProbes; i++ {
+		sock, err := cfg.listen(e.extraAddr())
+		if err != nil {
+			return nil
+		}
+		addr, err := getReflexive(sock, cfg)
+		sock.Close()
+		if err != nil || !addr.IP.Equal(srflx.IP) {
+			return nil
+		}
+		ports = append(ports, addr.Port)
+	}
+
+	stride := ports[1] - ports[0]
+	for i := 2; i < len(ports); i++ {
+		if ports[i]-ports[i-1] != stride {
+			stride = 0
+		}
+	}
+	e.log.Debug("measured NAT port allocation", "ports", ports, "stride", stride)
+
+	var ret []Candidate
+	last := ports[len(ports)-1]
+	for i := 1; i <= n; i++ {
+		port := 1024 + rand.Intn(65536-1024)
+		if stride != 0 {
+			port = last + i*stride
+		}
+		if port <= 0 || port > 65535 || port == srflx.Port {
+			continue
+		}
+		ret = append(ret, Candidate{
+			Type: CandidatePredicted,
+			Addr: &net.UDPAddr{IP: srflx.IP, Port: port},
+			Prio: 1,
+		})
+	}
+	return pruneCandidates(ret, cfg.BlacklistAddresses)
+}
+
+// predictCandidates adds predicted candidates to cands, if asked to.
+func (e *attemptEngine) predictCandidates(cands []Candidate) []Candidate {
+	if e.cfg.PredictPorts <= 0 {
+		return cands
+	}
+	for _, c := range cands {
+		if c.Type == CandidateServerReflexive {
+			return append(cands, e.predictPorts(c.Addr, e.cfg.PredictPorts)...)
+		}
+	}
+	return cands
+}
+
+// socket returns our socket number i. 0 is the main socket, the
+// others are spray sockets.
+func (e *attemptEngine) socket(i int) net.PacketConn {
+	if i == 0 {
+		return e.sock
+	}
+	return e.spray[i-1]
+}
+
+// extraAddr returns the address to bind our extra sockets to: the IP
+// of our main socket, with any port. Like gather, it goes by the
+// socket rather than Config.BindAddress, which can be nil.
+func (e *attemptEngine) extraAddr() *net.UDPAddr {
+	if laddr, ok := e.sock.LocalAddr().(*net.UDPAddr); ok {
+		return &net.UDPAddr{IP: laddr.IP}
+	}
+	return &net.UDPAddr{}
+}
+
+// openSpray opens n spray sockets.
+func (e *attemptEngine) openSpray(n int) error {
+	for i := 0; i < n; i++ {
+		sock, err := e.cfg.listen(e.extraAddr())
+		if err != nil {
+			e.closeSpray()
+			return err
+		}
+		e.spray = append(e.spray, sock)
+	}
+	return nil
+}
+
+func (e *attemptEngine) closeSpray() {
+	for _, sock := range e.spray {
+		sock.Close()
+	}
+	e.spray = nil
+}
+
+// addSprayAttempts pairs every spray socket with the peer's candidates
+// that sit behind a NAT, from e.attempts[from] on.
+func (e *attemptEngine) addSprayAttempts(from int) {
+	n := len(e.attempts)
+	for i := range e.spray {
+		for _, a := range e.attempts[from:n] {
+			if a.Type == CandidateHost {
+				continue
+			}
+			e.addAttempt(attempt{Candidate: a.Candidate, sock: i + 1})
+		}
+	}
+}
+
+// learn records from as a peer-reflexive candidate for socket via,
+// if we don't know it already. The peer checked us from there, so it
+// is likely to work the other way too.
+func (e *attemptEngine) learn(from *net.UDPAddr, via int) {
+	// e.selected points into e.attempts.
+	if e.selected != nil {
+		return
+	}
+	if _, ok := e.find(from, via); ok || e.learned >= maxLearned {
+		return
+	}
+	e.learned++
+	e.log.Debug("learned peer-reflexive candidate", "addr", from)
+	e.addAttempt(attempt{
+		Candidate: Candidate{
+			Type:      CandidatePeerReflexive,
+			Addr:      from,
+			Prio:      1,
+			Component: e.component,
+		},
+		sock: via,
+	})
+}
+
+// takeSocket returns the socket of the selected pair, and closes the
+// others.
+func (e *attemptEngine) takeSocket() net.PacketConn {
+	keep := e.socket(e.selected.sock)
+	if keep != e.sock {
+		e.sock.Close()
+		e.sock = keep
+		e.early = nil
+		// The gateway forwards to the main socket.
+		if e.lease != nil {
+			e.lease.Close()
+			e.lease = nil
+		}
+	}
+	for _, sock := range e.spray {
+		if sock != keep {
+			sock.Close()
+		}
+	}
+	e.spray = nil
+	e.selected.sock = 0
+	return keep
+}
@@ -0,0 +1,7 @@
+package nat
+
+// The syscall package predates these.
+const (
+	sysRecvmmsg = 299
+	sysSendmmsg = 307
+)
@@ -0,0 +1,127 @@
+package vnet
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A VirtualClock is a Clock that only moves when told to, so that
+// tests can go through minutes of timeouts in milliseconds.
+type VirtualClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	timers   []*virtualTimer // sorted by deadline
+	activity uint64
+}
+
+type virtualTimer struct {
+	at time.Time
+	f  func()
+}
+
+// NewVirtualClock returns a VirtualClock that starts at start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity++
+	return c.now
+}
+
+// AfterFunc calls f in its own goroutine once the clock has moved
+// forward by d.
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity++
+	t := &virtualTimer{c.now.Add(d), f}
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].at.After(t.at) })
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i := range c.timers {
+			if c.timers[i] == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Advance moves the clock forward by d, firing the timers that
+// expire on the way.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanceTo(c.now.Add(d))
+}
+
+// Next moves the clock to the next timer and fires it. It reports
+// false if there are no timers.
+func (c *VirtualClock) Next() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return false
+	}
+	c.advanceTo(c.timers[0].at)
+	return true
+}
+
+// advanceTo moves the clock to t. Called with c.mu held.
+func (c *VirtualClock) advanceTo(t time.Time) {
+	for len(c.timers) > 0 && !c.timers[0].at.After(t) {
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		if timer.at.After(c.now) {
+			c.now = timer.at
+		}
+		go timer.f()
+	}
+	if t.After(c.now) {
+		c.now = t
+	}
+	c.activity++
+}
+
+// Run moves the clock to the next timer whenever nobody used it for
+// idle of real time, i.e. when everyone waits for a timer, until stop
+// is called. idle must be long enough for the code under test to
+// react to a timer: a few milliseconds, more under the race
+// detector.
+func (c *VirtualClock) Run(idle time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(idle)
+		defer t.Stop()
+		var last uint64
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			c.mu.Lock()
+			busy := c.activity != last
+			last = c.activity
+			c.mu.Unlock()
+			if !busy {
+				c.Next()
+				c.mu.Lock()
+				last = c.activity
+				c.mu.Unlock()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
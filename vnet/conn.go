@@ -0,0 +1,159 @@
+package vnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxQueued is the receive buffer of a socket, in packets.
+const maxQueued = 1024
+
+type datagram struct {
+	buf  []byte
+	from *net.UDPAddr
+}
+
+// conn is a UDP socket on a Host.
+type conn struct {
+	h     *Host
+	laddr *net.UDPAddr
+
+	mu            sync.Mutex
+	queue         []datagram
+	wake          chan struct{} // closed when the state changes
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(h *Host, laddr *net.UDPAddr) *conn {
+	return &conn{
+		h:     h,
+		laddr: laddr,
+		wake:  make(chan struct{}),
+	}
+}
+
+// notify wakes up blocked readers. Called with c.mu held.
+func (c *conn) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+func (c *conn) push(b []byte, from *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.queue) >= maxQueued {
+		return
+	}
+	c.queue = append(c.queue, datagram{b, from})
+	c.notify()
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.laddr, Err: err}
+}
+
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	clock := c.h.n.clock()
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, nil, c.opError("read", net.ErrClosed)
+		}
+		if len(c.queue) > 0 {
+			d := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return copy(b, d.buf), d.from, nil
+		}
+		deadline, wake := c.readDeadline, c.wake
+		c.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-wake
+			continue
+		}
+		d := deadline.Sub(clock.Now())
+		if d <= 0 {
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		timeout := make(chan struct{})
+		stop := clock.AfterFunc(d, func() { close(timeout) })
+		select {
+		case <-wake:
+			stop()
+		case <-timeout:
+		}
+	}
+}
+
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", errors.New("not a UDP address"))
+	}
+	c.mu.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	if !deadline.IsZero() && !c.h.n.clock().Now().Before(deadline) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	buf := append([]byte(nil), b...)
+	src := &net.UDPAddr{IP: c.h.ip, Port: c.laddr.Port}
+	c.h.n.mu.Lock()
+	defer c.h.n.mu.Unlock()
+	c.h.send(buf, src, dst)
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	c.queue = nil
+	c.notify()
+	c.mu.Unlock()
+
+	c.h.n.mu.Lock()
+	defer c.h.n.mu.Unlock()
+	if c.h.socks[c.laddr.Port] == c {
+		delete(c.h.socks, c.laddr.Port)
+	}
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,214 @@
+package vnet
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Behavior is how a NAT maps or filters traffic, as described by RFC
+// 4787.
+type Behavior int
+
+// NAT behaviors, from the friendliest.
+const (
+	// EndpointIndependent mappings are reused for all destinations,
+	// and filters let anyone in.
+	EndpointIndependent Behavior = iota
+	// AddressDependent mappings and filters are per remote IP.
+	AddressDependent
+	// AddressPortDependent mappings and filters are per remote IP and
+	// port. A NAT that maps this way is often called symmetric.
+	AddressPortDependent
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case EndpointIndependent:
+		return "endpoint-independent"
+	case AddressDependent:
+		return "address-dependent"
+	case AddressPortDependent:
+		return "address-and-port-dependent"
+	}
+	return fmt.Sprintf("Behavior(%d)", int(b))
+}
+
+// NATConfig describes how a NAT behaves.
+type NATConfig struct {
+	// Mapping decides when outgoing packets share a public port.
+	Mapping Behavior
+	// Filtering decides who may send packets in through a mapping.
+	Filtering Behavior
+	// Hairpin lets hosts on the LAN reach each other through the
+	// public address of the NAT.
+	Hairpin bool
+	// PortStride, if not zero, allocates public ports sequentially
+	// with this stride. Zero allocates random ports.
+	PortStride int
+	// MappingTimeout is how long a mapping lives without outgoing
+	// traffic. Zero means forever.
+	MappingTimeout time.Duration
+}
+
+// A NAT connects a LAN of private hosts to a Network through a
+// public address.
+type NAT struct {
+	n      *Network
+	public net.IP
+	cfg    NATConfig
+
+	// Guarded by n.mu.
+	hosts    map[string]*Host // by private IP
+	mappings map[int]*mapping // by public port
+	lastPort int
+}
+
+type mapping struct {
+	internal *net.UDPAddr
+	external int
+	// remote is the destination that created the mapping, for
+	// dependent mappings.
+	remote   *net.UDPAddr
+	peers    map[string]bool // addresses and IPs we sent to
+	lastSent time.Time
+}
+
+// AddNAT adds a NAT with the public address ip.
+func (n *Network) AddNAT(ip net.IP, cfg NATConfig) (*NAT, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.inUse(ip) {
+		return nil, fmt.Errorf("address %v already in use", ip)
+	}
+	nat := &NAT{
+		n:        n,
+		public:   ip,
+		cfg:      cfg,
+		hosts:    map[string]*Host{},
+		mappings: map[int]*mapping{},
+		lastPort: 1024 + n.rand.Intn(60000),
+	}
+	n.nats[ip.String()] = nat
+	return nat, nil
+}
+
+// IP returns the public address of nat.
+func (nat *NAT) IP() net.IP {
+	return nat.public
+}
+
+// AddHost adds a host with the private address ip behind nat.
+func (nat *NAT) AddHost(ip net.IP) (*Host, error) {
+	nat.n.mu.Lock()
+	defer nat.n.mu.Unlock()
+	if nat.hosts[ip.String()] != nil || ip.Equal(nat.public) {
+		return nil, fmt.Errorf("address %v already in use", ip)
+	}
+	h := newHost(nat.n, nat, ip)
+	nat.hosts[ip.String()] = h
+	return h, nil
+}
+
+// outbound handles a packet from the LAN. Called with n.mu held.
+func (nat *NAT) outbound(b []byte, src, dst *net.UDPAddr) {
+	if h := nat.hosts[dst.IP.String()]; h != nil {
+		nat.n.deliver(h, b, src, dst.Port)
+		return
+	}
+	m := nat.mapping(src, dst)
+	if m == nil {
+		return
+	}
+	m.peers[dst.String()] = true
+	m.peers[dst.IP.String()] = true
+	m.lastSent = nat.n.clock().Now()
+	from := &net.UDPAddr{IP: nat.public, Port: m.external}
+	if dst.IP.Equal(nat.public) {
+		if nat.cfg.Hairpin {
+			nat.inbound(b, from, dst)
+		}
+		return
+	}
+	nat.n.route(b, from, dst)
+}
+
+// inbound handles a packet for the public address of nat. Called
+// with n.mu held.
+func (nat *NAT) inbound(b []byte, src, dst *net.UDPAddr) {
+	m := nat.mappings[dst.Port]
+	if m == nil || nat.expired(m) {
+		return
+	}
+	switch nat.cfg.Filtering {
+	case AddressDependent:
+		if !m.peers[src.IP.String()] {
+			return
+		}
+	case AddressPortDependent:
+		if !m.peers[src.String()] {
+			return
+		}
+	}
+	if h := nat.hosts[m.internal.IP.String()]; h != nil {
+		nat.n.deliver(h, b, src, m.internal.Port)
+	}
+}
+
+func (nat *NAT) expired(m *mapping) bool {
+	return nat.cfg.MappingTimeout > 0 && nat.n.clock().Now().Sub(m.lastSent) > nat.cfg.MappingTimeout
+}
+
+// mapping returns the mapping for packets from src to dst, creating
+// it if needed. Called with n.mu held.
+func (nat *NAT) mapping(src, dst *net.UDPAddr) *mapping {
+	for port, m := range nat.mappings {
+		if nat.expired(m) {
+			delete(nat.mappings, port)
+			continue
+		}
+		if m.internal.String() != src.String() {
+			continue
+		}
+		switch nat.cfg.Mapping {
+		case EndpointIndependent:
+			return m
+		case AddressDependent:
+			if m.remote.IP.Equal(dst.IP) {
+				return m
+			}
+		case AddressPortDependent:
+			if m.remote.String() == dst.String() {
+				return m
+			}
+		}
+	}
+
+	port := 0
+	for try := 0; try < 1000; try++ {
+		if nat.cfg.PortStride != 0 {
+			nat.lastPort += nat.cfg.PortStride
+			if nat.lastPort < 1024 || nat.lastPort > 65535 {
+				nat.lastPort = 1024 + (nat.lastPort%64512+64512)%64512
+			}
+			port = nat.lastPort
+		} else {
+			port = 1024 + nat.n.rand.Intn(64512)
+		}
+		if nat.mappings[port] == nil {
+			break
+		}
+		port = 0
+	}
+	if port == 0 {
+		return nil
+	}
+	m := &mapping{
+		internal: src,
+		external: port,
+		remote:   dst,
+		peers:    map[string]bool{},
+	}
+	nat.mappings[port] = m
+	return m
+}
@@ -0,0 +1,32 @@
+package vnet
+
+import (
+	"net"
+
+	"github.com/danderson/nat/stun"
+)
+
+// ServeSTUN answers STUN binding requests on sock with the address
+// they came from, until sock is closed.
+func ServeSTUN(sock net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := sock.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		packet, err := stun.ParsePacket(buf[:n], nil)
+		if err != nil || packet.Class != stun.ClassRequest || packet.Method != stun.MethodBinding {
+			continue
+		}
+		resp, err := stun.BindResponse(packet.Tid[:], from, nil, false)
+		if err != nil {
+			continue
+		}
+		sock.WriteTo(resp, from)
+	}
+}
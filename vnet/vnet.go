@@ -0,0 +1,255 @@
+// Package vnet is an in-memory network for testing NAT traversal
+// without real sockets.
+//
+// A Network is an internet of public hosts and NATs. Each NAT hides a
+// LAN of private hosts, and maps and filters their traffic with one
+// of the behaviors of RFC 4787. Hosts open sockets with ListenPacket,
+// which plugs into nat.Config:
+//
+//	n := vnet.New()
+//	stunAddr, _ := n.AddSTUNServer(net.IPv4(1, 2, 3, 4), 3478)
+//	gw, _ := n.AddNAT(net.IPv4(5, 6, 7, 8), vnet.NATConfig{Mapping: vnet.AddressPortDependent})
+//	h, _ := gw.AddHost(net.IPv4(10, 0, 0, 2))
+//	cfg := nat.DefaultConfig()
+//	cfg.ListenPacket = h.ListenPacket
+//	cfg.InterfaceAddrs = h.InterfaceAddrs
+//	cfg.STUNServer = stunAddr.String()
+package vnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Clock tells time on the network. It has the same methods as
+// nat.Clock, so one clock can drive both.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d, unless stop
+	// is called first.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// LinkConfig describes the quality of every link of a Network.
+type LinkConfig struct {
+	// Latency delays every packet.
+	Latency time.Duration
+	// Jitter adds a random delay of up to Jitter, which can reorder
+	// packets.
+	Jitter time.Duration
+	// Loss is the probability, from 0 to 1, that a packet is
+	// dropped.
+	Loss float64
+}
+
+// A Network is a virtual internet.
+type Network struct {
+	// Clock, if set before use, times latency, deadlines and NAT
+	// mapping expiry. Nil means the system clock.
+	Clock Clock
+
+	mu    sync.Mutex
+	link  LinkConfig
+	rand  *rand.Rand
+	hosts map[string]*Host // public hosts, by IP
+	nats  map[string]*NAT  // by public IP
+}
+
+// New returns an empty Network with perfect links.
+func New() *Network {
+	return &Network{
+		rand:  rand.New(rand.NewSource(1)),
+		hosts: map[string]*Host{},
+		nats:  map[string]*NAT{},
+	}
+}
+
+// Seed seeds the randomness of the network: packet loss, jitter and
+// port allocation.
+func (n *Network) Seed(seed int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rand.Seed(seed)
+}
+
+// SetLink changes the quality of all links.
+func (n *Network) SetLink(l LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.link = l
+}
+
+func (n *Network) clock() Clock {
+	if n.Clock == nil {
+		return realClock{}
+	}
+	return n.Clock
+}
+
+// inUse reports whether ip is taken on the internet. Called with
+// n.mu held.
+func (n *Network) inUse(ip net.IP) bool {
+	return n.hosts[ip.String()] != nil || n.nats[ip.String()] != nil
+}
+
+// AddHost adds a host with the public address ip.
+func (n *Network) AddHost(ip net.IP) (*Host, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.inUse(ip) {
+		return nil, fmt.Errorf("address %v already in use", ip)
+	}
+	h := newHost(n, nil, ip)
+	n.hosts[ip.String()] = h
+	return h, nil
+}
+
+// AddSTUNServer adds a STUN server listening on ip and port, on a new
+// public host, and returns its address.
+func (n *Network) AddSTUNServer(ip net.IP, port int) (*net.UDPAddr, error) {
+	h, err := n.AddHost(ip)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := h.ListenPacket("udp", (&net.UDPAddr{IP: ip, Port: port}).String())
+	if err != nil {
+		return nil, err
+	}
+	go ServeSTUN(sock)
+	return sock.LocalAddr().(*net.UDPAddr), nil
+}
+
+// A Host is a machine on the network, with a single address.
+type Host struct {
+	n   *Network
+	nat *NAT // nil for public hosts
+	ip  net.IP
+
+	// Guarded by n.mu.
+	socks map[int]*conn
+}
+
+func newHost(n *Network, nat *NAT, ip net.IP) *Host {
+	return &Host{
+		n:     n,
+		nat:   nat,
+		ip:    ip,
+		socks: map[int]*conn{},
+	}
+}
+
+// IP returns the address of h.
+func (h *Host) IP() net.IP {
+	return h.ip
+}
+
+// InterfaceAddrs returns the address of h, like net.InterfaceAddrs.
+func (h *Host) InterfaceAddrs() ([]net.Addr, error) {
+	bits := 8 * len(h.ip)
+	if ip4 := h.ip.To4(); ip4 != nil {
+		bits = 32
+	}
+	return []net.Addr{&net.IPNet{IP: h.ip, Mask: net.CIDRMask(bits, bits)}}, nil
+}
+
+// ListenPacket opens a UDP socket on h, like net.ListenPacket.
+// address may leave the IP unspecified, and a zero port picks a free
+// one.
+func (h *Host) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if laddr.IP != nil && !laddr.IP.IsUnspecified() && !laddr.IP.Equal(h.ip) {
+		return nil, fmt.Errorf("cannot bind to %v on host %v", laddr.IP, h.ip)
+	}
+
+	if laddr.IP == nil {
+		laddr.IP = net.IPv6unspecified
+		if h.ip.To4() != nil {
+			laddr.IP = net.IPv4zero
+		}
+	}
+
+	h.n.mu.Lock()
+	defer h.n.mu.Unlock()
+	port := laddr.Port
+	if port == 0 {
+		for try := 0; ; try++ {
+			if try == 1000 {
+				return nil, errors.New("no free port")
+			}
+			port = 49152 + h.n.rand.Intn(16384)
+			if h.socks[port] == nil {
+				break
+			}
+		}
+	} else if h.socks[port] != nil {
+		return nil, fmt.Errorf("address %v:%d already in use", h.ip, port)
+	}
+	c := newConn(h, &net.UDPAddr{IP: laddr.IP, Port: port})
+	h.socks[port] = c
+	return c, nil
+}
+
+// send routes a packet from the socket at src on h. Called with
+// n.mu held.
+func (h *Host) send(b []byte, src, dst *net.UDPAddr) {
+	if h.nat != nil {
+		h.nat.outbound(b, src, dst)
+		return
+	}
+	h.n.route(b, src, dst)
+}
+
+// route delivers a packet sent on the internet. Called with n.mu
+// held.
+func (n *Network) route(b []byte, src, dst *net.UDPAddr) {
+	if nat := n.nats[dst.IP.String()]; nat != nil {
+		nat.inbound(b, src, dst)
+		return
+	}
+	if h := n.hosts[dst.IP.String()]; h != nil {
+		n.deliver(h, b, src, dst.Port)
+	}
+}
+
+// deliver queues a packet on the socket of h at port, after the
+// link's latency, unless the link loses it. Called with n.mu held.
+func (n *Network) deliver(h *Host, b []byte, src *net.UDPAddr, port int) {
+	c := h.socks[port]
+	if c == nil {
+		return
+	}
+	if n.link.Loss > 0 && n.rand.Float64() < n.link.Loss {
+		return
+	}
+	delay := n.link.Latency
+	if n.link.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.link.Jitter)))
+	}
+	if delay <= 0 {
+		c.push(b, src)
+		return
+	}
+	n.clock().AfterFunc(delay, func() { c.push(b, src) })
+}